@@ -0,0 +1,198 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// APIKeyHeader - header with the partner API key
+	APIKeyHeader = "X-API-Key"
+
+	// apiKeyContextKey - context key of the verified *APIKey
+	apiKeyContextKey contextKey = "api_key"
+
+	// apiKeyCacheSize - max cached keys and max cached unknown key hashes of the FirestoreAPIKeyStore,
+	// the keys are attacker-supplied so the caches are bounded
+	apiKeyCacheSize = 1000
+	// apiKeyMissingTTL - time the unknown key hash is rejected without the Firestore read
+	apiKeyMissingTTL = time.Minute
+)
+
+var (
+	APIKeysCollection string = "api_keys"
+)
+
+// APIKey - API key metadata. ID is the SHA-256 hex hash of the key (HashAPIKey), raw keys are never stored
+type APIKey struct {
+	ID       string   `json:"id" firestore:"id,omitempty" structs:"id,omitempty"`
+	Owner    string   `json:"owner" firestore:"owner,omitempty" structs:"owner,omitempty"`
+	Scopes   []string `json:"scopes" firestore:"scopes,omitempty" structs:"scopes,omitempty"`
+	Disabled bool     `json:"disabled" firestore:"disabled" structs:"disabled"`
+}
+
+// HasScope - checks if the key has the scope
+func (k *APIKey) HasScope(scope string) bool {
+	return containsString(k.Scopes, scope)
+}
+
+// APIKeyStore - source of the API keys metadata used by RequireAPIKey
+// GetAPIKey should return nil and no error if the key doesn't exist
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, keyHash string) (*APIKey, error)
+}
+
+// HashAPIKey - returns SHA-256 hex hash of the raw API key, used as the APIKey ID
+func HashAPIKey(rawKey string) string {
+	hash := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// FirestoreAPIKeyStore - APIKeyStore which reads keys from the APIKeysCollection (document ID is the key hash)
+// and caches them in memory for the cacheTTL, unknown key hashes are cached for a minute
+type FirestoreAPIKeyStore struct {
+	fireclient *firestore.Client
+	cache      *ttlCache
+	missing    *ttlCache
+}
+
+func NewFirestoreAPIKeyStore(fireclient *firestore.Client, cacheTTL time.Duration) *FirestoreAPIKeyStore {
+	return &FirestoreAPIKeyStore{
+		fireclient: fireclient,
+		cache:      newBoundedTTLCache(cacheTTL, apiKeyCacheSize),
+		missing:    newBoundedTTLCache(apiKeyMissingTTL, apiKeyCacheSize),
+	}
+}
+
+// GetAPIKey - returns API key by hash from cache or Firestore
+func (s *FirestoreAPIKeyStore) GetAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	if cached, ok := s.cache.get(keyHash); ok {
+		return cached.(*APIKey), nil
+	}
+	if _, ok := s.missing.get(keyHash); ok {
+		return nil, nil
+	}
+
+	dsnap, err := s.fireclient.Collection(APIKeysCollection).Doc(keyHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		// cache missing keys too to avoid Firestore reads for repeated invalid keys
+		s.missing.set(keyHash, true)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key from the '%v' collection. Error: %v", APIKeysCollection, err.Error())
+	}
+
+	var key APIKey
+	err = dsnap.DataTo(&key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse API key. Error: %v", err.Error())
+	}
+	key.ID = keyHash
+
+	s.cache.set(keyHash, &key)
+
+	return &key, nil
+}
+
+// SecretManagerAPIKeyStore - APIKeyStore which reads the JSON list of APIKey from the Secret Manager secret
+// and caches it in memory for the cacheTTL
+type SecretManagerAPIKeyStore struct {
+	secretName string
+	cache      *ttlCache
+}
+
+func NewSecretManagerAPIKeyStore(secretName string, cacheTTL time.Duration) *SecretManagerAPIKeyStore {
+	return &SecretManagerAPIKeyStore{
+		secretName: secretName,
+		cache:      newTTLCache(cacheTTL),
+	}
+}
+
+// GetAPIKey - returns API key by hash from the cached secret
+func (s *SecretManagerAPIKeyStore) GetAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	var keys map[string]*APIKey
+	if cached, ok := s.cache.get(s.secretName); ok {
+		keys = cached.(map[string]*APIKey)
+	} else {
+		secret, err := GetSecret(ctx, s.secretName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get API keys secret. Error: %v", err.Error())
+		}
+
+		var keysList []APIKey
+		err = json.Unmarshal([]byte(secret), &keysList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal API keys secret. Error: %v", err.Error())
+		}
+
+		keys = make(map[string]*APIKey, len(keysList))
+		for i := range keysList {
+			keys[strings.ToLower(keysList[i].ID)] = &keysList[i]
+		}
+		s.cache.set(s.secretName, keys)
+	}
+
+	return keys[keyHash], nil
+}
+
+// RequireAPIKey - http middleware which validates the X-API-Key header against the store
+// and checks that the key is enabled and has all of the scopes.
+// Writes 401 error envelope (WriteError) for missing/unknown keys, 403 for disabled keys or missing scopes.
+// Stores the verified *APIKey in the request context (APIKeyFromContext)
+func RequireAPIKey(next http.HandlerFunc, store APIKeyStore, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		rawKey := r.Header.Get(APIKeyHeader)
+		if rawKey == "" {
+			WriteError(w, Errorf("RequireAPIKey", ErrorCodeUnauthenticated, "API key is missing"))
+			return
+		}
+
+		key, err := store.GetAPIKey(ctx, HashAPIKey(rawKey))
+		if err != nil {
+			LogWrite(LogTypeError2, ErrorCodeInternal, fmt.Sprintf("failed to get API key. Error: %v", err.Error()), "")
+			WriteError(w, E("RequireAPIKey", ErrorCodeInternal, err))
+			return
+		}
+
+		if key == nil {
+			LogWrite(LogTypeInfo, 0, "unknown API key", "")
+			WriteError(w, Errorf("RequireAPIKey", ErrorCodeUnauthenticated, "unknown API key"))
+			return
+		}
+
+		if key.Disabled {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("disabled API key of '%v' was used", key.Owner), "")
+			WriteError(w, Errorf("RequireAPIKey", ErrorCodePermissionDenied, "API key is disabled"))
+			return
+		}
+
+		for _, scope := range scopes {
+			if !key.HasScope(scope) {
+				LogWrite(LogTypeInfo, 0, fmt.Sprintf("API key of '%v' has no '%v' scope", key.Owner, scope), "")
+				WriteError(w, Errorf("RequireAPIKey", ErrorCodePermissionDenied, "API key has no %v scope", scope))
+				return
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, apiKeyContextKey, key)))
+	}
+}
+
+// APIKeyFromContext - returns the API key stored by RequireAPIKey middleware
+func APIKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(*APIKey)
+	return key, ok && key != nil
+}
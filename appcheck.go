@@ -0,0 +1,133 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// AppCheckHeader - header with the Firebase App Check token
+	AppCheckHeader = "X-Firebase-AppCheck"
+
+	appCheckJWKSURL = "https://firebaseappcheck.googleapis.com/v1/jwks"
+	appCheckIssuer  = "https://firebaseappcheck.googleapis.com/"
+)
+
+// AppCheckMode - defines how the App Check token is verified by the auth middleware
+type AppCheckMode string
+
+const (
+	// AppCheckDisabled - App Check token is ignored
+	AppCheckDisabled AppCheckMode = ""
+	// AppCheckOptional - requests without App Check token are allowed, but invalid tokens are rejected
+	AppCheckOptional AppCheckMode = "optional"
+	// AppCheckRequired - requests without valid App Check token are rejected
+	AppCheckRequired AppCheckMode = "required"
+)
+
+// appCheckKeys - cached App Check public keys, Firebase recommends to refresh them every 6 hours
+var appCheckKeys = newJWKSCache(appCheckJWKSURL, 6*time.Hour)
+
+// AppCheckToken - verified App Check token
+// AppID - Firebase app ID of the attested client
+type AppCheckToken struct {
+	AppID     string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+}
+
+// AppCheckModeFromEnv - returns App Check mode from FIREBASE_APP_CHECK_MODE env variable ("optional" or "required"),
+// so the mode can be configured per environment
+func AppCheckModeFromEnv() AppCheckMode {
+	return AppCheckMode(strings.ToLower(packageConfig().AppCheckMode))
+}
+
+// VerifyAppCheckToken - verifies App Check token signature, issuer, audience and expiration.
+// Audience should contain GCLOUD_PROJECT or FIREBASE_PROJECT_NUMBER project
+func VerifyAppCheckToken(ctx context.Context, rawToken string) (*AppCheckToken, error) {
+	token, err := parseJWT(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Header.Type != "JWT" {
+		return nil, fmt.Errorf("unexpected App Check token type '%v'", token.Header.Type)
+	}
+
+	publicKey, err := appCheckKeys.getKey(ctx, token.Header.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get App Check public key. Error: %v", err.Error())
+	}
+
+	err = token.verifyRS256(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid App Check token signature. Error: %v", err.Error())
+	}
+
+	err = token.verifyExpiration(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := token.stringClaim("iss")
+	if !strings.HasPrefix(issuer, appCheckIssuer) {
+		return nil, fmt.Errorf("unexpected App Check token issuer '%v'", issuer)
+	}
+
+	audience := token.audience()
+	allowedAudience := []string{
+		"projects/" + packageConfig().ProjectID,
+		"projects/" + packageConfig().ProjectNumber,
+	}
+	var audienceMatched bool
+	for _, aud := range audience {
+		if aud != "projects/" && containsString(allowedAudience, aud) {
+			audienceMatched = true
+			break
+		}
+	}
+	if !audienceMatched {
+		return nil, errors.New("App Check token audience doesn't match the project")
+	}
+
+	appCheckToken := &AppCheckToken{
+		AppID:    token.stringClaim("sub"),
+		Issuer:   issuer,
+		Audience: audience,
+	}
+	appCheckToken.ExpiresAt, _ = token.timeClaim("exp")
+	appCheckToken.IssuedAt, _ = token.timeClaim("iat")
+
+	return appCheckToken, nil
+}
+
+// verifyAppCheckRequest - verifies the request App Check header according to the mode
+// returns http.StatusOK or the status code which should be returned to the caller
+func verifyAppCheckRequest(ctx context.Context, r *http.Request, mode AppCheckMode) int {
+	if mode == AppCheckDisabled {
+		return http.StatusOK
+	}
+
+	rawToken := r.Header.Get(AppCheckHeader)
+	if rawToken == "" {
+		if mode == AppCheckRequired {
+			LogWrite(LogTypeInfo, 0, "empty App Check header", "")
+			return http.StatusUnauthorized
+		}
+		return http.StatusOK
+	}
+
+	_, err := VerifyAppCheckToken(ctx, rawToken)
+	if err != nil {
+		LogWrite(LogTypeInfo, 0, fmt.Sprintf("App Check token verification error: %v", err.Error()), "")
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusOK
+}
@@ -0,0 +1,158 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/logging"
+)
+
+var (
+	// ErrorCodeInvalidArgument - invalid input ErrorCode
+	ErrorCodeInvalidArgument int = 400
+	// ErrorCodeUnauthenticated - missing or invalid credentials ErrorCode
+	ErrorCodeUnauthenticated int = 401
+	// ErrorCodePermissionDenied - not enough permissions ErrorCode
+	ErrorCodePermissionDenied int = 403
+	// ErrorCodeNotFound - entity not found ErrorCode
+	ErrorCodeNotFound int = 404
+	// ErrorCodeConflict - entity state conflict ErrorCode
+	ErrorCodeConflict int = 409
+	// ErrorCodeValidation - well-formed input which violates the validation rules ErrorCode
+	ErrorCodeValidation int = 422
+	// ErrorCodeResourceExhausted - rate limit or quota exceeded ErrorCode
+	ErrorCodeResourceExhausted int = 429
+	// ErrorCodeUnavailable - service is temporarily unavailable, ex: maintenance ErrorCode
+	ErrorCodeUnavailable int = 503
+	// ErrorCodeDeadlineExceeded - operation timed out ErrorCode
+	ErrorCodeDeadlineExceeded int = 504
+
+	// errorCodeHTTPStatuses - HTTP status returned for the ErrorCode, http.StatusInternalServerError is used for unknown codes
+	errorCodeHTTPStatuses = map[int]int{
+		ErrorCodeExternalAPI:       http.StatusBadGateway,
+		ErrorCodeInternal:          http.StatusInternalServerError,
+		ErrorCodeFirebase:          http.StatusInternalServerError,
+		ErrorCodeInvalidArgument:   http.StatusBadRequest,
+		ErrorCodeUnauthenticated:   http.StatusUnauthorized,
+		ErrorCodePermissionDenied:  http.StatusForbidden,
+		ErrorCodeNotFound:          http.StatusNotFound,
+		ErrorCodeConflict:          http.StatusConflict,
+		ErrorCodeValidation:        http.StatusUnprocessableEntity,
+		ErrorCodeResourceExhausted: http.StatusTooManyRequests,
+		ErrorCodeUnavailable:       http.StatusServiceUnavailable,
+		ErrorCodeDeadlineExceeded:  http.StatusGatewayTimeout,
+	}
+)
+
+// AppError - typed error of the package functions
+// Op - operation which failed, usually the function name
+// Code - one of the ErrorCode values
+// Reason - code of the error codes catalog (RegisterErrorCode) returned to the caller, ErrorCodeName of the Code if empty
+// HTTPStatus - status which should be returned to the caller
+// Msg - message which is safe to return to the caller
+// Err - wrapped underlying error
+type AppError struct {
+	Op         string
+	Code       int
+	Reason     string
+	HTTPStatus int
+	Msg        string
+	Err        error
+}
+
+// E - builds AppError. If code is 0 and err wraps AppError, code, reason, status and message of the wrapped error are kept
+func E(op string, code int, err error) *AppError {
+	appErr := &AppError{
+		Op:   op,
+		Code: code,
+		Err:  err,
+	}
+
+	var inner *AppError
+	if code == 0 && errors.As(err, &inner) {
+		appErr.Code = inner.Code
+		appErr.Reason = inner.Reason
+		appErr.HTTPStatus = inner.HTTPStatus
+		appErr.Msg = inner.Msg
+		return appErr
+	}
+
+	appErr.HTTPStatus = HTTPStatusForErrorCode(appErr.Code)
+	appErr.Msg = http.StatusText(appErr.HTTPStatus)
+
+	return appErr
+}
+
+// Errorf - builds AppError with the formatted underlying error, %w verb is supported
+func Errorf(op string, code int, format string, args ...interface{}) *AppError {
+	return E(op, code, fmt.Errorf(format, args...))
+}
+
+// WithMessage - sets message which is returned to the caller
+func (e *AppError) WithMessage(msg string) *AppError {
+	e.Msg = msg
+	return e
+}
+
+func (e *AppError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %v", e.Op, e.Msg)
+	}
+
+	return fmt.Sprintf("%v: %v", e.Op, e.Err.Error())
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatusForErrorCode - returns HTTP status for the ErrorCode
+func HTTPStatusForErrorCode(code int) int {
+	if status, ok := errorCodeHTTPStatuses[code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// ErrorHTTPStatus - returns HTTP status and the caller safe message of the error.
+// http.StatusInternalServerError is returned for errors which are not AppError
+func ErrorHTTPStatus(err error) (int, string) {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.HTTPStatus, appErr.Msg
+	}
+
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// LogError - logs the error with severity chosen by its HTTP status (4xx - NOTICE, 5xx - ERROR)
+// and returns HTTP status and message which should be written to the caller, ex:
+// status, msg := logger.LogError(ctx, r, err)
+// WriteHTTPError(w, msg, status)
+// nil error isn't logged, http.StatusOK is returned for it
+func (pl *Logger) LogError(ctx context.Context, httpRequest *http.Request, err error) (int, string) {
+	if err == nil {
+		return http.StatusOK, http.StatusText(http.StatusOK)
+	}
+
+	status, msg := ErrorHTTPStatus(err)
+
+	severity := logging.Error
+	if status < http.StatusInternalServerError {
+		severity = logging.Notice
+	}
+
+	fields := Fields{"http_status": status}
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		fields["op"] = appErr.Op
+		fields["error_code"] = appErr.Code
+	}
+
+	pl.log(ctx, severity, httpRequest, err.Error(), []interface{}{fields})
+
+	return status, msg
+}
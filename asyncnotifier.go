@@ -0,0 +1,167 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotificationQueueFull - returned by AsyncNotifier when the queue is full and notification was dropped
+var ErrNotificationQueueFull = errors.New("notification queue is full")
+
+// ErrNotifierClosed - returned by AsyncNotifier after Close
+var ErrNotifierClosed = errors.New("notifier is closed")
+
+const (
+	asyncNotifierInitialBackoff = 500 * time.Millisecond
+	asyncNotifierMaxBackoff     = 10 * time.Second
+)
+
+// AsyncNotifier - Notifier which queues notifications and sends them in the background with retries,
+// so sending doesn't add latency to the log calls. Flush or Close should be called before the function
+// instance terminates to not lose pending notifications.
+// Notifications are sent with background context since the request context is usually done by that moment
+type AsyncNotifier struct {
+	notifier   Notifier
+	maxRetries int
+	queue      chan Notification
+
+	// pending - queued and in-flight notifications, idle is closed when it drops to zero.
+	// Counter is used instead of WaitGroup, since Flush can wait while Notify adds
+	pendingMu sync.Mutex
+	pending   int
+	idle      chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewAsyncNotifier - starts background dispatcher with bounded queue of queueSize notifications,
+// each notification is retried maxRetries times with exponential backoff
+func NewAsyncNotifier(notifier Notifier, queueSize, maxRetries int) *AsyncNotifier {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	an := &AsyncNotifier{
+		notifier:   notifier,
+		maxRetries: maxRetries,
+		queue:      make(chan Notification, queueSize),
+		done:       make(chan struct{}),
+		idle:       make(chan struct{}),
+	}
+	close(an.idle)
+	go an.run()
+
+	return an
+}
+
+// Notify - queues the notification, returns ErrNotificationQueueFull if the queue is full
+func (an *AsyncNotifier) Notify(ctx context.Context, notification Notification) error {
+	an.mu.RLock()
+	defer an.mu.RUnlock()
+
+	if an.closed {
+		return ErrNotifierClosed
+	}
+
+	an.addPending()
+	select {
+	case an.queue <- notification:
+		return nil
+	default:
+		an.donePending()
+		return ErrNotificationQueueFull
+	}
+}
+
+// Flush - waits until all queued notifications are sent or ctx is done
+func (an *AsyncNotifier) Flush(ctx context.Context) error {
+	an.pendingMu.Lock()
+	idle := an.idle
+	an.pendingMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush notifications. Error: %v", ctx.Err().Error())
+	}
+}
+
+// Close - stops accepting notifications, drains the queue and stops the dispatcher
+func (an *AsyncNotifier) Close(ctx context.Context) error {
+	an.mu.Lock()
+	if an.closed {
+		an.mu.Unlock()
+		return nil
+	}
+	an.closed = true
+	close(an.queue)
+	an.mu.Unlock()
+
+	select {
+	case <-an.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to drain notifications. Error: %v", ctx.Err().Error())
+	}
+}
+
+// run - dispatcher loop
+func (an *AsyncNotifier) run() {
+	defer close(an.done)
+
+	for notification := range an.queue {
+		an.send(notification)
+		an.donePending()
+	}
+}
+
+// addPending - counts the queued notification, the next Flush waits for it
+func (an *AsyncNotifier) addPending() {
+	an.pendingMu.Lock()
+	defer an.pendingMu.Unlock()
+
+	if an.pending == 0 {
+		an.idle = make(chan struct{})
+	}
+	an.pending++
+}
+
+// donePending - counts the sent or dropped notification, releases the waiting Flush calls when nothing is pending
+func (an *AsyncNotifier) donePending() {
+	an.pendingMu.Lock()
+	defer an.pendingMu.Unlock()
+
+	an.pending--
+	if an.pending == 0 {
+		close(an.idle)
+	}
+}
+
+// send - sends the notification with retries
+func (an *AsyncNotifier) send(notification Notification) {
+	backoff := asyncNotifierInitialBackoff
+
+	var err error
+	for i := 0; i <= an.maxRetries; i++ {
+		err = an.notifier.Notify(context.Background(), notification)
+		if err == nil {
+			return
+		}
+
+		if i < an.maxRetries {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > asyncNotifierMaxBackoff {
+				backoff = asyncNotifierMaxBackoff
+			}
+		}
+	}
+
+	LogWrite(LogTypeError2, ErrorCodeExternalAPI, fmt.Sprintf("failed to send notification after %d retries. Error: %v", an.maxRetries, err.Error()), "")
+}
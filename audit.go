@@ -0,0 +1,262 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// AuditActionAdd - entity was added by AddEntityToFirestoreWithAudit
+	AuditActionAdd = "add"
+	// AuditActionEdit - entity was edited by EditEntityInFirestoreWithAudit
+	AuditActionEdit = "edit"
+	// AuditActionDelete - entity was deleted by DeleteEntityFromFirestoreWithAudit
+	AuditActionDelete = "delete"
+)
+
+var (
+	AuditLogCollection string = "audit_log"
+)
+
+// firestorePkgPath - package of the Firestore sentinel and transform types, which are written as is
+var firestorePkgPath = reflect.TypeOf(firestore.Delete).PkgPath()
+
+// EntityAudit - audit options of the WithAudit entity helpers and TenantRepository.WithAudit
+// Hook - receives the record of the committed change (NewLoggerEntityAuditHook, NewFirestoreEntityAuditHook),
+// the change is not audited if nil. Before snapshot is read in the transaction of the edit or the delete
+// and the after data is the result of the write, so the record matches the committed change
+type EntityAudit struct {
+	Hook func(ctx context.Context, record AuditRecord)
+}
+
+// AuditRecord - data passed to the EntityAudit hook
+// ActorUID - UID of the caller verified by the auth middleware, empty for system writes
+// Before - document data before the change, nil for adds
+// After - document data after the change, nil for deletes. Field transforms (ex: firestore.ServerTimestamp)
+// are recorded as passed to the write
+// ChangedFields - top-level fields which differ between Before and After, both are compared as decoded from Firestore
+type AuditRecord struct {
+	Action        string                 `json:"action" firestore:"action"`
+	Collection    string                 `json:"collection" firestore:"collection"`
+	DocumentID    string                 `json:"document_id" firestore:"document_id"`
+	ActorUID      string                 `json:"actor_uid" firestore:"actor_uid"`
+	ExecutionID   string                 `json:"execution_id" firestore:"execution_id"`
+	Before        map[string]interface{} `json:"before" firestore:"before"`
+	After         map[string]interface{} `json:"after" firestore:"after"`
+	ChangedFields []string               `json:"changed_fields" firestore:"changed_fields"`
+	Timestamp     time.Time              `json:"timestamp" firestore:"timestamp"`
+}
+
+// NewLoggerEntityAuditHook - returns EntityAudit hook which writes audit records to the logger with NOTICE severity
+func NewLoggerEntityAuditHook(logger *Logger) func(ctx context.Context, record AuditRecord) {
+	return func(ctx context.Context, record AuditRecord) {
+		logger.Notice(ctx, nil, fmt.Sprintf("entity '%v/%v' %v", record.Collection, record.DocumentID, record.Action), record)
+	}
+}
+
+// NewFirestoreEntityAuditHook - returns EntityAudit hook which saves audit records to the AuditLogCollection
+func NewFirestoreEntityAuditHook(fireclient *firestore.Client) func(ctx context.Context, record AuditRecord) {
+	return func(ctx context.Context, record AuditRecord) {
+		_, err := AddEntityToFirestore(ctx, fireclient, AuditLogCollection, record)
+		if err != nil {
+			LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to save audit record for '%v/%v'. Error: %v", record.Collection, record.DocumentID, err.Error()), "")
+		}
+	}
+}
+
+// notify - passes the change to the hook
+func (a EntityAudit) notify(ctx context.Context, action, collectionName, entityID string, before, after map[string]interface{}) {
+	a.Hook(ctx, AuditRecord{
+		Action:        action,
+		Collection:    collectionName,
+		DocumentID:    entityID,
+		ActorUID:      UIDFromContext(ctx),
+		ExecutionID:   ExecutionIDFromContext(ctx),
+		Before:        before,
+		After:         after,
+		ChangedFields: changedFields(before, after),
+		Timestamp:     time.Now(),
+	})
+}
+
+// transactionSnapshot - returns data of the document read in the transaction or nil if it doesn't exist
+func transactionSnapshot(tx *firestore.Transaction, ref *firestore.DocumentRef) (map[string]interface{}, error) {
+	dsnap, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeAuditData(dsnap.Data()), nil
+}
+
+// entityData - top-level fields of the entity as they are stored: map keys or struct fields by firestore tags,
+// values are normalized by normalizeAuditValue to be comparable with the document read from Firestore
+func entityData(entity interface{}) map[string]interface{} {
+	if typed, ok := entity.(map[string]interface{}); ok {
+		return normalizeAuditData(typed)
+	}
+
+	value := reflect.ValueOf(entity)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	data := map[string]interface{}{}
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("firestore"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(options, "omitempty") && value.Field(i).IsZero() {
+			continue
+		}
+		data[name] = normalizeAuditValue(value.Field(i).Interface())
+	}
+
+	return data
+}
+
+// normalizeAuditData - normalizeAuditValue of every field
+func normalizeAuditData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+
+	normalized := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		normalized[key] = normalizeAuditValue(value)
+	}
+
+	return normalized
+}
+
+// normalizeAuditValue - converts the value to the type Firestore decodes it to: integers to int64, floats to float64,
+// slices and arrays to []interface{}, maps and structs to map[string]interface{}, times to UTC with microseconds precision.
+// Firestore sentinels and transforms (ex: firestore.Delete, firestore.Increment), references and bytes are kept as is
+func normalizeAuditValue(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case nil, []byte, *firestore.DocumentRef, *latlng.LatLng:
+		return typed
+	case time.Time:
+		return typed.UTC().Truncate(time.Microsecond)
+	case map[string]interface{}:
+		return normalizeAuditData(typed)
+	}
+
+	value := reflect.ValueOf(v)
+	if value.Type().PkgPath() == firestorePkgPath {
+		return v
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return normalizeAuditValue(value.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	case reflect.Bool:
+		return value.Bool()
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = normalizeAuditValue(value.Index(i).Interface())
+		}
+		return items
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		data := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			data[fmt.Sprint(iter.Key().Interface())] = normalizeAuditValue(iter.Value().Interface())
+		}
+		return data
+	case reflect.Struct:
+		return entityData(v)
+	}
+
+	return v
+}
+
+// mergeEntityData - data of the document after the MergeAll write of the update, nested maps are merged
+// and firestore.Delete removes the field
+func mergeEntityData(before, update map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(before)+len(update))
+	for key, value := range before {
+		merged[key] = value
+	}
+
+	for key, value := range update {
+		if value == firestore.Delete {
+			delete(merged, key)
+			continue
+		}
+
+		nestedUpdate, isMap := value.(map[string]interface{})
+		nestedBefore, wasMap := merged[key].(map[string]interface{})
+		if isMap && wasMap {
+			merged[key] = mergeEntityData(nestedBefore, nestedUpdate)
+			continue
+		}
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// changedFields - returns sorted top-level fields which were added, removed or changed
+func changedFields(before, after map[string]interface{}) []string {
+	changed := []string{}
+	for key, value := range after {
+		if previous, ok := before[key]; !ok || !reflect.DeepEqual(previous, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
@@ -0,0 +1,299 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	bigQueryInsertRetries  = 3
+	bigQueryInitialBackoff = 500 * time.Millisecond
+	bigQueryMaxBackoff     = 10 * time.Second
+	// bigQueryMirrorBatchSize - rows of the single streaming insert request of MirrorCollectionToBigQuery
+	bigQueryMirrorBatchSize = 500
+)
+
+var (
+	// cachedBigQueryClient - process-level BigQuery client, use GetBigQueryClient to get it
+	cachedBigQueryClient   *bigquery.Client
+	cachedBigQueryClientMu sync.Mutex
+)
+
+// FirestoreMirrorSchema - schema of the table written by MirrorCollectionToBigQuery with the default transform
+var FirestoreMirrorSchema = bigquery.Schema{
+	{Name: "document_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "data", Type: bigquery.JSONFieldType},
+	{Name: "update_time", Type: bigquery.TimestampFieldType},
+	{Name: "exported_at", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// BigQueryRowTransform - converts Firestore document into the BigQuery row, row is skipped if nil is returned
+type BigQueryRowTransform func(dsnap *firestore.DocumentSnapshot) (map[string]bigquery.Value, error)
+
+// bigQueryRow - row with the fixed insert ID, so the retried insert is deduplicated by BigQuery
+type bigQueryRow struct {
+	values   map[string]bigquery.Value
+	insertID string
+}
+
+// Save - implements bigquery.ValueSaver
+func (r *bigQueryRow) Save() (map[string]bigquery.Value, string, error) {
+	return r.values, r.insertID, nil
+}
+
+// GetBigQueryClient - returns process-level cached BigQuery client of the GCLOUD_PROJECT project.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetBigQueryClient(ctx context.Context) (*bigquery.Client, error) {
+	cachedBigQueryClientMu.Lock()
+	defer cachedBigQueryClientMu.Unlock()
+
+	if cachedBigQueryClient != nil {
+		return cachedBigQueryClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := bigquery.NewClient(context.Background(), packageConfig().ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client. Error: %v", err.Error())
+	}
+	cachedBigQueryClient = client
+
+	return cachedBigQueryClient, nil
+}
+
+// InsertRows - streams rows into the table. rows is a slice of structs (schema is inferred from bigquery tags),
+// bigquery.ValueSaver or map[string]interface{} values. Every row gets fixed insert ID before the first attempt,
+// so transient errors are retried with backoff without duplicating rows.
+// Rows rejected by BigQuery (ex: schema mismatch) are returned as AppError with ErrorCodeInvalidArgument
+// which wraps bigquery.PutMultiError with the index and reason of every rejected row
+func InsertRows(ctx context.Context, datasetID, tableID string, rows interface{}) error {
+	client, err := GetBigQueryClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	savers, err := bigQueryRows(rows)
+	if err != nil {
+		return err
+	}
+	if len(savers) == 0 {
+		return nil
+	}
+
+	inserter := client.Dataset(datasetID).Table(tableID).Inserter()
+	backoff := bigQueryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := inserter.Put(ctx, savers)
+		if err == nil {
+			return nil
+		}
+
+		var multiErr bigquery.PutMultiError
+		if errors.As(err, &multiErr) {
+			return Errorf("InsertRows", ErrorCodeInvalidArgument, "%v of %v rows rejected by %v.%v: %w",
+				len(multiErr), len(savers), datasetID, tableID, multiErr).
+				WithMessage("rows don't match the table schema")
+		}
+
+		if attempt >= bigQueryInsertRetries || !IsRetryableBigQueryError(err) {
+			return Errorf("InsertRows", ErrorCodeExternalAPI, "failed to insert rows into %v.%v: %w", datasetID, tableID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return Errorf("InsertRows", ErrorCodeDeadlineExceeded, "failed to insert rows into %v.%v: %w", datasetID, tableID, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > bigQueryMaxBackoff {
+			backoff = bigQueryMaxBackoff
+		}
+	}
+}
+
+// bigQueryRows - converts rows of InsertRows into the savers with fixed insert IDs
+func bigQueryRows(rows interface{}) ([]bigquery.ValueSaver, error) {
+	value := reflect.ValueOf(rows)
+	if value.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("failed to insert rows. Error: rows must be a slice, got %T", rows)
+	}
+
+	savers := make([]bigquery.ValueSaver, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		row := value.Index(i).Interface()
+
+		switch typed := row.(type) {
+		case bigquery.ValueSaver:
+			values, insertID, err := typed.Save()
+			if err != nil {
+				return nil, fmt.Errorf("failed to save row %v. Error: %v", i, err.Error())
+			}
+			if insertID == "" {
+				insertID = uuid.NewString()
+			}
+			savers = append(savers, &bigQueryRow{values: values, insertID: insertID})
+		case map[string]interface{}:
+			values := make(map[string]bigquery.Value, len(typed))
+			for key, fieldValue := range typed {
+				values[key] = fieldValue
+			}
+			savers = append(savers, &bigQueryRow{values: values, insertID: uuid.NewString()})
+		default:
+			savers = append(savers, &bigquery.StructSaver{Struct: row, InsertID: uuid.NewString()})
+		}
+	}
+
+	return savers, nil
+}
+
+// IsRetryableBigQueryError - checks if the BigQuery API error is transient (429 and 5xx statuses)
+func IsRetryableBigQueryError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
+
+// EnsureBigQueryTable - creates the table with the schema if it doesn't exist,
+// new fields of the schema are added to the existing table (BigQuery allows only additive schema changes)
+func EnsureBigQueryTable(ctx context.Context, datasetID, tableID string, schema bigquery.Schema) error {
+	client, err := GetBigQueryClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	table := client.Dataset(datasetID).Table(tableID)
+	metadata, err := table.Metadata(ctx)
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		err = table.Create(ctx, &bigquery.TableMetadata{Schema: schema})
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict) {
+			return fmt.Errorf("failed to create table %v.%v. Error: %v", datasetID, tableID, err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get table %v.%v. Error: %v", datasetID, tableID, err.Error())
+	}
+
+	existing := map[string]bool{}
+	for _, field := range metadata.Schema {
+		existing[field.Name] = true
+	}
+
+	updated := metadata.Schema
+	for _, field := range schema {
+		if !existing[field.Name] {
+			added := *field
+			added.Required = false // required fields can't be added to the table with rows
+			updated = append(updated, &added)
+		}
+	}
+	if len(updated) == len(metadata.Schema) {
+		return nil
+	}
+
+	_, err = table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: updated}, metadata.ETag)
+	if err != nil {
+		return fmt.Errorf("failed to update schema of %v.%v. Error: %v", datasetID, tableID, err.Error())
+	}
+
+	return nil
+}
+
+// MirrorCollectionToBigQuery - copies all documents of the Firestore collection into the table in batches,
+// returns the number of inserted rows. Default transform (nil) writes rows of FirestoreMirrorSchema
+// with the document data as JSON, the table is created if it doesn't exist then.
+// Insert ID is the document ID and update time, so the repeated mirror in the BigQuery deduplication window
+// (about a minute) doesn't duplicate unchanged documents
+func MirrorCollectionToBigQuery(ctx context.Context, fireclient *firestore.Client, collectionName, datasetID, tableID string, transform BigQueryRowTransform) (int, error) {
+	if transform == nil {
+		if err := EnsureBigQueryTable(ctx, datasetID, tableID, FirestoreMirrorSchema); err != nil {
+			return 0, err
+		}
+		transform = firestoreMirrorRow
+	}
+
+	exported := 0
+	batch := make([]*bigQueryRow, 0, bigQueryMirrorBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := InsertRows(ctx, datasetID, tableID, batch); err != nil {
+			return err
+		}
+		exported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	runner := NewQueryRunner(ctx, fireclient.Collection(collectionName).Query, QueryRunnerOptions{Name: "export_" + collectionName})
+	defer runner.Stop()
+
+	for {
+		dsnap, err := runner.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return exported, fmt.Errorf("failed to read '%v' collection. Error: %v", collectionName, err.Error())
+		}
+
+		values, err := transform(dsnap)
+		if err != nil {
+			return exported, fmt.Errorf("failed to transform document '%v'. Error: %v", dsnap.Ref.ID, err.Error())
+		}
+		if values == nil {
+			continue
+		}
+
+		batch = append(batch, &bigQueryRow{
+			values:   values,
+			insertID: dsnap.Ref.ID + "_" + strconv.FormatInt(dsnap.UpdateTime.UnixNano(), 10),
+		})
+		if len(batch) >= bigQueryMirrorBatchSize {
+			if err := flush(); err != nil {
+				return exported, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return exported, err
+	}
+
+	return exported, nil
+}
+
+// firestoreMirrorRow - default transform of MirrorCollectionToBigQuery
+func firestoreMirrorRow(dsnap *firestore.DocumentSnapshot) (map[string]bigquery.Value, error) {
+	data, err := json.Marshal(dsnap.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]bigquery.Value{
+		"document_id": dsnap.Ref.ID,
+		"data":        string(data),
+		"update_time": dsnap.UpdateTime,
+		"exported_at": time.Now(),
+	}, nil
+}
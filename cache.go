@@ -0,0 +1,96 @@
+package cloudfunctions_go_utils
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache - thread-safe in-memory cache with the same expiration time for all entries,
+// bounded caches (newBoundedTTLCache) evict the oldest entries when they are full
+type ttlCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]ttlCacheEntry
+}
+
+type ttlCacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		entries: map[string]ttlCacheEntry{},
+	}
+}
+
+// newBoundedTTLCache - ttlCache with at most maxEntries entries, used for the keys which come from the callers
+func newBoundedTTLCache(ttl time.Duration, maxEntries int) *ttlCache {
+	cache := newTTLCache(ttl)
+	cache.maxEntries = maxEntries
+
+	return cache
+}
+
+// get - returns not expired value by the key
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// set - saves the value, which expires after cache ttl
+func (c *ttlCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+
+	c.entries[key] = ttlCacheEntry{
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
+
+// delete - removes value by the key
+func (c *ttlCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// evict - removes the expired entries or the entry which expires first if none expired, called with the locked mutex
+func (c *ttlCache) evict() {
+	now := time.Now()
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expiresAt.Before(oldest) {
+			oldestKey, oldest = key, entry.expiresAt
+		}
+	}
+
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
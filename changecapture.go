@@ -0,0 +1,150 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+const (
+	// ChangeOperationCreate - document was created
+	ChangeOperationCreate = "create"
+	// ChangeOperationUpdate - document was updated
+	ChangeOperationUpdate = "update"
+	// ChangeOperationDelete - document was deleted
+	ChangeOperationDelete = "delete"
+)
+
+// FirestoreChangeLogSchema - schema of the change-log table written by FirestoreChangeCapture
+var FirestoreChangeLogSchema = bigquery.Schema{
+	{Name: "event_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "event_time", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "operation", Type: bigquery.StringFieldType, Required: true},
+	{Name: "collection", Type: bigquery.StringFieldType, Required: true},
+	{Name: "document_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "document_path", Type: bigquery.StringFieldType, Required: true},
+	{Name: "before", Type: bigquery.JSONFieldType},
+	{Name: "after", Type: bigquery.JSONFieldType},
+	{Name: "update_mask", Type: bigquery.StringFieldType, Repeated: true},
+}
+
+// ChangeCaptureOptions - options of the FirestoreChangeCapture
+// DatasetID, TableID - change-log table, created with FirestoreChangeLogSchema on the first event if it doesn't exist
+// Collections - collections which are captured (collection of the changed document, ex: users), all if empty
+type ChangeCaptureOptions struct {
+	DatasetID   string
+	TableID     string
+	Collections []string
+}
+
+// FirestoreChangeCapture - returns CloudEvents handler of the Firestore document written events which appends
+// the before/after snapshots of the document to the BigQuery change-log table.
+// Event ID is used as the insert ID, so the redelivered event is not duplicated in the deduplication window.
+// Returned error makes Eventarc retry the event (if retries are enabled for the trigger).
+// ex: functions.CloudEvent("UsersChangeLog", FirestoreChangeCapture(ChangeCaptureOptions{DatasetID: "audit", TableID: "changes", Collections: []string{UsersCollection, PromoItemsCollection}}))
+func FirestoreChangeCapture(options ChangeCaptureOptions) func(ctx context.Context, e event.Event) error {
+	var (
+		tableMu    sync.Mutex
+		tableReady bool
+	)
+
+	ensureTable := func(ctx context.Context) error {
+		tableMu.Lock()
+		defer tableMu.Unlock()
+
+		if tableReady {
+			return nil
+		}
+
+		if err := EnsureBigQueryTable(ctx, options.DatasetID, options.TableID, FirestoreChangeLogSchema); err != nil {
+			return err
+		}
+		tableReady = true
+
+		return nil
+	}
+
+	return func(ctx context.Context, e event.Event) error {
+		firestoreEvent, err := DecodeFirestoreEvent(e)
+		if err != nil {
+			// malformed event can't succeed on retry
+			LoggerFromContext(ctx).Error("failed to decode firestore event", Fields{"event_id": e.ID(), "error": err.Error()})
+			return nil
+		}
+
+		document := firestoreEvent.Value
+		if document == nil {
+			document = firestoreEvent.OldValue
+		}
+		if document == nil {
+			return nil
+		}
+
+		collection := documentCollection(document.Path())
+		if len(options.Collections) > 0 && !containsString(options.Collections, collection) {
+			return nil
+		}
+
+		row, err := changeLogRow(e, firestoreEvent, document, collection)
+		if err != nil {
+			LoggerFromContext(ctx).Error("failed to build change-log row", Fields{"event_id": e.ID(), "error": err.Error()})
+			return nil
+		}
+
+		if err := ensureTable(ctx); err != nil {
+			return err
+		}
+
+		return InsertRows(ctx, options.DatasetID, options.TableID, []*bigQueryRow{row})
+	}
+}
+
+// changeLogRow - builds the change-log row of the event with the event ID as the insert ID
+func changeLogRow(e event.Event, firestoreEvent *FirestoreEvent, document *FirestoreDocument, collection string) (*bigQueryRow, error) {
+	operation := ChangeOperationUpdate
+	switch {
+	case firestoreEvent.OldValue == nil:
+		operation = ChangeOperationCreate
+	case firestoreEvent.Value == nil:
+		operation = ChangeOperationDelete
+	}
+
+	values := map[string]bigquery.Value{
+		"event_id":      e.ID(),
+		"event_time":    e.Time(),
+		"operation":     operation,
+		"collection":    collection,
+		"document_id":   document.ID(),
+		"document_path": document.Path(),
+		"update_mask":   firestoreEvent.UpdateMask,
+	}
+
+	for column, snapshot := range map[string]*FirestoreDocument{"before": firestoreEvent.OldValue, "after": firestoreEvent.Value} {
+		if snapshot == nil {
+			continue
+		}
+
+		data, err := json.Marshal(snapshot.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %v snapshot. Error: %v", column, err.Error())
+		}
+		values[column] = string(data)
+	}
+
+	return &bigQueryRow{values: values, insertID: e.ID()}, nil
+}
+
+// documentCollection - returns ID of the collection of the document path, ex: users/abc/orders/xyz -> orders
+func documentCollection(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[len(parts)-2]
+}
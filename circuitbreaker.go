@@ -0,0 +1,243 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// CircuitClosed - requests are sent, consecutive failures are counted
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen - requests fail fast with ErrCircuitOpen until the cool-down passes
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen - limited number of probe requests is sent, success closes the circuit and failure opens it again
+	CircuitHalfOpen CircuitState = "half-open"
+
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitCoolDown         = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+// ErrCircuitOpen - request was not sent because the circuit of the target is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreakers - shared circuit breakers by the name (usually host of the target)
+var (
+	circuitBreakers   = map[string]*CircuitBreaker{}
+	circuitBreakersMu sync.Mutex
+)
+
+// CircuitState - state of the CircuitBreaker
+type CircuitState string
+
+// CircuitBreakerOptions - options of the NewCircuitBreaker
+// FailureThreshold - consecutive failures which open the circuit, 5 if empty
+// CoolDown - time of the open state before the probe requests are allowed, 30s if empty
+// HalfOpenRequests - concurrent probe requests of the half-open state, 1 if empty
+type CircuitBreakerOptions struct {
+	FailureThreshold int
+	CoolDown         time.Duration
+	HalfOpenRequests int
+}
+
+// CircuitBreaker - closed/open/half-open circuit breaker of the external API, safe for concurrent use.
+// It is kept in memory of the function instance, so a partner outage is detected per instance
+type CircuitBreaker struct {
+	name     string
+	options  CircuitBreakerOptions
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// NewCircuitBreaker - returns closed CircuitBreaker, name is used in the logs
+func NewCircuitBreaker(name string, options CircuitBreakerOptions) *CircuitBreaker {
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if options.CoolDown <= 0 {
+		options.CoolDown = defaultCircuitCoolDown
+	}
+	if options.HalfOpenRequests <= 0 {
+		options.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+
+	return &CircuitBreaker{name: name, options: options, state: CircuitClosed}
+}
+
+// GetCircuitBreaker - returns shared CircuitBreaker of the name with the default options, created on the first use
+func GetCircuitBreaker(name string) *CircuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	if breaker, ok := circuitBreakers[name]; ok {
+		return breaker
+	}
+
+	breaker := NewCircuitBreaker(name, CircuitBreakerOptions{})
+	circuitBreakers[name] = breaker
+
+	return breaker
+}
+
+// Name - name of the circuit breaker
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// State - current state, open circuit after the cool-down is reported as half-open
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.options.CoolDown {
+		return CircuitHalfOpen
+	}
+
+	return cb.state
+}
+
+// Allow - returns ErrCircuitOpen if the request should fail fast, otherwise done must be called with the result of the request
+func (cb *CircuitBreaker) Allow() (done func(success bool), err error) {
+	probe, err := cb.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func(success bool) {
+		once.Do(func() { cb.record(probe, success) })
+	}, nil
+}
+
+// Execute - runs fn if the circuit allows it, errors of fn are failures
+func (cb *CircuitBreaker) Execute(fn func() error) error {
+	done, err := cb.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	done(err == nil)
+
+	return err
+}
+
+// allow - moves the open circuit to half-open after the cool-down and takes the probe slot of the half-open circuit
+func (cb *CircuitBreaker) allow() (probe bool, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen {
+		if time.Since(cb.openedAt) < cb.options.CoolDown {
+			return false, ErrCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen)
+	}
+
+	if cb.state != CircuitHalfOpen {
+		return false, nil
+	}
+	if cb.probes >= cb.options.HalfOpenRequests {
+		return false, ErrCircuitOpen
+	}
+	cb.probes++
+
+	return true, nil
+}
+
+// release - frees the probe slot of the request which result says nothing about the target (ex: canceled by the caller)
+func (cb *CircuitBreaker) release(probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// record - updates the state with the result of the request
+func (cb *CircuitBreaker) record(probe, success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe && cb.probes > 0 {
+		cb.probes--
+	}
+
+	if success {
+		cb.failures = 0
+		if cb.state == CircuitHalfOpen {
+			cb.setState(CircuitClosed)
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.options.FailureThreshold {
+		cb.openedAt = time.Now()
+		cb.setState(CircuitOpen)
+	}
+}
+
+// setState - changes the state and logs the transition, must be called with the lock
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+
+	// opening is the failure, half-open probes and the recovery are informational
+	logType := LogTypeInfo
+	if state == CircuitOpen {
+		logType = LogTypeError2
+	}
+	LogWrite(logType, ErrorCodeExternalAPI, "circuit breaker '"+cb.name+"' changed state from "+string(cb.state)+" to "+string(state), "")
+	cb.state = state
+	if state != CircuitHalfOpen {
+		cb.probes = 0
+	}
+}
+
+// circuitBreakerTransport - RoundTripper which fails fast when the circuit of the request host is open.
+// Connection errors, 429 and 5xx responses are failures
+type circuitBreakerTransport struct {
+	base    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+// NewCircuitBreakerTransport - wraps base (http.DefaultTransport if nil) with the breaker,
+// shared GetCircuitBreaker of the request host is used if breaker is nil
+func NewCircuitBreakerTransport(base http.RoundTripper, breaker *CircuitBreaker) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &circuitBreakerTransport{base: base, breaker: breaker}
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.breaker
+	if breaker == nil {
+		breaker = GetCircuitBreaker(req.URL.Host)
+	}
+
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && errors.Is(err, context.Canceled) {
+		// canceled by the caller, says nothing about the target
+		breaker.release(probe)
+		return resp, err
+	}
+	breaker.record(probe, err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError)
+
+	return resp, err
+}
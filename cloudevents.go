@@ -0,0 +1,417 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// FirestoreEventWritten, FirestoreEventCreated, FirestoreEventUpdated, FirestoreEventDeleted - Firestore CloudEvent types
+	FirestoreEventWritten = "google.cloud.firestore.document.v1.written"
+	FirestoreEventCreated = "google.cloud.firestore.document.v1.created"
+	FirestoreEventUpdated = "google.cloud.firestore.document.v1.updated"
+	FirestoreEventDeleted = "google.cloud.firestore.document.v1.deleted"
+
+	// StorageEventFinalized, StorageEventDeleted - Cloud Storage CloudEvent types
+	StorageEventFinalized = "google.cloud.storage.object.v1.finalized"
+	StorageEventDeleted   = "google.cloud.storage.object.v1.deleted"
+
+	// PubSubEventPublished - Pub/Sub CloudEvent type
+	PubSubEventPublished = "google.cloud.pubsub.topic.v1.messagePublished"
+)
+
+// FirestoreDocument - document of the Firestore event with the fields converted to Go values
+// (int64, float64, bool, string, []byte, time.Time, *latlng.LatLng, []interface{}, map[string]interface{}, nil)
+type FirestoreDocument struct {
+	Name       string                 `json:"name"`
+	Fields     map[string]interface{} `json:"fields"`
+	CreateTime time.Time              `json:"create_time"`
+	UpdateTime time.Time              `json:"update_time"`
+}
+
+// ID - document ID
+func (d *FirestoreDocument) ID() string {
+	return d.Name[strings.LastIndex(d.Name, "/")+1:]
+}
+
+// Path - document path relative to the database, ex: users/abc
+func (d *FirestoreDocument) Path() string {
+	if _, path, ok := strings.Cut(d.Name, "/documents/"); ok {
+		return path
+	}
+
+	return d.Name
+}
+
+// DataTo - converts the document fields into dst struct with json tags
+func (d *FirestoreDocument) DataTo(dst interface{}) error {
+	data, err := json.Marshal(d.Fields)
+	if err != nil {
+		return fmt.Errorf("failed to marshal document fields. Error: %v", err.Error())
+	}
+
+	err = json.Unmarshal(data, dst)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal document fields. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// FirestoreEvent - data of the Firestore document event
+// Value - document after the change, nil for deletes
+// OldValue - document before the change, nil for creates
+// UpdateMask - changed fields of the updates
+type FirestoreEvent struct {
+	Value      *FirestoreDocument
+	OldValue   *FirestoreDocument
+	UpdateMask []string
+}
+
+// StorageObject - data of the Cloud Storage object event
+type StorageObject struct {
+	Bucket         string            `json:"bucket"`
+	Name           string            `json:"name"`
+	ContentType    string            `json:"contentType"`
+	Size           int64             `json:"size,string"`
+	Generation     int64             `json:"generation,string"`
+	Metageneration int64             `json:"metageneration,string"`
+	MD5Hash        string            `json:"md5Hash"`
+	CRC32C         string            `json:"crc32c"`
+	Metadata       map[string]string `json:"metadata"`
+	TimeCreated    time.Time         `json:"timeCreated"`
+	Updated        time.Time         `json:"updated"`
+}
+
+// DecodeFirestoreEvent - decodes data of the Firestore CloudEvent, both application/protobuf (default)
+// and application/json data content types are supported
+func DecodeFirestoreEvent(e event.Event) (*FirestoreEvent, error) {
+	var value, oldValue firestorepb.Document
+	var updateMask firestorepb.DocumentMask
+	var hasValue, hasOldValue bool
+
+	if strings.HasPrefix(e.DataContentType(), "application/json") {
+		raw := struct {
+			Value      json.RawMessage `json:"value"`
+			OldValue   json.RawMessage `json:"oldValue"`
+			UpdateMask json.RawMessage `json:"updateMask"`
+		}{}
+		if err := json.Unmarshal(e.Data(), &raw); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Firestore event. Error: %v", err.Error())
+		}
+
+		var err error
+		if hasValue, err = unmarshalProtoJSON(raw.Value, &value); err != nil {
+			return nil, err
+		}
+		if hasOldValue, err = unmarshalProtoJSON(raw.OldValue, &oldValue); err != nil {
+			return nil, err
+		}
+		if _, err = unmarshalProtoJSON(raw.UpdateMask, &updateMask); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		hasValue, hasOldValue, err = unmarshalDocumentEventData(e.Data(), &value, &oldValue, &updateMask)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	firestoreEvent := &FirestoreEvent{UpdateMask: updateMask.GetFieldPaths()}
+	if hasValue {
+		firestoreEvent.Value = documentFromProto(&value)
+	}
+	if hasOldValue {
+		firestoreEvent.OldValue = documentFromProto(&oldValue)
+	}
+
+	return firestoreEvent, nil
+}
+
+// unmarshalProtoJSON - unmarshals not empty JSON into the message
+func unmarshalProtoJSON(data json.RawMessage, message proto.Message) (bool, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return false, nil
+	}
+
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, message); err != nil {
+		return false, fmt.Errorf("failed to unmarshal Firestore event. Error: %v", err.Error())
+	}
+
+	return true, nil
+}
+
+// unmarshalDocumentEventData - decodes google.events.cloud.firestore.v1.DocumentEventData message
+// (1: value Document, 2: old_value Document, 3: update_mask DocumentMask)
+func unmarshalDocumentEventData(data []byte, value, oldValue *firestorepb.Document, updateMask *firestorepb.DocumentMask) (bool, bool, error) {
+	var hasValue, hasOldValue bool
+
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return false, false, fmt.Errorf("failed to decode Firestore event. Error: %v", protowire.ParseError(n).Error())
+		}
+		data = data[n:]
+
+		if wireType != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+			if n < 0 {
+				return false, false, fmt.Errorf("failed to decode Firestore event. Error: %v", protowire.ParseError(n).Error())
+			}
+			data = data[n:]
+			continue
+		}
+
+		field, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return false, false, fmt.Errorf("failed to decode Firestore event. Error: %v", protowire.ParseError(n).Error())
+		}
+		data = data[n:]
+
+		var err error
+		switch number {
+		case 1:
+			hasValue = true
+			err = proto.Unmarshal(field, value)
+		case 2:
+			hasOldValue = true
+			err = proto.Unmarshal(field, oldValue)
+		case 3:
+			err = proto.Unmarshal(field, updateMask)
+		}
+		if err != nil {
+			return false, false, fmt.Errorf("failed to decode Firestore event. Error: %v", err.Error())
+		}
+	}
+
+	return hasValue, hasOldValue, nil
+}
+
+// documentFromProto - converts Firestore document proto
+func documentFromProto(document *firestorepb.Document) *FirestoreDocument {
+	fields := make(map[string]interface{}, len(document.GetFields()))
+	for key, value := range document.GetFields() {
+		fields[key] = valueFromProto(value)
+	}
+
+	return &FirestoreDocument{
+		Name:       document.GetName(),
+		Fields:     fields,
+		CreateTime: document.GetCreateTime().AsTime(),
+		UpdateTime: document.GetUpdateTime().AsTime(),
+	}
+}
+
+// valueFromProto - converts Firestore value proto to Go value
+func valueFromProto(value *firestorepb.Value) interface{} {
+	switch v := value.GetValueType().(type) {
+	case *firestorepb.Value_BooleanValue:
+		return v.BooleanValue
+	case *firestorepb.Value_IntegerValue:
+		return v.IntegerValue
+	case *firestorepb.Value_DoubleValue:
+		return v.DoubleValue
+	case *firestorepb.Value_TimestampValue:
+		return v.TimestampValue.AsTime()
+	case *firestorepb.Value_StringValue:
+		return v.StringValue
+	case *firestorepb.Value_BytesValue:
+		return v.BytesValue
+	case *firestorepb.Value_ReferenceValue:
+		return v.ReferenceValue
+	case *firestorepb.Value_GeoPointValue:
+		return v.GeoPointValue
+	case *firestorepb.Value_ArrayValue:
+		values := make([]interface{}, 0, len(v.ArrayValue.GetValues()))
+		for _, item := range v.ArrayValue.GetValues() {
+			values = append(values, valueFromProto(item))
+		}
+		return values
+	case *firestorepb.Value_MapValue:
+		fields := make(map[string]interface{}, len(v.MapValue.GetFields()))
+		for key, item := range v.MapValue.GetFields() {
+			fields[key] = valueFromProto(item)
+		}
+		return fields
+	default:
+		return nil
+	}
+}
+
+// DecodeStorageEvent - decodes data of the Cloud Storage CloudEvent
+func DecodeStorageEvent(e event.Event) (*StorageObject, error) {
+	var object StorageObject
+	if err := json.Unmarshal(e.Data(), &object); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal storage event. Error: %v", err.Error())
+	}
+
+	return &object, nil
+}
+
+// DecodePubSubEvent - decodes data of the Pub/Sub CloudEvent, which has the same shape as the push envelope
+func DecodePubSubEvent(e event.Event) (*PubSubPush, error) {
+	var push PubSubPush
+	if err := json.Unmarshal(e.Data(), &push); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pubsub event. Error: %v", err.Error())
+	}
+
+	return &push, nil
+}
+
+// NewTestFirestoreEvent - builds Firestore CloudEvent of the eventType for the document path (ex: users/abc)
+// with JSON data, used to test event functions locally. value or oldValue is nil for creates and deletes
+func NewTestFirestoreEvent(eventType, documentPath string, value, oldValue map[string]interface{}) (event.Event, error) {
+	name := "projects/" + testEventProject() + "/databases/(default)/documents/" + documentPath
+
+	data := map[string]json.RawMessage{}
+	for key, fields := range map[string]map[string]interface{}{"value": value, "oldValue": oldValue} {
+		if fields == nil {
+			continue
+		}
+
+		document, err := documentToProto(name, fields)
+		if err != nil {
+			return event.Event{}, err
+		}
+
+		encoded, err := protojson.Marshal(document)
+		if err != nil {
+			return event.Event{}, fmt.Errorf("failed to marshal test document. Error: %v", err.Error())
+		}
+		data[key] = encoded
+	}
+
+	e := newTestEvent(eventType, "//firestore.googleapis.com/projects/"+testEventProject()+"/databases/(default)")
+	e.SetSubject("documents/" + documentPath)
+	if err := e.SetData("application/json", data); err != nil {
+		return event.Event{}, fmt.Errorf("failed to set test event data. Error: %v", err.Error())
+	}
+
+	return e, nil
+}
+
+// NewTestStorageEvent - builds Cloud Storage CloudEvent of the eventType for the object
+func NewTestStorageEvent(eventType string, object StorageObject) (event.Event, error) {
+	e := newTestEvent(eventType, "//storage.googleapis.com/projects/_/buckets/"+object.Bucket)
+	e.SetSubject("objects/" + object.Name)
+	if err := e.SetData("application/json", object); err != nil {
+		return event.Event{}, fmt.Errorf("failed to set test event data. Error: %v", err.Error())
+	}
+
+	return e, nil
+}
+
+// NewTestPubSubEvent - builds Pub/Sub CloudEvent with the message of the topic
+func NewTestPubSubEvent(topicID string, data []byte, attributes map[string]string) (event.Event, error) {
+	e := newTestEvent(PubSubEventPublished, "//pubsub.googleapis.com/projects/"+testEventProject()+"/topics/"+topicID)
+
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"messageId":   uuid.NewString(),
+			"data":        base64.StdEncoding.EncodeToString(data),
+			"attributes":  attributes,
+			"publishTime": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		"subscription": "projects/" + testEventProject() + "/subscriptions/test",
+	}
+	if err := e.SetData("application/json", payload); err != nil {
+		return event.Event{}, fmt.Errorf("failed to set test event data. Error: %v", err.Error())
+	}
+
+	return e, nil
+}
+
+// newTestEvent - CloudEvent with the generated ID and current time
+func newTestEvent(eventType, source string) event.Event {
+	e := event.New()
+	e.SetID(uuid.NewString())
+	e.SetType(eventType)
+	e.SetSource(source)
+	e.SetTime(time.Now())
+
+	return e
+}
+
+// testEventProject - project of the test events, GCLOUD_PROJECT or "test-project"
+func testEventProject() string {
+	if project := packageConfig().ProjectID; project != "" {
+		return project
+	}
+
+	return "test-project"
+}
+
+// documentToProto - converts the fields into Firestore document proto
+func documentToProto(name string, fields map[string]interface{}) (*firestorepb.Document, error) {
+	protoFields := make(map[string]*firestorepb.Value, len(fields))
+	for key, value := range fields {
+		protoValue, err := valueToProto(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert field '%v'. Error: %v", key, err.Error())
+		}
+		protoFields[key] = protoValue
+	}
+
+	now := timestamppb.Now()
+	return &firestorepb.Document{Name: name, Fields: protoFields, CreateTime: now, UpdateTime: now}, nil
+}
+
+// valueToProto - converts Go value into Firestore value proto
+func valueToProto(value interface{}) (*firestorepb.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}, nil
+	case bool:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_BooleanValue{BooleanValue: v}}, nil
+	case int:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_IntegerValue{IntegerValue: int64(v)}}, nil
+	case int64:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_IntegerValue{IntegerValue: v}}, nil
+	case float64:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_DoubleValue{DoubleValue: v}}, nil
+	case string:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_StringValue{StringValue: v}}, nil
+	case []byte:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_BytesValue{BytesValue: v}}, nil
+	case time.Time:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_TimestampValue{TimestampValue: timestamppb.New(v)}}, nil
+	case *latlng.LatLng:
+		return &firestorepb.Value{ValueType: &firestorepb.Value_GeoPointValue{GeoPointValue: v}}, nil
+	case []interface{}:
+		values := make([]*firestorepb.Value, 0, len(v))
+		for _, item := range v {
+			protoValue, err := valueToProto(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, protoValue)
+		}
+		return &firestorepb.Value{ValueType: &firestorepb.Value_ArrayValue{ArrayValue: &firestorepb.ArrayValue{Values: values}}}, nil
+	case map[string]interface{}:
+		fields := make(map[string]*firestorepb.Value, len(v))
+		for key, item := range v {
+			protoValue, err := valueToProto(item)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = protoValue
+		}
+		return &firestorepb.Value{ValueType: &firestorepb.Value_MapValue{MapValue: &firestorepb.MapValue{Fields: fields}}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", value)
+	}
+}
@@ -0,0 +1,151 @@
+package cloudfunctions_go_utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestNewTestFirestoreEventRoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	value := map[string]interface{}{
+		"name":       "Alice",
+		"age":        30,
+		"score":      4.5,
+		"active":     true,
+		"created_at": createdAt,
+		"location":   &latlng.LatLng{Latitude: 52.37, Longitude: 4.89},
+		"tags":       []interface{}{"a", "b"},
+		"address":    map[string]interface{}{"city": "Amsterdam"},
+		"deleted_at": nil,
+	}
+	oldValue := map[string]interface{}{"name": "Al"}
+
+	e, err := NewTestFirestoreEvent(FirestoreEventUpdated, "users/abc", value, oldValue)
+	if err != nil {
+		t.Fatalf("NewTestFirestoreEvent failed: %v", err)
+	}
+	if e.Type() != FirestoreEventUpdated || e.Subject() != "documents/users/abc" {
+		t.Errorf("unexpected event type %v or subject %v", e.Type(), e.Subject())
+	}
+
+	decoded, err := DecodeFirestoreEvent(e)
+	if err != nil {
+		t.Fatalf("DecodeFirestoreEvent failed: %v", err)
+	}
+	if decoded.Value == nil || decoded.OldValue == nil {
+		t.Fatalf("expected both documents, got value %v old value %v", decoded.Value, decoded.OldValue)
+	}
+	if decoded.Value.ID() != "abc" || decoded.Value.Path() != "users/abc" {
+		t.Errorf("unexpected document ID %v or path %v", decoded.Value.ID(), decoded.Value.Path())
+	}
+
+	fields := decoded.Value.Fields
+	expected := map[string]interface{}{
+		"name":       "Alice",
+		"age":        int64(30),
+		"score":      4.5,
+		"active":     true,
+		"tags":       []interface{}{"a", "b"},
+		"address":    map[string]interface{}{"city": "Amsterdam"},
+		"deleted_at": nil,
+	}
+	for key, want := range expected {
+		if got, ok := fields[key]; !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("field %v: expected %#v, got %#v", key, want, got)
+		}
+	}
+	if got, ok := fields["created_at"].(time.Time); !ok || !got.Equal(createdAt) {
+		t.Errorf("field created_at: expected %v, got %#v", createdAt, fields["created_at"])
+	}
+	if got, ok := fields["location"].(*latlng.LatLng); !ok || got.GetLatitude() != 52.37 || got.GetLongitude() != 4.89 {
+		t.Errorf("field location: unexpected %#v", fields["location"])
+	}
+	if decoded.OldValue.Fields["name"] != "Al" {
+		t.Errorf("unexpected old value fields: %v", decoded.OldValue.Fields)
+	}
+}
+
+func TestNewTestFirestoreEventCreate(t *testing.T) {
+	e, err := NewTestFirestoreEvent(FirestoreEventCreated, "users/abc", map[string]interface{}{"name": "Alice"}, nil)
+	if err != nil {
+		t.Fatalf("NewTestFirestoreEvent failed: %v", err)
+	}
+
+	decoded, err := DecodeFirestoreEvent(e)
+	if err != nil {
+		t.Fatalf("DecodeFirestoreEvent failed: %v", err)
+	}
+	if decoded.Value == nil || decoded.OldValue != nil {
+		t.Errorf("expected only the value of the created document, got value %v old value %v", decoded.Value, decoded.OldValue)
+	}
+}
+
+func TestNewTestFirestoreEventUnsupportedType(t *testing.T) {
+	if _, err := NewTestFirestoreEvent(FirestoreEventCreated, "users/abc", map[string]interface{}{"c": make(chan int)}, nil); err == nil {
+		t.Error("expected error for the unsupported field type")
+	}
+}
+
+func TestNewTestStorageEventRoundTrip(t *testing.T) {
+	object := StorageObject{
+		Bucket:         "uploads",
+		Name:           "images/a.png",
+		ContentType:    "image/png",
+		Size:           1024,
+		Generation:     1714559400000000,
+		Metageneration: 1,
+		Metadata:       map[string]string{"owner": "abc"},
+		TimeCreated:    time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC),
+		Updated:        time.Date(2024, 5, 1, 10, 31, 0, 0, time.UTC),
+	}
+
+	e, err := NewTestStorageEvent(StorageEventFinalized, object)
+	if err != nil {
+		t.Fatalf("NewTestStorageEvent failed: %v", err)
+	}
+	if e.Subject() != "objects/images/a.png" {
+		t.Errorf("unexpected subject %v", e.Subject())
+	}
+
+	decoded, err := DecodeStorageEvent(e)
+	if err != nil {
+		t.Fatalf("DecodeStorageEvent failed: %v", err)
+	}
+	if !reflect.DeepEqual(*decoded, object) {
+		t.Errorf("expected %+v, got %+v", object, *decoded)
+	}
+}
+
+func TestNewTestPubSubEventRoundTrip(t *testing.T) {
+	data := []byte(`{"order_id":"o1"}`)
+	attributes := map[string]string{"type": "order.created"}
+
+	e, err := NewTestPubSubEvent("orders", data, attributes)
+	if err != nil {
+		t.Fatalf("NewTestPubSubEvent failed: %v", err)
+	}
+	if e.Type() != PubSubEventPublished {
+		t.Errorf("unexpected event type %v", e.Type())
+	}
+
+	push, err := DecodePubSubEvent(e)
+	if err != nil {
+		t.Fatalf("DecodePubSubEvent failed: %v", err)
+	}
+	if string(push.Message.Data) != string(data) || !reflect.DeepEqual(push.Message.Attributes, attributes) {
+		t.Errorf("unexpected message %+v", push.Message)
+	}
+	if push.Message.ID == "" || push.Message.PublishTime.IsZero() || push.Subscription == "" {
+		t.Errorf("expected message ID, publish time and subscription, got %+v", push)
+	}
+
+	var payload struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := push.Message.DecodeJSON(&payload); err != nil || payload.OrderID != "o1" {
+		t.Errorf("expected decoded order_id, got %+v (error %v)", payload, err)
+	}
+}
@@ -0,0 +1,216 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// ColdStartMetric - timing metric of the time from the process start to the end of the eager init
+	ColdStartMetric = "cold_start"
+	// InitStepMetric - timing metric of the single init step, labels: step, lazy
+	InitStepMetric = "init_step"
+)
+
+// processStartedAt - approximate start time of the instance, package vars are initialized before main
+var processStartedAt = time.Now()
+
+// InitStep - initialization step of the function dependency
+// Name - unique name of the step, used by Require and in the logs
+// Lazy - step is not run by Run but on the first Require, for the dependencies used by few requests
+// Init - initializes the dependency, failed lazy step is run again by the next Require
+type InitStep struct {
+	Name string
+	Lazy bool
+	Init func(ctx context.Context) error
+}
+
+// InitStepResult - state of the step, returned by Results
+type InitStepResult struct {
+	Name       string  `json:"name"`
+	Lazy       bool    `json:"lazy"`
+	Done       bool    `json:"done"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// initStepState - registered step and its result
+type initStepState struct {
+	step   InitStep
+	mu     sync.Mutex
+	result InitStepResult
+}
+
+// Initializer - measures and logs the init steps of the function and the cold start time, ex:
+// initializer := NewInitializer(logger)
+// initializer.Add(FirestoreInitStep(&fireclient), SecretInitStep("ie_credentials", &credentials, true))
+// if err := initializer.Run(ctx); err != nil { panic(err) }
+type Initializer struct {
+	logger *Logger
+
+	mu      sync.Mutex
+	steps   []*initStepState
+	byName  map[string]*initStepState
+	started bool
+}
+
+// NewInitializer - returns Initializer which writes the logs and the metrics with the logger
+func NewInitializer(logger *Logger) *Initializer {
+	return &Initializer{logger: logger, byName: map[string]*initStepState{}}
+}
+
+// Add - registers the steps, eager steps are run by Run in the order of the registration
+func (in *Initializer) Add(steps ...InitStep) *Initializer {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, step := range steps {
+		if _, ok := in.byName[step.Name]; ok {
+			panic(fmt.Sprintf("init step %v is already registered", step.Name))
+		}
+
+		state := &initStepState{step: step, result: InitStepResult{Name: step.Name, Lazy: step.Lazy}}
+		in.steps = append(in.steps, state)
+		in.byName[step.Name] = state
+	}
+
+	return in
+}
+
+// Run - runs the eager steps one by one, stops on the first failed step. The cold start metric is recorded once,
+// after the first Run, with the time since the process start
+func (in *Initializer) Run(ctx context.Context) error {
+	in.mu.Lock()
+	steps := append([]*initStepState(nil), in.steps...)
+	first := !in.started
+	in.started = true
+	in.mu.Unlock()
+
+	for _, state := range steps {
+		if state.step.Lazy {
+			continue
+		}
+		if err := in.run(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	if first {
+		coldStart := time.Since(processStartedAt)
+		in.logger.Timing(ctx, ColdStartMetric, coldStart, nil)
+		in.logger.Info(ctx, nil, fmt.Sprintf("cold start finished in %v", coldStart.Round(time.Millisecond)), Fields{"steps": in.Results()})
+	}
+
+	return nil
+}
+
+// Require - runs the step if it's not done yet (the lazy step on the first use), concurrent calls wait for the same run
+func (in *Initializer) Require(ctx context.Context, name string) error {
+	in.mu.Lock()
+	state, ok := in.byName[name]
+	in.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("init step %v is not registered", name)
+	}
+
+	return in.run(ctx, state)
+}
+
+// Results - returns state of all steps in the order of the registration
+func (in *Initializer) Results() []InitStepResult {
+	in.mu.Lock()
+	steps := append([]*initStepState(nil), in.steps...)
+	in.mu.Unlock()
+
+	results := make([]InitStepResult, 0, len(steps))
+	for _, state := range steps {
+		state.mu.Lock()
+		results = append(results, state.result)
+		state.mu.Unlock()
+	}
+
+	return results
+}
+
+// run - runs the step once, measures and logs it
+func (in *Initializer) run(ctx context.Context, state *initStepState) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.result.Done {
+		return nil
+	}
+
+	start := time.Now()
+	err := state.step.Init(ctx)
+	duration := time.Since(start)
+
+	state.result.DurationMs = float64(duration) / float64(time.Millisecond)
+	in.logger.Timing(ctx, InitStepMetric, duration, map[string]string{"step": state.step.Name, "lazy": fmt.Sprintf("%v", state.step.Lazy)})
+
+	if err != nil {
+		state.result.Error = err.Error()
+		in.logger.Error(ctx, nil, fmt.Sprintf("init step %v failed", state.step.Name), Fields{"step": state.step.Name, "duration_ms": state.result.DurationMs, "error": err.Error()})
+		return fmt.Errorf("failed to init %v. Error: %v", state.step.Name, err.Error())
+	}
+
+	state.result.Done = true
+	state.result.Error = ""
+	in.logger.Debug(ctx, nil, fmt.Sprintf("init step %v done", state.step.Name), Fields{"step": state.step.Name, "duration_ms": state.result.DurationMs})
+
+	return nil
+}
+
+// FirestoreInitStep - eager step which creates the Firestore client into dst
+func FirestoreInitStep(dst **firestore.Client) InitStep {
+	return InitStep{
+		Name: "firestore",
+		Init: func(ctx context.Context) error {
+			// background context is used since the client outlives the init
+			_, fireclient, err := GetFirestoreAppAndClientWithContext(context.Background())
+			if err != nil {
+				return err
+			}
+			*dst = fireclient
+
+			return nil
+		},
+	}
+}
+
+// SecretInitStep - step which reads the secret into dst, named secret:<secret name>
+func SecretInitStep(secretName string, dst *string, lazy bool) InitStep {
+	return InitStep{
+		Name: "secret:" + secretName,
+		Lazy: lazy,
+		Init: func(ctx context.Context) error {
+			secret, err := GetSecret(ctx, secretName)
+			if err != nil {
+				return err
+			}
+			*dst = secret
+
+			return nil
+		},
+	}
+}
+
+// ConfigInitStep - step which reads the config documents into the ConfigStore cache, named config
+func ConfigInitStep(store *ConfigStore, keys ...string) InitStep {
+	return InitStep{
+		Name: "config",
+		Init: func(ctx context.Context) error {
+			for _, key := range keys {
+				if _, err := store.document(ctx, key); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
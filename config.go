@@ -0,0 +1,241 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EnvTag - struct tag with the env variable name, ex: `env:"GCLOUD_PROJECT"`
+	EnvTag = "env"
+	// EnvDefaultTag - struct tag with the value used if the env variable is empty, ex: `default:"1"`
+	EnvDefaultTag = "default"
+	// EnvRequiredTag - struct tag which marks the env variable as required, ex: `required:"true"`
+	EnvRequiredTag = "required"
+
+	// SecretValuePrefix - env variable value with this prefix is read from Secret Manager, ex: "secret://ie-refresh-token"
+	SecretValuePrefix = "secret://"
+)
+
+// Config - settings of the package functions read from the env variables
+type Config struct {
+	ProjectID               string        `env:"GCLOUD_PROJECT" required:"true"`
+	ProjectNumber           string        `env:"FIREBASE_PROJECT_NUMBER"`
+	Service                 string        `env:"K_SERVICE"`
+	Revision                string        `env:"K_REVISION"`
+	FunctionTimeout         time.Duration `env:"FUNCTION_TIMEOUT_SEC" default:"60s"`
+	FirestoreRetriesNumber  int           `env:"FIRESTORE_RETRIES_NUMBER" default:"1"`
+	Debug                   bool          `env:"DEBUG" default:"false"`
+	LogLevel                string        `env:"LOG_LEVEL"`
+	LogStdout               bool          `env:"LOG_STDOUT" default:"false"`
+	AppCheckMode            string        `env:"FIREBASE_APP_CHECK_MODE"`
+	GoogleIDTokenAudience   string        `env:"GOOGLE_ID_TOKEN_AUDIENCE"`
+	ImprintEngineAuthURL    string        `env:"IMPRINT_ENGINE_AUTH_URL"`
+	ImprintEngineGraphQLURL string        `env:"IMPRINT_ENGINE_GRAPHQL_URL"`
+	IEPlatformAppID         int64         `env:"IE_PLATFORM_APP_ID"`
+	IESandbox               bool          `env:"IE_SANDBOX" default:"false"`
+	FirestoreQueryProfiling bool          `env:"FIRESTORE_QUERY_PROFILING" default:"false"`
+	FunctionTarget          string        `env:"FUNCTION_TARGET"`
+	FunctionRegion          string        `env:"FUNCTION_REGION"`
+	TasksLocation           string        `env:"CLOUD_TASKS_LOCATION"`
+	TasksServiceAccount     string        `env:"CLOUD_TASKS_SERVICE_ACCOUNT"`
+}
+
+// ConfigError - all missing and invalid settings found by LoadConfig
+type ConfigError struct {
+	Missing []string
+	Invalid []string
+}
+
+func (ce *ConfigError) Error() string {
+	var parts []string
+	if len(ce.Missing) > 0 {
+		parts = append(parts, "missing settings: "+strings.Join(ce.Missing, ", "))
+	}
+	if len(ce.Invalid) > 0 {
+		parts = append(parts, "invalid settings: "+strings.Join(ce.Invalid, ", "))
+	}
+
+	return "invalid configuration: " + strings.Join(parts, "; ")
+}
+
+var (
+	config     atomic.Pointer[Config]
+	configErr  error
+	configOnce sync.Once
+
+	envConfig     *Config
+	envConfigOnce sync.Once
+)
+
+// GetConfig - returns package Config loaded once on the first call, should be called in the function init
+// to fail fast on the missing settings. The package functions use the loaded config after the call
+func GetConfig(ctx context.Context) (*Config, error) {
+	configOnce.Do(func() {
+		var loaded Config
+		configErr = LoadConfig(ctx, &loaded)
+		if configErr == nil {
+			config.Store(&loaded)
+		}
+	})
+
+	return config.Load(), configErr
+}
+
+// packageConfig - settings read by the package functions: Config loaded by GetConfig, or the env variables
+// parsed once without Secret Manager values if GetConfig wasn't called or failed. Invalid settings keep the defaults
+func packageConfig() *Config {
+	if loaded := config.Load(); loaded != nil {
+		return loaded
+	}
+
+	envConfigOnce.Do(func() {
+		var parsed Config
+		loadConfigValues(context.Background(), reflect.ValueOf(&parsed).Elem(), false)
+		envConfig = &parsed
+	})
+
+	return envConfig
+}
+
+// Validate - checks that all required settings of the config are set
+func (c *Config) Validate() error {
+	return validateConfig(reflect.ValueOf(c).Elem(), nil)
+}
+
+// LoadConfig - populates dst struct pointer from the env variables by `env` tags with `default` and `required` tags support.
+// Values with "secret://" prefix are read from Secret Manager. Supported field types: string, bool, ints, floats,
+// time.Duration (Go duration or seconds) and []string (comma separated).
+// Returns *ConfigError with all missing and invalid settings
+func LoadConfig(ctx context.Context, dst interface{}) error {
+	value := reflect.ValueOf(dst)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("failed to load config. Error: dst must be a pointer to struct")
+	}
+	value = value.Elem()
+
+	return validateConfig(value, loadConfigValues(ctx, value, true))
+}
+
+// loadConfigValues - sets the tagged fields of the struct value, returns the invalid settings.
+// Values with "secret://" prefix are skipped if resolveSecrets is false
+func loadConfigValues(ctx context.Context, value reflect.Value, resolveSecrets bool) []string {
+	valueType := value.Type()
+
+	var invalid []string
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		name := field.Tag.Get(EnvTag)
+		if name == "" || !field.IsExported() {
+			continue
+		}
+
+		raw := os.Getenv(name)
+		if raw == "" {
+			raw = field.Tag.Get(EnvDefaultTag)
+		}
+		if raw == "" {
+			continue
+		}
+
+		if strings.HasPrefix(raw, SecretValuePrefix) {
+			if !resolveSecrets {
+				continue
+			}
+			secret, err := GetSecret(ctx, strings.TrimPrefix(raw, SecretValuePrefix))
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%v (failed to get secret: %v)", name, err.Error()))
+				continue
+			}
+			raw = secret
+		}
+
+		if err := setConfigValue(value.Field(i), raw); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%v (%v)", name, err.Error()))
+		}
+	}
+
+	return invalid
+}
+
+// validateConfig - collects required settings which are empty
+func validateConfig(value reflect.Value, invalid []string) error {
+	var missing []string
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		required, _ := strconv.ParseBool(field.Tag.Get(EnvRequiredTag))
+		if required && value.Field(i).IsZero() {
+			missing = append(missing, field.Tag.Get(EnvTag))
+		}
+	}
+
+	if len(missing) > 0 || len(invalid) > 0 {
+		return &ConfigError{Missing: missing, Invalid: invalid}
+	}
+
+	return nil
+}
+
+// setConfigValue - parses the setting value into the field
+func setConfigValue(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			value.SetInt(int64(time.Duration(seconds) * time.Second))
+			return nil
+		}
+
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration")
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		value.SetInt(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		value.SetFloat(parsed)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", value.Type())
+		}
+
+		var values []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		value.Set(reflect.ValueOf(values).Convert(value.Type()))
+	default:
+		return fmt.Errorf("unsupported type %v", value.Type())
+	}
+
+	return nil
+}
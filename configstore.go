@@ -0,0 +1,253 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultConfigRefreshInterval = time.Minute
+)
+
+var (
+	ConfigCollection string = "config"
+)
+
+// ConfigChangeFunc - called when the config document changes, data is nil if the document was deleted
+type ConfigChangeFunc func(ctx context.Context, key string, data map[string]interface{})
+
+// ConfigStore - configuration documents of the ConfigCollection (document ID is the key) cached in memory.
+// Start refreshes the read keys periodically, so long-lived instances pick up the changes without restart
+type ConfigStore struct {
+	fireclient      *firestore.Client
+	refreshInterval time.Duration
+
+	mu        sync.RWMutex
+	documents map[string]*firestore.DocumentSnapshot
+	listeners map[string][]ConfigChangeFunc
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	started   bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewConfigStore - returns ConfigStore, refreshInterval is 1 minute if empty
+func NewConfigStore(fireclient *firestore.Client, refreshInterval time.Duration) *ConfigStore {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultConfigRefreshInterval
+	}
+
+	return &ConfigStore{
+		fireclient:      fireclient,
+		refreshInterval: refreshInterval,
+		documents:       map[string]*firestore.DocumentSnapshot{},
+		listeners:       map[string][]ConfigChangeFunc{},
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// Get - decodes the config document into dst (by firestore tags), the document is read once and then refreshed by Start.
+// Returns NotFound AppError if the document doesn't exist
+func (cs *ConfigStore) Get(ctx context.Context, key string, dst interface{}) error {
+	dsnap, err := cs.document(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !dsnap.Exists() {
+		return Errorf("ConfigStore.Get", ErrorCodeNotFound, "config %v not found", key)
+	}
+
+	if err := dsnap.DataTo(dst); err != nil {
+		return Errorf("ConfigStore.Get", ErrorCodeInternal, "failed to decode config %v: %w", key, err)
+	}
+
+	return nil
+}
+
+// GetValue - returns the field of the config document or the default value if the document or the field is missing
+func (cs *ConfigStore) GetValue(ctx context.Context, key, field string, defaultValue interface{}) interface{} {
+	dsnap, err := cs.document(ctx, key)
+	if err != nil || !dsnap.Exists() {
+		return defaultValue
+	}
+
+	value, err := dsnap.DataAt(field)
+	if err != nil || value == nil {
+		return defaultValue
+	}
+
+	return value
+}
+
+// Set - saves the config document and notifies the listeners of this instance, other instances get it on the refresh
+func (cs *ConfigStore) Set(ctx context.Context, key string, value interface{}) error {
+	ref := cs.fireclient.Collection(ConfigCollection).Doc(key)
+	if _, err := ref.Set(ctx, value); err != nil {
+		return Errorf("ConfigStore.Set", ErrorCodeFirebase, "failed to save config %v: %w", key, err)
+	}
+
+	dsnap, err := ref.Get(ctx)
+	if err != nil {
+		// cached value is dropped, the next Get reads the saved document
+		cs.mu.Lock()
+		delete(cs.documents, key)
+		cs.mu.Unlock()
+		return nil
+	}
+	cs.update(ctx, key, dsnap)
+
+	return nil
+}
+
+// OnChange - adds the listener of the config document changes, the key is refreshed by Start from now on.
+// The listener is called with the first read document too
+func (cs *ConfigStore) OnChange(key string, fn ConfigChangeFunc) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.listeners[key] = append(cs.listeners[key], fn)
+	if _, ok := cs.documents[key]; !ok {
+		cs.documents[key] = nil
+	}
+}
+
+// Start - refreshes the read and listened keys every refresh interval until Stop is called.
+// ctx is used for the reads and the listeners, it should not be the request context
+func (cs *ConfigStore) Start(ctx context.Context) {
+	cs.startOnce.Do(func() {
+		cs.mu.Lock()
+		cs.started = true
+		cs.mu.Unlock()
+
+		go cs.run(ctx)
+	})
+}
+
+// run - refresh loop of Start
+func (cs *ConfigStore) run(ctx context.Context) {
+	defer close(cs.done)
+
+	ticker := time.NewTicker(cs.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cs.Refresh(ctx); err != nil {
+				LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to refresh config. Error: %v", err.Error()), "")
+			}
+		}
+	}
+}
+
+// Stop - stops the refresh of Start, can be registered with RegisterShutdown
+func (cs *ConfigStore) Stop(ctx context.Context) error {
+	cs.stopOnce.Do(func() { close(cs.stop) })
+
+	cs.mu.RLock()
+	started := cs.started
+	cs.mu.RUnlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-cs.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Refresh - reads all known keys and notifies the listeners of the changed documents
+func (cs *ConfigStore) Refresh(ctx context.Context) error {
+	cs.mu.RLock()
+	refs := make([]*firestore.DocumentRef, 0, len(cs.documents))
+	for key := range cs.documents {
+		refs = append(refs, cs.fireclient.Collection(ConfigCollection).Doc(key))
+	}
+	cs.mu.RUnlock()
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	dsnaps, err := cs.fireclient.GetAll(ctx, refs)
+	if err != nil {
+		return Errorf("ConfigStore.Refresh", ErrorCodeFirebase, "failed to read config: %w", err)
+	}
+
+	for _, dsnap := range dsnaps {
+		cs.update(ctx, dsnap.Ref.ID, dsnap)
+	}
+
+	return nil
+}
+
+// document - returns cached document snapshot or reads it
+func (cs *ConfigStore) document(ctx context.Context, key string) (*firestore.DocumentSnapshot, error) {
+	cs.mu.RLock()
+	dsnap := cs.documents[key]
+	cs.mu.RUnlock()
+	if dsnap != nil {
+		return dsnap, nil
+	}
+
+	dsnap, err := cs.fireclient.Collection(ConfigCollection).Doc(key).Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, Errorf("ConfigStore.Get", ErrorCodeFirebase, "failed to read config %v: %w", key, err)
+	}
+	cs.update(ctx, key, dsnap)
+
+	return dsnap, nil
+}
+
+// update - caches the snapshot and calls the listeners if the document changed,
+// the first read existing document counts as the change
+func (cs *ConfigStore) update(ctx context.Context, key string, dsnap *firestore.DocumentSnapshot) {
+	cs.mu.Lock()
+	previous := cs.documents[key]
+	cs.documents[key] = dsnap
+	listeners := append([]ConfigChangeFunc(nil), cs.listeners[key]...)
+	cs.mu.Unlock()
+
+	if len(listeners) == 0 {
+		return
+	}
+	if previous == nil && !dsnap.Exists() {
+		return
+	}
+	if previous != nil && !configChanged(previous, dsnap) {
+		return
+	}
+
+	var data map[string]interface{}
+	if dsnap.Exists() {
+		data = dsnap.Data()
+	}
+	for _, listener := range listeners {
+		listener(ctx, key, data)
+	}
+}
+
+// configChanged - documents differ by existence or update time
+func configChanged(previous, current *firestore.DocumentSnapshot) bool {
+	if previous.Exists() != current.Exists() {
+		return true
+	}
+
+	return previous.Exists() && !previous.UpdateTime.Equal(current.UpdateTime)
+}
@@ -0,0 +1,130 @@
+package cloudfunctions_go_utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultCORSAllowedHeaders - request headers allowed by SetCORSHeaders and CORS middleware if CORSOptions.AllowedHeaders is empty
+	DefaultCORSAllowedHeaders = []string{
+		"Content-Type", "Content-Length", "Accept-Encoding", "Accept", "Authorization", "auth_code", "redirect_url",
+		"Type", "Version", "crm_type", "email_provider", AppCheckHeader, APIKeyHeader,
+	}
+	// DefaultCORSAllowedMethods - methods allowed by CORS middleware if CORSOptions.AllowedMethods is empty
+	DefaultCORSAllowedMethods = []string{
+		http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+)
+
+// defaultCORSMaxAge - default time the preflight response is cached by the browser
+const defaultCORSMaxAge = time.Hour
+
+// CORSOptions - options of the CORS middleware
+// AllowedOrigins - allowed origins: exact (https://app.example.com), wildcard subdomain (https://*.example.com) or "*" for any origin
+// AllowedMethods - DefaultCORSAllowedMethods if empty
+// AllowedHeaders - DefaultCORSAllowedHeaders if empty
+// ExposedHeaders - response headers available to the browser code
+// AllowCredentials - allows cookies and Authorization header, can't be used with "*" origin
+// MaxAge - preflight cache time, 1 hour if empty
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS - http middleware which sets CORS headers for the allowed origins and answers OPTIONS preflight requests
+// with 204 (403 for not allowed origins) without calling next.
+// Panics if AllowCredentials is used with "*" origin, since every site could make the credentialed requests
+func CORS(options CORSOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.AllowCredentials && containsString(options.AllowedOrigins, "*") {
+		panic("CORS AllowCredentials can't be used with \"*\" origin")
+	}
+	if len(options.AllowedMethods) == 0 {
+		options.AllowedMethods = DefaultCORSAllowedMethods
+	}
+	if len(options.AllowedHeaders) == 0 {
+		options.AllowedHeaders = DefaultCORSAllowedHeaders
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = defaultCORSMaxAge
+	}
+
+	allowedMethods := strings.Join(options.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(options.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(options.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(options.MaxAge.Seconds()))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+
+		if !originAllowed(options.AllowedOrigins, origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next(w, r)
+			return
+		}
+
+		if containsString(options.AllowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if options.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if exposedHeaders != "" {
+			w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+		}
+
+		next(w, r)
+	}
+}
+
+// originAllowed - checks the origin against exact, wildcard subdomain and "*" patterns
+func originAllowed(allowedOrigins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range allowedOrigins {
+		allowed = strings.ToLower(allowed)
+
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+
+	return false
+}
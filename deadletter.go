@@ -0,0 +1,387 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DeadLetterSourceSubscriptionAttribute - attribute of the forwarded message with the subscription which failed it
+	DeadLetterSourceSubscriptionAttribute = "CloudPubSubDeadLetterSourceSubscription"
+	// DeadLetterSourceProjectAttribute - attribute of the forwarded message with the project of the source subscription
+	DeadLetterSourceProjectAttribute = "CloudPubSubDeadLetterSourceSubscriptionProject"
+	// DeadLetterDeliveryCountAttribute - attribute of the forwarded message with the delivery attempts of the source subscription
+	DeadLetterDeliveryCountAttribute = "CloudPubSubDeadLetterSourceDeliveryCount"
+	// DeadLetterPublishTimeAttribute - attribute of the forwarded message with the publish time of the source topic
+	DeadLetterPublishTimeAttribute = "CloudPubSubDeadLetterSourceTopicPublishTime"
+	// ReplayedFromAttribute - attribute of the replayed message with the failed event ID, so the consumers can tell the replays
+	ReplayedFromAttribute = "replayed_from"
+
+	// FailedEventStatusFailed - event is waiting for the replay
+	FailedEventStatusFailed = "failed"
+	// FailedEventStatusReplayed - event was republished to the topic
+	FailedEventStatusReplayed = "replayed"
+
+	sourceTopicCacheTTL = time.Hour
+	// maxFailedEventInlineData - max data stored in the failed event document, Pub/Sub message can be up to 10MB
+	// while the document is limited to 1MiB together with the attributes
+	maxFailedEventInlineData = 512 << 10
+)
+
+var (
+	FailedEventsCollection string = "failed_events"
+	// FailedEventsBucket - Cloud Storage bucket of the data larger than 512KiB, stored as failed_events/<event ID> object.
+	// The data is truncated in the document if the bucket is empty, truncated events can't be replayed
+	FailedEventsBucket string = ""
+)
+
+// sourceTopics - cached topic names of the source subscriptions
+var sourceTopics = newTTLCache(sourceTopicCacheTTL)
+
+// FailedEvent - dead-lettered Pub/Sub message in the FailedEventsCollection, document ID is the dead letter message ID
+// Data - original message data, Attributes - original attributes without the dead letter ones
+// DataObject - object of the data in the FailedEventsBucket if it was too large for the document, Data is empty then
+// DataSize - size of the original data, DataTruncated - Data is the truncated prefix of the original data
+// SourceTopic - full name of the topic of the source subscription (projects/<project>/topics/<topic>), the replay target,
+// empty if it couldn't be resolved
+// DeliveryAttempts - delivery attempts of the source subscription before the message was dead-lettered
+// ReplayMessageIDs - message IDs of the replays, newest last
+type FailedEvent struct {
+	ID                     string            `json:"id" firestore:"-"`
+	Status                 string            `json:"status" firestore:"status"`
+	SourceSubscription     string            `json:"source_subscription" firestore:"source_subscription"`
+	SourceProject          string            `json:"source_project,omitempty" firestore:"source_project,omitempty"`
+	SourceTopic            string            `json:"source_topic,omitempty" firestore:"source_topic,omitempty"`
+	DeadLetterSubscription string            `json:"dead_letter_subscription,omitempty" firestore:"dead_letter_subscription,omitempty"`
+	Data                   []byte            `json:"data" firestore:"data"`
+	DataObject             string            `json:"data_object,omitempty" firestore:"data_object,omitempty"`
+	DataSize               int               `json:"data_size" firestore:"data_size"`
+	DataTruncated          bool              `json:"data_truncated,omitempty" firestore:"data_truncated,omitempty"`
+	Attributes             map[string]string `json:"attributes,omitempty" firestore:"attributes,omitempty"`
+	OrderingKey            string            `json:"ordering_key,omitempty" firestore:"ordering_key,omitempty"`
+	DeliveryAttempts       int               `json:"delivery_attempts" firestore:"delivery_attempts"`
+	PublishedAt            time.Time         `json:"published_at,omitempty" firestore:"published_at,omitempty"`
+	ExecutionID            string            `json:"execution_id,omitempty" firestore:"execution_id,omitempty"`
+	ReplayCount            int               `json:"replay_count" firestore:"replay_count"`
+	ReplayMessageIDs       []string          `json:"replay_message_ids,omitempty" firestore:"replay_message_ids,omitempty"`
+	ReplayedAt             time.Time         `json:"replayed_at,omitempty" firestore:"replayed_at,omitempty"`
+	CreatedAt              time.Time         `json:"created_at" firestore:"created_at"`
+}
+
+// DecodeJSON - unmarshals JSON data of the original message into dst, Data should be loaded by LoadData
+// if it was stored in the FailedEventsBucket
+func (e *FailedEvent) DecodeJSON(dst interface{}) error {
+	message := PubSubMessage{ID: e.ID, Data: e.Data}
+	return message.DecodeJSON(dst)
+}
+
+// LoadData - downloads Data stored in the FailedEventsBucket, no-op for the data stored in the document
+func (e *FailedEvent) LoadData(ctx context.Context) error {
+	if e.DataObject == "" || len(e.Data) > 0 {
+		return nil
+	}
+
+	data, err := DownloadObject(ctx, FailedEventsBucket, e.DataObject)
+	if err != nil {
+		return Errorf("FailedEvent.LoadData", ErrorCodeExternalAPI, "failed to download data of failed event %v: %w", e.ID, err)
+	}
+	e.Data = data
+
+	return nil
+}
+
+// NewFailedEvent - converts the push of the dead letter subscription into the FailedEvent,
+// the source topic of the subscription is resolved with the Pub/Sub API (requires pubsub.subscriptions.get)
+func NewFailedEvent(ctx context.Context, push *PubSubPush) *FailedEvent {
+	message := push.Message
+	attributes := map[string]string{}
+	for key, value := range message.Attributes {
+		if !strings.HasPrefix(key, "CloudPubSubDeadLetter") {
+			attributes[key] = value
+		}
+	}
+
+	event := &FailedEvent{
+		ID:                     message.ID,
+		Status:                 FailedEventStatusFailed,
+		SourceSubscription:     message.Attributes[DeadLetterSourceSubscriptionAttribute],
+		SourceProject:          message.Attributes[DeadLetterSourceProjectAttribute],
+		DeadLetterSubscription: push.Subscription,
+		Data:                   message.Data,
+		DataSize:               len(message.Data),
+		Attributes:             attributes,
+		OrderingKey:            message.OrderingKey,
+		PublishedAt:            message.PublishTime,
+		ExecutionID:            message.ExecutionID(),
+		CreatedAt:              time.Now(),
+	}
+	event.DeliveryAttempts, _ = strconv.Atoi(message.Attributes[DeadLetterDeliveryCountAttribute])
+	if publishedAt, err := time.Parse(time.RFC3339Nano, message.Attributes[DeadLetterPublishTimeAttribute]); err == nil {
+		event.PublishedAt = publishedAt
+	}
+
+	if event.SourceSubscription != "" {
+		topicName, err := subscriptionTopic(ctx, event.SourceProject, event.SourceSubscription)
+		if err != nil {
+			LoggerFromContext(ctx).Warning("failed to resolve topic of the dead-lettered message", Fields{"subscription": event.SourceSubscription, "error": err.Error()})
+		}
+		event.SourceTopic = topicName
+	}
+
+	return event
+}
+
+// RecordDeadLetter - logs the dead-lettered message with its context (without the data, it can contain personal data)
+// and stores it in the FailedEventsCollection. Data larger than 512KiB is uploaded to the FailedEventsBucket
+// or truncated if the bucket is not set. Redeliveries of the same dead letter message are stored once
+func RecordDeadLetter(ctx context.Context, fireclient *firestore.Client, push *PubSubPush) (*FailedEvent, error) {
+	event := NewFailedEvent(ctx, push)
+
+	LoggerFromContext(ctx).Error("pubsub message dead-lettered", Fields{
+		"message_id":          event.ID,
+		"source_subscription": event.SourceSubscription,
+		"source_topic":        event.SourceTopic,
+		"delivery_attempts":   event.DeliveryAttempts,
+		"published_at":        event.PublishedAt,
+		"publisher_execution": event.ExecutionID,
+		"attributes":          event.Attributes,
+		"data_size":           event.DataSize,
+	})
+
+	if len(event.Data) > maxFailedEventInlineData {
+		if err := offloadFailedEventData(ctx, event); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := fireclient.Collection(FailedEventsCollection).Doc(event.ID).Create(ctx, event)
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return nil, Errorf("RecordDeadLetter", ErrorCodeFirebase, "failed to store failed event %v: %w", event.ID, err)
+	}
+
+	return event, nil
+}
+
+// offloadFailedEventData - moves the data to the FailedEventsBucket, or truncates it if the bucket is not set
+func offloadFailedEventData(ctx context.Context, event *FailedEvent) error {
+	if FailedEventsBucket == "" {
+		LoggerFromContext(ctx).Warning("failed event data is too large, truncated", Fields{"message_id": event.ID, "data_size": event.DataSize})
+		event.Data = event.Data[:maxFailedEventInlineData]
+		event.DataTruncated = true
+		return nil
+	}
+
+	object := FailedEventsCollection + "/" + event.ID
+	if err := UploadObject(ctx, FailedEventsBucket, object, event.Data, "application/octet-stream"); err != nil {
+		return Errorf("RecordDeadLetter", ErrorCodeExternalAPI, "failed to upload data of failed event %v: %w", event.ID, err)
+	}
+	event.Data = nil
+	event.DataObject = object
+
+	return nil
+}
+
+// deadLetterRejected - the store failure which won't succeed on the redelivery (ex: invalid document)
+func deadLetterRejected(err error) bool {
+	switch firestoreErrorCode(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return true
+	default:
+		return false
+	}
+}
+
+// DeadLetterHandler - http handler of the dead letter push subscription: verifies the push token (see ParsePubSubPush)
+// and records the message. Transient storage failures return 500, so Pub/Sub redelivers the dead letter.
+// The message which Firestore rejects permanently is logged and acked, since the redeliveries would fail the same way
+func DeadLetterHandler(fireclient *firestore.Client, audience string, allowedEmails ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		push, err := ParsePubSubPush(r, audience, allowedEmails...)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+
+		if _, err := RecordDeadLetter(r.Context(), fireclient, push); err != nil {
+			LoggerFromContext(r.Context()).Error("failed to record dead letter", Fields{"message_id": push.Message.ID, "error": err.Error()})
+			if !deadLetterRejected(err) {
+				WriteError(w, err)
+				return
+			}
+		}
+
+		WriteNoContent(w)
+	}
+}
+
+// GetFailedEvent - returns the failed event, NotFound AppError if it doesn't exist
+func GetFailedEvent(ctx context.Context, fireclient *firestore.Client, eventID string) (*FailedEvent, error) {
+	dsnap, err := fireclient.Collection(FailedEventsCollection).Doc(eventID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, Errorf("GetFailedEvent", ErrorCodeNotFound, "failed event %v not found", eventID)
+	}
+	if err != nil {
+		return nil, Errorf("GetFailedEvent", ErrorCodeFirebase, "failed to get failed event %v: %w", eventID, err)
+	}
+
+	return decodeFailedEvent(dsnap)
+}
+
+// ListFailedEvents - returns up to limit (100 if empty) not replayed events of the source subscription
+// (all subscriptions if empty), oldest first. Query needs composite index on status, source_subscription and created_at
+func ListFailedEvents(ctx context.Context, fireclient *firestore.Client, sourceSubscription string, limit int) ([]*FailedEvent, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := fireclient.Collection(FailedEventsCollection).Where("status", "==", FailedEventStatusFailed)
+	if sourceSubscription != "" {
+		query = query.Where("source_subscription", "==", sourceSubscription)
+	}
+	query = query.OrderBy("created_at", firestore.Asc)
+
+	events := []*FailedEvent{}
+	err := NewQueryRunner(ctx, query, QueryRunnerOptions{Limit: limit, Name: "failed_events"}).ForEach(func(dsnap *firestore.DocumentSnapshot) error {
+		event, err := decodeFailedEvent(dsnap)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, Errorf("ListFailedEvents", ErrorCodeFirebase, "failed to list failed events: %w", err)
+	}
+
+	return events, nil
+}
+
+// ReplayOptions - options of the ReplayFailedEvents
+// TopicID - topic ID or full topic name the events are republished to, the source topic of every event if empty
+// Force - already replayed events are republished again
+type ReplayOptions struct {
+	TopicID string
+	Force   bool
+}
+
+// ReplayFailedEvents - republishes the selected events with the original data, attributes, ordering key and ReplayedFromAttribute,
+// and marks them replayed. Replays continue after the failed event, the first error is returned with the count of the replayed ones
+func ReplayFailedEvents(ctx context.Context, fireclient *firestore.Client, options ReplayOptions, eventIDs ...string) (int, error) {
+	replayed := 0
+	var firstErr error
+	for _, eventID := range eventIDs {
+		err := replayFailedEvent(ctx, fireclient, options, eventID)
+		if err != nil {
+			LoggerFromContext(ctx).Error("failed to replay event", Fields{"event_id": eventID, "error": err.Error()})
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		replayed++
+	}
+
+	return replayed, firstErr
+}
+
+// replayFailedEvent - republishes the event and records the replay
+func replayFailedEvent(ctx context.Context, fireclient *firestore.Client, options ReplayOptions, eventID string) error {
+	op := "ReplayFailedEvents"
+	event, err := GetFailedEvent(ctx, fireclient, eventID)
+	if err != nil {
+		return err
+	}
+	if event.Status == FailedEventStatusReplayed && !options.Force {
+		return Errorf(op, ErrorCodeConflict, "event %v was already replayed", eventID)
+	}
+
+	topicID := options.TopicID
+	if topicID == "" {
+		topicID = event.SourceTopic
+	}
+	if topicID == "" {
+		return Errorf(op, ErrorCodeInvalidArgument, "event %v has no source topic, topic ID should be set", eventID)
+	}
+	if event.DataTruncated {
+		return Errorf(op, ErrorCodeConflict, "event %v data was truncated, it can't be replayed", eventID)
+	}
+	if err := event.LoadData(ctx); err != nil {
+		return err
+	}
+
+	attributes := map[string]string{}
+	for key, value := range event.Attributes {
+		attributes[key] = value
+	}
+	attributes[ReplayedFromAttribute] = event.ID
+
+	messageID, err := Publish(ctx, topicID, &pubsub.Message{Data: event.Data, Attributes: attributes, OrderingKey: event.OrderingKey})
+	if err != nil {
+		return Errorf(op, ErrorCodeExternalAPI, "failed to republish event %v: %w", eventID, err)
+	}
+
+	_, err = fireclient.Collection(FailedEventsCollection).Doc(eventID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: FailedEventStatusReplayed},
+		{Path: "replay_count", Value: firestore.Increment(1)},
+		{Path: "replay_message_ids", Value: firestore.ArrayUnion(messageID)},
+		{Path: "replayed_at", Value: time.Now()},
+	})
+	if err != nil {
+		return Errorf(op, ErrorCodeFirebase, "event %v was republished as %v but not marked replayed: %w", eventID, messageID, err)
+	}
+
+	LoggerFromContext(ctx).Info("failed event replayed", Fields{"event_id": eventID, "topic": topicID, "message_id": messageID})
+
+	return nil
+}
+
+// subscriptionTopic - returns the cached full topic name of the subscription, so the replay publishes to the source project
+func subscriptionTopic(ctx context.Context, project, subscriptionID string) (string, error) {
+	// the attribute can be the full subscription name
+	if index := strings.LastIndex(subscriptionID, "/"); index >= 0 {
+		subscriptionID = subscriptionID[index+1:]
+	}
+	if project == "" {
+		project = packageConfig().ProjectID
+	}
+
+	key := project + "/" + subscriptionID
+	if cached, ok := sourceTopics.get(key); ok {
+		return cached.(string), nil
+	}
+
+	client, err := GetPubSubClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	config, err := client.SubscriptionInProject(subscriptionID, project).Config(ctx)
+	if err != nil {
+		return "", err
+	}
+	if config.Topic == nil {
+		return "", errors.New("subscription has no topic")
+	}
+	sourceTopics.set(key, config.Topic.String())
+
+	return config.Topic.String(), nil
+}
+
+// decodeFailedEvent - converts the document into FailedEvent
+func decodeFailedEvent(dsnap *firestore.DocumentSnapshot) (*FailedEvent, error) {
+	var event FailedEvent
+	if err := dsnap.DataTo(&event); err != nil {
+		return nil, Errorf("FailedEvent", ErrorCodeInternal, "failed to decode failed event %v: %w", dsnap.Ref.ID, err)
+	}
+	event.ID = dsnap.Ref.ID
+
+	return &event, nil
+}
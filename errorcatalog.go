@@ -0,0 +1,126 @@
+package cloudfunctions_go_utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrorDefinition - entry of the error codes catalog
+// Code - stable machine-readable code returned in the ResponseError, ex: ORDER_NOT_FOUND
+// ErrorCode - ErrorCode category of the error (logging, metrics)
+// HTTPStatus - status returned to the caller, HTTP status of the ErrorCode
+// Message - default caller safe message
+type ErrorDefinition struct {
+	Code       string `json:"code"`
+	ErrorCode  int    `json:"-"`
+	HTTPStatus int    `json:"http_status"`
+	Message    string `json:"message"`
+}
+
+var (
+	errorCatalog   = map[string]*ErrorDefinition{}
+	errorCatalogMu sync.RWMutex
+)
+
+var (
+	// ErrTokenExpired - ID token or session cookie is expired, the client should refresh it and retry
+	ErrTokenExpired = RegisterErrorCode("TOKEN_EXPIRED", ErrorCodeUnauthenticated, "token is expired")
+	// ErrTokenRevoked - token was revoked, the client should sign in again
+	ErrTokenRevoked = RegisterErrorCode("TOKEN_REVOKED", ErrorCodeUnauthenticated, "token was revoked")
+	// ErrUserNotFound - user doesn't exist
+	ErrUserNotFound = RegisterErrorCode("USER_NOT_FOUND", ErrorCodeNotFound, "user not found")
+	// ErrUserExists - user with the UID or email already exists
+	ErrUserExists = RegisterErrorCode("USER_ALREADY_EXISTS", ErrorCodeConflict, "user already exists")
+	// ErrOrderNotFound - order (shipment) doesn't exist
+	ErrOrderNotFound = RegisterErrorCode("ORDER_NOT_FOUND", ErrorCodeNotFound, "order not found")
+	// ErrPromoNotFound - promo doesn't exist or is not active
+	ErrPromoNotFound = RegisterErrorCode("PROMO_NOT_FOUND", ErrorCodeNotFound, "promo not found")
+	// ErrPromoUnavailable - promo is expired, not started or its redemption limit of the user is reached
+	ErrPromoUnavailable = RegisterErrorCode("PROMO_UNAVAILABLE", ErrorCodeConflict, "promo is not available")
+	// ErrPromoOutOfStock - promo has not enough items left
+	ErrPromoOutOfStock = RegisterErrorCode("PROMO_OUT_OF_STOCK", ErrorCodeConflict, "promo is out of stock")
+	// ErrMaintenance - the function is in the maintenance mode, the client should retry after the Retry-After
+	ErrMaintenance = RegisterErrorCode("MAINTENANCE", ErrorCodeUnavailable, "service is under maintenance")
+)
+
+// RegisterErrorCode - adds the code to the catalog and returns its definition, should be called from the package level var
+// declarations of the functions, ex: var ErrCartEmpty = RegisterErrorCode("CART_EMPTY", ErrorCodeConflict, "cart is empty").
+// Panics if the code is already registered with another category, since the clients rely on the codes being stable
+func RegisterErrorCode(code string, errorCode int, message string) *ErrorDefinition {
+	errorCatalogMu.Lock()
+	defer errorCatalogMu.Unlock()
+
+	if existing, ok := errorCatalog[code]; ok {
+		if existing.ErrorCode != errorCode {
+			panic(fmt.Sprintf("error code %v is already registered with ErrorCode %v", code, existing.ErrorCode))
+		}
+		return existing
+	}
+
+	definition := &ErrorDefinition{
+		Code:       code,
+		ErrorCode:  errorCode,
+		HTTPStatus: HTTPStatusForErrorCode(errorCode),
+		Message:    message,
+	}
+	errorCatalog[code] = definition
+
+	return definition
+}
+
+// LookupErrorCode - returns definition of the registered code
+func LookupErrorCode(code string) (*ErrorDefinition, bool) {
+	errorCatalogMu.RLock()
+	defer errorCatalogMu.RUnlock()
+
+	definition, ok := errorCatalog[code]
+	return definition, ok
+}
+
+// ErrorCodeCatalog - returns all registered definitions sorted by code, ex: to serve them to the clients or the docs
+func ErrorCodeCatalog() []ErrorDefinition {
+	errorCatalogMu.RLock()
+	defer errorCatalogMu.RUnlock()
+
+	definitions := make([]ErrorDefinition, 0, len(errorCatalog))
+	for _, definition := range errorCatalog {
+		definitions = append(definitions, *definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Code < definitions[j].Code })
+
+	return definitions
+}
+
+// E - builds AppError of the definition with the default message and the wrapped err
+func (d *ErrorDefinition) E(op string, err error) *AppError {
+	return &AppError{
+		Op:         op,
+		Code:       d.ErrorCode,
+		Reason:     d.Code,
+		HTTPStatus: d.HTTPStatus,
+		Msg:        d.Message,
+		Err:        err,
+	}
+}
+
+// Errorf - E with the formatted underlying error, %w verb is supported
+func (d *ErrorDefinition) Errorf(op string, format string, args ...interface{}) *AppError {
+	return d.E(op, fmt.Errorf(format, args...))
+}
+
+// Is - checks if the err wraps AppError of the definition, ex: if ErrOrderNotFound.Is(err) { ... }
+func (d *ErrorDefinition) Is(err error) bool {
+	var appErr *AppError
+	return errors.As(err, &appErr) && appErr.Reason == d.Code
+}
+
+// errorReason - catalog code of the AppError or the name of its ErrorCode
+func errorReason(appErr *AppError) string {
+	if appErr.Reason != "" {
+		return appErr.Reason
+	}
+
+	return ErrorCodeName(appErr.Code)
+}
@@ -0,0 +1,50 @@
+package cloudfunctions_go_utils
+
+import (
+	"runtime/debug"
+
+	"cloud.google.com/go/logging"
+)
+
+// ReportedErrorEventType - @type of the log entry payload which makes Google Error Reporting group the entry
+const ReportedErrorEventType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// ErrorServiceContext - service which reported the error, used by Error Reporting for grouping and filtering
+type ErrorServiceContext struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+}
+
+// WithErrorReporting - returns derived logger which adds stack trace and Error Reporting fields
+// to Error, Critical and Emergency entries. K_SERVICE and K_REVISION env variables are used if service or version are empty
+func (pl *Logger) WithErrorReporting(service, version string) *Logger {
+	if service == "" {
+		service = packageConfig().Service
+	}
+	if service == "" {
+		service = pl.LoggerInvoker
+	}
+	if version == "" {
+		version = packageConfig().Revision
+	}
+
+	derived := *pl
+	derived.errorServiceContext = &ErrorServiceContext{
+		Service: service,
+		Version: version,
+	}
+
+	return &derived
+}
+
+// addErrorReportingFields - sets Error Reporting fields for Error and higher severities
+func (pl *Logger) addErrorReportingFields(severity logging.Severity, payload *LogEntryPayload) {
+	if pl.errorServiceContext == nil || severity < logging.Error {
+		return
+	}
+
+	payload.Type = ReportedErrorEventType
+	payload.ServiceContext = pl.errorServiceContext
+	// Error Reporting expects the message on the first line followed by the goroutine stack
+	payload.StackTrace = payload.Message + "\n\n" + string(debug.Stack())
+}
@@ -0,0 +1,47 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ExecutionIDHeader - header with the execution ID set by Cloud Functions for HTTP triggers
+	ExecutionIDHeader = "Function-Execution-Id"
+
+	// executionIDContextKey - context key of the execution ID
+	executionIDContextKey contextKey = "execution_id"
+)
+
+// ContextWithExecutionID - returns copy of ctx with the execution ID, generates UUID if executionID is empty.
+// Should be used by Pub/Sub-triggered functions and local runs, where there is no Function-Execution-Id header,
+// so all log entries of one execution share a correlation ID
+func ContextWithExecutionID(ctx context.Context, executionID string) context.Context {
+	if executionID == "" {
+		executionID = uuid.NewString()
+	}
+
+	return context.WithValue(ctx, executionIDContextKey, executionID)
+}
+
+// ExecutionIDFromContext - returns the execution ID stored by ContextWithExecutionID or WithExecutionID middleware
+func ExecutionIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	executionID, _ := ctx.Value(executionIDContextKey).(string)
+	return executionID
+}
+
+// WithExecutionID - http middleware which stores Function-Execution-Id header value in the request context
+// or generates UUID if the header is missing
+func WithExecutionID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithExecutionID(r.Context(), r.Header.Get(ExecutionIDHeader))
+
+		next(w, r.WithContext(ctx))
+	}
+}
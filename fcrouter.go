@@ -0,0 +1,252 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// fcRegistryCacheKey - cache key of the loaded fulfillment centers
+	fcRegistryCacheKey = "fulfillment_centers"
+)
+
+var (
+	FulfillmentCentersCollection string = "fulfillment_centers"
+)
+
+// FulfillmentCenter - fulfillment center document of the FulfillmentCentersCollection
+// APICredentialsID - document ID of the FCShippingSecretDataCollection with the Imprint Engine credentials
+// GraphQLURL - Imprint Engine GraphQL endpoint of the FC
+// AppID - Imprint Engine app ID of the FC
+// Countries - ISO 3166-1 alpha-2 destination countries the FC ships to, all countries if empty
+// SKUs - SKUs stocked by the FC, all SKUs if empty
+// Priority - higher priority FC wins when several FCs match the order
+// Default - FC used when no FC matches the order
+type FulfillmentCenter struct {
+	ID               string   `json:"id" firestore:"-"`
+	Name             string   `json:"name" firestore:"name"`
+	APICredentialsID string   `json:"api_credentials_id" firestore:"api_credentials_id"`
+	GraphQLURL       string   `json:"graphql_url" firestore:"graphql_url"`
+	AppID            int64    `json:"app_id" firestore:"app_id"`
+	Countries        []string `json:"countries" firestore:"countries"`
+	SKUs             []string `json:"skus" firestore:"skus"`
+	Priority         int      `json:"priority" firestore:"priority"`
+	Default          bool     `json:"default" firestore:"default"`
+	Active           bool     `json:"active" firestore:"active"`
+}
+
+// FCRegistry - active fulfillment centers of the FulfillmentCentersCollection cached for the TTL
+type FCRegistry struct {
+	fireclient *firestore.Client
+	cache      *ttlCache
+}
+
+// NewFCRegistry - returns FCRegistry, cacheTTL is 5 minutes if empty
+func NewFCRegistry(fireclient *firestore.Client, cacheTTL time.Duration) *FCRegistry {
+	if cacheTTL <= 0 {
+		cacheTTL = 5 * time.Minute
+	}
+
+	return &FCRegistry{
+		fireclient: fireclient,
+		cache:      newTTLCache(cacheTTL),
+	}
+}
+
+// List - returns active fulfillment centers sorted by the priority (highest first) and ID
+func (r *FCRegistry) List(ctx context.Context) ([]FulfillmentCenter, error) {
+	if cached, ok := r.cache.get(fcRegistryCacheKey); ok {
+		return cached.([]FulfillmentCenter), nil
+	}
+
+	query := r.fireclient.Collection(FulfillmentCentersCollection).Where("active", "==", true)
+	runner := NewQueryRunner(ctx, query, QueryRunnerOptions{Name: "active_fulfillment_centers"})
+	defer runner.Stop()
+
+	centers := []FulfillmentCenter{}
+	for {
+		dsnap, err := runner.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, Errorf("FCRegistry.List", ErrorCodeFirebase, "failed to read fulfillment centers: %w", err)
+		}
+
+		var center FulfillmentCenter
+		if err := dsnap.DataTo(&center); err != nil {
+			LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to decode fulfillment center '%v'. Error: %v", dsnap.Ref.ID, err.Error()), "")
+			continue
+		}
+		center.ID = dsnap.Ref.ID
+		centers = append(centers, center)
+	}
+
+	sort.SliceStable(centers, func(i, j int) bool {
+		if centers[i].Priority != centers[j].Priority {
+			return centers[i].Priority > centers[j].Priority
+		}
+		return centers[i].ID < centers[j].ID
+	})
+	r.cache.set(fcRegistryCacheKey, centers)
+
+	return centers, nil
+}
+
+// Get - returns active fulfillment center by ID
+func (r *FCRegistry) Get(ctx context.Context, fcID string) (*FulfillmentCenter, error) {
+	centers, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range centers {
+		if centers[i].ID == fcID {
+			center := centers[i]
+			return &center, nil
+		}
+	}
+
+	return nil, Errorf("FCRegistry.Get", ErrorCodeNotFound, "fulfillment center %v not found", fcID)
+}
+
+// Refresh - drops cached fulfillment centers, so the next call reads them from Firestore
+func (r *FCRegistry) Refresh() {
+	r.cache.delete(fcRegistryCacheKey)
+}
+
+// Client - returns IEClient of the fulfillment center for the organization
+func (r *FCRegistry) Client(ctx context.Context, fcID, orgID string) (*IEClient, error) {
+	center, err := r.Get(ctx, fcID)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFCIEClient(ctx, r.fireclient, *center, orgID)
+}
+
+// NewFCIEClient - returns IEClient with the credentials, GraphQL endpoint and app ID of the fulfillment center,
+// mutations aren't retried (see NewIEClient)
+func NewFCIEClient(ctx context.Context, fireclient *firestore.Client, center FulfillmentCenter, orgID string) (*IEClient, error) {
+	if IsShippingSandbox() {
+		return NewSandboxIEClient(DefaultShippingSandbox), nil
+	}
+
+	if center.GraphQLURL == "" || center.APICredentialsID == "" {
+		return nil, Errorf("NewFCIEClient", ErrorCodeInternal, "fulfillment center %v has no GraphQL URL or API credentials", center.ID)
+	}
+
+	externalID, err := ieExternalID(orgID)
+	if err != nil {
+		return nil, E("NewFCIEClient", 0, err)
+	}
+
+	httpClient, err := imprintEngineMNAuthorizedClient(ctx, fireclient, center.APICredentialsID)
+	if err != nil {
+		return nil, Errorf("NewFCIEClient", 0, "failed to get http client: %w", err)
+	}
+
+	return &IEClient{
+		graphql:    NewGraphQLClient(center.GraphQLURL, httpClient, GraphQLOptions{}),
+		endpoint:   center.GraphQLURL,
+		appID:      center.AppID,
+		externalID: externalID,
+	}, nil
+}
+
+// FCRouter - selects the fulfillment center of the order
+type FCRouter struct {
+	registry *FCRegistry
+}
+
+// NewFCRouter - returns FCRouter of the registry
+func NewFCRouter(registry *FCRegistry) *FCRouter {
+	return &FCRouter{registry: registry}
+}
+
+// Route - returns fulfillment center of the order: FC which ships to the destination country and stocks all SKUs of the order,
+// FCs with the explicit SKUs list win over the FCs which stock everything, then the priority decides.
+// Default FC is returned if no FC matches, NotFound AppError if there is no default FC either
+func (r *FCRouter) Route(ctx context.Context, request ShipmentRequest) (*FulfillmentCenter, error) {
+	centers, err := r.registry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched, fallback *FulfillmentCenter
+	for i := range centers {
+		center := &centers[i]
+		if center.Default && fallback == nil {
+			fallback = center
+		}
+		if !fcShipsTo(center, request.Address.Country) || !fcStocks(center, request.Items) {
+			continue
+		}
+		// centers are sorted by the priority, the first FC of the explicit SKUs stays
+		if matched == nil || (len(matched.SKUs) == 0 && len(center.SKUs) > 0) {
+			matched = center
+		}
+	}
+
+	if matched == nil {
+		matched = fallback
+	}
+	if matched == nil {
+		return nil, Errorf("FCRouter.Route", ErrorCodeNotFound, "no fulfillment center for order %v to %v", request.OrderID, request.Address.Country).
+			WithMessage("order can't be fulfilled")
+	}
+
+	center := *matched
+	return &center, nil
+}
+
+// Provider - returns fulfillment center of the order and IEClient of it
+func (r *FCRouter) Provider(ctx context.Context, request ShipmentRequest, orgID string) (ShippingProvider, *FulfillmentCenter, error) {
+	center, err := r.Route(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := NewFCIEClient(ctx, r.registry.fireclient, *center, orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, center, nil
+}
+
+// fcShipsTo - FC ships to the country
+func fcShipsTo(center *FulfillmentCenter, country string) bool {
+	if len(center.Countries) == 0 {
+		return true
+	}
+
+	for _, fcCountry := range center.Countries {
+		if strings.EqualFold(fcCountry, country) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fcStocks - FC stocks all SKUs of the items
+func fcStocks(center *FulfillmentCenter, items []ShipmentItem) bool {
+	if len(center.SKUs) == 0 {
+		return true
+	}
+
+	for _, item := range items {
+		if !containsString(center.SKUs, item.SKU) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,132 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	FeatureFlagsCollection string = "feature_flags"
+)
+
+// FeatureFlags - flags client which reads all flags of the FeatureFlagsCollection document and caches them for the TTL.
+// Flag value is bool, string, number or rollout map, ex:
+// {"new_checkout": {"enabled": true, "rollout_percentage": 25}, "label_format": "pdf", "max_items": 100}
+// Methods return the default value if the flag is missing, has another type or flags can't be read
+type FeatureFlags struct {
+	fireclient *firestore.Client
+	documentID string
+	cache      *ttlCache
+}
+
+func NewFeatureFlags(fireclient *firestore.Client, documentID string, cacheTTL time.Duration) *FeatureFlags {
+	return &FeatureFlags{
+		fireclient: fireclient,
+		documentID: documentID,
+		cache:      newTTLCache(cacheTTL),
+	}
+}
+
+// flags - returns cached flags or reads them from Firestore
+func (ff *FeatureFlags) flags(ctx context.Context) map[string]interface{} {
+	if cached, ok := ff.cache.get(ff.documentID); ok {
+		return cached.(map[string]interface{})
+	}
+
+	dsnap, err := ff.fireclient.Collection(FeatureFlagsCollection).Doc(ff.documentID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		ff.cache.set(ff.documentID, map[string]interface{}{})
+		return map[string]interface{}{}
+	}
+	if err != nil {
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to get feature flags '%v'. Error: %v", ff.documentID, err.Error()), "")
+		return map[string]interface{}{}
+	}
+
+	flags := dsnap.Data()
+	ff.cache.set(ff.documentID, flags)
+
+	return flags
+}
+
+// Refresh - drops cached flags, so the next call reads them from Firestore
+func (ff *FeatureFlags) Refresh() {
+	ff.cache.delete(ff.documentID)
+}
+
+// Bool - returns bool flag (enabled field for the rollout flags without UID check)
+func (ff *FeatureFlags) Bool(ctx context.Context, name string, defaultValue bool) bool {
+	switch value := ff.flags(ctx)[name].(type) {
+	case bool:
+		return value
+	case map[string]interface{}:
+		if enabled, ok := value["enabled"].(bool); ok {
+			return enabled
+		}
+	}
+
+	return defaultValue
+}
+
+// String - returns string flag
+func (ff *FeatureFlags) String(ctx context.Context, name string, defaultValue string) string {
+	if value, ok := ff.flags(ctx)[name].(string); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+// Number - returns number flag
+func (ff *FeatureFlags) Number(ctx context.Context, name string, defaultValue float64) float64 {
+	switch value := ff.flags(ctx)[name].(type) {
+	case int64:
+		return float64(value)
+	case float64:
+		return value
+	}
+
+	return defaultValue
+}
+
+// EnabledFor - checks if the flag is enabled for the UID. For the rollout flags the UID is in the rollout
+// if its stable bucket (0..99, hash of the flag name and UID) is less than rollout_percentage,
+// so the same users stay in the rollout while the percentage grows
+func (ff *FeatureFlags) EnabledFor(ctx context.Context, name string, uid string) bool {
+	switch value := ff.flags(ctx)[name].(type) {
+	case bool:
+		return value
+	case map[string]interface{}:
+		if enabled, ok := value["enabled"].(bool); ok && !enabled {
+			return false
+		}
+
+		var percentage float64
+		switch rollout := value["rollout_percentage"].(type) {
+		case int64:
+			percentage = float64(rollout)
+		case float64:
+			percentage = rollout
+		default:
+			return true
+		}
+
+		return float64(rolloutBucket(name, uid)) < percentage
+	}
+
+	return false
+}
+
+// rolloutBucket - stable bucket 0..99 of the UID for the flag
+func rolloutBucket(name, uid string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(name + ":" + uid))
+
+	return hash.Sum32() % 100
+}
@@ -0,0 +1,328 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// encryptedFieldPrefix - prefix of the encrypted values: enc:v1:<key ref>:<base64 nonce and ciphertext>
+	encryptedFieldPrefix = "enc:v1:"
+
+	// secureTag - struct tag of the encrypted fields, ex: `secure:"true"`, tagged struct fields are encrypted entirely
+	secureTag = "secure"
+
+	fieldKeySize         = 32
+	secretFieldKeyPrefix = "s"
+	kmsFieldKeyPrefix    = "k"
+	fieldDataKeyCacheTTL = time.Hour
+)
+
+// IsEncryptedField - checks if the value was encrypted by FieldEncryptor
+func IsEncryptedField(value string) bool {
+	return strings.HasPrefix(value, encryptedFieldPrefix)
+}
+
+// FieldEncryptor - AES-256-GCM encryption of the sensitive document fields, ex: the shipping addresses.
+// Encrypted values are strings which can be stored in the same fields, so the documents can be migrated gradually:
+// DecryptField returns the values which are not encrypted as is
+type FieldEncryptor struct {
+	// keyRef - reference of the current key written into the encrypted values
+	keyRef string
+	aead   cipher.AEAD
+	// resolve - returns the key of the reference of another key, ex: the rotated one
+	resolve func(ctx context.Context, keyRef string) (cipher.AEAD, error)
+}
+
+// NewSecretFieldEncryptor - returns FieldEncryptor with the keys from the secret: base64 encoded 32 byte keys, one per line.
+// The first key encrypts, others decrypt the values of the previous keys, so the key is rotated by adding the new key
+// on the first line and removing the old one after the documents are re-encrypted
+func NewSecretFieldEncryptor(ctx context.Context, secretName string) (*FieldEncryptor, error) {
+	secret, err := GetSecret(ctx, secretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get field encryption keys. Error: %v", err.Error())
+	}
+
+	keys := map[string]cipher.AEAD{}
+	var current string
+	for _, line := range strings.Split(secret, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != fieldKeySize {
+			return nil, fmt.Errorf("field encryption keys of %v must be base64 encoded %d byte keys", secretName, fieldKeySize)
+		}
+		aead, err := newFieldAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprint := sha256.Sum256(key)
+		keyRef := secretFieldKeyPrefix + hex.EncodeToString(fingerprint[:4])
+		keys[keyRef] = aead
+		if current == "" {
+			current = keyRef
+		}
+	}
+	if current == "" {
+		return nil, fmt.Errorf("secret %v has no field encryption keys", secretName)
+	}
+
+	return &FieldEncryptor{
+		keyRef: current,
+		aead:   keys[current],
+		resolve: func(ctx context.Context, keyRef string) (cipher.AEAD, error) {
+			if aead, ok := keys[keyRef]; ok {
+				return aead, nil
+			}
+			return nil, fmt.Errorf("field was encrypted with key %v which is not in secret %v", keyRef, secretName)
+		},
+	}, nil
+}
+
+// NewKMSFieldEncryptor - returns FieldEncryptor with the envelope encryption: the random data key of the instance is wrapped
+// with the KMS key and stored in the encrypted values, so KMS is called once per instance and once per data key on decryption.
+// The KMS key can be rotated in KMS, the data keys of the old key versions are unwrapped while the versions are enabled
+func NewKMSFieldEncryptor(ctx context.Context, keyName string) (*FieldEncryptor, error) {
+	key := make([]byte, fieldKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate field data key. Error: %v", err.Error())
+	}
+	aead, err := newFieldAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := KMSEncrypt(ctx, keyName, key)
+	if err != nil {
+		return nil, err
+	}
+	keyRef := kmsFieldKeyPrefix + base64.RawURLEncoding.EncodeToString(wrapped)
+
+	dataKeys := newTTLCache(fieldDataKeyCacheTTL)
+	var unwrapMu sync.Mutex
+
+	return &FieldEncryptor{
+		keyRef: keyRef,
+		aead:   aead,
+		resolve: func(ctx context.Context, keyRef string) (cipher.AEAD, error) {
+			if cached, ok := dataKeys.get(keyRef); ok {
+				return cached.(cipher.AEAD), nil
+			}
+			if !strings.HasPrefix(keyRef, kmsFieldKeyPrefix) {
+				return nil, fmt.Errorf("field was not encrypted with kms key %v", keyName)
+			}
+
+			// concurrent decryptions of the documents written by the same instance unwrap the key once
+			unwrapMu.Lock()
+			defer unwrapMu.Unlock()
+			if cached, ok := dataKeys.get(keyRef); ok {
+				return cached.(cipher.AEAD), nil
+			}
+
+			wrapped, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(keyRef, kmsFieldKeyPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid field data key. Error: %v", err.Error())
+			}
+			key, err := KMSDecrypt(ctx, keyName, wrapped)
+			if err != nil {
+				return nil, err
+			}
+			aead, err := newFieldAEAD(key)
+			if err != nil {
+				return nil, err
+			}
+			dataKeys.set(keyRef, aead)
+
+			return aead, nil
+		},
+	}, nil
+}
+
+// EncryptField - encrypts the value, empty value is returned as is. The value with the encrypted prefix is encrypted too,
+// so the plaintext which only looks encrypted isn't stored unencrypted.
+// field is bound to the ciphertext as additional data, so the value can't be copied into another field.
+// EncryptStruct binds Go field path of the value, ex: PhoneNumber, Address.Street1 or Items[].Note
+func (fe *FieldEncryptor) EncryptField(ctx context.Context, field, value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	nonce := make([]byte, fe.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce. Error: %v", err.Error())
+	}
+	sealed := fe.aead.Seal(nonce, nonce, []byte(value), []byte(field))
+
+	return encryptedFieldPrefix + fe.keyRef + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptField - decrypts the value of EncryptField of the same field, the values which are not encrypted are returned as is
+func (fe *FieldEncryptor) DecryptField(ctx context.Context, field, value string) (string, error) {
+	if !IsEncryptedField(value) {
+		return value, nil
+	}
+
+	keyRef, payload, ok := strings.Cut(strings.TrimPrefix(value, encryptedFieldPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("invalid encrypted field")
+	}
+
+	aead := fe.aead
+	if keyRef != fe.keyRef {
+		var err error
+		if aead, err = fe.resolve(ctx, keyRef); err != nil {
+			return "", err
+		}
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted field")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt field. Error: %v", err.Error())
+	}
+
+	return string(plaintext), nil
+}
+
+// EncryptStruct - encrypts the string fields tagged with `secure:"true"` of the struct pointer, ex:
+// stored := *shipment; err := encryptor.EncryptStruct(ctx, &stored). Tagged struct fields are encrypted entirely,
+// nested structs, pointers and slices are walked (interfaces and maps are not). Fields of the struct itself are changed
+// in place, while the changed pointers and slices are replaced with the copies, so the struct sharing them keeps the plaintext.
+// Nil encryptor does nothing
+func (fe *FieldEncryptor) EncryptStruct(ctx context.Context, ptr interface{}) error {
+	if fe == nil {
+		return nil
+	}
+
+	return fe.walkStruct(ptr, func(field, value string) (string, error) { return fe.EncryptField(ctx, field, value) })
+}
+
+// DecryptStruct - decrypts the fields encrypted by EncryptStruct in place. Nil encryptor does nothing
+func (fe *FieldEncryptor) DecryptStruct(ctx context.Context, ptr interface{}) error {
+	if fe == nil {
+		return nil
+	}
+
+	return fe.walkStruct(ptr, func(field, value string) (string, error) { return fe.DecryptField(ctx, field, value) })
+}
+
+// walkStruct - applies transform to the secure fields of the struct pointer
+func (fe *FieldEncryptor) walkStruct(ptr interface{}, transform func(field, value string) (string, error)) error {
+	value := reflect.ValueOf(ptr)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("secure fields can be processed only in the struct pointer, got %T", ptr)
+	}
+
+	_, err := walkSecureFields(value.Elem(), false, "", transform)
+	return err
+}
+
+// walkSecureFields - applies transform to the strings of the value if secure, or to the tagged fields of the structs.
+// Returns true if anything was changed. Pointers and slices are walked in the copies, which replace them only if changed
+func walkSecureFields(value reflect.Value, secure bool, path string, transform func(field, value string) (string, error)) (bool, error) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return false, nil
+		}
+		copied := reflect.New(value.Type().Elem())
+		copied.Elem().Set(value.Elem())
+		changed, err := walkSecureFields(copied.Elem(), secure, path, transform)
+		if changed {
+			value.Set(copied)
+		}
+		return changed, err
+	case reflect.String:
+		if !secure {
+			return false, nil
+		}
+		transformed, err := transform(path, value.String())
+		if err != nil {
+			return false, fmt.Errorf("failed to process field %v. Error: %v", path, err.Error())
+		}
+		if transformed == value.String() {
+			return false, nil
+		}
+		value.SetString(transformed)
+		return true, nil
+	case reflect.Slice:
+		if value.IsNil() {
+			return false, nil
+		}
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(copied, value)
+		changed, err := walkSecureItems(copied, secure, path, transform)
+		if changed {
+			value.Set(copied)
+		}
+		return changed, err
+	case reflect.Array:
+		return walkSecureItems(value, secure, path, transform)
+	case reflect.Struct:
+		if value.Type() == reflect.TypeOf(time.Time{}) {
+			return false, nil
+		}
+		changed := false
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			fieldSecure := secure || field.Tag.Get(secureTag) == "true"
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			fieldChanged, err := walkSecureFields(value.Field(i), fieldSecure, fieldPath, transform)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || fieldChanged
+		}
+		return changed, nil
+	}
+
+	return false, nil
+}
+
+// walkSecureItems - walkSecureFields of the slice or array items, items share the path, so they can be reordered
+func walkSecureItems(value reflect.Value, secure bool, path string, transform func(field, value string) (string, error)) (bool, error) {
+	changed := false
+	for i := 0; i < value.Len(); i++ {
+		itemChanged, err := walkSecureFields(value.Index(i), secure, path+"[]", transform)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || itemChanged
+	}
+
+	return changed, nil
+}
+
+// newFieldAEAD - AES-GCM of the 32 byte key
+func newFieldAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field encryption key. Error: %v", err.Error())
+	}
+
+	return cipher.NewGCM(block)
+}
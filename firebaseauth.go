@@ -0,0 +1,355 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/auth"
+)
+
+// contextKey - type for the values stored by this package in the request context
+type contextKey string
+
+const (
+	// firebaseTokenContextKey - context key of the verified *auth.Token
+	firebaseTokenContextKey contextKey = "firebase_token"
+
+	// SessionCookieName - the only cookie name forwarded by Firebase Hosting to the functions
+	SessionCookieName = "__session"
+
+	// RolesClaim - custom claim with the list of the user roles, ex: {"roles": ["admin", "support"]}
+	RolesClaim = "roles"
+)
+
+var (
+	// cachedAuthClient - process-level Firebase Auth client, use GetFirebaseAuthClient to get it
+	cachedAuthClient   *auth.Client
+	cachedAuthClientMu sync.Mutex
+)
+
+// ErrForbidden - returned when the verified token doesn't have the required custom claims
+var ErrForbidden = errors.New("forbidden")
+
+// FirebaseAuthOptions - per-route options of the Firebase auth middleware
+// CheckRevoked - additionally checks that the token was not revoked. Adds extra latency since user record is fetched on every request
+// AppCheck - verifies X-Firebase-AppCheck header alongside the ID token, AppCheckModeFromEnv can be used to configure it per environment
+// AllowSessionCookie - accepts __session cookie (CreateSessionCookie) if there is no Bearer token
+// Optional - requests without valid credentials are passed to next as anonymous (UserFromContext returns false)
+type FirebaseAuthOptions struct {
+	CheckRevoked       bool
+	AppCheck           AppCheckMode
+	AllowSessionCookie bool
+	Optional           bool
+}
+
+// RequireFirebaseAuth - http middleware which verifies the "Bearer [token]" Authorization header,
+// stores the verified *auth.Token in the request context and calls next.
+// Writes 401 JSON response for missing/invalid tokens (TOKEN_EXPIRED and TOKEN_REVOKED codes for the expired and revoked ones,
+// so the client can tell the token refresh from the sign in) and 500 if the token can't be verified
+func RequireFirebaseAuth(next http.HandlerFunc) http.HandlerFunc {
+	return RequireFirebaseAuthWithOptions(next, FirebaseAuthOptions{})
+}
+
+// RequireFirebaseAuthStrict - same as RequireFirebaseAuth but also rejects revoked tokens
+func RequireFirebaseAuthStrict(next http.HandlerFunc) http.HandlerFunc {
+	return RequireFirebaseAuthWithOptions(next, FirebaseAuthOptions{CheckRevoked: true})
+}
+
+// RequireFirebaseAuthOrSessionCookie - same as RequireFirebaseAuth but accepts either a Bearer token or a __session cookie
+func RequireFirebaseAuthOrSessionCookie(next http.HandlerFunc) http.HandlerFunc {
+	return RequireFirebaseAuthWithOptions(next, FirebaseAuthOptions{AllowSessionCookie: true})
+}
+
+// OptionalFirebaseAuth - attaches the verified token to the request context when it's present
+// but doesn't reject unauthenticated requests, for endpoints serving both logged-in and anonymous users
+func OptionalFirebaseAuth(next http.HandlerFunc) http.HandlerFunc {
+	return RequireFirebaseAuthWithOptions(next, FirebaseAuthOptions{Optional: true})
+}
+
+// RequireFirebaseAuthWithOptions - RequireFirebaseAuth middleware configured by the options
+func RequireFirebaseAuthWithOptions(next http.HandlerFunc, options FirebaseAuthOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// unattested clients are rejected even if the authentication is optional
+		statusCode := verifyAppCheckRequest(ctx, r, options.AppCheck)
+		if statusCode != http.StatusOK {
+			WriteError(w, Errorf("RequireFirebaseAuth", ErrorCodeUnauthenticated, "app check verification failed"))
+			return
+		}
+
+		token, err := verifyFirebaseRequest(ctx, r, options)
+		var appErr *AppError
+		if err != nil && options.Optional && errors.As(err, &appErr) && appErr.Code == ErrorCodeUnauthenticated {
+			next(w, r)
+			return
+		}
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, firebaseTokenContextKey, token)))
+	}
+}
+
+// UserFromContext - returns the verified Firebase token stored by the auth middleware
+func UserFromContext(ctx context.Context) (*auth.Token, bool) {
+	token, ok := ctx.Value(firebaseTokenContextKey).(*auth.Token)
+	return token, ok && token != nil
+}
+
+// UIDFromContext - returns UID of the caller verified by the auth middleware or empty string
+func UIDFromContext(ctx context.Context) string {
+	token, ok := UserFromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	return token.UID
+}
+
+// verifyFirebaseRequest - verifies the request Bearer token according to the options
+// returns verified token or AppError which should be written to the caller (see firebaseTokenError)
+func verifyFirebaseRequest(ctx context.Context, r *http.Request, options FirebaseAuthOptions) (*auth.Token, error) {
+	op := "RequireFirebaseAuth"
+	idToken, ok := getBearerToken(r)
+	if !ok && options.AllowSessionCookie {
+		return verifySessionCookieRequest(ctx, r, options)
+	}
+	if !ok {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "missing bearer token")
+	}
+
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to get firebase auth client. Error: %v", err.Error()), "")
+		return nil, Errorf(op, ErrorCodeFirebase, "failed to get firebase auth client: %w", err)
+	}
+
+	var token *auth.Token
+	if options.CheckRevoked {
+		token, err = authClient.VerifyIDTokenAndCheckRevoked(ctx, idToken)
+	} else {
+		token, err = authClient.VerifyIDToken(ctx, idToken)
+	}
+	if err != nil || token == nil {
+		if auth.IsIDTokenRevoked(err) {
+			LogWrite(LogTypeInfo, 0, "ID token was revoked", "")
+		} else {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("authClient.VerifyIDTokenError: %v", err), "")
+		}
+		return nil, firebaseTokenError(op, err)
+	}
+
+	return token, nil
+}
+
+// verifySessionCookieRequest - verifies the request __session cookie
+// returns verified token or AppError which should be written to the caller
+func verifySessionCookieRequest(ctx context.Context, r *http.Request, options FirebaseAuthOptions) (*auth.Token, error) {
+	op := "RequireFirebaseAuth"
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "missing bearer token and session cookie")
+	}
+
+	token, err := VerifySessionCookie(ctx, cookie.Value, options.CheckRevoked)
+	if err != nil {
+		LogWrite(LogTypeInfo, 0, fmt.Sprintf("session cookie verification error: %v", err.Error()), "")
+		return nil, firebaseTokenError(op, err)
+	}
+
+	return token, nil
+}
+
+// firebaseTokenError - ErrTokenRevoked or ErrTokenExpired AppError of the failed ID token or session cookie verification,
+// ErrorCodeUnauthenticated for other verification errors
+func firebaseTokenError(op string, err error) *AppError {
+	if err == nil {
+		return Errorf(op, ErrorCodeUnauthenticated, "empty token")
+	}
+
+	switch {
+	case auth.IsIDTokenRevoked(err) || auth.IsSessionCookieRevoked(err):
+		return ErrTokenRevoked.E(op, err)
+	case isFirebaseTokenExpired(err):
+		return ErrTokenExpired.E(op, err)
+	default:
+		return Errorf(op, ErrorCodeUnauthenticated, "invalid token: %w", err)
+	}
+}
+
+// isFirebaseTokenExpired - checks if the verification failed on the exp claim,
+// the SDK version has no typed error of it ("ID token has expired at: ...", "session cookie has expired at: ...")
+func isFirebaseTokenExpired(err error) bool {
+	return strings.Contains(err.Error(), "has expired at")
+}
+
+// CreateSessionCookie - exchanges ID token for the session cookie valid for expiresIn (from 5 minutes to 2 weeks)
+func CreateSessionCookie(ctx context.Context, idToken string, expiresIn time.Duration) (string, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	cookie, err := authClient.SessionCookie(ctx, idToken, expiresIn)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session cookie. Error: %v", err.Error())
+	}
+
+	return cookie, nil
+}
+
+// VerifySessionCookie - verifies the session cookie and optionally checks if it was revoked
+func VerifySessionCookie(ctx context.Context, sessionCookie string, checkRevoked bool) (*auth.Token, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkRevoked {
+		return authClient.VerifySessionCookieAndCheckRevoked(ctx, sessionCookie)
+	}
+
+	return authClient.VerifySessionCookie(ctx, sessionCookie)
+}
+
+// SetSessionCookie - writes the __session cookie to the response as secure http only cookie
+func SetSessionCookie(w http.ResponseWriter, sessionCookie string, expiresIn time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sessionCookie,
+		Path:     "/",
+		MaxAge:   int(expiresIn.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearSessionCookie - removes the __session cookie, ex: on sign out
+func ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// getBearerToken - returns token from the "Bearer [token]" Authorization header
+func getBearerToken(r *http.Request) (string, bool) {
+	tokenSlice := strings.Fields(r.Header.Get("Authorization"))
+	if len(tokenSlice) != 2 || tokenSlice[0] != "Bearer" {
+		return "", false
+	}
+
+	return tokenSlice[1], true
+}
+
+// GetFirebaseAuthClient - returns process-level cached Firebase Auth client of the default app.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetFirebaseAuthClient(ctx context.Context) (*auth.Client, error) {
+	cachedAuthClientMu.Lock()
+	defer cachedAuthClientMu.Unlock()
+
+	if cachedAuthClient != nil {
+		return cachedAuthClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	fireapp, err := firebase.NewApp(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fireapp. Error: %v", err.Error())
+	}
+
+	client, err := fireapp.Auth(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth client. Error: %v", err.Error())
+	}
+	cachedAuthClient = client
+
+	return cachedAuthClient, nil
+}
+
+// HasRole - checks if the token has the role. Role is granted by the `"<role>": true` custom claim
+// or by the role presence in the RolesClaim list
+func HasRole(token *auth.Token, role string) bool {
+	if token == nil || token.Claims == nil {
+		return false
+	}
+
+	if granted, ok := token.Claims[role].(bool); ok && granted {
+		return true
+	}
+
+	roles, ok := token.Claims[RolesClaim].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasAnyRole - checks if the token has at least one of the roles
+func HasAnyRole(token *auth.Token, roles ...string) bool {
+	for _, role := range roles {
+		if HasRole(token, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckClaims - returns error wrapping ErrForbidden if the token doesn't have all of the claims
+func CheckClaims(token *auth.Token, claims ...string) error {
+	var missing []string
+	for _, claim := range claims {
+		if !HasRole(token, claim) {
+			missing = append(missing, claim)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing claims %v", ErrForbidden, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// RequireClaims - http middleware which checks that the verified token has all of the claims, writes 403 error envelope otherwise.
+// Should be wrapped by RequireFirebaseAuth, ex: RequireFirebaseAuth(RequireClaims(handler, "admin"))
+func RequireClaims(next http.HandlerFunc, claims ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := UserFromContext(r.Context())
+		if !ok {
+			WriteError(w, Errorf("RequireClaims", ErrorCodeUnauthenticated, "request has no verified token"))
+			return
+		}
+
+		err := CheckClaims(token, claims...)
+		if err != nil {
+			LogWrite(LogTypeInfo, 0, err.Error(), token.UID)
+			WriteError(w, Errorf("RequireClaims", ErrorCodePermissionDenied, "%w", err))
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -5,45 +5,71 @@ import (
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"context"
-	"errors"
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/auth"
 	"fmt"
 	"google.golang.org/api/iterator"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
+// Deprecated: the messages of the library errors change between versions, IsRetryableFirestoreError should be used instead
 const (
 	ClosingTransportError   = "Unavailable desc = transport is closing"                   // message which Firestore returns connection issue error
 	UnavailableServiceError = "Unavailable desc = The service is temporarily unavailable" // connection error message which Firestore returns
+)
 
+const (
+	firestoreRetryBackoff    = 200 * time.Millisecond
+	firestoreMaxRetryBackoff = 5 * time.Second
 )
 
 var (
-	UsersCollection      string = "users"
-	PromoItemsCollection string = "promo_items"
+	UsersCollection             string = "users"
+	PromoItemsCollection        string = "promo_items"
+	SecretAccessAuditCollection string = "secret_access_audit"
 	// each time new collection is added to firestore - add it to this list
 	FirestoreCollectionNames = []string{
-		UsersCollection, PromoItemsCollection,
+		UsersCollection, PromoItemsCollection, SecretAccessAuditCollection, APIKeysCollection,
+		IdempotencyKeysCollection, RateLimitsCollection, FeatureFlagsCollection, LocksCollection,
+		JobRunsCollection, OutboxCollection, AuditLogCollection, TenantsCollection,
+		WebhookEventsCollection, FulfillmentCentersCollection, OrderShipmentsCollection,
+		ConfigCollection, PromoRedemptionsCollection, WebhookDeliveriesCollection, FailedEventsCollection,
 	}
 )
 
+var (
+	// SecretAccessHook - optional hook invoked on every secret access (successful or not).
+	// Can be wired to the Logger (NewLoggerSecretAccessHook) or an audit collection (NewFirestoreSecretAccessHook)
+	SecretAccessHook func(ctx context.Context, event SecretAccessEvent)
+	// SecretAccessInvoker - label of the function which accesses secrets, K_SERVICE env variable is used if empty
+	SecretAccessInvoker string
+)
+
+// SecretAccessEvent - data passed to the SecretAccessHook for compliance review
+type SecretAccessEvent struct {
+	KeyName    string    `json:"key_name" firestore:"key_name" structs:"key_name"`
+	Version    string    `json:"version" firestore:"version" structs:"version"`
+	Invoker    string    `json:"invoker" firestore:"invoker" structs:"invoker"`
+	Success    bool      `json:"success" firestore:"success" structs:"success"`
+	Error      string    `json:"error,omitempty" firestore:"error,omitempty" structs:"error,omitempty"`
+	AccessedAt time.Time `json:"accessed_at" firestore:"accessed_at" structs:"accessed_at"`
+}
+
 // GetFirestoreClient Get a new Firestore Client
 func GetFirestoreAppAndClient() (*firebase.App, *firestore.Client, context.Context) {
 
 	ctx := context.Background()
 	fireapp, err := firebase.NewApp(ctx, nil)
 	if err != nil {
-		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("Error getting fireapp: %v", err.Error()), "")
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to get fireapp. Error: %v", err.Error()), "")
 		panic(err)
 	}
 
 	fireclient, err := fireapp.Firestore(ctx)
 	if err != nil {
-		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("Error getting fireclient: %v", err.Error()), "")
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to get fireclient. Error: %v", err.Error()), "")
 		panic(err)
 	}
 
@@ -70,11 +96,12 @@ func GetSecret(ctx context.Context, keyName string) (string, error) {
 // It gets the latest version of the secret.
 func GetSecretRaw(ctx context.Context, keyName string) ([]byte, error) {
 
-	name := "projects/" + os.Getenv("GCLOUD_PROJECT") + "/secrets/" + keyName + "/versions/latest"
+	name := "projects/" + packageConfig().ProjectID + "/secrets/" + keyName + "/versions/latest"
 
 	// Create the client.
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
+		notifySecretAccess(ctx, keyName, "latest", err)
 		return nil, err
 	}
 
@@ -86,11 +113,71 @@ func GetSecretRaw(ctx context.Context, keyName string) ([]byte, error) {
 	// Call the API.
 	result, err := client.AccessSecretVersion(ctx, req)
 	if err != nil {
+		notifySecretAccess(ctx, keyName, "latest", err)
 		return nil, err
 	}
+
+	// result name contains the resolved version, ex: projects/<project>/secrets/<key>/versions/3
+	version := "latest"
+	if idx := strings.LastIndex(result.Name, "/"); idx != -1 {
+		version = result.Name[idx+1:]
+	}
+	notifySecretAccess(ctx, keyName, version, nil)
+
 	return result.Payload.Data, nil
 }
 
+// notifySecretAccess - calls SecretAccessHook if it was set
+func notifySecretAccess(ctx context.Context, keyName, version string, err error) {
+	if SecretAccessHook == nil {
+		return
+	}
+
+	invoker := SecretAccessInvoker
+	if invoker == "" {
+		invoker = packageConfig().Service
+	}
+
+	event := SecretAccessEvent{
+		KeyName:    keyName,
+		Version:    version,
+		Invoker:    invoker,
+		Success:    err == nil,
+		AccessedAt: time.Now(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	SecretAccessHook(ctx, event)
+}
+
+// NewLoggerSecretAccessHook - returns SecretAccessHook which writes secret access events to the logger
+// successful access is logged with NOTICE severity, failed one with WARNING
+func NewLoggerSecretAccessHook(logger *Logger) func(ctx context.Context, event SecretAccessEvent) {
+	return func(ctx context.Context, event SecretAccessEvent) {
+		if event.Success {
+			logger.Notice(ctx, nil, fmt.Sprintf("secret '%v' was accessed", event.KeyName), event)
+			return
+		}
+
+		logger.Warning(ctx, nil, fmt.Sprintf("failed to access secret '%v'", event.KeyName), event)
+	}
+}
+
+// NewFirestoreSecretAccessHook - returns SecretAccessHook which saves secret access events to the SecretAccessAuditCollection
+func NewFirestoreSecretAccessHook(fireclient *firestore.Client) func(ctx context.Context, event SecretAccessEvent) {
+	return func(ctx context.Context, event SecretAccessEvent) {
+		_, err := AddEntityToFirestore(ctx, fireclient, SecretAccessAuditCollection, event)
+		if err != nil {
+			LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to save secret access event for '%v'. Error: %v", event.KeyName, err.Error()), "")
+		}
+	}
+}
+
+// CheckFirebaseUserAuthorized - verifies the "Bearer [token]" Authorization header of the request
+// returns verified token and http.StatusOK or nil and the status code which should be returned to the caller.
+// fireclient is not used and can be nil, cached Auth client (GetFirebaseAuthClient) is used if fireapp is nil
 func CheckFirebaseUserAuthorized(ctx context.Context, fireapp *firebase.App, fireclient *firestore.Client, r *http.Request) (*auth.Token, int) {
 	authHeader := r.Header.Get("Authorization")
 	//LogWrite(LogTypeInfo,0,authHeader)
@@ -109,7 +196,14 @@ func CheckFirebaseUserAuthorized(ctx context.Context, fireapp *firebase.App, fir
 	userToken := tokenSlice[1]
 
 	//any error here will return as internal
-	authClient, err := fireapp.Auth(ctx)
+	//cached client is used if fireapp was not passed
+	var authClient *auth.Client
+	var err error
+	if fireapp != nil {
+		authClient, err = fireapp.Auth(ctx)
+	} else {
+		authClient, err = GetFirebaseAuthClient(ctx)
+	}
 	if err != nil {
 		LogWrite(LogTypeInfo, 0, fmt.Sprintf("fireapp.Auth error: %v", err.Error()), "")
 		return nil, http.StatusInternalServerError
@@ -118,196 +212,201 @@ func CheckFirebaseUserAuthorized(ctx context.Context, fireapp *firebase.App, fir
 	token, err := authClient.VerifyIDToken(ctx, userToken)
 	if err != nil || token == nil {
 		//token failed
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("authClient.VerifyIDTokenError: %v", err.Error()), "")
-		return nil, 401
+		LogWrite(LogTypeInfo, 0, fmt.Sprintf("authClient.VerifyIDTokenError: %v", err), "")
+		return nil, http.StatusUnauthorized
 	}
 
 	return token, http.StatusOK
 }
 
-// FirebaseDocumentIteratorWithRetry - gets firestore iterator with retries
+// FirebaseDocumentIteratorWithRetry - returns the next document of the iterator, iterator.Done after the last one.
+// Deprecated: DocumentIterator returns the same error on every Next after the stream failure, so it can't be retried.
+// QueryRunner executes the query again after the last returned document and should be used instead
 func FirebaseDocumentIteratorWithRetry(iter *firestore.DocumentIterator) (*firestore.DocumentSnapshot, error) {
-	firestoreRetriesNumber, err := strconv.Atoi(os.Getenv("FIRESTORE_RETRIES_NUMBER"))
-	if err != nil {
-		firestoreRetriesNumber = 1
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("FIRESTORE_RETRIES_NUMBER is missing, was set to: %v", firestoreRetriesNumber), "")
-	}
-
-	for i := 0; i < firestoreRetriesNumber; i++ {
-		doc, err := iter.Next()
-		if err == nil {
-			return doc, nil
-		}
-
-		if err.Error() == ClosingTransportError {
-			//do retry if ClosingTransportError
-			continue
-		}
-
-		// return iterator.Done to handle it in the right way
-		if err == iterator.Done {
-			return nil, err
-		}
-
-		//return if another error
-		return nil, fmt.Errorf("Unsuccessful document iteration, Error: %v", err.Error())
+	doc, err := iter.Next()
+	if err == nil || err == iterator.Done {
+		return doc, err
 	}
 
-	// we got here if we exceed retries number
-	return nil, fmt.Errorf("Unsuccessful document iteration, Error: %v", err.Error())
+	return nil, Errorf("FirebaseDocumentIteratorWithRetry", ErrorCodeFirebase, "failed to iterate documents: %w", err)
 }
 
-// AddEntityToFirestore - adds any entity to the firestore collection with retries
+// AddEntityToFirestore - adds any entity to the firestore collection with retries.
+// The document ID is generated once, so the retry of the write committed before the timeout doesn't add the duplicate
 func AddEntityToFirestore(ctx context.Context, fireclient *firestore.Client, collectionName string, entity interface{}) (*firestore.DocumentRef, error) {
-	var docRef *firestore.DocumentRef
-
-	firestoreRetriesNumber, err := strconv.Atoi(os.Getenv("FIRESTORE_RETRIES_NUMBER"))
-	if err != nil {
-		firestoreRetriesNumber = 1
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("FIRESTORE_RETRIES_NUMBER is missing, was set to: %v", firestoreRetriesNumber), "")
-	}
-
-	for i := 0; i < firestoreRetriesNumber; i++ {
-		docRef, _, err = fireclient.Collection(collectionName).Add(ctx, entity)
-		if err == nil {
-			return docRef, nil
-		}
+	return AddEntityToFirestoreWithAudit(ctx, fireclient, collectionName, entity, EntityAudit{})
+}
 
-		if err.Error() == ClosingTransportError {
-			//recreate fireclient connection
-			_, fireclient, err = GetFirestoreAppAndClientWithContext(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("Error updating fireclient (%d - retries left): %v", firestoreRetriesNumber-i, err.Error())
-			}
+// AddEntityToFirestoreWithAudit - AddEntityToFirestore which passes the added entity to the audit hook
+func AddEntityToFirestoreWithAudit(ctx context.Context, fireclient *firestore.Client, collectionName string, entity interface{}, audit EntityAudit) (*firestore.DocumentRef, error) {
+	docRef := fireclient.Collection(collectionName).NewDoc()
 
-			//do retry if ClosingTransportError
-			continue
+	err := withFirestoreRetries(ctx, func(attempt int) error {
+		_, err := docRef.Create(ctx, entity)
+		if attempt > 0 && IsAlreadyExists(err) {
+			// the previous attempt was committed
+			return nil
 		}
-
-		//return if another error
-		return nil, fmt.Errorf("Unsuccessful adding data to the '%v' collection, Error: %v", collectionName, err.Error())
+		return err
+	})
+	if err != nil {
+		return nil, Errorf("AddEntityToFirestore", ErrorCodeFirebase, "failed to add data to the '%v' collection: %w", collectionName, err)
 	}
 
-	// we got here if we exceed retries number
-	return nil, fmt.Errorf("Exceed retries number for adding data to the '%v' collection, Error: %v", collectionName, err.Error())
+	if audit.Hook != nil {
+		audit.notify(ctx, AuditActionAdd, collectionName, docRef.ID, nil, entityData(entity))
+	}
+	return docRef, nil
 }
 
 // GetEntityFromFirestore - gets any entity from the firestore collection with retries
 // getting only one by one
 func GetEntityFromFirestore(ctx context.Context, fireclient *firestore.Client, collectionName, entityID string) (*firestore.DocumentSnapshot, error) {
-	var doc *firestore.DocumentSnapshot
-
-	firestoreRetriesNumber, err := strconv.Atoi(os.Getenv("FIRESTORE_RETRIES_NUMBER"))
-	if err != nil {
-		firestoreRetriesNumber = 1
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("FIRESTORE_RETRIES_NUMBER is missing, was set to: %v", firestoreRetriesNumber), "")
-	}
-
 	if entityID == "" {
-		return nil, errors.New("entity ID is required field for get")
+		return nil, Errorf("GetEntityFromFirestore", ErrorCodeInvalidArgument, "entity ID is required field for get")
 	}
 
-	for i := 0; i < firestoreRetriesNumber; i++ {
+	var doc *firestore.DocumentSnapshot
+	err := withFirestoreRetries(ctx, func(attempt int) error {
+		var err error
 		doc, err = fireclient.Collection(collectionName).Doc(entityID).Get(ctx)
-		if err == nil {
-			return doc, nil
-		}
-
-		if err.Error() == ClosingTransportError || strings.Contains(err.Error(), "The service is temporarily unavailable") {
-			LogWrite(LogTypeInfo, 0, fmt.Sprintf("failed to get data from the '%v' collection, Error: %v. Will do retry!", collectionName, err.Error()), "")
-
-			// recreate fireclient connection
-			_, fireclient, err = GetFirestoreAppAndClientWithContext(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("error updating fireclient (%d - retries left): %v", firestoreRetriesNumber-i, err.Error())
-			}
-
-			// do retry if ClosingTransportError or service unavailable error
-			continue
-		}
-
-		// return if another error
-		return nil, fmt.Errorf("unsuccessful getting data from the '%v' collection, Error: %v", collectionName, err.Error())
+		return err
+	})
+	if err != nil {
+		return nil, Errorf("GetEntityFromFirestore", ErrorCodeFirebase, "failed to get '%v' from the '%v' collection: %w", entityID, collectionName, err)
 	}
 
-	// we got here if we exceed retries number
-	return nil, fmt.Errorf("Exceed retries number for getting data from the '%v' collection, Error: %v", collectionName, err.Error())
+	return doc, nil
 }
 
 // EditEntityInFirestore - edits any entity in the firestore collection with retries
 func EditEntityInFirestore(ctx context.Context, fireclient *firestore.Client, collectionName, entityID string, entity interface{}) error {
-	firestoreRetriesNumber, err := strconv.Atoi(os.Getenv("FIRESTORE_RETRIES_NUMBER"))
-	if err != nil {
-		firestoreRetriesNumber = 1
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("FIRESTORE_RETRIES_NUMBER is missing, was set to: %v", firestoreRetriesNumber), "")
-	}
+	return EditEntityInFirestoreWithAudit(ctx, fireclient, collectionName, entityID, entity, EntityAudit{})
+}
 
+// EditEntityInFirestoreWithAudit - EditEntityInFirestore which passes the change to the audit hook,
+// the document is read and written in one transaction (retried by RunTransaction, not FIRESTORE_RETRIES_NUMBER)
+func EditEntityInFirestoreWithAudit(ctx context.Context, fireclient *firestore.Client, collectionName, entityID string, entity interface{}, audit EntityAudit) error {
 	if entityID == "" {
-		return errors.New("Entity ID is required field for edit")
+		return Errorf("EditEntityInFirestore", ErrorCodeInvalidArgument, "entity ID is required field for edit")
 	}
 
-	for i := 0; i < firestoreRetriesNumber; i++ {
-		//MergeAll expects to use only mapped data
-		_, err = fireclient.Collection(collectionName).Doc(entityID).Set(ctx, entity, firestore.MergeAll)
-		if err == nil {
-			return nil
-		}
-
-		if err.Error() == ClosingTransportError || strings.Contains(err.Error(), UnavailableServiceError) {
-			//recreate fireclient connection
-			_, fireclient, err = GetFirestoreAppAndClientWithContext(ctx)
+	ref := fireclient.Collection(collectionName).Doc(entityID)
+	var before, after map[string]interface{}
+	var err error
+	if audit.Hook == nil {
+		err = withFirestoreRetries(ctx, func(attempt int) error {
+			//MergeAll expects to use only mapped data
+			_, err := ref.Set(ctx, entity, firestore.MergeAll)
+			return err
+		})
+	} else {
+		// RunTransaction retries the aborted transactions itself
+		err = fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			var err error
+			before, err = transactionSnapshot(tx, ref)
 			if err != nil {
-				return fmt.Errorf("Error updating fireclient (%d - retries left): %v", firestoreRetriesNumber-i, err.Error())
+				return err
 			}
-			//do retry if ClosingTransportError
-			continue
-		}
+			after = mergeEntityData(before, entityData(entity))
 
-		//return if another error
-		return fmt.Errorf("Unsuccessful updating '%v' in the '%v' collection, Error: %v", entityID, collectionName, err.Error())
+			//MergeAll expects to use only mapped data
+			return tx.Set(ref, entity, firestore.MergeAll)
+		})
+	}
+	if err != nil {
+		return Errorf("EditEntityInFirestore", ErrorCodeFirebase, "failed to update '%v' in the '%v' collection: %w", entityID, collectionName, err)
 	}
 
-	// we got here if we exceed retries number
-	return fmt.Errorf("Exceed retries number for updating '%v' in the '%v' collection, Error: %v", entityID, collectionName, err.Error())
+	if audit.Hook != nil {
+		audit.notify(ctx, AuditActionEdit, collectionName, entityID, before, after)
+	}
+	return nil
 }
 
 // DeleteEntityFromFirestore - delets any entity from the firestore collection with retries
 func DeleteEntityFromFirestore(ctx context.Context, fireclient *firestore.Client, collectionName, entityID string) (*firestore.WriteResult, error) {
+	return DeleteEntityFromFirestoreWithAudit(ctx, fireclient, collectionName, entityID, EntityAudit{})
+}
+
+// DeleteEntityFromFirestoreWithAudit - DeleteEntityFromFirestore which passes the deleted document to the audit hook,
+// the document is read and deleted in one transaction. Returns nil WriteResult for the audited delete,
+// since the transaction doesn't return the commit time
+func DeleteEntityFromFirestoreWithAudit(ctx context.Context, fireclient *firestore.Client, collectionName, entityID string, audit EntityAudit) (*firestore.WriteResult, error) {
+	if entityID == "" {
+		return nil, Errorf("DeleteEntityFromFirestore", ErrorCodeInvalidArgument, "entity ID is required field for deletion")
+	}
+
+	ref := fireclient.Collection(collectionName).Doc(entityID)
+	var before map[string]interface{}
 	var result *firestore.WriteResult
+	var err error
+	if audit.Hook == nil {
+		err = withFirestoreRetries(ctx, func(attempt int) error {
+			var err error
+			result, err = ref.Delete(ctx)
+			return err
+		})
+	} else {
+		// RunTransaction retries the aborted transactions itself
+		err = fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			var err error
+			before, err = transactionSnapshot(tx, ref)
+			if err != nil {
+				return err
+			}
 
-	firestoreRetriesNumber, err := strconv.Atoi(os.Getenv("FIRESTORE_RETRIES_NUMBER"))
+			return tx.Delete(ref)
+		})
+	}
 	if err != nil {
-		firestoreRetriesNumber = 1
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("FIRESTORE_RETRIES_NUMBER is missing, was set to: %v", firestoreRetriesNumber), "")
+		return nil, Errorf("DeleteEntityFromFirestore", ErrorCodeFirebase, "failed to delete '%v' from the '%v' collection: %w", entityID, collectionName, err)
 	}
 
-	if entityID == "" {
-		return nil, errors.New("Entity ID is required field for deletion")
+	if audit.Hook != nil {
+		audit.notify(ctx, AuditActionDelete, collectionName, entityID, before, nil)
 	}
+	return result, nil
+}
 
-	for i := 0; i < firestoreRetriesNumber; i++ {
-		result, err = fireclient.Collection(collectionName).Doc(entityID).Delete(ctx)
-		if err != nil {
-			if err.Error() == ClosingTransportError {
-				//recreate fireclient connection
-				_, fireclient, err = GetFirestoreAppAndClientWithContext(ctx)
-				if err != nil {
-					return result, fmt.Errorf("Error updating fireclient (%d - retries left): %v", firestoreRetriesNumber-i, err.Error())
-				}
-
-				//do retry if ClosingTransportError
-				continue
+// withFirestoreRetries - calls fn up to FIRESTORE_RETRIES_NUMBER times (1 if empty) while it fails with the transient error,
+// the attempts are delayed with the exponential backoff. Returns the error of the last attempt
+func withFirestoreRetries(ctx context.Context, fn func(attempt int) error) error {
+	retries := firestoreRetriesNumber()
+	backoff := firestoreRetryBackoff
+
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+			backoff *= 2
+			if backoff > firestoreMaxRetryBackoff {
+				backoff = firestoreMaxRetryBackoff
 			}
+		}
 
-			//return if another error
-			return nil, fmt.Errorf("Unsuccessful deletion %v from %v collection, Error: %v", entityID, collectionName, err.Error())
+		err = fn(attempt)
+		if err == nil || !IsRetryableFirestoreError(err) {
+			return err
 		}
+		LogWrite(LogTypeInfo, ErrorCodeFirebase, fmt.Sprintf("firestore call failed (%d of %d attempts). Error: %v", attempt+1, retries, err.Error()), "")
+	}
+
+	return err
+}
 
-		return result, nil
+// firestoreRetriesNumber - attempts of the entity helpers from FIRESTORE_RETRIES_NUMBER env variable, 1 if empty or invalid
+func firestoreRetriesNumber() int {
+	retries := packageConfig().FirestoreRetriesNumber
+	if retries < 1 {
+		return 1
 	}
 
-	// we got here if we exceed retries number
-	return nil, fmt.Errorf("Exceed retries number for deletion %v from %v collection, Error: %v", entityID, collectionName, err.Error())
+	return retries
 }
 
 func GetFirestoreAppAndClientWithContext(ctx context.Context) (*firebase.App, *firestore.Client, error) {
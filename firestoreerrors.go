@@ -0,0 +1,59 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IsRetryableFirestoreError - checks if the Firestore call failed with the transient error (unavailable, closing transport,
+// quota, aborted, internal, deadline exceeded) by its gRPC status code, so the retries don't depend on the error messages.
+// Errors of the done context are not retryable
+func IsRetryableFirestoreError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	grpcStatus, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch grpcStatus.Code() {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsNotFound - checks if the Firestore call failed because the document doesn't exist
+func IsNotFound(err error) bool {
+	return firestoreErrorCode(err) == codes.NotFound
+}
+
+// IsAlreadyExists - checks if the Firestore Create failed because the document exists
+func IsAlreadyExists(err error) bool {
+	return firestoreErrorCode(err) == codes.AlreadyExists
+}
+
+// IsPermissionDenied - checks if the Firestore call was rejected by the IAM or the security rules
+func IsPermissionDenied(err error) bool {
+	return firestoreErrorCode(err) == codes.PermissionDenied
+}
+
+// firestoreErrorCode - gRPC status code of the error, codes.OK for nil and codes.Unknown for non gRPC errors
+func firestoreErrorCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+
+	grpcStatus, ok := status.FromError(err)
+	if !ok {
+		return codes.Unknown
+	}
+
+	return grpcStatus.Code()
+}
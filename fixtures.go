@@ -0,0 +1,261 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FixtureServerTimestamp - fixture value replaced with the server timestamp of the write
+	FixtureServerTimestamp = "$serverTimestamp"
+	// FixtureRefKey - key of the fixture object replaced with the document reference, ex: {"$ref": "users/u1"}
+	FixtureRefKey = "$ref"
+	// FixtureTimestampKey - key of the fixture object replaced with the RFC3339 time, ex: {"$timestamp": "2024-01-02T15:04:05Z"}
+	FixtureTimestampKey = "$timestamp"
+	// FixtureCollectionsKey - key of the fixture document with its subcollections, same shape as the top level collections
+	FixtureCollectionsKey = "$collections"
+)
+
+// fixtureFile - fixture file, collections are mapped to the documents by ID:
+//
+//	collections:
+//	  users:
+//	    u1:
+//	      name: Ann
+//	      created_at: $serverTimestamp
+//	      manager: {$ref: users/u2}
+//	      $collections:
+//	        orders:
+//	          o1: {total: 10}
+type fixtureFile struct {
+	Collections map[string]map[string]map[string]interface{} `json:"collections" yaml:"collections"`
+}
+
+// LoadFixtures - writes the documents of the .json, .yaml and .yml fixture files of the fsys (ex: embed.FS of the tests or
+// the bootstrap function) and returns the number of written documents. Documents are set by their IDs, so the loading
+// can be repeated and the documents are replaced with the fixture data. A document defined in several files is an error
+func LoadFixtures(ctx context.Context, client *firestore.Client, fsys fs.FS) (int, error) {
+	op := "LoadFixtures"
+	writes := map[string]map[string]interface{}{}
+	paths := []string{}
+
+	err := fs.WalkDir(fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		extension := strings.ToLower(path.Ext(filePath))
+		if entry.IsDir() || (extension != ".json" && extension != ".yaml" && extension != ".yml") {
+			return nil
+		}
+
+		content, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+		fixture, err := decodeFixtureFile(content, extension)
+		if err != nil {
+			return fmt.Errorf("invalid fixture file %v: %w", filePath, err)
+		}
+
+		return addFixtureCollections(client, nil, fixture.Collections, func(docPath string, data map[string]interface{}) error {
+			if _, ok := writes[docPath]; ok {
+				return fmt.Errorf("document %v of fixture file %v is already defined", docPath, filePath)
+			}
+			writes[docPath] = data
+			paths = append(paths, docPath)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, Errorf(op, ErrorCodeInvalidArgument, "failed to read fixtures: %w", err)
+	}
+
+	bulkWriter := client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, 0, len(paths))
+	for _, docPath := range paths {
+		job, err := bulkWriter.Set(client.Doc(docPath), writes[docPath])
+		if err != nil {
+			bulkWriter.End()
+			return 0, Errorf(op, ErrorCodeFirebase, "failed to write fixture %v: %w", docPath, err)
+		}
+		jobs = append(jobs, job)
+	}
+	bulkWriter.End()
+
+	written := 0
+	var lastErr error
+	for i, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			lastErr = fmt.Errorf("%v: %w", paths[i], err)
+			continue
+		}
+		written++
+	}
+	if lastErr != nil {
+		return written, Errorf(op, ErrorCodeFirebase, "failed to write %d fixtures: %w", len(jobs)-written, lastErr)
+	}
+
+	return written, nil
+}
+
+// decodeFixtureFile - decodes the JSON or YAML fixture, JSON integers are kept as int64
+func decodeFixtureFile(content []byte, extension string) (*fixtureFile, error) {
+	fixture := &fixtureFile{}
+	if extension == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(fixture); err != nil {
+			return nil, err
+		}
+		return fixture, nil
+	}
+
+	if err := yaml.Unmarshal(content, fixture); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// addFixtureCollections - converts the documents of the collections (subcollections of the parent if set) and passes them to add
+func addFixtureCollections(client *firestore.Client, parent *firestore.DocumentRef, collections map[string]map[string]map[string]interface{}, add func(string, map[string]interface{}) error) error {
+	for collectionID, documents := range collections {
+		collection := client.Collection(collectionID)
+		if parent != nil {
+			collection = parent.Collection(collectionID)
+		}
+		if collection == nil {
+			return fmt.Errorf("invalid collection %v", collectionID)
+		}
+
+		for docID, fields := range documents {
+			ref := collection.Doc(docID)
+			if ref == nil {
+				return fmt.Errorf("invalid document ID %v of collection %v", docID, collectionID)
+			}
+
+			data := map[string]interface{}{}
+			for key, value := range fields {
+				if key == FixtureCollectionsKey {
+					continue
+				}
+				converted, err := fixtureValue(client, value, true)
+				if err != nil {
+					return fmt.Errorf("%v field %v: %w", ref.Path, key, err)
+				}
+				data[key] = converted
+			}
+			if err := add(ref.Path, data); err != nil {
+				return err
+			}
+
+			if subcollections, ok := fields[FixtureCollectionsKey]; ok {
+				nested, err := fixtureSubcollections(subcollections)
+				if err != nil {
+					return fmt.Errorf("%v subcollections: %w", ref.Path, err)
+				}
+				if err := addFixtureCollections(client, ref, nested, add); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// fixtureSubcollections - converts the decoded $collections value into the collections map
+func fixtureSubcollections(value interface{}) (map[string]map[string]map[string]interface{}, error) {
+	collections, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("should be an object")
+	}
+
+	result := map[string]map[string]map[string]interface{}{}
+	for collectionID, documentsValue := range collections {
+		documents, ok := documentsValue.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("collection %v should be an object", collectionID)
+		}
+		result[collectionID] = map[string]map[string]interface{}{}
+		for docID, fieldsValue := range documents {
+			fields, ok := fieldsValue.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("document %v/%v should be an object", collectionID, docID)
+			}
+			result[collectionID][docID] = fields
+		}
+	}
+
+	return result, nil
+}
+
+// fixtureValue - replaces the fixture placeholders with the Firestore values.
+// Server timestamps aren't allowed in the arrays (topLevel is false in the array elements)
+func fixtureValue(client *firestore.Client, value interface{}, topLevel bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if v == FixtureServerTimestamp {
+			if !topLevel {
+				return nil, fmt.Errorf("%v isn't allowed in arrays", FixtureServerTimestamp)
+			}
+			return firestore.ServerTimestamp, nil
+		}
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := fixtureValue(client, item, false)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	case map[string]interface{}:
+		if ref, ok := v[FixtureRefKey]; ok && len(v) == 1 {
+			refPath, _ := ref.(string)
+			docRef := client.Doc(refPath)
+			if docRef == nil {
+				return nil, fmt.Errorf("invalid reference %v", ref)
+			}
+			return docRef, nil
+		}
+		if timestamp, ok := v[FixtureTimestampKey]; ok && len(v) == 1 {
+			if t, ok := timestamp.(time.Time); ok {
+				return t, nil
+			}
+			text, _ := timestamp.(string)
+			t, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %v", timestamp)
+			}
+			return t, nil
+		}
+
+		result := map[string]interface{}{}
+		for key, item := range v {
+			converted, err := fixtureValue(client, item, topLevel)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = converted
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
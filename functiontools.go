@@ -3,10 +3,12 @@ package cloudfunctions_go_utils
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+
+	"cloud.google.com/go/logging"
 )
 
 var (
@@ -25,26 +27,67 @@ var (
 	ErrorCodeFirebase int = 510
 )
 
+// legacyLogBackend - structured stdout writer used by LogWrite
+var legacyLogBackend logBackend = &stdoutLogBackend{writer: os.Stdout}
+
 // LogWrite function to be called for all logs to be able to parse logs in the right format
-// user ID is optional since may be unavailable at some points, ex: parsing request
+// user ID is optional since may be unavailable at some points, ex: parsing request.
+// Entries are written to stdout as structured JSON (the same format as Logger.WithStdout) with severity mapped
+// from the logType (LogTypeError1 - CRITICAL, LogTypeError2 - ERROR, LogTypeInfo - INFO)
+// and application, logType, errorCode, userId as labels
+//
+// Deprecated: use Logger or the Logging interface (LogWriteLogger for the incremental migration)
 func LogWrite(logType string, errorCode int, errorMessage string, userId string) {
-	var userIdMessagePart string
-	if userId != "" {
-		userIdMessagePart = fmt.Sprintf(", UserId: %v", userId)
-	}
-	log.Printf("application:server, " + "logType:" + logType + ", errorCode:" + strconv.Itoa(errorCode) + userIdMessagePart + ", message:" + errorMessage)
+	writeLegacyLogEntry(legacySeverity(logType), logType, errorCode, errorMessage, userId)
 }
 
 // LogWriteDebug - function used for logging some extra data needed for debugging
 // it works only in "DEBUG" env variable was set to true in deploy instruction
+//
+// Deprecated: use Logger.Debug
 func LogWriteDebug(message string) {
-	if os.Getenv("DEBUG") == strconv.FormatBool(true) {
-		LogWrite(LogTypeInfo, 0, fmt.Sprintf("[DEBUG] %v", message), "")
+	if packageConfig().Debug {
+		writeLegacyLogEntry(logging.Debug, LogTypeInfo, 0, fmt.Sprintf("[DEBUG] %v", message), "")
+	}
+}
+
+// legacySeverity - maps legacy log type to the log severity
+func legacySeverity(logType string) logging.Severity {
+	switch logType {
+	case LogTypeError1:
+		return logging.Critical
+	case LogTypeError2:
+		return logging.Error
+	case LogTypeInfo:
+		return logging.Info
+	default:
+		return logging.Default
 	}
 }
 
+// writeLegacyLogEntry - writes LogWrite entry as structured JSON
+func writeLegacyLogEntry(severity logging.Severity, logType string, errorCode int, message string, userId string) {
+	labels := map[string]string{
+		"application": "server",
+		"logType":     logType,
+		"errorCode":   strconv.Itoa(errorCode),
+	}
+	if userId != "" {
+		labels["userId"] = userId
+	}
+
+	legacyLogBackend.log("", "", logging.Entry{
+		Payload: LogEntryPayload{
+			Invoker: "server",
+			Message: message,
+		},
+		Severity: severity,
+		Labels:   labels,
+	})
+}
+
 // WriteHTTPError allows you to create an error http with json as a response,
-// and "message" as the map key
+// and "message" as the map key. WriteError should be used for the new code to return the standard ResponseEnvelope
 func WriteHTTPError(w http.ResponseWriter, message string, statusCode int) {
 	bodyMap := map[string]string{
 		"message": message,
@@ -54,11 +97,14 @@ func WriteHTTPError(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(bodyMap)
 }
 
+// SetCORSHeaders - writes 204 response with CORS headers allowing any origin
+//
+// Deprecated: use CORS middleware, which supports allowed origins and credentials
 func SetCORSHeaders(w *http.ResponseWriter, allowMethods string) {
 
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", allowMethods)
-	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, Accept, Authorization, auth_code, redirect_url, Type, Version, crm_type, email_provider")
+	(*w).Header().Set("Access-Control-Allow-Headers", strings.Join(DefaultCORSAllowedHeaders, ", "))
 	(*w).Header().Set("Access-Control-Max-Age", "3600")
 	(*w).WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,288 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diegosz/go-graphql-client"
+)
+
+const (
+	// graphQLCallContextKey - context key of the *graphQLCall of the running request
+	graphQLCallContextKey contextKey = "graphql_call"
+
+	defaultGraphQLTimeout    = 15 * time.Second
+	defaultGraphQLMaxRetries = 2
+	graphQLInitialBackoff    = 200 * time.Millisecond
+	graphQLMaxBackoff        = 5 * time.Second
+)
+
+// GraphQLErrorItem - item of the "errors" array of the GraphQL response
+type GraphQLErrorItem struct {
+	Message   string `json:"message"`
+	Locations []struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+	} `json:"locations,omitempty"`
+}
+
+// GraphQLError - failed GraphQL operation
+// Operation - operation name
+// StatusCode - HTTP status of the response, 0 if there was no response
+// Errors - errors array of the response with 200 status
+// Err - underlying transport or decoding error
+type GraphQLError struct {
+	Operation  string
+	StatusCode int
+	Errors     []GraphQLErrorItem
+	Err        error
+}
+
+func (e *GraphQLError) Error() string {
+	if len(e.Errors) > 0 {
+		messages := make([]string, 0, len(e.Errors))
+		for _, item := range e.Errors {
+			messages = append(messages, item.Message)
+		}
+		return fmt.Sprintf("graphql %v failed: %v", e.Operation, strings.Join(messages, "; "))
+	}
+
+	return fmt.Sprintf("graphql %v failed with status %v: %v", e.Operation, e.StatusCode, e.Err)
+}
+
+func (e *GraphQLError) Unwrap() error {
+	return e.Err
+}
+
+// GraphQLOptions - options of the NewGraphQLClient
+// Timeout - timeout of the single attempt, 15s if empty
+// MaxRetries - retries of the connection errors, timeouts, 429 and 5xx responses, 2 if empty, negative to disable.
+// GraphQL errors of 200 responses are not retried
+// RetryMutations - mutations are retried too, only for the mutations which are idempotent on the server
+// (ex: rejected duplicates of the external ID)
+// Logger - logger of the operations, LoggerFromContext of the request context if empty
+// MaxRetryAfter - longest Retry-After of the 429 response which is waited for before the retry, 30s if empty.
+// 429 responses which are not retried fail with GraphQLError wrapping RateLimitedError
+// CircuitBreaker - circuit breaker of the endpoint, shared GetCircuitBreaker of the endpoint host if empty
+type GraphQLOptions struct {
+	Timeout        time.Duration
+	MaxRetries     int
+	RetryMutations bool
+	Logger         *Logger
+	MaxRetryAfter  time.Duration
+	CircuitBreaker *CircuitBreaker
+}
+
+// GraphQLClient - github.com/diegosz/go-graphql-client wrapper with the timeouts, retries, logging and typed errors
+type GraphQLClient struct {
+	client  *graphql.Client
+	options GraphQLOptions
+}
+
+// graphQLCall - HTTP status and retry hint of the attempt, recorded by graphQLTransport
+type graphQLCall struct {
+	mu         sync.Mutex
+	statusCode int
+	retryAfter time.Duration
+	hinted     bool
+}
+
+// graphQLTransport - records the response status into the graphQLCall of the request context
+type graphQLTransport struct {
+	base http.RoundTripper
+}
+
+func (t *graphQLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if call, ok := req.Context().Value(graphQLCallContextKey).(*graphQLCall); ok && resp != nil {
+		call.mu.Lock()
+		call.statusCode = resp.StatusCode
+		if resp.StatusCode == http.StatusTooManyRequests {
+			call.retryAfter, call.hinted = ParseRetryAfter(resp.Header, time.Now())
+		}
+		call.mu.Unlock()
+	}
+
+	return resp, err
+}
+
+// NewGraphQLClient - returns GraphQLClient of the endpoint, httpClient carries the authentication (ex: oauth2.NewClient)
+func NewGraphQLClient(url string, httpClient *http.Client, options GraphQLOptions) *GraphQLClient {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultGraphQLTimeout
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = defaultGraphQLMaxRetries
+	}
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	}
+	if options.MaxRetryAfter <= 0 {
+		options.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	wrapped := *httpClient
+	wrapped.Transport = &graphQLTransport{base: NewCircuitBreakerTransport(base, options.CircuitBreaker)}
+
+	return &GraphQLClient{
+		client:  graphql.NewClient(url, &wrapped),
+		options: options,
+	}
+}
+
+// Query - runs the named query, q is the struct query of github.com/diegosz/go-graphql-client
+func (c *GraphQLClient) Query(ctx context.Context, name string, q interface{}, variables map[string]interface{}) error {
+	return c.run(ctx, name, true, func(ctx context.Context) error {
+		return c.client.NamedQuery(ctx, name, q, variables)
+	})
+}
+
+// Mutate - runs the named mutation, m is the struct mutation of github.com/diegosz/go-graphql-client
+func (c *GraphQLClient) Mutate(ctx context.Context, name string, m interface{}, variables map[string]interface{}) error {
+	return c.run(ctx, name, c.options.RetryMutations, func(ctx context.Context) error {
+		return c.client.NamedMutate(ctx, name, m, variables)
+	})
+}
+
+// run - runs the operation attempts with the timeout and logs them
+func (c *GraphQLClient) run(ctx context.Context, name string, retryable bool, operation func(ctx context.Context) error) error {
+	rl := LoggerFromContext(ctx)
+	if c.options.Logger != nil {
+		rl = c.options.Logger.ForRequest(ctx, nil)
+	}
+
+	backoff := graphQLInitialBackoff
+	for attempt := 0; ; attempt++ {
+		call := &graphQLCall{}
+		attemptCtx, cancel := context.WithTimeout(context.WithValue(ctx, graphQLCallContextKey, call), c.options.Timeout)
+
+		start := time.Now()
+		err := operation(attemptCtx)
+		cancel()
+
+		call.mu.Lock()
+		statusCode, retryAfter, hinted := call.statusCode, call.retryAfter, call.hinted
+		call.mu.Unlock()
+
+		fields := Fields{
+			"operation":  name,
+			"attempt":    attempt + 1,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if statusCode != 0 {
+			fields["status"] = statusCode
+		}
+		if err == nil {
+			rl.Debug("graphql operation", fields)
+			return nil
+		}
+
+		graphQLErr := newGraphQLError(name, statusCode, err)
+		fields["error"] = graphQLErr.Error()
+
+		if statusCode == http.StatusTooManyRequests {
+			rateLimitedErr := &RateLimitedError{Target: name, Err: err}
+			if hinted {
+				rateLimitedErr.RetryAfter = retryAfter
+				fields["retry_after_ms"] = float64(retryAfter) / float64(time.Millisecond)
+			} else {
+				retryAfter = backoff
+			}
+			graphQLErr.Err = rateLimitedErr
+
+			if !retryable || attempt >= c.options.MaxRetries || !waitRetryAfter(ctx, retryAfter, c.options.MaxRetryAfter) {
+				rl.Warning("graphql operation rate limited", fields)
+				return graphQLErr
+			}
+			rl.Warning("graphql operation rate limited, retried", fields)
+
+			backoff *= 2
+			if backoff > graphQLMaxBackoff {
+				backoff = graphQLMaxBackoff
+			}
+			continue
+		}
+
+		if !retryable || attempt >= c.options.MaxRetries || ctx.Err() != nil || !isRetryableGraphQLError(graphQLErr) {
+			rl.Error("graphql operation failed", fields)
+			return graphQLErr
+		}
+		rl.Warning("graphql operation failed, retrying", fields)
+
+		select {
+		case <-ctx.Done():
+			return newGraphQLError(name, 0, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > graphQLMaxBackoff {
+			backoff = graphQLMaxBackoff
+		}
+	}
+}
+
+// newGraphQLError - converts the client error into GraphQLError.
+// Errors array of the client is an unexported slice type, its items are read by the field names
+func newGraphQLError(name string, statusCode int, err error) *GraphQLError {
+	graphQLErr := &GraphQLError{Operation: name, StatusCode: statusCode, Err: err}
+
+	value := reflect.ValueOf(err)
+	if statusCode != http.StatusOK || value.Kind() != reflect.Slice {
+		return graphQLErr
+	}
+
+	for i := 0; i < value.Len(); i++ {
+		item := value.Index(i)
+		if item.Kind() != reflect.Struct {
+			continue
+		}
+
+		var errorItem GraphQLErrorItem
+		if message := item.FieldByName("Message"); message.Kind() == reflect.String {
+			errorItem.Message = message.String()
+		}
+		if locations := item.FieldByName("Locations"); locations.Kind() == reflect.Slice {
+			for j := 0; j < locations.Len(); j++ {
+				location := locations.Index(j)
+				errorItem.Locations = append(errorItem.Locations, struct {
+					Line   int `json:"line"`
+					Column int `json:"column"`
+				}{Line: int(location.FieldByName("Line").Int()), Column: int(location.FieldByName("Column").Int())})
+			}
+		}
+		graphQLErr.Errors = append(graphQLErr.Errors, errorItem)
+	}
+
+	return graphQLErr
+}
+
+// isRetryableGraphQLError - connection errors, attempt timeouts, 429 and 5xx responses are transient,
+// open circuit and rate limit of the outbound client (already waited for) are not
+func isRetryableGraphQLError(err *GraphQLError) bool {
+	if len(err.Errors) > 0 {
+		return false
+	}
+
+	switch {
+	case err.StatusCode == 0:
+		return err.Err != nil && !errors.Is(err.Err, context.Canceled) && !errors.Is(err.Err, ErrCircuitOpen) && !errors.Is(err.Err, ErrRateLimited)
+	case err.StatusCode == http.StatusTooManyRequests, err.StatusCode >= http.StatusInternalServerError:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,196 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// HealthStatusOK - status of the passed check and healthy service
+	HealthStatusOK = "ok"
+	// HealthStatusFail - status of the failed check and unhealthy service
+	HealthStatusFail = "fail"
+
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+// HealthCheck - dependency check of the Health handler
+// Name - key of the check in the response
+// Timeout - timeout of the check, 5s if empty
+// Check - returns error if the dependency is unavailable
+type HealthCheck struct {
+	Name    string
+	Timeout time.Duration
+	Check   func(ctx context.Context) error
+}
+
+// HealthCheckResult - result of the single check in the HealthResponse
+type HealthCheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthResponse - response of the Health handler
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// Health - readiness handler which runs the checks concurrently and writes JSON summary,
+// 200 if all checks passed and 503 otherwise
+func Health(checks ...HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := RunHealthChecks(r.Context(), checks...)
+
+		statusCode := http.StatusOK
+		if response.Status != HealthStatusOK {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		WriteJSON(w, statusCode, response)
+	}
+}
+
+// Liveness - handler which always writes 200 {"status": "ok"}, used when the instance should not be restarted
+// because of the dependencies outage
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, HealthResponse{Status: HealthStatusOK})
+}
+
+// RunHealthChecks - runs the checks concurrently with their timeouts
+func RunHealthChecks(ctx context.Context, checks ...HealthCheck) HealthResponse {
+	response := HealthResponse{
+		Status: HealthStatusOK,
+		Checks: make(map[string]HealthCheckResult, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+
+		go func(check HealthCheck) {
+			defer wg.Done()
+
+			result := runHealthCheck(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[check.Name] = result
+			if result.Status != HealthStatusOK {
+				response.Status = HealthStatusFail
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return response
+}
+
+// runHealthCheck - runs the check with the timeout, check which doesn't return in the timeout is failed
+func runHealthCheck(ctx context.Context, check HealthCheck) HealthCheckResult {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("check timed out after %v", timeout)
+	}
+
+	result := HealthCheckResult{
+		Status:    HealthStatusOK,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = HealthStatusFail
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// FirestoreHealthCheck - checks that Firestore is reachable by reading nonexistent document
+func FirestoreHealthCheck(fireclient *firestore.Client) HealthCheck {
+	return HealthCheck{
+		Name: "firestore",
+		Check: func(ctx context.Context) error {
+			_, err := fireclient.Collection("_health").Doc("ping").Get(ctx)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+
+			return nil
+		},
+	}
+}
+
+// SecretManagerHealthCheck - checks that the latest version of the secret is available
+// (reads the version metadata only, so the secret payload isn't accessed)
+func SecretManagerHealthCheck(secretName string) HealthCheck {
+	return HealthCheck{
+		Name: "secret_manager",
+		Check: func(ctx context.Context) error {
+			client, err := secretmanager.NewClient(ctx)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			_, err = client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+				Name: "projects/" + packageConfig().ProjectID + "/secrets/" + secretName + "/versions/latest",
+			})
+
+			return err
+		},
+	}
+}
+
+// HTTPHealthCheck - checks that the URL responds with status < 500
+func HTTPHealthCheck(name, url string) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("unexpected status %v", resp.StatusCode)
+			}
+
+			return nil
+		},
+	}
+}
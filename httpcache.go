@@ -0,0 +1,122 @@
+package cloudfunctions_go_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl - Cache-Control directives of the response
+// MaxAge - max-age of the browser caches
+// SharedMaxAge - s-maxage of the CDN and proxies, not set if empty
+// StaleWhileRevalidate - time the stale response can be served while it's revalidated, not set if empty
+// Private - response is cached by the browser only (user specific data)
+// NoCache - response is cached but revalidated with the ETag on every use
+// NoStore - response is not cached at all, other directives are ignored
+type CacheControl struct {
+	MaxAge               time.Duration
+	SharedMaxAge         time.Duration
+	StaleWhileRevalidate time.Duration
+	Private              bool
+	NoCache              bool
+	NoStore              bool
+}
+
+// PublicCatalogCache - Cache-Control of the mostly static public endpoints: 5 minutes in the browser, 1 hour in the CDN
+var PublicCatalogCache = CacheControl{
+	MaxAge:               5 * time.Minute,
+	SharedMaxAge:         time.Hour,
+	StaleWhileRevalidate: time.Minute,
+}
+
+// String - Cache-Control header value
+func (cc CacheControl) String() string {
+	if cc.NoStore {
+		return "no-store"
+	}
+
+	directives := []string{"public"}
+	if cc.Private {
+		directives[0] = "private"
+	}
+	if cc.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	directives = append(directives, "max-age="+strconv.Itoa(int(cc.MaxAge/time.Second)))
+	if cc.SharedMaxAge > 0 && !cc.Private {
+		directives = append(directives, "s-maxage="+strconv.Itoa(int(cc.SharedMaxAge/time.Second)))
+	}
+	if cc.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+strconv.Itoa(int(cc.StaleWhileRevalidate/time.Second)))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// SetCacheControl - sets Cache-Control header of the response
+func SetCacheControl(w http.ResponseWriter, cacheControl CacheControl) {
+	w.Header().Set("Cache-Control", cacheControl.String())
+}
+
+// ComputeETag - returns strong ETag (quoted) of the bytes
+func ComputeETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// ETagMatches - checks if the If-None-Match header value matches the ETag, weak comparison is used as RFC 9110 requires for If-None-Match
+func ETagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteCachedJSON - writes payload as JSON response with the ETag of the body and Cache-Control headers.
+// GET and HEAD requests with the matching If-None-Match get 304 without body
+func WriteCachedJSON(w http.ResponseWriter, r *http.Request, statusCode int, payload interface{}, cacheControl CacheControl) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		LogWrite(LogTypeError2, ErrorCodeInternal, "failed to encode JSON response. Error: "+err.Error(), "")
+		WriteError(w, E("WriteCachedJSON", ErrorCodeInternal, err))
+		return
+	}
+	body = append(body, '\n')
+
+	etag := ComputeETag(body)
+	w.Header().Set("ETag", etag)
+	SetCacheControl(w, cacheControl)
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && ETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		LogWrite(LogTypeError2, ErrorCodeInternal, "failed to write JSON response. Error: "+err.Error(), "")
+	}
+}
+
+// WriteCachedData - WriteCachedJSON of the data in the ResponseEnvelope with 200 status
+func WriteCachedData(w http.ResponseWriter, r *http.Request, data interface{}, meta map[string]interface{}, cacheControl CacheControl) {
+	WriteCachedJSON(w, r, http.StatusOK, ResponseEnvelope{Data: data, Meta: meta}, cacheControl)
+}
@@ -0,0 +1,281 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// IdempotencyKeyHeader - request header with the client generated idempotency key
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader - response header set to "true" when the stored response is replayed
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// IdempotencyStateInProgress - request with the key is being processed
+	IdempotencyStateInProgress = "in_progress"
+	// IdempotencyStateCompleted - response of the request with the key is stored
+	IdempotencyStateCompleted = "completed"
+
+	defaultIdempotencyTTL = 24 * time.Hour
+	// idempotencyLockMargin - added to the function timeout, so the record isn't abandoned while the handler still runs
+	idempotencyLockMargin   = 30 * time.Second
+	idempotencyPollInterval = 200 * time.Millisecond
+	// defaultIdempotencyMaxBodyBytes - stored response body limit, Firestore document is limited to 1 MiB
+	defaultIdempotencyMaxBodyBytes = 512 * 1024
+)
+
+var (
+	IdempotencyKeysCollection string = "idempotency_keys"
+)
+
+// IdempotencyRecord - stored state and response of the request with the idempotency key
+type IdempotencyRecord struct {
+	Key         string `json:"key" firestore:"key"`
+	State       string `json:"state" firestore:"state"`
+	Method      string `json:"method" firestore:"method"`
+	Path        string `json:"path" firestore:"path"`
+	StatusCode  int    `json:"status_code" firestore:"status_code"`
+	ContentType string `json:"content_type" firestore:"content_type"`
+	Body        []byte `json:"body" firestore:"body"`
+	// BodyTooLarge - the response body exceeded MaxBodyBytes and wasn't stored, the duplicates get 409
+	BodyTooLarge bool      `json:"body_too_large" firestore:"body_too_large"`
+	LockedUntil  time.Time `json:"locked_until" firestore:"locked_until"`
+	ExpiresAt    time.Time `json:"expires_at" firestore:"expires_at"`
+}
+
+// IdempotencyStore - storage of the idempotency records used by Idempotent middleware
+// Begin - atomically creates in progress record if there is no record (or it's expired) and returns it with acquired true,
+// otherwise returns existing record
+// Complete - stores the response of the acquired record
+// Release - deletes the acquired record so the request can be retried (ex: handler failed with 5xx)
+type IdempotencyStore interface {
+	Begin(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, bool, error)
+	Complete(ctx context.Context, record IdempotencyRecord) error
+	Release(ctx context.Context, key string) error
+}
+
+// FirestoreIdempotencyStore - IdempotencyStore in the IdempotencyKeysCollection, document ID is the record key.
+// Firestore TTL policy can be configured on the expires_at field to delete expired records
+type FirestoreIdempotencyStore struct {
+	fireclient *firestore.Client
+}
+
+func NewFirestoreIdempotencyStore(fireclient *firestore.Client) *FirestoreIdempotencyStore {
+	return &FirestoreIdempotencyStore{fireclient: fireclient}
+}
+
+// Begin - creates in progress record in the transaction or returns valid existing record
+func (s *FirestoreIdempotencyStore) Begin(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, bool, error) {
+	ref := s.fireclient.Collection(IdempotencyKeysCollection).Doc(record.Key)
+
+	var existing *IdempotencyRecord
+	err := s.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing = nil
+
+		dsnap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		if err == nil {
+			var stored IdempotencyRecord
+			if err := dsnap.DataTo(&stored); err != nil {
+				return err
+			}
+
+			now := time.Now()
+			expired := stored.ExpiresAt.Before(now)
+			abandoned := stored.State == IdempotencyStateInProgress && stored.LockedUntil.Before(now)
+			if !expired && !abandoned {
+				existing = &stored
+				return nil
+			}
+		}
+
+		return tx.Set(ref, record)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin idempotent request. Error: %v", err.Error())
+	}
+
+	if existing != nil {
+		return existing, false, nil
+	}
+
+	return &record, true, nil
+}
+
+// Complete - stores the completed record
+func (s *FirestoreIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.fireclient.Collection(IdempotencyKeysCollection).Doc(record.Key).Set(ctx, record)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// Release - deletes the record
+func (s *FirestoreIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.fireclient.Collection(IdempotencyKeysCollection).Doc(key).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// IdempotencyOptions - options of the Idempotent middleware
+// TTL - time the response is replayed for the duplicates, 24 hours if empty
+// LockTimeout - time after which in progress record is considered abandoned, FunctionTimeoutFromEnv plus 30s if empty
+// (also the longest time concurrent duplicate waits for the first request). Should not be shorter than the function timeout,
+// otherwise the duplicate runs the handler again while the first request is still in progress
+// Scope - optional prefix of the key, ex: UID of the user, so keys of different callers don't collide
+// Required - requests without Idempotency-Key are rejected with 400
+// MaxBodyBytes - largest response body which is stored for the replay, 512 KiB if empty. Larger responses are recorded
+// as too large and their duplicates are rejected with 409 instead of running the handler again
+type IdempotencyOptions struct {
+	TTL          time.Duration
+	LockTimeout  time.Duration
+	Scope        func(r *http.Request) string
+	Required     bool
+	MaxBodyBytes int
+}
+
+// Idempotent - http middleware which replays the stored response for the requests with the same Idempotency-Key
+// during the TTL. Concurrent duplicate waits until the first request completes (409 if it doesn't in the LockTimeout).
+// Responses with 5xx status are not stored, so such requests can be retried.
+// Reusing the key for another method or path returns 422
+func Idempotent(store IdempotencyStore, options IdempotencyOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.TTL <= 0 {
+		options.TTL = defaultIdempotencyTTL
+	}
+	if options.LockTimeout <= 0 {
+		options.LockTimeout = FunctionTimeoutFromEnv() + idempotencyLockMargin
+	}
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = defaultIdempotencyMaxBodyBytes
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" {
+			if options.Required {
+				WriteError(w, Errorf("Idempotent", ErrorCodeInvalidArgument, "missing %v header", IdempotencyKeyHeader).
+					WithMessage(IdempotencyKeyHeader+" header is required"))
+				return
+			}
+
+			next(w, r)
+			return
+		}
+
+		scope := ""
+		if options.Scope != nil {
+			scope = options.Scope(r)
+		}
+		hash := sha256.Sum256([]byte(scope + ":" + idempotencyKey))
+		now := time.Now()
+
+		record := IdempotencyRecord{
+			Key:         hex.EncodeToString(hash[:]),
+			State:       IdempotencyStateInProgress,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			LockedUntil: now.Add(options.LockTimeout),
+			ExpiresAt:   now.Add(options.TTL),
+		}
+
+		existing, acquired, err := waitIdempotencyRecord(ctx, store, record, options.LockTimeout)
+		if err != nil {
+			LoggerFromContext(ctx).Error("failed to begin idempotent request", Fields{"error": err.Error()})
+			WriteError(w, E("Idempotent", ErrorCodeFirebase, err))
+			return
+		}
+
+		if !acquired {
+			writeStoredResponse(w, r, existing)
+			return
+		}
+
+		recorder := newResponseRecorder(w, options.MaxBodyBytes)
+		next(recorder, r)
+
+		if recorder.statusCode >= http.StatusInternalServerError {
+			if err := store.Release(context.Background(), record.Key); err != nil {
+				LogWrite(LogTypeError2, ErrorCodeFirebase, err.Error(), "")
+			}
+			return
+		}
+
+		record.State = IdempotencyStateCompleted
+		record.StatusCode = recorder.statusCode
+		record.ContentType = recorder.Header().Get("Content-Type")
+		if recorder.size > options.MaxBodyBytes {
+			record.BodyTooLarge = true
+		} else {
+			record.Body = recorder.body.Bytes()
+		}
+		if err := store.Complete(context.Background(), record); err != nil {
+			LogWrite(LogTypeError2, ErrorCodeFirebase, err.Error(), "")
+		}
+	}
+}
+
+// waitIdempotencyRecord - begins the record, waits while concurrent duplicate is in progress
+func waitIdempotencyRecord(ctx context.Context, store IdempotencyStore, record IdempotencyRecord, lockTimeout time.Duration) (*IdempotencyRecord, bool, error) {
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		existing, acquired, err := store.Begin(ctx, record)
+		if err != nil || acquired || existing.State == IdempotencyStateCompleted || time.Now().After(deadline) {
+			return existing, acquired, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return existing, false, nil
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+// writeStoredResponse - replays the completed record or writes error for in progress or mismatched one
+func writeStoredResponse(w http.ResponseWriter, r *http.Request, record *IdempotencyRecord) {
+	if record.Method != r.Method || record.Path != r.URL.Path {
+		WriteJSON(w, http.StatusUnprocessableEntity, ResponseEnvelope{Error: &ResponseError{
+			Code:    "IDEMPOTENCY_KEY_REUSED",
+			Message: IdempotencyKeyHeader + " was used for another request",
+		}})
+		return
+	}
+
+	if record.State != IdempotencyStateCompleted {
+		WriteError(w, Errorf("Idempotent", ErrorCodeConflict, "request with the same %v is in progress", IdempotencyKeyHeader).
+			WithMessage("request with the same "+IdempotencyKeyHeader+" is in progress"))
+		return
+	}
+
+	if record.BodyTooLarge {
+		WriteError(w, Errorf("Idempotent", ErrorCodeConflict, "response of the request with the same %v is too large to replay", IdempotencyKeyHeader).
+			WithMessage("response of the request with the same "+IdempotencyKeyHeader+" is too large to replay"))
+		return
+	}
+
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
@@ -0,0 +1,193 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/diegosz/go-graphql-client"
+)
+
+const (
+	// IEOrderStatusCreated - order was accepted by Imprint Engine
+	IEOrderStatusCreated = "CREATED"
+	// IEOrderStatusInProduction - order is being fulfilled
+	IEOrderStatusInProduction = "IN_PRODUCTION"
+	// IEOrderStatusShipped - order was handed over to the carrier
+	IEOrderStatusShipped = "SHIPPED"
+	// IEOrderStatusCancelled - order was cancelled
+	IEOrderStatusCancelled = "CANCELLED"
+)
+
+// AddressInput - shipping address of the Imprint Engine order.
+// Go type names of the inputs are the GraphQL input type names of the Imprint Engine schema
+type AddressInput struct {
+	Name       string `json:"name"`
+	Company    string `json:"company,omitempty"`
+	Street1    string `json:"street1"`
+	Street2    string `json:"street2,omitempty"`
+	City       string `json:"city"`
+	State      string `json:"state,omitempty"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone,omitempty"`
+	Email      string `json:"email,omitempty"`
+}
+
+// OrderItemInput - item of the Imprint Engine order
+type OrderItemInput struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// OrderInput - createOrder mutation input
+// ExternalOrderID - our order ID, Imprint Engine rejects duplicates of it
+type OrderInput struct {
+	ExternalOrderID string           `json:"externalOrderId"`
+	ShippingMethod  string           `json:"shippingMethod,omitempty"`
+	Address         AddressInput     `json:"address"`
+	Items           []OrderItemInput `json:"items"`
+}
+
+// IEOrder - Imprint Engine order
+type IEOrder struct {
+	ID              string    `json:"id" graphql:"id"`
+	ExternalOrderID string    `json:"external_order_id" graphql:"externalOrderId"`
+	Status          string    `json:"status" graphql:"status"`
+	CreatedAt       time.Time `json:"created_at" graphql:"createdAt"`
+	UpdatedAt       time.Time `json:"updated_at" graphql:"updatedAt"`
+}
+
+// IEWarehouse - Imprint Engine warehouse of the app
+type IEWarehouse struct {
+	ID      string `json:"id" graphql:"id"`
+	Name    string `json:"name" graphql:"name"`
+	AppID   int64  `json:"app_id" graphql:"appId"`
+	Country string `json:"country" graphql:"country"`
+}
+
+// IEClient - Imprint Engine MN API client of the organization
+type IEClient struct {
+	graphql    *GraphQLClient
+	endpoint   string
+	appID      int64
+	externalID int64
+	sandbox    *ShippingSandbox
+}
+
+// NewIEClient - returns IEClient with the access token of the API credentials and IE_PLATFORM_APP_ID app.
+// Mutations aren't retried: createOrder and cancelOrder committed before the timeout fail on the retry with the duplicate or
+// conflict error, so the caller would see the failure of the existing order. In the IE_SANDBOX mode returns NewSandboxIEClient of the DefaultShippingSandbox without reading the credentials
+func NewIEClient(ctx context.Context, fireclient *firestore.Client, orgID, apiCredentialsID string) (*IEClient, error) {
+	if IsShippingSandbox() {
+		return NewSandboxIEClient(DefaultShippingSandbox), nil
+	}
+
+	appID, err := iePlatformAppID()
+	if err != nil {
+		return nil, E("NewIEClient", 0, err)
+	}
+	externalID, err := ieExternalID(orgID)
+	if err != nil {
+		return nil, E("NewIEClient", 0, err)
+	}
+
+	postURL, httpClient, err := imprintEngineMNHTTPClient(ctx, fireclient, apiCredentialsID)
+	if err != nil {
+		return nil, Errorf("NewIEClient", 0, "failed to get http client: %w", err)
+	}
+
+	return &IEClient{
+		graphql:    NewGraphQLClient(postURL, httpClient, GraphQLOptions{}),
+		endpoint:   postURL,
+		appID:      appID,
+		externalID: externalID,
+	}, nil
+}
+
+// CreateOrder - creates the order in Imprint Engine
+func (c *IEClient) CreateOrder(ctx context.Context, input OrderInput) (*IEOrder, error) {
+	if c.sandbox != nil {
+		return c.sandbox.createOrder(ctx, input)
+	}
+
+	var mutation struct {
+		CreateOrder IEOrder `graphql:"createOrder(appId: $appId, externalId: $externalId, input: $input)"`
+	}
+	variables := map[string]interface{}{
+		"appId":      graphql.Int(c.appID),
+		"externalId": graphql.Int(c.externalID),
+		"input":      input,
+	}
+
+	if err := c.graphql.Mutate(ctx, "CreateOrder", &mutation, variables); err != nil {
+		return nil, Errorf("IEClient.CreateOrder", ErrorCodeExternalAPI, "failed to create order %v: %w", input.ExternalOrderID, err)
+	}
+
+	return &mutation.CreateOrder, nil
+}
+
+// GetOrderStatus - returns the order with its current status
+func (c *IEClient) GetOrderStatus(ctx context.Context, orderID string) (*IEOrder, error) {
+	if c.sandbox != nil {
+		return c.sandbox.getOrder(orderID)
+	}
+
+	var query struct {
+		Order *IEOrder `graphql:"order(appId: $appId, id: $id)"`
+	}
+	variables := map[string]interface{}{
+		"appId": graphql.Int(c.appID),
+		"id":    graphql.String(orderID),
+	}
+
+	if err := c.graphql.Query(ctx, "GetOrderStatus", &query, variables); err != nil {
+		return nil, Errorf("IEClient.GetOrderStatus", ErrorCodeExternalAPI, "failed to get order %v: %w", orderID, err)
+	}
+	if query.Order == nil {
+		return nil, Errorf("IEClient.GetOrderStatus", ErrorCodeNotFound, "order %v not found", orderID)
+	}
+
+	return query.Order, nil
+}
+
+// CancelOrder - cancels the order which is not shipped yet
+func (c *IEClient) CancelOrder(ctx context.Context, orderID string) (*IEOrder, error) {
+	if c.sandbox != nil {
+		return c.sandbox.cancelOrder(orderID)
+	}
+
+	var mutation struct {
+		CancelOrder IEOrder `graphql:"cancelOrder(appId: $appId, id: $id)"`
+	}
+	variables := map[string]interface{}{
+		"appId": graphql.Int(c.appID),
+		"id":    graphql.String(orderID),
+	}
+
+	if err := c.graphql.Mutate(ctx, "CancelOrder", &mutation, variables); err != nil {
+		return nil, Errorf("IEClient.CancelOrder", ErrorCodeExternalAPI, "failed to cancel order %v: %w", orderID, err)
+	}
+
+	return &mutation.CancelOrder, nil
+}
+
+// ListWarehouses - returns warehouses of the app
+func (c *IEClient) ListWarehouses(ctx context.Context) ([]IEWarehouse, error) {
+	if c.sandbox != nil {
+		return c.sandbox.Warehouses, nil
+	}
+
+	var query struct {
+		Warehouses []IEWarehouse `graphql:"warehouses(appId: $appId)"`
+	}
+	variables := map[string]interface{}{
+		"appId": graphql.Int(c.appID),
+	}
+
+	if err := c.graphql.Query(ctx, "ListWarehouses", &query, variables); err != nil {
+		return nil, Errorf("IEClient.ListWarehouses", ErrorCodeExternalAPI, "failed to list warehouses: %w", err)
+	}
+
+	return query.Warehouses, nil
+}
@@ -4,15 +4,12 @@ import (
 	"cloud.google.com/go/firestore"
 	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/diegosz/go-graphql-client"
-	"github.com/fatih/structs"
 	"golang.org/x/oauth2"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -33,63 +30,85 @@ type FCShippingSecretData struct {
 func GetShippingSecretDataModel(ctx context.Context, fireclient *firestore.Client, ID string) (FCShippingSecretData, error) {
 	dsnap, err := GetEntityFromFirestore(ctx, fireclient, FCShippingSecretDataCollection, ID)
 	if err != nil {
-		return FCShippingSecretData{}, fmt.Errorf("failed to get shipping secret data by ID %v. Error: %v", ID, err.Error())
+		return FCShippingSecretData{}, Errorf("GetShippingSecretDataModel", ErrorCodeFirebase, "failed to get shipping secret data by ID %v: %w", ID, err)
 	}
 
 	secretDataBytes, err := json.Marshal(dsnap.Data())
 	if err != nil {
-		return FCShippingSecretData{}, fmt.Errorf("failed to marshal data. Error: %v", err.Error())
+		return FCShippingSecretData{}, Errorf("GetShippingSecretDataModel", ErrorCodeInternal, "failed to marshal data: %w", err)
 	}
 
 	var secretData FCShippingSecretData
 	err = json.Unmarshal(secretDataBytes, &secretData)
 	if err != nil {
-		return FCShippingSecretData{}, fmt.Errorf("failed to unmarshal data. Error: %v", err.Error())
+		return FCShippingSecretData{}, Errorf("GetShippingSecretDataModel", ErrorCodeInternal, "failed to unmarshal data: %w", err)
 	}
 
 	return secretData, nil
 }
 
-// GetIEAccessToken - return Imprint Engine access token from DB or regenerates it by API
+var (
+	// ieTokenManagers - token managers of the Imprint Engine API credentials IDs
+	ieTokenManagers   = map[string]*TokenManager{}
+	ieTokenManagersMu sync.Mutex
+)
+
+// GetIEAccessToken - return Imprint Engine access token from memory, DB or regenerates it by API
 func GetIEAccessToken(ctx context.Context, fireclient *firestore.Client, apiCredentialsID string) (string, error) {
-	secretDataModel, err := GetShippingSecretDataModel(ctx, fireclient, apiCredentialsID)
+	token, err := ieTokenManager(fireclient, apiCredentialsID).Token(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get secretDataModel. Error: %v", err.Error())
+		return "", Errorf("GetIEAccessToken", 0, "failed to get Imprint Engine access token: %w", err)
 	}
 
-	if secretDataModel.TokenExpirationDate.Before(time.Now()) {
-		newToken, err := RenewImprintEngineAccessToken(ctx, secretDataModel.SecretName)
+	return token, nil
+}
+
+// ieTokenManager - returns cached TokenManager of the API credentials stored in the FCShippingSecretDataCollection
+func ieTokenManager(fireclient *firestore.Client, apiCredentialsID string) *TokenManager {
+	ieTokenManagersMu.Lock()
+	defer ieTokenManagersMu.Unlock()
+
+	if manager, ok := ieTokenManagers[apiCredentialsID]; ok {
+		return manager
+	}
+
+	refresh := func(ctx context.Context) (*oauth2.Token, error) {
+		secretDataModel, err := GetShippingSecretDataModel(ctx, fireclient, apiCredentialsID)
 		if err != nil {
-			return "", fmt.Errorf("failed to get Imprint Engine access token. Error: %v", err.Error())
+			return nil, Errorf("GetIEAccessToken", 0, "failed to get secretDataModel: %w", err)
 		}
 
-		secretDataModel.AccessToken = newToken
-		// we add 20 hours instead of 24 to be sure that token wil not be expired earlier
-		secretDataModel.TokenExpirationDate = time.Now().Add(time.Hour * time.Duration(20))
-
-		err = EditEntityInFirestore(ctx, fireclient, FCShippingSecretDataCollection, secretDataModel.ID, structs.Map(secretDataModel))
+		newToken, err := RenewImprintEngineAccessToken(ctx, secretDataModel.SecretName)
 		if err != nil {
-			return "", fmt.Errorf("failed to update FCShippingSecretData. Error: %v", err.Error())
+			return nil, err
 		}
 
-		return newToken, nil
+		// we add 20 hours instead of 24 to be sure that token wil not be expired earlier
+		return &oauth2.Token{AccessToken: newToken, Expiry: time.Now().Add(time.Hour * time.Duration(20))}, nil
 	}
 
-	return secretDataModel.AccessToken, nil
+	manager := NewTokenManager(apiCredentialsID, NewFirestoreTokenStore(fireclient, FCShippingSecretDataCollection), refresh, 0).
+		WithRefreshLock(fireclient)
+	ieTokenManagers[apiCredentialsID] = manager
+
+	return manager
 }
 
 func RenewImprintEngineAccessToken(ctx context.Context, tokenSecretName string) (string, error) {
 	refreshToken, err := GetSecret(ctx, tokenSecretName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get refresh token from sercet manager. Error: %v", err.Error())
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeInternal, "failed to get refresh token from sercet manager: %w", err)
 	}
 
-	client := http.Client{}
-	requestURL := os.Getenv("IMPRINT_ENGINE_AUTH_URL")
+	client, err := NewOutboundClient(ctx)
+	if err != nil {
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeInternal, "failed to create http client: %w", err)
+	}
+	requestURL := packageConfig().ImprintEngineAuthURL
 
-	req, err := http.NewRequest("POST", requestURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request. Error: %v", err.Error())
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeInternal, "failed to create request: %w", err)
 	}
 
 	token := "Bearer " + refreshToken
@@ -97,17 +116,17 @@ func RenewImprintEngineAccessToken(ctx context.Context, tokenSecretName string)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request. Error: %v", err.Error())
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeExternalAPI, "failed to send request: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("failed to get IE access token")
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeExternalAPI, "failed to get IE access token")
 	}
 
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body. Error: %v", err.Error())
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeExternalAPI, "failed to read response body: %w", err)
 	}
 
 	ieAuthResponse := struct {
@@ -116,7 +135,7 @@ func RenewImprintEngineAccessToken(ctx context.Context, tokenSecretName string)
 
 	err = json.Unmarshal(respBody, &ieAuthResponse)
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal response body. Error: %v", err.Error())
+		return "", Errorf("RenewImprintEngineAccessToken", ErrorCodeExternalAPI, "failed to unmarshal response body: %w", err)
 	}
 
 	return ieAuthResponse.AccessToken, nil
@@ -124,39 +143,80 @@ func RenewImprintEngineAccessToken(ctx context.Context, tokenSecretName string)
 
 // GetImprintEngineMNGraphQLClient - returns GraphQL client
 func GetImprintEngineMNGraphQLClient(ctx context.Context, fireclient *firestore.Client, apiCredentialsID string) (*graphql.Client, error) {
-	token, err := GetIEAccessToken(ctx, fireclient, apiCredentialsID)
+	postURL, httpClient, err := imprintEngineMNHTTPClient(ctx, fireclient, apiCredentialsID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get access token. Error: %v", err.Error())
+		return nil, Errorf("GetImprintEngineMNGraphQLClient", 0, "failed to get http client: %w", err)
 	}
 
-	src := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
+	client := graphql.NewClient(postURL, httpClient)
+
+	return client, nil
+}
+
+// imprintEngineMNHTTPClient - returns GraphQL endpoint of the IMPRINT_ENGINE_GRAPHQL_URL env and http client of the API credentials.
+// Deployments with several fulfillment centers use FCRegistry instead
+func imprintEngineMNHTTPClient(ctx context.Context, fireclient *firestore.Client, apiCredentialsID string) (string, *http.Client, error) {
+	httpClient, err := imprintEngineMNAuthorizedClient(ctx, fireclient, apiCredentialsID)
+	if err != nil {
+		return "", nil, err
+	}
 
-	postURL := os.Getenv("IMPRINT_ENGINE_GRAPHQL_URL")
+	postURL := packageConfig().ImprintEngineGraphQLURL
 	if postURL == "" {
-		return nil, errors.New("IMPRINT_ENGINE_GRAPHQL_URL is empty")
+		return "", nil, Errorf("GetImprintEngineMNGraphQLClient", ErrorCodeInternal, "IMPRINT_ENGINE_GRAPHQL_URL is empty")
 	}
 
-	httpClient := oauth2.NewClient(ctx, src)
-	client := graphql.NewClient(postURL, httpClient)
+	return postURL, httpClient, nil
+}
 
-	return client, nil
+// imprintEngineMNAuthorizedClient - returns http client which authorizes requests with the token of the API credentials
+// and retries them once with the refreshed token when Imprint Engine rejects it
+func imprintEngineMNAuthorizedClient(ctx context.Context, fireclient *firestore.Client, apiCredentialsID string) (*http.Client, error) {
+	manager := ieTokenManager(fireclient, apiCredentialsID)
+	if _, err := manager.Token(ctx); err != nil {
+		return nil, Errorf("GetImprintEngineMNGraphQLClient", 0, "failed to get access token: %w", err)
+	}
+
+	return NewReauthClient(manager, nil), nil
+}
+
+// ieExternalID - parses the organization ID into the Imprint Engine external ID, 0 if empty
+func ieExternalID(orgID string) (int64, error) {
+	if orgID == "" {
+		return 0, nil
+	}
+
+	externalID, err := strconv.ParseInt(orgID, 10, 64) // parse the value into IE request format
+	if err != nil {
+		return 0, Errorf("GetImprintEngineMNRequestConfig", ErrorCodeInvalidArgument, "invalid format of the external ID: %w", err)
+	}
+
+	return externalID, nil
+}
+
+// iePlatformAppID - IE_PLATFORM_APP_ID setting of the config
+func iePlatformAppID() (int64, error) {
+	appID := packageConfig().IEPlatformAppID
+	if appID == 0 {
+		return 0, Errorf("GetImprintEngineMNRequestConfig", ErrorCodeInternal, "IE_PLATFORM_APP_ID is empty or invalid")
+	}
+
+	return appID, nil
 }
 
 func GetImprintEngineMNRequestConfig(ctx context.Context, fireclient *firestore.Client, orgID, apiCredentialsID string) (PreparedIEOrderData, error) {
 	graphqlClient, err := GetImprintEngineMNGraphQLClient(ctx, fireclient, apiCredentialsID)
 	if err != nil {
-		return PreparedIEOrderData{}, fmt.Errorf("failed to get ImprintEngine Client HTTP. Error: %v", err.Error())
+		return PreparedIEOrderData{}, Errorf("GetImprintEngineMNRequestConfig", 0, "failed to get ImprintEngine Client HTTP: %w", err)
 	}
 
-	appID, err := strconv.ParseInt(os.Getenv("IE_PLATFORM_APP_ID"), 10, 64)
+	appID, err := iePlatformAppID()
 	if err != nil {
-		return PreparedIEOrderData{}, fmt.Errorf("failed parce IE_PLATFORM_APP_ID. Error: %v", err.Error())
+		return PreparedIEOrderData{}, err
 	}
 
 	if err != nil {
-		return PreparedIEOrderData{}, fmt.Errorf("failed to get Organization fro DB. Error: %v", err.Error())
+		return PreparedIEOrderData{}, Errorf("GetImprintEngineMNRequestConfig", ErrorCodeFirebase, "failed to get Organization fro DB: %w", err)
 	}
 
 	config := PreparedIEOrderData{
@@ -164,11 +224,9 @@ func GetImprintEngineMNRequestConfig(ctx context.Context, fireclient *firestore.
 		AppID:  appID,
 	}
 
-	if orgID != "" {
-		config.ExternalID, err = strconv.ParseInt(orgID, 10, 64) // parse the value into IE request format
-		if err != nil {
-			return PreparedIEOrderData{}, fmt.Errorf("invalid format of the external ID. Error: %v", err.Error())
-		}
+	config.ExternalID, err = ieExternalID(orgID)
+	if err != nil {
+		return PreparedIEOrderData{}, err
 	}
 
 	return config, nil
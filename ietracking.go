@@ -0,0 +1,200 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/diegosz/go-graphql-client"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// TrackingStatusPending - carrier has the label but not the parcel
+	TrackingStatusPending = "pending"
+	// TrackingStatusInTransit - parcel is on the way
+	TrackingStatusInTransit = "in_transit"
+	// TrackingStatusOutForDelivery - parcel is out for the delivery
+	TrackingStatusOutForDelivery = "out_for_delivery"
+	// TrackingStatusDelivered - parcel was delivered
+	TrackingStatusDelivered = "delivered"
+	// TrackingStatusException - delivery failed or the parcel is returned
+	TrackingStatusException = "exception"
+	// TrackingStatusUnknown - carrier status which is not mapped
+	TrackingStatusUnknown = "unknown"
+)
+
+// ieTrackingStatuses - normalized statuses of the Imprint Engine tracking statuses
+var ieTrackingStatuses = map[string]string{
+	"LABEL_CREATED":    TrackingStatusPending,
+	"PRE_TRANSIT":      TrackingStatusPending,
+	"IN_TRANSIT":       TrackingStatusInTransit,
+	"OUT_FOR_DELIVERY": TrackingStatusOutForDelivery,
+	"DELIVERED":        TrackingStatusDelivered,
+	"FAILURE":          TrackingStatusException,
+	"RETURNED":         TrackingStatusException,
+	"EXCEPTION":        TrackingStatusException,
+}
+
+// TrackingEvent - normalized tracking event of the shipment
+type TrackingEvent struct {
+	Carrier        string    `json:"carrier" firestore:"carrier"`
+	TrackingNumber string    `json:"tracking_number" firestore:"tracking_number"`
+	TrackingURL    string    `json:"tracking_url" firestore:"tracking_url"`
+	Status         string    `json:"status" firestore:"status"`
+	CarrierStatus  string    `json:"carrier_status" firestore:"carrier_status"`
+	Description    string    `json:"description" firestore:"description"`
+	Location       string    `json:"location" firestore:"location"`
+	OccurredAt     time.Time `json:"occurred_at" firestore:"occurred_at"`
+}
+
+// ieShipment - shipment of the order tracking query
+type ieShipment struct {
+	Carrier        string `graphql:"carrier"`
+	TrackingNumber string `graphql:"trackingNumber"`
+	TrackingURL    string `graphql:"trackingUrl"`
+	Events         []struct {
+		Status      string    `graphql:"status"`
+		Description string    `graphql:"description"`
+		Location    string    `graphql:"location"`
+		OccurredAt  time.Time `graphql:"occurredAt"`
+	} `graphql:"events"`
+}
+
+// GetTracking - returns tracking events of all shipments of the order sorted by the time (oldest first)
+func (c *IEClient) GetTracking(ctx context.Context, orderID string) ([]TrackingEvent, error) {
+	if c.sandbox != nil {
+		return c.sandbox.tracking(orderID)
+	}
+
+	var query struct {
+		Order *struct {
+			Shipments []ieShipment `graphql:"shipments"`
+		} `graphql:"order(appId: $appId, id: $id)"`
+	}
+	variables := map[string]interface{}{
+		"appId": graphql.Int(c.appID),
+		"id":    graphql.String(orderID),
+	}
+
+	if err := c.graphql.Query(ctx, "GetTracking", &query, variables); err != nil {
+		return nil, Errorf("IEClient.GetTracking", ErrorCodeExternalAPI, "failed to get tracking of order %v: %w", orderID, err)
+	}
+	if query.Order == nil {
+		return nil, Errorf("IEClient.GetTracking", ErrorCodeNotFound, "order %v not found", orderID)
+	}
+
+	events := []TrackingEvent{}
+	for _, shipment := range query.Order.Shipments {
+		for _, event := range shipment.Events {
+			events = append(events, TrackingEvent{
+				Carrier:        shipment.Carrier,
+				TrackingNumber: shipment.TrackingNumber,
+				TrackingURL:    shipment.TrackingURL,
+				Status:         normalizeIETrackingStatus(event.Status),
+				CarrierStatus:  event.Status,
+				Description:    event.Description,
+				Location:       event.Location,
+				OccurredAt:     event.OccurredAt,
+			})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].OccurredAt.Before(events[j].OccurredAt) })
+
+	return events, nil
+}
+
+// normalizeIETrackingStatus - returns TrackingStatus of the Imprint Engine status
+func normalizeIETrackingStatus(status string) string {
+	if normalized, ok := ieTrackingStatuses[strings.ToUpper(status)]; ok {
+		return normalized
+	}
+
+	return TrackingStatusUnknown
+}
+
+// TrackingPollOptions - options of the PollTracking
+// Query - query of the order documents which are not delivered yet, ex: fireclient.Collection("orders").Where("tracking_status", "in", []string{"", "pending", "in_transit"})
+// OrderIDField - document field with the Imprint Engine order ID, ie_order_id if empty
+type TrackingPollOptions struct {
+	Query        firestore.Query
+	OrderIDField string
+}
+
+// PollTracking - gets tracking of the queried orders and updates tracking_status, tracking_events and
+// tracking_updated_at fields (plus carrier, tracking_number and tracking_url of the latest event) of the documents which changed.
+// Returns the number of updated documents, errors of the single orders don't stop the poll
+func PollTracking(ctx context.Context, client *IEClient, options TrackingPollOptions) (int, error) {
+	if options.OrderIDField == "" {
+		options.OrderIDField = "ie_order_id"
+	}
+
+	runner := NewQueryRunner(ctx, options.Query, QueryRunnerOptions{Name: "tracking_poll_orders"})
+	defer runner.Stop()
+
+	updated := 0
+	var errs []error
+	for {
+		dsnap, err := runner.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return updated, fmt.Errorf("failed to read orders. Error: %v", err.Error())
+		}
+
+		orderID, _ := dsnap.Data()[options.OrderIDField].(string)
+		if orderID == "" {
+			continue
+		}
+
+		events, err := client.GetTracking(ctx, orderID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		latest := events[len(events)-1]
+		if stored, _ := dsnap.Data()["tracking_status"].(string); stored == latest.Status && len(events) == trackingEventsCount(dsnap) {
+			continue
+		}
+
+		_, err = dsnap.Ref.Update(ctx, []firestore.Update{
+			{Path: "tracking_status", Value: latest.Status},
+			{Path: "tracking_events", Value: events},
+			{Path: "carrier", Value: latest.Carrier},
+			{Path: "tracking_number", Value: latest.TrackingNumber},
+			{Path: "tracking_url", Value: latest.TrackingURL},
+			{Path: "tracking_updated_at", Value: time.Now()},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update tracking of '%v'. Error: %v", dsnap.Ref.ID, err.Error()))
+			continue
+		}
+		updated++
+	}
+
+	return updated, errors.Join(errs...)
+}
+
+// TrackingPollJob - PollTracking as the JobFunc for the ScheduledJob
+func TrackingPollJob(client *IEClient, options TrackingPollOptions) JobFunc {
+	return func(ctx context.Context) error {
+		updated, err := PollTracking(ctx, client, options)
+		LoggerFromContext(ctx).Info("tracking poll finished", Fields{"updated": updated})
+		return err
+	}
+}
+
+// trackingEventsCount - number of the stored tracking events of the order document
+func trackingEventsCount(dsnap *firestore.DocumentSnapshot) int {
+	events, _ := dsnap.Data()["tracking_events"].([]interface{})
+	return len(events)
+}
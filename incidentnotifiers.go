@@ -0,0 +1,173 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+const (
+	PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	OpsgenieAlertsURL  = "https://api.opsgenie.com/v2/alerts"
+
+	// opsgenieMaxMessageLength - Opsgenie rejects alerts with longer message
+	opsgenieMaxMessageLength = 130
+)
+
+// notifierHTTPClient - http client used by the notifiers, timeout is short to not block the logging
+var notifierHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// PagerDutyNotifier - Notifier which triggers PagerDuty incidents with the Events API v2
+// RoutingKey - integration key of the PagerDuty service
+type PagerDutyNotifier struct {
+	RoutingKey string
+	URL        string
+}
+
+func NewPagerDutyNotifier(routingKey string) *PagerDutyNotifier {
+	return &PagerDutyNotifier{
+		RoutingKey: routingKey,
+		URL:        PagerDutyEventsURL,
+	}
+}
+
+// Notify - sends trigger event, dedup key makes repeated notifications within one execution update the same incident
+func (pd *PagerDutyNotifier) Notify(ctx context.Context, notification Notification) error {
+	source := notification.Invoker
+	if source == "" {
+		source = "cloudfunctions-go-utils"
+	}
+
+	event := map[string]interface{}{
+		"routing_key":  pd.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    notification.DedupKey(),
+		"payload": map[string]interface{}{
+			"summary":   notification.Message,
+			"source":    source,
+			"severity":  pagerDutySeverity(notification.Severity),
+			"timestamp": notification.Timestamp.Format(time.RFC3339),
+			"custom_details": map[string]interface{}{
+				"execution_id": notification.ExecutionID,
+				"trace":        notification.Trace,
+				"fields":       notification.Fields,
+				"labels":       notification.Labels,
+			},
+		},
+	}
+
+	return postNotification(ctx, pd.URL, nil, event, http.StatusAccepted)
+}
+
+// pagerDutySeverity - maps log severity to the PagerDuty one (critical, error, warning, info)
+func pagerDutySeverity(severity logging.Severity) string {
+	switch {
+	case severity >= logging.Critical:
+		return "critical"
+	case severity >= logging.Error:
+		return "error"
+	case severity >= logging.Warning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// OpsgenieNotifier - Notifier which creates Opsgenie alerts
+// APIKey - API key of the Opsgenie API integration
+type OpsgenieNotifier struct {
+	APIKey string
+	URL    string
+}
+
+func NewOpsgenieNotifier(apiKey string) *OpsgenieNotifier {
+	return &OpsgenieNotifier{
+		APIKey: apiKey,
+		URL:    OpsgenieAlertsURL,
+	}
+}
+
+// Notify - creates alert, alias works as dedup key so repeated notifications within one execution are grouped
+func (og *OpsgenieNotifier) Notify(ctx context.Context, notification Notification) error {
+	message := notification.Message
+	if len(message) > opsgenieMaxMessageLength {
+		message = message[:opsgenieMaxMessageLength]
+	}
+
+	details := map[string]string{
+		"execution_id": notification.ExecutionID,
+		"trace":        notification.Trace,
+		"severity":     notification.Severity.String(),
+	}
+	for key, value := range notification.Labels {
+		details[key] = value
+	}
+	for key, value := range notification.Fields {
+		details[key] = fmt.Sprintf("%v", value)
+	}
+
+	alert := map[string]interface{}{
+		"message":     message,
+		"alias":       notification.DedupKey(),
+		"description": notification.Message,
+		"priority":    opsgeniePriority(notification.Severity),
+		"source":      notification.Invoker,
+		"details":     details,
+	}
+
+	headers := map[string]string{"Authorization": "GenieKey " + og.APIKey}
+
+	return postNotification(ctx, og.URL, headers, alert, http.StatusAccepted)
+}
+
+// opsgeniePriority - maps log severity to the Opsgenie priority (P1 is the highest)
+func opsgeniePriority(severity logging.Severity) string {
+	switch {
+	case severity >= logging.Emergency:
+		return "P1"
+	case severity >= logging.Critical:
+		return "P2"
+	case severity >= logging.Error:
+		return "P3"
+	case severity >= logging.Warning:
+		return "P4"
+	default:
+		return "P5"
+	}
+}
+
+// postNotification - sends JSON body to the notification API and checks the response status code
+func postNotification(ctx context.Context, url string, headers map[string]string, body interface{}, expectedStatusCode int) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification. Error: %v", err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create request. Error: %v", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := notifierHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request. Error: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatusCode && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected notification response status code %v: %v", resp.StatusCode, string(respBody))
+	}
+
+	return nil
+}
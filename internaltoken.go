@@ -0,0 +1,471 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+const (
+	// InternalTokenHeader - header of the internal token, used instead of Authorization
+	// which can be replaced by the proxies between the functions
+	InternalTokenHeader = "X-Internal-Token"
+
+	// internalClaimsContextKey - context key of the verified *InternalClaims
+	internalClaimsContextKey contextKey = "internal_claims"
+
+	defaultInternalTokenTTL    = 5 * time.Minute
+	maxInternalTokenTTL        = time.Hour
+	defaultInternalTokenLeeway = 30 * time.Second
+	internalTokenKeyCacheTTL   = 10 * time.Minute
+)
+
+// reservedInternalClaims - registered claims which can't be set by the custom claims
+var reservedInternalClaims = []string{"iss", "sub", "aud", "iat", "nbf", "exp", "jti"}
+
+// InternalTokenKey - signing key of the internal tokens: NewSecretTokenKey (HS256) or KMSSigner (ES256, RS256, PS256...)
+// SigningKey - returns the JWT alg and kid of the key which signs the new tokens
+// SignJWT - signs the JWT signing input with the key of the kid
+// VerifyJWT - checks the signature with the key of the kid, the alg must be the alg of the key. Returns error wrapping
+// ErrInvalidSignature if the token isn't signed by the key, other errors are failures of the key source (ex: Secret Manager)
+type InternalTokenKey interface {
+	SigningKey(ctx context.Context) (alg string, keyID string, err error)
+	SignJWT(ctx context.Context, keyID string, signingInput []byte) ([]byte, error)
+	VerifyJWT(ctx context.Context, alg, keyID string, signingInput, signature []byte) error
+}
+
+// InternalClaims - claims of the verified internal token
+// Custom - claims other than the registered ones, numbers are json.Number
+type InternalClaims struct {
+	Issuer    string                 `json:"iss"`
+	Subject   string                 `json:"sub,omitempty"`
+	Audience  []string               `json:"aud"`
+	ID        string                 `json:"jti"`
+	IssuedAt  time.Time              `json:"iat"`
+	ExpiresAt time.Time              `json:"exp"`
+	Custom    map[string]interface{} `json:"custom,omitempty"`
+}
+
+// InternalTokenOptions - options of the NewInternalTokens
+// Issuer - iss of the minted tokens, K_SERVICE env variable if empty
+// TTL - lifetime of the minted tokens, 5 minutes if empty, max 1 hour
+// AllowedIssuers - issuers accepted by Verify, any issuer if empty
+// Leeway - clock skew allowed by Verify, 30 seconds if empty
+type InternalTokenOptions struct {
+	Issuer         string
+	TTL            time.Duration
+	AllowedIssuers []string
+	Leeway         time.Duration
+}
+
+// InternalTokens - mints and verifies short-lived JWTs of the function-to-function calls
+// where Google OIDC tokens can't be used, ex: the calls through the third-party proxy. The tokens are sent in InternalTokenHeader
+type InternalTokens struct {
+	key     InternalTokenKey
+	options InternalTokenOptions
+}
+
+// NewInternalTokens - returns InternalTokens signed with the key
+func NewInternalTokens(key InternalTokenKey, options InternalTokenOptions) *InternalTokens {
+	if options.Issuer == "" {
+		options.Issuer = packageConfig().Service
+	}
+	if options.TTL <= 0 {
+		options.TTL = defaultInternalTokenTTL
+	}
+	if options.TTL > maxInternalTokenTTL {
+		options.TTL = maxInternalTokenTTL
+	}
+	if options.Leeway <= 0 {
+		options.Leeway = defaultInternalTokenLeeway
+	}
+
+	return &InternalTokens{key: key, options: options}
+}
+
+// Mint - returns the token for the audience (usually the URL or the name of the called function) with the custom claims,
+// ex: tokens.Mint(ctx, "orders-sync", uid, map[string]interface{}{"org_id": orgID})
+func (it *InternalTokens) Mint(ctx context.Context, audience, subject string, custom map[string]interface{}) (string, error) {
+	if audience == "" {
+		return "", errors.New("internal token audience is empty")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate token ID. Error: %v", err.Error())
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{}
+	for name, value := range custom {
+		if containsString(reservedInternalClaims, name) {
+			return "", fmt.Errorf("custom claim %v is reserved", name)
+		}
+		claims[name] = value
+	}
+	claims["iss"] = it.options.Issuer
+	claims["aud"] = audience
+	claims["jti"] = hex.EncodeToString(id)
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(it.options.TTL).Unix()
+	if subject != "" {
+		claims["sub"] = subject
+	}
+
+	claimsBytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token claims. Error: %v", err.Error())
+	}
+
+	alg, keyID, err := it.key.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	headerBytes, err := json.Marshal(jwtHeader{Algorithm: alg, Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token header. Error: %v", err.Error())
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+	signature, err := it.key.SignJWT(ctx, keyID, []byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify - checks the signature, the audience, the issuer and the lifetime of the token, returns its claims.
+// Returns Unauthenticated or PermissionDenied AppError for the rejected token and Unavailable if the keys can't be loaded
+func (it *InternalTokens) Verify(ctx context.Context, rawToken, audience string) (*InternalClaims, error) {
+	op := "InternalTokens.Verify"
+	token, err := parseJWT(rawToken)
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "malformed internal token: %w", err)
+	}
+
+	if err := it.key.VerifyJWT(ctx, token.Header.Algorithm, token.Header.KeyID, []byte(token.SigningInput), token.Signature); err != nil {
+		if !errors.Is(err, ErrInvalidSignature) {
+			// the key source failure isn't the caller's fault, so it's not reported as the invalid token
+			return nil, Errorf(op, ErrorCodeUnavailable, "failed to verify internal token signature: %w", err)
+		}
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "invalid internal token signature: %w", err)
+	}
+
+	if err := token.verifyLifetime(time.Now(), it.options.Leeway); err != nil {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "%w", err)
+	}
+	issuedAt, _ := token.timeClaim("iat")
+	expiresAt, _ := token.timeClaim("exp")
+	if expiresAt.Sub(issuedAt) > maxInternalTokenTTL {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "internal token lifetime exceeds %v", maxInternalTokenTTL)
+	}
+
+	tokenAudience := token.audience()
+	if !containsString(tokenAudience, audience) {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "internal token is not issued for %v", audience)
+	}
+	issuer := token.stringClaim("iss")
+	if len(it.options.AllowedIssuers) > 0 && !containsString(it.options.AllowedIssuers, issuer) {
+		return nil, Errorf(op, ErrorCodePermissionDenied, "internal token issuer %v is not allowed", issuer)
+	}
+
+	claims := &InternalClaims{
+		Issuer:    issuer,
+		Subject:   token.stringClaim("sub"),
+		Audience:  tokenAudience,
+		ID:        token.stringClaim("jti"),
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+		Custom:    map[string]interface{}{},
+	}
+	for name, value := range token.Claims {
+		if !containsString(reservedInternalClaims, name) {
+			claims.Custom[name] = value
+		}
+	}
+
+	return claims, nil
+}
+
+// Authorize - sets the InternalTokenHeader of the outbound request with the token minted for the audience
+func (it *InternalTokens) Authorize(ctx context.Context, req *http.Request, audience, subject string, custom map[string]interface{}) error {
+	token, err := it.Mint(ctx, audience, subject, custom)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(InternalTokenHeader, token)
+
+	return nil
+}
+
+// RequireInternalToken - http middleware which verifies the InternalTokenHeader token (or the Bearer token if the header is empty)
+// issued for the audience. Writes 401 error envelope for missing or invalid tokens, 403 for not allowed issuers.
+// Stores the verified *InternalClaims in the request context (InternalClaimsFromContext)
+func RequireInternalToken(next http.HandlerFunc, tokens *InternalTokens, audience string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		rawToken := r.Header.Get(InternalTokenHeader)
+		if rawToken == "" {
+			rawToken, _ = getBearerToken(r)
+		}
+		if rawToken == "" {
+			WriteError(w, Errorf("RequireInternalToken", ErrorCodeUnauthenticated, "missing internal token"))
+			return
+		}
+
+		claims, err := tokens.Verify(ctx, rawToken, audience)
+		if err != nil {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("internal token rejected: %v", err.Error()), "")
+			WriteError(w, err)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, internalClaimsContextKey, claims)))
+	}
+}
+
+// InternalClaimsFromContext - returns the claims stored by RequireInternalToken middleware
+func InternalClaimsFromContext(ctx context.Context) (*InternalClaims, bool) {
+	claims, ok := ctx.Value(internalClaimsContextKey).(*InternalClaims)
+	return claims, ok && claims != nil
+}
+
+// SecretTokenKey - HS256 keys of the internal tokens from Secret Manager, see NewSecretTokenKey
+type SecretTokenKey struct {
+	secretName string
+	keys       *ttlCache
+}
+
+// NewSecretTokenKey - returns HS256 InternalTokenKey with the keys from the secret, one per line (at least 32 bytes each).
+// The first key signs, others verify the tokens of the previous keys, so the key is rotated by adding the new key
+// on the first line. The secret is cached for 10 minutes
+func NewSecretTokenKey(secretName string) *SecretTokenKey {
+	return &SecretTokenKey{secretName: secretName, keys: newTTLCache(internalTokenKeyCacheTTL)}
+}
+
+// SigningKey - implements InternalTokenKey, kid is the fingerprint of the first key
+func (sk *SecretTokenKey) SigningKey(ctx context.Context) (string, string, error) {
+	keys, err := sk.secretKeys(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	return "HS256", keys[0].id, nil
+}
+
+// SignJWT - implements InternalTokenKey
+func (sk *SecretTokenKey) SignJWT(ctx context.Context, keyID string, signingInput []byte) ([]byte, error) {
+	key, err := sk.key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signingInput)
+
+	return mac.Sum(nil), nil
+}
+
+// VerifyJWT - implements InternalTokenKey, compares the signatures in constant time
+func (sk *SecretTokenKey) VerifyJWT(ctx context.Context, alg, keyID string, signingInput, signature []byte) error {
+	if alg != "HS256" {
+		return fmt.Errorf("%w: unexpected JWT algorithm '%v'", ErrInvalidSignature, alg)
+	}
+
+	expected, err := sk.SignJWT(ctx, keyID, signingInput)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// secretTokenKey - HS256 key of the secret and its fingerprint
+type secretTokenKey struct {
+	id  string
+	key []byte
+}
+
+// key - returns the key of the kid
+func (sk *SecretTokenKey) key(ctx context.Context, keyID string) ([]byte, error) {
+	keys, err := sk.secretKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.id == keyID {
+			return key.key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown JWT key ID '%v'", ErrInvalidSignature, keyID)
+}
+
+// secretKeys - returns the cached keys of the secret, the signing key first
+func (sk *SecretTokenKey) secretKeys(ctx context.Context) ([]secretTokenKey, error) {
+	if cached, ok := sk.keys.get(sk.secretName); ok {
+		return cached.([]secretTokenKey), nil
+	}
+
+	secret, err := GetSecret(ctx, sk.secretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get internal token keys. Error: %v", err.Error())
+	}
+
+	keys := []secretTokenKey{}
+	for _, line := range strings.Split(secret, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 32 {
+			return nil, fmt.Errorf("internal token keys of %v must have at least 32 bytes", sk.secretName)
+		}
+
+		fingerprint := sha256.Sum256([]byte(line))
+		keys = append(keys, secretTokenKey{id: hex.EncodeToString(fingerprint[:4]), key: []byte(line)})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("secret %v has no internal token keys", sk.secretName)
+	}
+	sk.keys.set(sk.secretName, keys)
+
+	return keys, nil
+}
+
+// SigningKey - implements InternalTokenKey, kid is the newest enabled key version
+func (ks *KMSSigner) SigningKey(ctx context.Context) (string, string, error) {
+	version, err := ks.currentVersion(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	publicKey, err := ks.publicKey(ctx, version)
+	if err != nil {
+		return "", "", err
+	}
+
+	alg, err := kmsJWTAlgorithm(publicKey.algorithm)
+	if err != nil {
+		return "", "", err
+	}
+
+	return alg, version, nil
+}
+
+// SignJWT - implements InternalTokenKey, EC signatures are converted into the JWS R || S form
+func (ks *KMSSigner) SignJWT(ctx context.Context, keyID string, signingInput []byte) ([]byte, error) {
+	algorithm, signature, err := ks.signRaw(ctx, keyID, signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	if size := ecSignatureSize(algorithm); size > 0 {
+		return ecDERToJWS(signature, size)
+	}
+
+	return signature, nil
+}
+
+// VerifyJWT - implements InternalTokenKey
+func (ks *KMSSigner) VerifyJWT(ctx context.Context, alg, keyID string, signingInput, signature []byte) error {
+	publicKey, err := ks.publicKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+
+	expected, err := kmsJWTAlgorithm(publicKey.algorithm)
+	if err != nil {
+		return err
+	}
+	if alg != expected {
+		return fmt.Errorf("%w: unexpected JWT algorithm '%v'", ErrInvalidSignature, alg)
+	}
+
+	if size := ecSignatureSize(publicKey.algorithm); size > 0 {
+		if signature, err = ecJWSToDER(signature, size); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err.Error())
+		}
+	}
+
+	return ks.verifyRaw(ctx, "KMSSigner.VerifyJWT", keyID, signingInput, signature)
+}
+
+// kmsJWTAlgorithm - JWT alg of the KMS signing algorithm
+func kmsJWTAlgorithm(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (string, error) {
+	name := algorithm.String()
+	switch {
+	case algorithm == kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:
+		return "ES256", nil
+	case algorithm == kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:
+		return "ES384", nil
+	case strings.HasPrefix(name, "RSA_SIGN_PKCS1_") && strings.HasSuffix(name, "_SHA256"):
+		return "RS256", nil
+	case strings.HasPrefix(name, "RSA_SIGN_PKCS1_") && strings.HasSuffix(name, "_SHA512"):
+		return "RS512", nil
+	case strings.HasPrefix(name, "RSA_SIGN_PSS_") && strings.HasSuffix(name, "_SHA256"):
+		return "PS256", nil
+	case strings.HasPrefix(name, "RSA_SIGN_PSS_") && strings.HasSuffix(name, "_SHA512"):
+		return "PS512", nil
+	}
+
+	return "", fmt.Errorf("kms algorithm %v can't sign JWTs", name)
+}
+
+// ecSignatureSize - size of R and S of the EC algorithm, 0 for other algorithms
+func ecSignatureSize(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) int {
+	switch algorithm {
+	case kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:
+		return 32
+	case kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:
+		return 48
+	}
+
+	return 0
+}
+
+// ecSignature - ASN.1 form of the EC signature
+type ecSignature struct {
+	R, S *big.Int
+}
+
+// ecDERToJWS - converts ASN.1 DER EC signature into the fixed size R || S of JWS
+func ecDERToJWS(der []byte, size int) ([]byte, error) {
+	var signature ecSignature
+	if _, err := asn1.Unmarshal(der, &signature); err != nil {
+		return nil, fmt.Errorf("failed to parse ec signature. Error: %v", err.Error())
+	}
+
+	jws := make([]byte, 2*size)
+	signature.R.FillBytes(jws[:size])
+	signature.S.FillBytes(jws[size:])
+
+	return jws, nil
+}
+
+// ecJWSToDER - converts R || S of JWS into ASN.1 DER EC signature
+func ecJWSToDER(jws []byte, size int) ([]byte, error) {
+	if len(jws) != 2*size {
+		return nil, errors.New("invalid ec signature size")
+	}
+
+	return asn1.Marshal(ecSignature{R: new(big.Int).SetBytes(jws[:size]), S: new(big.Int).SetBytes(jws[size:])})
+}
@@ -0,0 +1,178 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// JobStatusRunning - job run is in progress
+	JobStatusRunning = "running"
+	// JobStatusSucceeded - job function returned no error
+	JobStatusSucceeded = "succeeded"
+	// JobStatusFailed - job function returned error or panicked
+	JobStatusFailed = "failed"
+	// JobStatusSkipped - job run was skipped since the previous run of the job is still in progress
+	JobStatusSkipped = "skipped"
+
+	defaultJobLockTTL = time.Minute
+)
+
+var (
+	JobRunsCollection string = "job_runs"
+)
+
+// JobFunc - scheduled job, ctx is cancelled when the job lock is lost
+type JobFunc func(ctx context.Context) error
+
+// JobRun - bookkeeping record of the job run in the JobRunsCollection
+type JobRun struct {
+	ID          string    `json:"id" firestore:"-"`
+	Job         string    `json:"job" firestore:"job"`
+	Status      string    `json:"status" firestore:"status"`
+	ExecutionID string    `json:"execution_id" firestore:"execution_id"`
+	StartedAt   time.Time `json:"started_at" firestore:"started_at"`
+	FinishedAt  time.Time `json:"finished_at,omitempty" firestore:"finished_at,omitempty"`
+	DurationMs  int64     `json:"duration_ms" firestore:"duration_ms"`
+	Error       string    `json:"error,omitempty" firestore:"error,omitempty"`
+}
+
+// JobOptions - options of the ScheduledJob
+// Name - name of the job, used for the lock and the run records
+// Audience - audience of the Cloud Scheduler OIDC token, required unless SkipTokenVerification is set
+// SkipTokenVerification - the token is not verified, only for the functions which are protected by the IAM invoker check
+// AllowedEmails - service accounts of the scheduler jobs, any Google-signed token of the audience if empty
+// LockTTL - ttl of the job lock, 1 minute if empty (lock is extended while the job runs)
+type JobOptions struct {
+	Name                  string
+	Audience              string
+	SkipTokenVerification bool
+	AllowedEmails         []string
+	LockTTL               time.Duration
+}
+
+// ScheduledJob - http handler for the Cloud Scheduler invoked job: verifies the scheduler OIDC token,
+// skips the run if the previous one still holds the job lock, records the run in the JobRunsCollection
+// and writes summary log entry. Returns 500 for the failed run so the scheduler retry config applies,
+// skipped run returns 200 since retrying it would overlap again. Empty Audience without SkipTokenVerification
+// is the configuration error, every run returns 500 instead of running unauthenticated
+func ScheduledJob(fireclient *firestore.Client, options JobOptions, job JobFunc) http.HandlerFunc {
+	if options.LockTTL <= 0 {
+		options.LockTTL = defaultJobLockTTL
+	}
+
+	var configErr error
+	if options.Audience == "" && !options.SkipTokenVerification {
+		configErr = Errorf("ScheduledJob", ErrorCodeInternal, "job %v audience is empty, set SkipTokenVerification to skip the token verification", options.Name)
+		LogWrite(LogTypeError2, ErrorCodeInternal, configErr.Error(), "")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if configErr != nil {
+			WriteError(w, configErr)
+			return
+		}
+
+		if !options.SkipTokenVerification {
+			_, statusCode := verifyGoogleIDTokenRequest(ctx, r, options.Audience, options.AllowedEmails)
+			if statusCode != http.StatusOK {
+				WriteError(w, googleIDTokenError("ScheduledJob", statusCode))
+				return
+			}
+		}
+
+		logger := LoggerFromContext(ctx).With(Fields{"job": options.Name})
+		run := &JobRun{
+			Job:         options.Name,
+			Status:      JobStatusRunning,
+			ExecutionID: ExecutionIDFromContext(ctx),
+			StartedAt:   time.Now(),
+		}
+
+		lock, err := AcquireLock(ctx, fireclient, "job_"+options.Name, options.LockTTL)
+		if errors.Is(err, ErrLockHeld) {
+			run.Status = JobStatusSkipped
+			run.FinishedAt = run.StartedAt
+			recordJobRun(ctx, fireclient, run)
+			logger.Warning("job run skipped, previous run is in progress", Fields{"run_id": run.ID})
+			WriteData(w, http.StatusOK, run, nil)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to acquire job lock", Fields{"error": err.Error()})
+			WriteError(w, E("ScheduledJob", ErrorCodeFirebase, err))
+			return
+		}
+		defer lock.Release(ctx)
+
+		recordJobRun(ctx, fireclient, run)
+
+		jobCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-lock.Lost():
+				cancel()
+			case <-jobCtx.Done():
+			}
+		}()
+
+		err = runJob(jobCtx, job)
+
+		run.FinishedAt = time.Now()
+		run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+		run.Status = JobStatusSucceeded
+		if err != nil {
+			run.Status = JobStatusFailed
+			run.Error = err.Error()
+		}
+		recordJobRun(ctx, fireclient, run)
+
+		summary := Fields{"run_id": run.ID, "status": run.Status, "duration_ms": run.DurationMs}
+		if err != nil {
+			summary["error"] = run.Error
+			logger.Error("job run failed", summary)
+			WriteError(w, E("ScheduledJob", ErrorCodeInternal, err).WithMessage("job run failed"))
+			return
+		}
+
+		logger.Info("job run succeeded", summary)
+		WriteData(w, http.StatusOK, run, nil)
+	}
+}
+
+// runJob - runs the job converting panic into the error, so the run is recorded as failed and the lock is released
+func runJob(ctx context.Context, job JobFunc) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+
+	return job(ctx)
+}
+
+// recordJobRun - creates or updates the run record, bookkeeping errors are logged and don't fail the job
+func recordJobRun(ctx context.Context, fireclient *firestore.Client, run *JobRun) {
+	collection := fireclient.Collection(JobRunsCollection)
+
+	var err error
+	if run.ID == "" {
+		ref := collection.NewDoc()
+		run.ID = ref.ID
+		_, err = ref.Create(ctx, run)
+	} else {
+		_, err = collection.Doc(run.ID).Set(ctx, run)
+	}
+
+	if err != nil {
+		LoggerFromContext(ctx).Error("failed to record job run", Fields{"job": run.Job, "error": err.Error()})
+	}
+}
@@ -0,0 +1,295 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksMinRefetchInterval - min interval between the JWKS fetches caused by the unknown key IDs
+	jwksMinRefetchInterval = time.Minute
+	// jwksFetchTimeout - timeout of the shared JWKS fetch, which doesn't depend on the context of the caller
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwtHeader - JOSE header of the JWT
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// parsedJWT - decoded, not yet verified JWT
+type parsedJWT struct {
+	Header       jwtHeader
+	Claims       map[string]interface{}
+	SigningInput string
+	Signature    []byte
+}
+
+// parseJWT - decodes the compact serialized JWT without signature verification
+func parseJWT(rawToken string) (*parsedJWT, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid JWT format")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT header. Error: %v", err.Error())
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT claims. Error: %v", err.Error())
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT signature. Error: %v", err.Error())
+	}
+
+	token := &parsedJWT{
+		SigningInput: parts[0] + "." + parts[1],
+		Signature:    signature,
+	}
+
+	err = json.Unmarshal(headerBytes, &token.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWT header. Error: %v", err.Error())
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(claimsBytes)))
+	decoder.UseNumber()
+	err = decoder.Decode(&token.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWT claims. Error: %v", err.Error())
+	}
+
+	return token, nil
+}
+
+// verifyRS256 - verifies RS256 signature of the token
+func (t *parsedJWT) verifyRS256(publicKey *rsa.PublicKey) error {
+	if t.Header.Algorithm != "RS256" {
+		return fmt.Errorf("unexpected JWT algorithm '%v'", t.Header.Algorithm)
+	}
+
+	hash := sha256.Sum256([]byte(t.SigningInput))
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], t.Signature)
+}
+
+// stringClaim - returns string claim or empty string
+func (t *parsedJWT) stringClaim(name string) string {
+	value, _ := t.Claims[name].(string)
+	return value
+}
+
+// timeClaim - returns NumericDate claim (exp, iat, nbf) as time
+func (t *parsedJWT) timeClaim(name string) (time.Time, bool) {
+	number, ok := t.Claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := number.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0), true
+}
+
+// audience - returns "aud" claim values, it can be a string or a list
+func (t *parsedJWT) audience() []string {
+	switch aud := t.Claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var audience []string
+		for _, item := range aud {
+			if value, ok := item.(string); ok {
+				audience = append(audience, value)
+			}
+		}
+		return audience
+	}
+
+	return nil
+}
+
+// verifyExpiration - checks exp and nbf claims, exp claim is required
+func (t *parsedJWT) verifyExpiration(now time.Time) error {
+	return t.verifyLifetime(now, 0)
+}
+
+// verifyLifetime - verifyExpiration which tolerates the clock skew of the leeway in both directions:
+// the token is accepted leeway after its exp and leeway before its nbf
+func (t *parsedJWT) verifyLifetime(now time.Time, leeway time.Duration) error {
+	expiresAt, ok := t.timeClaim("exp")
+	if !ok {
+		return errors.New("JWT has no exp claim")
+	}
+	if now.Add(-leeway).After(expiresAt) {
+		return errors.New("JWT is expired")
+	}
+
+	if notBefore, ok := t.timeClaim("nbf"); ok && now.Add(leeway).Before(notBefore) {
+		return errors.New("JWT is not valid yet")
+	}
+
+	return nil
+}
+
+// jwksCache - caches RSA public keys from the JSON Web Key Set URL
+type jwksCache struct {
+	url       string
+	ttl       time.Duration
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expiresAt time.Time
+	fetchedAt time.Time
+	group     singleflight.Group
+}
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		url: url,
+		ttl: ttl,
+	}
+}
+
+// getKey - returns public key by key ID, keys are refetched if cache is expired or key ID is unknown.
+// Unknown key ID refetches the keys at most once per jwksMinRefetchInterval, so tokens with random key IDs
+// don't turn into the JWKS requests
+func (c *jwksCache) getKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[keyID]
+	fresh := time.Now().Before(c.expiresAt)
+	recentlyFetched := time.Since(c.fetchedAt) < jwksMinRefetchInterval
+	c.mu.Unlock()
+
+	if ok && fresh {
+		return key, nil
+	}
+	if !fresh || !recentlyFetched {
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		key, ok = c.keys[keyID]
+		c.mu.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown JWT key ID '%v'", keyID)
+	}
+
+	return key, nil
+}
+
+// refresh - fetches the keys without holding the lock, concurrent callers share one fetch. The fetch runs on the detached
+// context with jwksFetchTimeout, so the cancelled request of the first caller doesn't fail the others
+func (c *jwksCache) refresh(ctx context.Context) error {
+	results := c.group.DoChan(c.url, func() (interface{}, error) {
+		c.mu.Lock()
+		c.fetchedAt = time.Now()
+		c.mu.Unlock()
+
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+		defer cancel()
+
+		keys, err := fetchJWKS(fetchCtx, c.url)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.keys = keys
+		c.expiresAt = time.Now().Add(c.ttl)
+		c.mu.Unlock()
+
+		return nil, nil
+	})
+
+	select {
+	case result := <-results:
+		return result.Err
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for JWKS. Error: %v", ctx.Err().Error())
+	}
+}
+
+// fetchJWKS - downloads and parses RSA keys of the JSON Web Key Set
+func fetchJWKS(ctx context.Context, url string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request. Error: %v", err.Error())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request. Error: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get JWKS, status code: %v", resp.StatusCode)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body. Error: %v", err.Error())
+	}
+
+	jwks := struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err = json.Unmarshal(respBody, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWKS. Error: %v", err.Error())
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+
+		nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key '%v' modulus. Error: %v", jwk.KeyID, err.Error())
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key '%v' exponent. Error: %v", jwk.KeyID, err.Error())
+		}
+
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,413 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// SignedURLExpiresParam - query param of the SignURL expiry, unix seconds
+	SignedURLExpiresParam = "expires"
+	// SignedURLSignatureParam - query param of the SignURL signature
+	SignedURLSignatureParam = "signature"
+
+	defaultKMSVersionCacheTTL = 10 * time.Minute
+	// kmsMissingVersionTTL - time the unknown or disabled versions are rejected without the KMS call
+	kmsMissingVersionTTL = time.Minute
+	// kmsMaxCachedVersions - max cached public keys and missing versions of the signer,
+	// the versions come from the signatures of the callers
+	kmsMaxCachedVersions = 256
+)
+
+// ErrInvalidSignature - wrapped by the signature verification errors of KMSSigner and InternalTokenKey when the signature
+// or its key version is not valid, so they can be told from the failures of the key source
+var ErrInvalidSignature = errors.New("invalid signature")
+
+var (
+	// cachedKMSClient - process-level Cloud KMS client, use GetKMSClient to get it
+	cachedKMSClient   *kms.KeyManagementClient
+	cachedKMSClientMu sync.Mutex
+)
+
+// GetKMSClient - returns process-level cached Cloud KMS client.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetKMSClient(ctx context.Context) (*kms.KeyManagementClient, error) {
+	cachedKMSClientMu.Lock()
+	defer cachedKMSClientMu.Unlock()
+
+	if cachedKMSClient != nil {
+		return cachedKMSClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms client. Error: %v", err.Error())
+	}
+	cachedKMSClient = client
+
+	return cachedKMSClient, nil
+}
+
+// KMSEncrypt - encrypts the plaintext with the primary version of the symmetric key,
+// keyName is the key resource name, ex: projects/<project>/locations/global/keyRings/<ring>/cryptoKeys/<key>
+func KMSEncrypt(ctx context.Context, keyName string, plaintext []byte) ([]byte, error) {
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: keyName, Plaintext: plaintext})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with kms key %v. Error: %v", keyName, err.Error())
+	}
+
+	return response.Ciphertext, nil
+}
+
+// KMSDecrypt - decrypts the ciphertext of KMSEncrypt, the key version is read from the ciphertext,
+// so the ciphertexts of the rotated versions are decrypted while the versions are enabled
+func KMSDecrypt(ctx context.Context, keyName string, ciphertext []byte) ([]byte, error) {
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: keyName, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with kms key %v. Error: %v", keyName, err.Error())
+	}
+
+	return response.Plaintext, nil
+}
+
+// kmsPublicKey - public key of the asymmetric key version
+type kmsPublicKey struct {
+	algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	key       crypto.PublicKey
+}
+
+// KMSSigner - signs the payloads with the asymmetric Cloud KMS key (EC_SIGN_* or RSA_SIGN_* with the digest)
+// and verifies the signatures locally by the public keys, ex: signed download links, signatures of the partner callbacks.
+// Signatures are "<key version>.<base64url signature>", so the key can be rotated by adding the new version in KMS:
+// new signatures use the newest enabled version, the signatures of the old versions are valid until the versions are disabled
+// (the versions and the public keys are cached for 10 minutes)
+type KMSSigner struct {
+	keyName string
+
+	versionTTL      time.Duration
+	mu              sync.Mutex
+	version         string
+	versionAt       time.Time
+	publicKeys      *ttlCache
+	missingVersions *ttlCache
+}
+
+// NewKMSSigner - returns KMSSigner of the crypto key,
+// keyName is the key resource name, ex: projects/<project>/locations/global/keyRings/<ring>/cryptoKeys/<key>
+func NewKMSSigner(keyName string) *KMSSigner {
+	return &KMSSigner{
+		keyName:         keyName,
+		versionTTL:      defaultKMSVersionCacheTTL,
+		publicKeys:      newBoundedTTLCache(defaultKMSVersionCacheTTL, kmsMaxCachedVersions),
+		missingVersions: newBoundedTTLCache(kmsMissingVersionTTL, kmsMaxCachedVersions),
+	}
+}
+
+// Sign - signs the payload with the newest enabled key version, the version is cached for 10 minutes
+func (ks *KMSSigner) Sign(ctx context.Context, payload []byte) (string, error) {
+	version, err := ks.currentVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, signature, err := ks.signRaw(ctx, version, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return version + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify - checks the signature of Sign, Unauthenticated AppError if the signature is invalid
+// or the key version is disabled
+func (ks *KMSSigner) Verify(ctx context.Context, payload []byte, signature string) error {
+	op := "KMSSigner.Verify"
+	version, encoded, ok := strings.Cut(signature, ".")
+	if !ok || version == "" {
+		return Errorf(op, ErrorCodeUnauthenticated, "malformed signature")
+	}
+	if _, err := strconv.Atoi(version); err != nil {
+		return Errorf(op, ErrorCodeUnauthenticated, "malformed signature key version")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Errorf(op, ErrorCodeUnauthenticated, "malformed signature: %w", err)
+	}
+
+	return ks.verifyRaw(ctx, op, version, payload, raw)
+}
+
+// signRaw - signs the payload with the key version, returns the algorithm of the version and the signature
+// (ASN.1 DER for the EC keys)
+func (ks *KMSSigner) signRaw(ctx context.Context, version string, payload []byte) (kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, []byte, error) {
+	publicKey, err := ks.publicKey(ctx, version)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	digest := kmsDigest(kmsDigestHash(publicKey.algorithm), payload)
+	response, err := client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: ks.versionName(version), Digest: digest})
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to sign with kms key %v. Error: %v", ks.keyName, err.Error())
+	}
+
+	return publicKey.algorithm, response.Signature, nil
+}
+
+// verifyRaw - checks the signature of signRaw by the public key of the version, Unauthenticated AppError if it's invalid,
+// Unavailable if the public key can't be loaded
+func (ks *KMSSigner) verifyRaw(ctx context.Context, op, version string, payload, raw []byte) error {
+	publicKey, err := ks.publicKey(ctx, version)
+	if errors.Is(err, ErrInvalidSignature) {
+		return Errorf(op, ErrorCodeUnauthenticated, "unknown signature key version %v: %w", version, err)
+	}
+	if err != nil {
+		return Errorf(op, ErrorCodeUnavailable, "failed to get signature key version %v: %w", version, err)
+	}
+
+	hash := kmsDigestHash(publicKey.algorithm)
+	hasher := hash.New()
+	hasher.Write(payload)
+	sum := hasher.Sum(nil)
+
+	valid := false
+	switch key := publicKey.key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, sum, raw)
+	case *rsa.PublicKey:
+		if strings.HasPrefix(publicKey.algorithm.String(), "RSA_SIGN_PSS") {
+			valid = rsa.VerifyPSS(key, hash, sum, raw, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		} else {
+			valid = rsa.VerifyPKCS1v15(key, hash, sum, raw) == nil
+		}
+	}
+	if !valid {
+		return Errorf(op, ErrorCodeUnauthenticated, "%w", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// PublicKeyPEM - PEM public key of the key version, to be shared with the partners verifying the signatures
+func (ks *KMSSigner) PublicKeyPEM(ctx context.Context, version string) (string, error) {
+	if !validKMSVersion(version) {
+		return "", fmt.Errorf("invalid version %q of kms key %v", version, ks.keyName)
+	}
+
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: ks.versionName(version)})
+	if err != nil {
+		return "", fmt.Errorf("failed to get public key of %v. Error: %v", ks.versionName(version), err.Error())
+	}
+
+	return response.Pem, nil
+}
+
+// SignURL - returns the URL with the expires and signature query params, ex: time limited download link.
+// The signature covers the path, the query and the expiry, so none of them can be changed
+func (ks *KMSSigner) SignURL(ctx context.Context, rawURL string, expiresAt time.Time) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse url. Error: %v", err.Error())
+	}
+
+	query := parsed.Query()
+	query.Del(SignedURLSignatureParam)
+	query.Set(SignedURLExpiresParam, strconv.FormatInt(expiresAt.Unix(), 10))
+	parsed.RawQuery = query.Encode()
+
+	signature, err := ks.Sign(ctx, []byte(parsed.EscapedPath()+"?"+parsed.RawQuery))
+	if err != nil {
+		return "", err
+	}
+	query.Set(SignedURLSignatureParam, signature)
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// VerifySignedURL - checks the signature and the expiry of the SignURL URL, ex: VerifySignedURL(ctx, r.URL).
+// Unauthenticated AppError if the URL is not signed, tampered or expired
+func (ks *KMSSigner) VerifySignedURL(ctx context.Context, signedURL *url.URL) error {
+	op := "KMSSigner.VerifySignedURL"
+	query := signedURL.Query()
+	signature := query.Get(SignedURLSignatureParam)
+	if signature == "" {
+		return Errorf(op, ErrorCodeUnauthenticated, "url is not signed")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(SignedURLExpiresParam), 10, 64)
+	if err != nil {
+		return Errorf(op, ErrorCodeUnauthenticated, "url has no valid expiry")
+	}
+	if time.Now().Unix() > expires {
+		return Errorf(op, ErrorCodeUnauthenticated, "signed url expired").WithMessage("link expired")
+	}
+
+	query.Del(SignedURLSignatureParam)
+	if err := ks.Verify(ctx, []byte(signedURL.EscapedPath()+"?"+query.Encode()), signature); err != nil {
+		return E(op, 0, err)
+	}
+
+	return nil
+}
+
+// currentVersion - returns the newest enabled key version, cached for the version TTL
+func (ks *KMSSigner) currentVersion(ctx context.Context) (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.version != "" && time.Since(ks.versionAt) < ks.versionTTL {
+		return ks.version, nil
+	}
+
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	newest := 0
+	versions := client.ListCryptoKeyVersions(ctx, &kmspb.ListCryptoKeyVersionsRequest{Parent: ks.keyName, Filter: "state=ENABLED"})
+	for {
+		version, err := versions.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to list versions of kms key %v. Error: %v", ks.keyName, err.Error())
+		}
+
+		number, err := strconv.Atoi(version.Name[strings.LastIndex(version.Name, "/")+1:])
+		if err == nil && number > newest {
+			newest = number
+		}
+	}
+	if newest == 0 {
+		return "", fmt.Errorf("kms key %v has no enabled versions", ks.keyName)
+	}
+
+	ks.version = strconv.Itoa(newest)
+	ks.versionAt = time.Now()
+
+	return ks.version, nil
+}
+
+// publicKey - returns the parsed public key of the version, cached for the version TTL,
+// so the disabled versions stop verifying after the TTL. The version comes from the untrusted signature, so only
+// the version numbers of the signer key are resolved and the failed lookups are cached for kmsMissingVersionTTL
+func (ks *KMSSigner) publicKey(ctx context.Context, version string) (*kmsPublicKey, error) {
+	if !validKMSVersion(version) {
+		return nil, fmt.Errorf("%w: invalid version %q of kms key %v", ErrInvalidSignature, version, ks.keyName)
+	}
+	if cached, ok := ks.publicKeys.get(version); ok {
+		return cached.(*kmsPublicKey), nil
+	}
+	if _, missing := ks.missingVersions.get(version); missing {
+		return nil, fmt.Errorf("%w: public key of %v is not available", ErrInvalidSignature, ks.versionName(version))
+	}
+
+	client, err := GetKMSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: ks.versionName(version)})
+	if err != nil {
+		// only the versions which don't exist or can't verify are missing, KMS outages are returned as is
+		if code := status.Code(err); code == codes.NotFound || code == codes.InvalidArgument || code == codes.FailedPrecondition {
+			ks.missingVersions.set(version, true)
+			return nil, fmt.Errorf("%w: public key of %v is not available. Error: %v", ErrInvalidSignature, ks.versionName(version), err.Error())
+		}
+		return nil, fmt.Errorf("failed to get public key of %v. Error: %v", ks.versionName(version), err.Error())
+	}
+
+	block, _ := pem.Decode([]byte(response.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key pem of %v", ks.versionName(version))
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key of %v. Error: %v", ks.versionName(version), err.Error())
+	}
+
+	publicKey := &kmsPublicKey{algorithm: response.Algorithm, key: key}
+	ks.publicKeys.set(version, publicKey)
+
+	return publicKey, nil
+}
+
+// validKMSVersion - version is the canonical positive number, ex: "3", so it can't name another resource
+func validKMSVersion(version string) bool {
+	number, err := strconv.Atoi(version)
+	return err == nil && number > 0 && len(version) <= 9 && strconv.Itoa(number) == version
+}
+
+// versionName - resource name of the key version
+func (ks *KMSSigner) versionName(version string) string {
+	return ks.keyName + "/cryptoKeyVersions/" + version
+}
+
+// kmsDigestHash - digest hash of the signing algorithm
+func kmsDigestHash(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) crypto.Hash {
+	name := algorithm.String()
+	switch {
+	case strings.HasSuffix(name, "SHA512"):
+		return crypto.SHA512
+	case strings.HasSuffix(name, "SHA384"):
+		return crypto.SHA384
+	default:
+		return crypto.SHA256
+	}
+}
+
+// kmsDigest - digest of the payload for the AsymmetricSign request
+func kmsDigest(hash crypto.Hash, payload []byte) *kmspb.Digest {
+	switch hash {
+	case crypto.SHA512:
+		sum := sha512.Sum512(payload)
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha512{Sha512: sum[:]}}
+	case crypto.SHA384:
+		sum := sha512.Sum384(payload)
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: sum[:]}}
+	default:
+		sum := sha256.Sum256(payload)
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: sum[:]}}
+	}
+}
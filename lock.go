@@ -0,0 +1,230 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// lockHeartbeatDivisor - lock is extended every ttl/lockHeartbeatDivisor
+	lockHeartbeatDivisor = 3
+	lockReleaseTimeout   = 10 * time.Second
+)
+
+var (
+	LocksCollection string = "locks"
+)
+
+var (
+	// ErrLockHeld - returned by AcquireLock when the lock is held by another owner
+	ErrLockHeld = errors.New("lock is held by another owner")
+	// ErrLockLost - returned by Extend when the lock expired and was acquired by another owner
+	ErrLockLost = errors.New("lock was lost")
+)
+
+// lockRecord - document of the lock in the LocksCollection, document ID is the lock name
+type lockRecord struct {
+	Name        string    `firestore:"name"`
+	Token       string    `firestore:"token"`
+	ExecutionID string    `firestore:"execution_id"`
+	AcquiredAt  time.Time `firestore:"acquired_at"`
+	ExpiresAt   time.Time `firestore:"expires_at"`
+}
+
+// Lock - acquired Firestore lock, extended by the heartbeat until Release.
+// Lost channel is closed if the heartbeat fails to extend the lock, the holder should stop the work then
+type Lock struct {
+	fireclient *firestore.Client
+	name       string
+	token      string
+	ttl        time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	lostOnce sync.Once
+	lost     chan struct{}
+}
+
+// AcquireLock - acquires the named lock for the ttl in the transaction, the lock can be taken over only after it expires.
+// Returns ErrLockHeld if the lock is held by another owner. Acquired lock is extended every ttl/3 until Release,
+// so the ttl only limits how long the lock survives the crashed holder.
+// ex: lock, err := AcquireLock(ctx, fireclient, "refresh_ie_token", time.Minute); ...; defer lock.Release(ctx)
+func AcquireLock(ctx context.Context, fireclient *firestore.Client, name string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("failed to acquire lock '%v'. Error: ttl must be positive", name)
+	}
+
+	ref := fireclient.Collection(LocksCollection).Doc(name)
+	token := uuid.NewString()
+
+	err := fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		now := time.Now()
+		if err == nil {
+			var stored lockRecord
+			if err := dsnap.DataTo(&stored); err != nil {
+				return err
+			}
+
+			if stored.ExpiresAt.After(now) {
+				return ErrLockHeld
+			}
+		}
+
+		return tx.Set(ref, lockRecord{
+			Name:        name,
+			Token:       token,
+			ExecutionID: ExecutionIDFromContext(ctx),
+			AcquiredAt:  now,
+			ExpiresAt:   now.Add(ttl),
+		})
+	})
+	if errors.Is(err, ErrLockHeld) {
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock '%v'. Error: %v", name, err.Error())
+	}
+
+	lock := &Lock{
+		fireclient: fireclient,
+		name:       name,
+		token:      token,
+		ttl:        ttl,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		lost:       make(chan struct{}),
+	}
+	go lock.heartbeat()
+
+	return lock, nil
+}
+
+// Name - name of the lock
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Token - ownership token of the lock, can be used as fencing token in the writes protected by the lock
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// Lost - channel which is closed when the lock is lost (heartbeat failed to extend it)
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Extend - extends the lock for the ttl from now, returns ErrLockLost if the lock is not owned anymore
+func (l *Lock) Extend(ctx context.Context) error {
+	ref := l.fireclient.Collection(LocksCollection).Doc(l.name)
+
+	err := l.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		owned, err := l.owned(tx, ref)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			return ErrLockLost
+		}
+
+		return tx.Update(ref, []firestore.Update{{Path: "expires_at", Value: time.Now().Add(l.ttl)}})
+	})
+	if errors.Is(err, ErrLockLost) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extend lock '%v'. Error: %v", l.name, err.Error())
+	}
+
+	return nil
+}
+
+// Release - stops the heartbeat and deletes the lock if it's still owned, so another owner can acquire it immediately.
+// Safe to call multiple times
+func (l *Lock) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+
+	// context of the finished request may be already cancelled, the lock would block others until the ttl then
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+
+	ref := l.fireclient.Collection(LocksCollection).Doc(l.name)
+	err := l.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		owned, err := l.owned(tx, ref)
+		if err != nil || !owned {
+			return err
+		}
+
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release lock '%v'. Error: %v", l.name, err.Error())
+	}
+
+	return nil
+}
+
+// owned - checks in the transaction that the lock document still has the token of the lock
+func (l *Lock) owned(tx *firestore.Transaction, ref *firestore.DocumentRef) (bool, error) {
+	dsnap, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var stored lockRecord
+	if err := dsnap.DataTo(&stored); err != nil {
+		return false, err
+	}
+
+	return stored.Token == l.token, nil
+}
+
+// heartbeat - extends the lock until it's released, closes lost channel if the lock can't be extended before it expires
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / lockHeartbeatDivisor)
+	defer ticker.Stop()
+
+	extendedAt := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/lockHeartbeatDivisor)
+		err := l.Extend(ctx)
+		cancel()
+
+		if err == nil {
+			extendedAt = time.Now()
+			continue
+		}
+
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to extend lock '%v'. Error: %v", l.name, err.Error()), "")
+		if errors.Is(err, ErrLockLost) || time.Since(extendedAt) >= l.ttl {
+			l.lostOnce.Do(func() { close(l.lost) })
+			return
+		}
+	}
+}
@@ -5,9 +5,30 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"runtime"
 
 	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logging - common interface of the package loggers, so call sites don't depend on the implementation.
+// Implemented by Logger (Cloud Logging entries) and LogWriteLogger (LogWrite structured JSON entries)
+type Logging interface {
+	Debug(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Info(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Notice(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Warning(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Error(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Critical(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+	Emergency(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{})
+}
+
+var (
+	_ Logging = (*Logger)(nil)
+	_ Logging = (*LogWriteLogger)(nil)
 )
 
 // Logger - the main model
@@ -16,117 +37,336 @@ type Logger struct {
 	ProjectID     string
 	LoggerInvoker string
 	LogName       string
+
+	fields   Fields
+	labels   map[string]string
+	redactor *Redactor
+	sampler  *logSampler
+
+	errorServiceContext *ErrorServiceContext
+	sourceLocation      bool
+	sourceLocationSkip  int
+	notifier            Notifier
+	notifierMinSeverity logging.Severity
+	minSeverity         *logLevel
+	backend             logBackend
+	metricWriter        MetricWriter
 }
 
+// NewLogger - minimum severity is set from LOG_LEVEL env variable (MinSeverityFromEnv).
+// Cloud Logging client is created once and reused, every entry is flushed immediately (WithBatching to change it).
+// Entries are written to stdout instead if LOG_STDOUT env variable is set to true (WithStdout)
 func NewLogger(projectID string, loggerInvoker string, logName string) *Logger {
-	return &Logger{
+	logger := &Logger{
 		ProjectID:     projectID,
 		LoggerInvoker: loggerInvoker,
 		LogName:       logName,
+		minSeverity:   newLogLevel(MinSeverityFromEnv()),
+		backend:       newLoggingBackend(BatchingOptions{}),
+	}
+
+	if stdoutLoggingEnabled() {
+		logger.backend = &stdoutLogBackend{writer: os.Stdout}
 	}
+
+	return logger
 }
 
 // LogEntryPayload - used as a data model for Log Entry payload
+// Fields - named data, queryable in Log Explorer as jsonPayload.fields.<key>
+// Type, StackTrace, ServiceContext - Error Reporting fields, set only by the logger WithErrorReporting
 type LogEntryPayload struct {
-	Invoker     string        `json:"invoker"`
-	Message     string        `json:"message"`
-	ExecutionID string        `json:"execution_id"`
-	DataObject  []interface{} `json:"data_object"`
+	Invoker        string               `json:"invoker"`
+	Message        string               `json:"message"`
+	ExecutionID    string               `json:"execution_id"`
+	RequestID      string               `json:"request_id,omitempty"`
+	DataObject     []interface{}        `json:"data_object"`
+	Fields         Fields               `json:"fields,omitempty"`
+	Type           string               `json:"@type,omitempty"`
+	StackTrace     string               `json:"stack_trace,omitempty"`
+	ServiceContext *ErrorServiceContext `json:"serviceContext,omitempty"`
 }
 
-func (pl *Logger) getExecutionFunctionIDFromRequest(httpRequest *http.Request) string {
+// Fields - named data of the log entry. Can be passed to the log calls as a data object
+// ex: logger.Info(ctx, r, "order created", Fields{"order_id": orderID})
+type Fields map[string]interface{}
+
+// Labels - labels of a single log entry, merged with the logger labels.
+// Can be passed to the log calls as a data object, ex: rl.Info("order shipped", Labels{"order_id": orderID})
+type Labels map[string]string
+
+// KV - builds Fields from key/value pairs, ex: KV("order_id", orderID, "tenant", tenantID)
+// non-string keys are formatted with %v, the value of the odd last key is nil
+func KV(keyValues ...interface{}) Fields {
+	fields := make(Fields, len(keyValues)/2)
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprintf("%v", keyValues[i])
+		if i+1 < len(keyValues) {
+			fields[key] = keyValues[i+1]
+		} else {
+			fields[key] = nil
+		}
+	}
+
+	return fields
+}
+
+// merge - returns new Fields with values of both, other values take precedence
+func (f Fields) merge(other Fields) Fields {
+	if len(f) == 0 && len(other) == 0 {
+		return nil
+	}
+
+	merged := make(Fields, len(f)+len(other))
+	for key, value := range f {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// getExecutionID - returns Function-Execution-Id header value or the execution ID stored in ctx (ContextWithExecutionID)
+func (pl *Logger) getExecutionID(ctx context.Context, httpRequest *http.Request) string {
 	if httpRequest != nil {
-		return httpRequest.Header.Get("Function-Execution-Id")
+		if executionID := httpRequest.Header.Get(ExecutionIDHeader); executionID != "" {
+			return executionID
+		}
+	}
+
+	return ExecutionIDFromContext(ctx)
+}
+
+// getRequestID - returns the request ID stored in ctx (WithRequestID) or the valid X-Request-Id header value
+func (pl *Logger) getRequestID(ctx context.Context, httpRequest *http.Request) string {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		return requestID
+	}
+
+	if httpRequest != nil && validRequestID(httpRequest.Header.Get(RequestIDHeader)) {
+		return httpRequest.Header.Get(RequestIDHeader)
 	}
 
 	return ""
 }
 
-func (pl *Logger) getTraceId(httpRequest *http.Request) string {
-	var trace string
+// setTraceSpanInfo - sets trace, span ID and sampled flag of the entry
+// and adds the entry as an event to the recording OpenTelemetry span
+func (pl *Logger) setTraceSpanInfo(ctx context.Context, httpRequest *http.Request, entry *logging.Entry) {
+	traceContext, ok := extractTraceContext(ctx, httpRequest)
+	if !ok {
+		return
+	}
+
 	if pl.ProjectID != "" {
-		traceHeader := httpRequest.Header.Get("X-Cloud-Trace-Context")
-		traceParts := strings.Split(traceHeader, "/")
-		if len(traceParts) > 0 && len(traceParts[0]) > 0 {
-			trace = fmt.Sprintf("projects/%s/traces/%s", pl.ProjectID, traceParts[0])
-		}
+		entry.Trace = fmt.Sprintf("projects/%s/traces/%s", pl.ProjectID, traceContext.TraceID)
 	}
+	entry.SpanID = traceContext.SpanID
+	entry.TraceSampled = traceContext.Sampled
 
-	return trace
+	if ctx == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	var message string
+	if payload, ok := entry.Payload.(LogEntryPayload); ok {
+		message = payload.Message
+	}
+	span.AddEvent("log", trace.WithAttributes(
+		attribute.String("log.severity", entry.Severity.String()),
+		attribute.String("log.message", message),
+	))
 }
 
 // Debug - calls sendLogs with 100(DEBUG) severity. Used for BE team
 func (pl *Logger) Debug(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Debug, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Debug, httpRequest, message, dataObject)
 }
 
 // Info - calls sendLogs with 200(INFO) severity. Used for BE team
 func (pl *Logger) Info(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Info, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Info, httpRequest, message, dataObject)
 }
 
 // Notice - calls sendLogs with 300(NOTICE) severity. Used for Support team
 func (pl *Logger) Notice(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Notice, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Notice, httpRequest, message, dataObject)
 }
 
 // Warning - calls sendLogs with 400(WARNING) severity. Like Error2 informal (the flow is not stopped)
 func (pl *Logger) Warning(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Warning, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Warning, httpRequest, message, dataObject)
 }
 
 // Error - calls sendLogs with 500(ERROR) severity. Like Error2 that stops the flow
 func (pl *Logger) Error(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Error, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Error, httpRequest, message, dataObject)
 }
 
 // Critical - calls sendLogs with 600(CRITICAL) severity. Like Error1 with fix time 24 hours
 func (pl *Logger) Critical(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Critical, LogEntryPayload{
-		Invoker:     pl.LoggerInvoker,
-		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+	pl.log(ctx, logging.Critical, httpRequest, message, dataObject)
 }
 
 // Emergency - calls sendLogs with 800(EMERGENCY) severity. Like Error1 P0 that should be fixed ASAP
 func (pl *Logger) Emergency(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
-	pl.sendLogs(ctx, logging.Emergency, LogEntryPayload{
+	pl.log(ctx, logging.Emergency, httpRequest, message, dataObject)
+}
+
+// log - builds the payload and calls sendLogs. Fields items of the dataObject are merged into the payload fields,
+// Labels items are merged into the entry labels
+func (pl *Logger) log(ctx context.Context, severity logging.Severity, httpRequest *http.Request, message string, dataObject []interface{}) {
+	if pl.minSeverity != nil && severity < pl.minSeverity.get() {
+		return
+	}
+
+	if pl.sampler != nil {
+		pl.reportDroppedEntries(ctx)
+		if !pl.sampler.allow(severity, message) {
+			return
+		}
+	}
+
+	payload := LogEntryPayload{
 		Invoker:     pl.LoggerInvoker,
 		Message:     message,
-		ExecutionID: pl.getExecutionFunctionIDFromRequest(httpRequest),
-		DataObject:  dataObject,
-	}, pl.getTraceId(httpRequest))
+		ExecutionID: pl.getExecutionID(ctx, httpRequest),
+		RequestID:   pl.getRequestID(ctx, httpRequest),
+		Fields:      pl.fields.merge(nil),
+	}
+
+	labels := pl.labels
+	for _, item := range dataObject {
+		switch typed := item.(type) {
+		case Fields:
+			payload.Fields = payload.Fields.merge(typed)
+		case Labels:
+			labels = mergeLabels(labels, typed)
+		default:
+			payload.DataObject = append(payload.DataObject, item)
+		}
+	}
+
+	if pl.redactor != nil {
+		payload.Message = pl.redactor.RedactString(payload.Message)
+		payload.Fields = pl.redactor.RedactFields(payload.Fields)
+		for i := range payload.DataObject {
+			payload.DataObject[i] = pl.redactor.Redact(payload.DataObject[i])
+		}
+	}
+
+	pl.addErrorReportingFields(severity, &payload)
+
+	entry := logging.Entry{
+		// Log anything that can be marshaled to JSON.
+		Payload:  payload,
+		Severity: severity,
+		Labels:   labels,
+	}
+	pl.setTraceSpanInfo(ctx, httpRequest, &entry)
+
+	if pl.sourceLocation && severity >= logging.Warning {
+		// skip log and exported severity method to get the caller
+		entry.SourceLocation = captureSourceLocation(2 + pl.sourceLocationSkip)
+	}
+
+	pl.sendLogs(ctx, entry)
+	pl.notify(ctx, entry)
+}
+
+// With - returns derived logger which adds the fields to every entry
+func (pl *Logger) With(fields Fields) *Logger {
+	derived := *pl
+	derived.fields = pl.fields.merge(fields)
+
+	return &derived
+}
+
+// WithLabels - returns derived logger which adds the labels to every entry, ex: order_id, tenant
+func (pl *Logger) WithLabels(labels map[string]string) *Logger {
+	derived := *pl
+	derived.labels = mergeLabels(pl.labels, labels)
+
+	return &derived
+}
+
+// mergeLabels - returns new labels map with values of both, other values take precedence
+func mergeLabels(labels, other map[string]string) map[string]string {
+	if len(labels) == 0 && len(other) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(labels)+len(other))
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// WithRedaction - returns derived logger which removes sensitive data from the message, fields and data objects
+// before entries are sent, ex: logger.WithRedaction(NewDefaultRedactor())
+func (pl *Logger) WithRedaction(redactor *Redactor) *Logger {
+	derived := *pl
+	derived.redactor = redactor
+
+	return &derived
+}
+
+// WithSourceLocation - returns derived logger which adds file, line and function of the caller to Warning and higher entries.
+// skip - number of additional stack frames to skip, used when the logger is called from a wrapper function
+func (pl *Logger) WithSourceLocation(skip int) *Logger {
+	derived := *pl
+	derived.sourceLocation = true
+	derived.sourceLocationSkip = skip
+
+	return &derived
+}
+
+// captureSourceLocation - returns source location of the caller, skip 0 is the function calling captureSourceLocation
+func captureSourceLocation(skip int) *loggingpb.LogEntrySourceLocation {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return nil
+	}
+
+	location := &loggingpb.LogEntrySourceLocation{
+		File: file,
+		Line: int64(line),
+	}
+	if function := runtime.FuncForPC(pc); function != nil {
+		location.Function = function.Name()
+	}
+
+	return location
+}
+
+// ForRequest - returns RequestLogger bound to the request, so context and request are not passed to every call
+func (pl *Logger) ForRequest(ctx context.Context, httpRequest *http.Request) *RequestLogger {
+	return &RequestLogger{
+		logger:      pl,
+		ctx:         ctx,
+		httpRequest: httpRequest,
+	}
 }
 
 // sendLogs - the main business logic function used in other high-level functions
-func (pl *Logger) sendLogs(ctx context.Context, severity logging.Severity, payload LogEntryPayload, trace string) {
+func (pl *Logger) sendLogs(ctx context.Context, entry logging.Entry) {
+	if pl.backend != nil {
+		pl.backend.log(pl.ProjectID, pl.LogName, entry)
+		return
+	}
+
+	// logger was created without NewLogger, the client is created for every entry
 	client, err := logging.NewClient(ctx, pl.ProjectID)
 	if err != nil {
 		log.Fatalf("Failed to create logging client: %v", err)
@@ -135,10 +375,64 @@ func (pl *Logger) sendLogs(ctx context.Context, severity logging.Severity, paylo
 	logger := client.Logger(pl.LogName)
 	defer logger.Flush() // Ensure the entry is written.
 
-	logger.Log(logging.Entry{
-		// Log anything that can be marshaled to JSON.
-		Payload:  payload,
-		Severity: severity,
-		Trace:    trace,
-	})
+	logger.Log(entry)
+}
+
+// LogWriteLogger - Logging adapter which writes entries with LogWrite (structured JSON with the logType and errorCode labels),
+// so LogWrite call sites can be migrated to the Logging interface without breaking existing log-based alerts.
+// Severities are mapped to the legacy log types: Debug - LogWriteDebug, Info/Notice - LogTypeInfo,
+// Warning/Error - LogTypeError2, Critical/Emergency - LogTypeError1
+// ErrorCode - errorCode used for Warning and higher severities
+type LogWriteLogger struct {
+	ErrorCode int
+}
+
+func NewLogWriteLogger(errorCode int) *LogWriteLogger {
+	return &LogWriteLogger{
+		ErrorCode: errorCode,
+	}
+}
+
+// Debug - calls LogWriteDebug, works only if "DEBUG" env variable was set to true
+func (lw *LogWriteLogger) Debug(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWriteDebug(lw.formatMessage(message, dataObject))
+}
+
+// Info - calls LogWrite with LogTypeInfo
+func (lw *LogWriteLogger) Info(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeInfo, 0, lw.formatMessage(message, dataObject), "")
+}
+
+// Notice - calls LogWrite with LogTypeInfo
+func (lw *LogWriteLogger) Notice(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeInfo, 0, lw.formatMessage(message, dataObject), "")
+}
+
+// Warning - calls LogWrite with LogTypeError2
+func (lw *LogWriteLogger) Warning(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeError2, lw.ErrorCode, lw.formatMessage(message, dataObject), "")
+}
+
+// Error - calls LogWrite with LogTypeError2
+func (lw *LogWriteLogger) Error(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeError2, lw.ErrorCode, lw.formatMessage(message, dataObject), "")
+}
+
+// Critical - calls LogWrite with LogTypeError1
+func (lw *LogWriteLogger) Critical(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeError1, lw.ErrorCode, lw.formatMessage(message, dataObject), "")
+}
+
+// Emergency - calls LogWrite with LogTypeError1
+func (lw *LogWriteLogger) Emergency(ctx context.Context, httpRequest *http.Request, message string, dataObject ...interface{}) {
+	LogWrite(LogTypeError1, lw.ErrorCode, lw.formatMessage(message, dataObject), "")
+}
+
+// formatMessage - appends data objects to the message since LogWrite accepts only string message
+func (lw *LogWriteLogger) formatMessage(message string, dataObject []interface{}) string {
+	if len(dataObject) == 0 {
+		return message
+	}
+
+	return fmt.Sprintf("%v, data: %+v", message, dataObject)
 }
@@ -0,0 +1,170 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// BatchingOptions - buffering options of the Cloud Logging client
+// Buffered - entries are sent in the background by the thresholds and by Flush. Otherwise every entry is flushed
+// immediately, which is the safe default for Cloud Functions since instances are frozen after the response.
+// Buffered loggers should be flushed before the response is written, ex: with FlushAfter middleware
+// DelayThreshold, EntryCountThreshold, EntryByteThreshold - client defaults are used if empty
+type BatchingOptions struct {
+	Buffered            bool
+	DelayThreshold      time.Duration
+	EntryCountThreshold int
+	EntryByteThreshold  int
+}
+
+// logBackend - destination of the log entries shared by the logger and loggers derived from it
+type logBackend interface {
+	log(projectID, logName string, entry logging.Entry)
+	flush() error
+	close() error
+}
+
+// loggingBackend - Cloud Logging client
+type loggingBackend struct {
+	options BatchingOptions
+
+	mu     sync.Mutex
+	client *logging.Client
+	logger *logging.Logger
+}
+
+func newLoggingBackend(options BatchingOptions) *loggingBackend {
+	return &loggingBackend{
+		options: options,
+	}
+}
+
+// getLogger - returns Cloud Logging logger, client is created lazily on the first call
+func (b *loggingBackend) getLogger(projectID, logName string) (*logging.Logger, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.logger != nil {
+		return b.logger, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := logging.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var loggerOptions []logging.LoggerOption
+	if b.options.DelayThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.DelayThreshold(b.options.DelayThreshold))
+	}
+	if b.options.EntryCountThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.EntryCountThreshold(b.options.EntryCountThreshold))
+	}
+	if b.options.EntryByteThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.EntryByteThreshold(b.options.EntryByteThreshold))
+	}
+
+	b.client = client
+	b.logger = client.Logger(logName, loggerOptions...)
+
+	return b.logger, nil
+}
+
+// log - sends the entry, falls back to stdout if the client can't be created
+func (b *loggingBackend) log(projectID, logName string, entry logging.Entry) {
+	logger, err := b.getLogger(projectID, logName)
+	if err != nil {
+		log.Printf("Failed to create logging client: %v, entry: %+v", err, entry.Payload)
+		return
+	}
+
+	logger.Log(entry)
+	if !b.options.Buffered {
+		logger.Flush()
+	}
+}
+
+func (b *loggingBackend) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.logger == nil {
+		return nil
+	}
+
+	return b.logger.Flush()
+}
+
+func (b *loggingBackend) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.client == nil {
+		return nil
+	}
+
+	err := b.client.Close()
+	b.client = nil
+	b.logger = nil
+
+	return err
+}
+
+// WithBatching - returns derived logger with its own Cloud Logging client configured by the options
+func (pl *Logger) WithBatching(options BatchingOptions) *Logger {
+	derived := *pl
+	derived.backend = newLoggingBackend(options)
+
+	return &derived
+}
+
+// Flush - sends all buffered entries
+func (pl *Logger) Flush() error {
+	if pl.backend == nil {
+		return nil
+	}
+
+	err := pl.backend.flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush log entries. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// Close - flushes buffered entries and closes the Cloud Logging client, should be called on instance shutdown.
+// The client is recreated if the logger is used after Close
+func (pl *Logger) Close() error {
+	if pl.backend == nil {
+		return nil
+	}
+
+	err := pl.backend.close()
+	if err != nil {
+		return fmt.Errorf("failed to close logging client. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// FlushAfter - http middleware which flushes the buffered logger after the handler,
+// so entries are not lost when the function instance is frozen
+func FlushAfter(logger *Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := logger.Flush()
+			if err != nil {
+				log.Print(err.Error())
+			}
+		}()
+
+		next(w, r)
+	}
+}
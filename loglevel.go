@@ -0,0 +1,108 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/logging"
+)
+
+var (
+	// LogLevelsCollection - remote log level configuration, document ID is the function name,
+	// ex: {"min_severity": "DEBUG"}
+	LogLevelsCollection string = "log_levels"
+)
+
+// logLevel - minimum severity shared by the logger and loggers derived from it
+type logLevel struct {
+	severity atomic.Int32
+}
+
+func newLogLevel(severity logging.Severity) *logLevel {
+	level := &logLevel{}
+	level.severity.Store(int32(severity))
+
+	return level
+}
+
+func (l *logLevel) get() logging.Severity {
+	return logging.Severity(l.severity.Load())
+}
+
+// MinSeverityFromEnv - returns minimum severity from LOG_LEVEL env variable, ex: LOG_LEVEL=INFO drops Debug entries.
+// logging.Default (everything is logged) is returned if the variable is empty or invalid
+func MinSeverityFromEnv() logging.Severity {
+	value := packageConfig().LogLevel
+	if value == "" {
+		return logging.Default
+	}
+
+	return logging.ParseSeverity(strings.ToUpper(value))
+}
+
+// SetMinSeverity - sets minimum severity at runtime, entries with lower severity are dropped.
+// Affects the logger and all loggers derived from it. The level is created by NewLogger and only stored atomically here,
+// so it's safe while other goroutines log; Logger which wasn't created by NewLogger has no level and is not changed
+func (pl *Logger) SetMinSeverity(severity logging.Severity) {
+	if pl.minSeverity == nil {
+		return
+	}
+
+	pl.minSeverity.severity.Store(int32(severity))
+}
+
+// MinSeverity - returns current minimum severity
+func (pl *Logger) MinSeverity() logging.Severity {
+	if pl.minSeverity == nil {
+		return logging.Default
+	}
+
+	return pl.minSeverity.get()
+}
+
+// WatchMinSeverity - polls "min_severity" field of the LogLevelsCollection document every interval
+// and updates minimum severity, so Debug logging can be turned on for a single function without redeploy.
+// Polling stops when ctx is done. Missing document or field keeps current severity
+func (pl *Logger) WatchMinSeverity(ctx context.Context, fireclient *firestore.Client, documentID string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			pl.refreshMinSeverity(ctx, fireclient, documentID)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshMinSeverity - reads minimum severity from the LogLevelsCollection document
+func (pl *Logger) refreshMinSeverity(ctx context.Context, fireclient *firestore.Client, documentID string) {
+	dsnap, err := fireclient.Collection(LogLevelsCollection).Doc(documentID).Get(ctx)
+	if err != nil {
+		if dsnap == nil || dsnap.Exists() {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("failed to get log level of '%v'. Error: %v", documentID, err.Error()), "")
+		}
+		return
+	}
+
+	value, err := dsnap.DataAt("min_severity")
+	if err != nil {
+		return
+	}
+
+	severityName, ok := value.(string)
+	if !ok || severityName == "" {
+		return
+	}
+
+	pl.SetMinSeverity(logging.ParseSeverity(strings.ToUpper(severityName)))
+}
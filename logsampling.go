@@ -0,0 +1,160 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// maxRateLimitBuckets - number of tracked messages, buckets are reset after the limit to bound memory usage
+const maxRateLimitBuckets = 10000
+
+// SamplingOptions - options of the log sampling and rate limiting
+// SampleRates - share of the entries (0..1) which are sent per severity, ex: {logging.Debug: 0.1, logging.Info: 0.5}
+// severities which are not in the map are not sampled
+// RateLimit - number of identical messages allowed per second, 0 disables rate limiting.
+// Critical and Emergency entries are never dropped
+// Burst - max number of identical messages sent at once, RateLimit is used if less than 1
+// DroppedReportInterval - how often the Notice entry with dropped entries counters is emitted, 1 minute if empty
+type SamplingOptions struct {
+	SampleRates           map[logging.Severity]float64
+	RateLimit             float64
+	Burst                 int
+	DroppedReportInterval time.Duration
+}
+
+// logSampler - shared between derived loggers sampling state
+type logSampler struct {
+	options SamplingOptions
+
+	mu         sync.Mutex
+	buckets    map[uint64]*tokenBucket
+	dropped    map[logging.Severity]int
+	lastReport time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newLogSampler(options SamplingOptions) *logSampler {
+	if options.DroppedReportInterval <= 0 {
+		options.DroppedReportInterval = time.Minute
+	}
+	if options.Burst < 1 {
+		options.Burst = int(options.RateLimit)
+		if options.Burst < 1 {
+			options.Burst = 1
+		}
+	}
+
+	return &logSampler{
+		options:    options,
+		buckets:    map[uint64]*tokenBucket{},
+		dropped:    map[logging.Severity]int{},
+		lastReport: time.Now(),
+	}
+}
+
+// allow - decides if the entry should be sent, counts dropped entries
+func (s *logSampler) allow(severity logging.Severity, message string) bool {
+	if severity >= logging.Critical {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rate, ok := s.options.SampleRates[severity]; ok && rand.Float64() >= rate {
+		s.dropped[severity]++
+		return false
+	}
+
+	if s.options.RateLimit > 0 && !s.takeToken(message) {
+		s.dropped[severity]++
+		return false
+	}
+
+	return true
+}
+
+// takeToken - token bucket rate limiting keyed by the message hash
+func (s *logSampler) takeToken(message string) bool {
+	hash := fnv.New64a()
+	hash.Write([]byte(message))
+	key := hash.Sum64()
+
+	now := time.Now()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxRateLimitBuckets {
+			s.buckets = map[uint64]*tokenBucket{}
+		}
+		bucket = &tokenBucket{tokens: float64(s.options.Burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updatedAt).Seconds() * s.options.RateLimit
+	if bucket.tokens > float64(s.options.Burst) {
+		bucket.tokens = float64(s.options.Burst)
+	}
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// takeDroppedReport - returns dropped entries counters if the report interval passed and resets them
+func (s *logSampler) takeDroppedReport() (Fields, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.dropped) == 0 || time.Since(s.lastReport) < s.options.DroppedReportInterval {
+		return nil, false
+	}
+
+	report := Fields{}
+	for severity, count := range s.dropped {
+		report[severity.String()] = count
+	}
+	s.dropped = map[logging.Severity]int{}
+	s.lastReport = time.Now()
+
+	return report, true
+}
+
+// WithSampling - returns derived logger which samples and rate limits entries to control Cloud Logging costs.
+// Counters of the dropped entries are emitted periodically as a Notice entry
+func (pl *Logger) WithSampling(options SamplingOptions) *Logger {
+	derived := *pl
+	derived.sampler = newLogSampler(options)
+
+	return &derived
+}
+
+// reportDroppedEntries - emits the dropped entries counters if it's time to do it
+func (pl *Logger) reportDroppedEntries(ctx context.Context) {
+	report, ok := pl.sampler.takeDroppedReport()
+	if !ok {
+		return
+	}
+
+	pl.sendLogs(ctx, logging.Entry{
+		Payload: LogEntryPayload{
+			Invoker: pl.LoggerInvoker,
+			Message: "log entries were dropped by sampling",
+			Fields:  Fields{"dropped_entries": report},
+		},
+		Severity: logging.Notice,
+		Labels:   pl.labels,
+	})
+}
@@ -0,0 +1,365 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	sendGridSendURL = "https://api.sendgrid.com/v3/mail/send"
+	gmailSendURL    = "https://gmail.googleapis.com/gmail/v1/users/me/messages/send"
+	gmailSendScope  = "https://www.googleapis.com/auth/gmail.send"
+)
+
+// EmailAddress - email address with the optional display name
+type EmailAddress struct {
+	Email string `json:"email" validate:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// String - RFC 5322 address, ex: "Bluebird" <noreply@example.com>
+func (a EmailAddress) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// EmailMessage - email of the Mailer, at least one of HTML and Text should be set
+// Categories - provider tags of the message for the statistics (SendGrid categories), ignored by Gmail
+type EmailMessage struct {
+	From       EmailAddress   `json:"from"`
+	To         []EmailAddress `json:"to" validate:"required,min=1"`
+	CC         []EmailAddress `json:"cc,omitempty"`
+	BCC        []EmailAddress `json:"bcc,omitempty"`
+	ReplyTo    *EmailAddress  `json:"reply_to,omitempty"`
+	Subject    string         `json:"subject" validate:"required"`
+	HTML       string         `json:"html,omitempty"`
+	Text       string         `json:"text,omitempty"`
+	Categories []string       `json:"categories,omitempty"`
+}
+
+// ValidateFields - message has a body
+func (m EmailMessage) ValidateFields(v *Validator) {
+	if m.HTML == "" && m.Text == "" {
+		v.Add("text", "required", "html or text is required")
+	}
+}
+
+// Mailer - email provider. Implementations send with NewOutboundClient, so 429 responses are retried with backoff.
+// 5xx responses and connection errors aren't retried since the providers have no idempotency keys and the email
+// accepted before the failure would be sent twice
+type Mailer interface {
+	Name() string
+	Send(ctx context.Context, message *EmailMessage) error
+}
+
+// EmailSendError - provider rejected the message
+type EmailSendError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *EmailSendError) Error() string {
+	return fmt.Sprintf("%v rejected email with status %v: %v", e.Provider, e.StatusCode, e.Body)
+}
+
+// SendEmail - validates the message and sends it with the mailer
+func SendEmail(ctx context.Context, mailer Mailer, message *EmailMessage) error {
+	if err := ValidateStruct(message); err != nil {
+		return E("SendEmail", ErrorCodeValidation, err)
+	}
+
+	if err := mailer.Send(ctx, message); err != nil {
+		return Errorf("SendEmail", ErrorCodeExternalAPI, "failed to send email with %v: %w", mailer.Name(), err)
+	}
+	LoggerFromContext(ctx).Info("email sent", Fields{"provider": mailer.Name(), "subject": message.Subject, "recipients": len(message.To) + len(message.CC) + len(message.BCC)})
+
+	return nil
+}
+
+// EmailTemplate - subject, HTML and text templates of the email. Templates fail on the missing keys,
+// so the data struct of the template must have all fields used by it
+type EmailTemplate struct {
+	name    string
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// NewEmailTemplate - parses the templates, html or text can be empty
+func NewEmailTemplate(name, subject, html, text string) (*EmailTemplate, error) {
+	t := &EmailTemplate{name: name}
+
+	var err error
+	if t.subject, err = texttemplate.New(name + ".subject").Option("missingkey=error").Parse(subject); err != nil {
+		return nil, fmt.Errorf("failed to parse subject template of '%v'. Error: %v", name, err.Error())
+	}
+	if html != "" {
+		if t.html, err = htmltemplate.New(name + ".html").Option("missingkey=error").Parse(html); err != nil {
+			return nil, fmt.Errorf("failed to parse html template of '%v'. Error: %v", name, err.Error())
+		}
+	}
+	if text != "" {
+		if t.text, err = texttemplate.New(name + ".text").Option("missingkey=error").Parse(text); err != nil {
+			return nil, fmt.Errorf("failed to parse text template of '%v'. Error: %v", name, err.Error())
+		}
+	}
+
+	return t, nil
+}
+
+// MustEmailTemplate - NewEmailTemplate which panics on the invalid template, for the package level templates
+func MustEmailTemplate(name, subject, html, text string) *EmailTemplate {
+	t, err := NewEmailTemplate(name, subject, html, text)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// Message - renders the templates with the data struct into the message to the recipients
+func (t *EmailTemplate) Message(data interface{}, from EmailAddress, to ...EmailAddress) (*EmailMessage, error) {
+	message := &EmailMessage{From: from, To: to}
+
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render subject of '%v'. Error: %v", t.name, err.Error())
+	}
+	message.Subject = strings.TrimSpace(buf.String())
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render html of '%v'. Error: %v", t.name, err.Error())
+		}
+		message.HTML = buf.String()
+	}
+
+	if t.text != nil {
+		buf.Reset()
+		if err := t.text.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render text of '%v'. Error: %v", t.name, err.Error())
+		}
+		message.Text = buf.String()
+	}
+
+	return message, nil
+}
+
+// SendGridMailer - Mailer of the SendGrid v3 API
+type SendGridMailer struct {
+	apiKey string
+}
+
+// NewSendGridMailer - returns SendGridMailer with the API key of the Secret Manager secret
+func NewSendGridMailer(ctx context.Context, apiKeySecretName string) (*SendGridMailer, error) {
+	apiKey, err := GetSecret(ctx, apiKeySecretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SendGrid API key. Error: %v", err.Error())
+	}
+
+	return &SendGridMailer{apiKey: strings.TrimSpace(apiKey)}, nil
+}
+
+// Name - provider name of the SendGrid
+func (sg *SendGridMailer) Name() string {
+	return "sendgrid"
+}
+
+// Send - sends the message with SendGrid
+func (sg *SendGridMailer) Send(ctx context.Context, message *EmailMessage) error {
+	personalization := map[string]interface{}{"to": message.To}
+	if len(message.CC) > 0 {
+		personalization["cc"] = message.CC
+	}
+	if len(message.BCC) > 0 {
+		personalization["bcc"] = message.BCC
+	}
+
+	var content []map[string]string
+	if message.Text != "" {
+		content = append(content, map[string]string{"type": "text/plain", "value": message.Text})
+	}
+	if message.HTML != "" {
+		content = append(content, map[string]string{"type": "text/html", "value": message.HTML})
+	}
+
+	body := map[string]interface{}{
+		"personalizations": []interface{}{personalization},
+		"from":             message.From,
+		"subject":          message.Subject,
+		"content":          content,
+	}
+	if message.ReplyTo != nil {
+		body["reply_to"] = message.ReplyTo
+	}
+	if len(message.Categories) > 0 {
+		body["categories"] = message.Categories
+	}
+
+	return postEmail(ctx, sg.Name(), nil, sendGridSendURL, map[string]string{"Authorization": "Bearer " + sg.apiKey}, body, http.StatusAccepted)
+}
+
+// GmailMailer - Mailer of the Gmail API, the service account sends as the workspace user with the domain-wide delegation
+type GmailMailer struct {
+	credentials []byte
+	sender      string
+}
+
+// NewGmailMailer - returns GmailMailer with the service account key JSON of the Secret Manager secret,
+// sender is the workspace user the messages are sent as
+func NewGmailMailer(ctx context.Context, credentialsSecretName, sender string) (*GmailMailer, error) {
+	credentials, err := GetSecretRaw(ctx, credentialsSecretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Gmail credentials. Error: %v", err.Error())
+	}
+
+	if _, err := google.JWTConfigFromJSON(credentials, gmailSendScope); err != nil {
+		return nil, fmt.Errorf("failed to parse Gmail credentials. Error: %v", err.Error())
+	}
+
+	return &GmailMailer{credentials: credentials, sender: sender}, nil
+}
+
+// Name - provider name of the Gmail
+func (gm *GmailMailer) Name() string {
+	return "gmail"
+}
+
+// Send - sends the message as MIME message of the sender, From of the message defaults to the sender
+func (gm *GmailMailer) Send(ctx context.Context, message *EmailMessage) error {
+	jwtConfig, err := google.JWTConfigFromJSON(gm.credentials, gmailSendScope)
+	if err != nil {
+		return fmt.Errorf("failed to parse Gmail credentials. Error: %v", err.Error())
+	}
+	jwtConfig.Subject = gm.sender
+
+	outboundClient, err := NewOutboundClient(ctx)
+	if err != nil {
+		return err
+	}
+	client := jwtConfig.Client(context.WithValue(ctx, oauth2.HTTPClient, outboundClient))
+
+	withSender := *message
+	if withSender.From.Email == "" {
+		withSender.From.Email = gm.sender
+	}
+	raw, err := mimeMessage(&withSender)
+	if err != nil {
+		return err
+	}
+
+	return postEmail(ctx, gm.Name(), client, gmailSendURL, nil, map[string]string{"raw": base64.URLEncoding.EncodeToString(raw)}, http.StatusOK)
+}
+
+// mimeMessage - RFC 5322 message with the multipart/alternative body
+func mimeMessage(message *EmailMessage) ([]byte, error) {
+	boundaryBytes := make([]byte, 12)
+	if _, err := rand.Read(boundaryBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate MIME boundary. Error: %v", err.Error())
+	}
+	boundary := hex.EncodeToString(boundaryBytes)
+
+	var buf bytes.Buffer
+	writeHeader := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+
+	writeHeader("From", message.From.String())
+	writeHeader("To", joinEmailAddresses(message.To))
+	if len(message.CC) > 0 {
+		writeHeader("Cc", joinEmailAddresses(message.CC))
+	}
+	if len(message.BCC) > 0 {
+		writeHeader("Bcc", joinEmailAddresses(message.BCC))
+	}
+	if message.ReplyTo != nil {
+		writeHeader("Reply-To", message.ReplyTo.String())
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	writeHeader("MIME-Version", "1.0")
+	writeHeader("Content-Type", `multipart/alternative; boundary="`+boundary+`"`)
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{{"text/plain", message.Text}, {"text/html", message.HTML}} {
+		if part.body == "" {
+			continue
+		}
+		buf.WriteString("--" + boundary + "\r\n")
+		writeHeader("Content-Type", part.contentType+"; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "base64")
+		buf.WriteString("\r\n")
+
+		encoded := base64.StdEncoding.EncodeToString([]byte(part.body))
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded + "\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// joinEmailAddresses - comma separated RFC 5322 addresses
+func joinEmailAddresses(addresses []EmailAddress) string {
+	values := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		values = append(values, address.String())
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// postEmail - sends JSON body to the provider API with the client (NewOutboundClient if nil) and checks the status code
+func postEmail(ctx context.Context, provider string, client *http.Client, url string, headers map[string]string, body interface{}, expectedStatusCode int) error {
+	if client == nil {
+		var err error
+		if client, err = NewOutboundClient(ctx); err != nil {
+			return err
+		}
+	}
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email. Error: %v", err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create request. Error: %v", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request. Error: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatusCode {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &EmailSendError{Provider: provider, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+const (
+	// MaintenanceConfigKey - default ConfigStore key of the MaintenanceConfig document
+	MaintenanceConfigKey = "maintenance"
+	// MaintenanceBypassRole - default role of the users which bypass the maintenance mode
+	MaintenanceBypassRole = "admin"
+
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+)
+
+// MaintenanceConfig - maintenance mode document of the ConfigCollection
+// Enabled - the maintenance mode is on
+// ReadOnly - only the writes are rejected (GET, HEAD and OPTIONS requests pass), ex: during the data migrations
+// Message - caller safe message of the 503 response, the ErrMaintenance message if empty
+// Until - expected end of the maintenance, used for Retry-After (5 minutes if empty), the mode is off after it
+// Services - K_SERVICE names of the functions in the maintenance mode, all functions if empty
+type MaintenanceConfig struct {
+	Enabled  bool      `firestore:"enabled" json:"enabled"`
+	ReadOnly bool      `firestore:"read_only" json:"read_only"`
+	Message  string    `firestore:"message,omitempty" json:"message,omitempty"`
+	Until    time.Time `firestore:"until,omitempty" json:"until"`
+	Services []string  `firestore:"services,omitempty" json:"services,omitempty"`
+}
+
+// Active - checks if the maintenance mode applies to the service at the time
+func (mc *MaintenanceConfig) Active(service string, now time.Time) bool {
+	if mc == nil || !mc.Enabled {
+		return false
+	}
+	if !mc.Until.IsZero() && now.After(mc.Until) {
+		return false
+	}
+
+	return len(mc.Services) == 0 || containsString(mc.Services, service)
+}
+
+// MaintenanceOptions - options of the MaintenanceMode
+// ConfigKey - ConfigStore key of the MaintenanceConfig, MaintenanceConfigKey if empty
+// Service - name of the function matched with the Services, K_SERVICE env variable if empty
+// BypassRoles - roles of the Firebase users which bypass the maintenance mode (HasAnyRole), MaintenanceBypassRole if empty
+type MaintenanceOptions struct {
+	ConfigKey   string
+	Service     string
+	BypassRoles []string
+}
+
+// MaintenanceDetails - details of the maintenance 503 response
+type MaintenanceDetails struct {
+	ReadOnly bool       `json:"read_only"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// MaintenanceMode - http middleware which rejects the requests with 503 MAINTENANCE response and Retry-After header while
+// the MaintenanceConfig is active, so the writes can be frozen without redeploying the functions. The config is cached
+// and refreshed by the ConfigStore (store.Start), failed reads don't block the requests.
+// Users with the bypass roles pass, the token is taken from RequireFirebaseAuth or verified from the Bearer token
+func MaintenanceMode(next http.HandlerFunc, store *ConfigStore, options MaintenanceOptions) http.HandlerFunc {
+	if options.ConfigKey == "" {
+		options.ConfigKey = MaintenanceConfigKey
+	}
+	if options.Service == "" {
+		options.Service = packageConfig().Service
+	}
+	if len(options.BypassRoles) == 0 {
+		options.BypassRoles = []string{MaintenanceBypassRole}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		config, err := GetMaintenanceConfig(ctx, store, options.ConfigKey)
+		if err != nil {
+			LoggerFromContext(ctx).Error("failed to read maintenance config", Fields{"error": err.Error()})
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		if !config.Active(options.Service, now) || (config.ReadOnly && isReadOnlyMethod(r.Method)) {
+			next(w, r)
+			return
+		}
+
+		if HasAnyRole(maintenanceBypassToken(ctx, r), options.BypassRoles...) {
+			next(w, r)
+			return
+		}
+
+		retryAfter := defaultMaintenanceRetryAfter
+		details := MaintenanceDetails{ReadOnly: config.ReadOnly}
+		if !config.Until.IsZero() {
+			retryAfter = config.Until.Sub(now)
+			until := config.Until
+			details.Until = &until
+		}
+
+		appErr := ErrMaintenance.Errorf("MaintenanceMode", "%v is in the maintenance mode", options.Service)
+		if config.Message != "" {
+			appErr = appErr.WithMessage(config.Message)
+		}
+		statusCode, envelope := errorResponse(appErr)
+		envelope.Error.Details = details
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		WriteJSON(w, statusCode, envelope)
+	}
+}
+
+// GetMaintenanceConfig - returns the cached maintenance config, the disabled config if the document doesn't exist
+func GetMaintenanceConfig(ctx context.Context, store *ConfigStore, key string) (*MaintenanceConfig, error) {
+	config := &MaintenanceConfig{}
+	err := store.Get(ctx, key, config)
+	var appErr *AppError
+	if errors.As(err, &appErr) && appErr.Code == ErrorCodeNotFound {
+		return &MaintenanceConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// SetMaintenanceMode - saves the maintenance config, other instances apply it on the ConfigStore refresh,
+// ex: SetMaintenanceMode(ctx, store, "", MaintenanceConfig{Enabled: true, ReadOnly: true, Until: time.Now().Add(time.Hour)})
+func SetMaintenanceMode(ctx context.Context, store *ConfigStore, key string, config MaintenanceConfig) error {
+	if key == "" {
+		key = MaintenanceConfigKey
+	}
+
+	return store.Set(ctx, key, config)
+}
+
+// maintenanceBypassToken - Firebase token of the request from the context or the Bearer token, nil if there is no valid token
+func maintenanceBypassToken(ctx context.Context, r *http.Request) *auth.Token {
+	if token, ok := UserFromContext(ctx); ok {
+		return token
+	}
+	if _, ok := getBearerToken(r); !ok {
+		return nil
+	}
+
+	token, err := verifyFirebaseRequest(ctx, r, FirebaseAuthOptions{})
+	if err != nil {
+		return nil
+	}
+
+	return token
+}
+
+// isReadOnlyMethod - the method doesn't change the data
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
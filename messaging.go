@@ -0,0 +1,293 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MessageChannelSMS - SMS message
+	MessageChannelSMS = "sms"
+	// MessageChannelWhatsApp - WhatsApp message
+	MessageChannelWhatsApp = "whatsapp"
+
+	// TwilioSignatureHeader - header with the signature of the Twilio callbacks
+	TwilioSignatureHeader = "X-Twilio-Signature"
+
+	twilioAPIURL                = "https://api.twilio.com/2010-04-01/Accounts/"
+	defaultMessageLimit         = 5
+	defaultMessageLimitWindow   = time.Hour
+	whatsAppAddressPrefix       = "whatsapp:"
+	maxTwilioCallbackBodyBytes  = 64 << 10
+	twilioStatusDeliveredStatus = "delivered"
+)
+
+// MessageSender - SMS and WhatsApp provider of the shipping-update notifications, to is the E.164 phone number
+type MessageSender interface {
+	SendSMS(ctx context.Context, to, body string) (*SentMessage, error)
+	SendWhatsApp(ctx context.Context, to, body string) (*SentMessage, error)
+}
+
+// SentMessage - message accepted by the provider
+type SentMessage struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+	Status  string `json:"status"`
+}
+
+// MessageStatusEvent - delivery status callback of the message
+// Status - provider status, ex: queued, sent, delivered, undelivered, failed, read
+type MessageStatusEvent struct {
+	MessageID    string `json:"message_id"`
+	Channel      string `json:"channel"`
+	To           string `json:"to"`
+	From         string `json:"from"`
+	Status       string `json:"status"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// Delivered - message was delivered (or read)
+func (e MessageStatusEvent) Delivered() bool {
+	return e.Status == twilioStatusDeliveredStatus || e.Status == "read"
+}
+
+// TwilioCredentials - JSON of the Twilio Secret Manager secret
+// From - SMS sender number or messaging service SID (MG...)
+// WhatsAppFrom - WhatsApp sender number, without the whatsapp: prefix
+// StatusCallbackURL - public URL of the StatusCallback handler, status callbacks are not requested if empty
+type TwilioCredentials struct {
+	AccountSID        string `json:"account_sid"`
+	AuthToken         string `json:"auth_token"`
+	From              string `json:"from"`
+	WhatsAppFrom      string `json:"whatsapp_from"`
+	StatusCallbackURL string `json:"status_callback_url"`
+}
+
+// TwilioOptions - options of the NewTwilioSender
+// RateLimitStore - counters of the per-destination limit, NewMemoryRateLimitStore if empty
+// (FirestoreRateLimitStore limits all instances)
+// DestinationLimit - max messages to the single destination in the window, 5 if empty
+// DestinationWindow - window of the destination limit, 1 hour if empty
+type TwilioOptions struct {
+	RateLimitStore    RateLimitStore
+	DestinationLimit  int
+	DestinationWindow time.Duration
+}
+
+// TwilioSender - MessageSender of the Twilio Messages API
+type TwilioSender struct {
+	credentials TwilioCredentials
+	options     TwilioOptions
+}
+
+var _ MessageSender = (*TwilioSender)(nil)
+
+// NewTwilioSender - returns TwilioSender with the TwilioCredentials JSON of the Secret Manager secret
+func NewTwilioSender(ctx context.Context, credentialsSecretName string, options TwilioOptions) (*TwilioSender, error) {
+	secret, err := GetSecretRaw(ctx, credentialsSecretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Twilio credentials. Error: %v", err.Error())
+	}
+
+	var credentials TwilioCredentials
+	if err := json.Unmarshal(secret, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Twilio credentials. Error: %v", err.Error())
+	}
+	if credentials.AccountSID == "" || credentials.AuthToken == "" {
+		return nil, fmt.Errorf("Twilio credentials have no account SID or auth token")
+	}
+
+	if options.RateLimitStore == nil {
+		options.RateLimitStore = NewMemoryRateLimitStore()
+	}
+	if options.DestinationLimit <= 0 {
+		options.DestinationLimit = defaultMessageLimit
+	}
+	if options.DestinationWindow <= 0 {
+		options.DestinationWindow = defaultMessageLimitWindow
+	}
+
+	return &TwilioSender{credentials: credentials, options: options}, nil
+}
+
+// SendSMS - sends SMS from the From number of the credentials
+func (ts *TwilioSender) SendSMS(ctx context.Context, to, body string) (*SentMessage, error) {
+	return ts.send(ctx, MessageChannelSMS, to, ts.credentials.From, body)
+}
+
+// SendWhatsApp - sends WhatsApp message from the WhatsAppFrom number of the credentials.
+// Outside of the 24 hours session WhatsApp accepts the approved templates only
+func (ts *TwilioSender) SendWhatsApp(ctx context.Context, to, body string) (*SentMessage, error) {
+	if ts.credentials.WhatsAppFrom == "" {
+		return nil, Errorf("TwilioSender.SendWhatsApp", ErrorCodeInternal, "Twilio credentials have no WhatsApp sender")
+	}
+
+	return ts.send(ctx, MessageChannelWhatsApp, whatsAppAddressPrefix+to, whatsAppAddressPrefix+ts.credentials.WhatsAppFrom, body)
+}
+
+// send - checks the destination limit and creates the message
+func (ts *TwilioSender) send(ctx context.Context, channel, to, from, body string) (*SentMessage, error) {
+	op := "TwilioSender.Send"
+	if to == "" || body == "" {
+		return nil, Errorf(op, ErrorCodeInvalidArgument, "message has no destination or body")
+	}
+
+	// destination is hashed, so the phone numbers are not stored in the counters
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(to, whatsAppAddressPrefix)))
+	result, err := ts.options.RateLimitStore.Allow(ctx, "message_"+hex.EncodeToString(hash[:8]), ts.options.DestinationLimit, ts.options.DestinationWindow)
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeInternal, "failed to check destination rate limit: %w", err)
+	}
+	if !result.Allowed {
+		return nil, Errorf(op, ErrorCodeResourceExhausted, "too many messages to the destination until %v", result.ResetAt.Format(time.RFC3339)).
+			WithMessage("too many messages to the destination")
+	}
+
+	form := url.Values{"To": {to}, "Body": {body}}
+	if strings.HasPrefix(from, "MG") {
+		form.Set("MessagingServiceSid", from)
+	} else {
+		form.Set("From", from)
+	}
+	if ts.credentials.StatusCallbackURL != "" {
+		form.Set("StatusCallback", ts.credentials.StatusCallbackURL)
+	}
+
+	// the POST is retried only on 429, Twilio has no idempotency key for the messages, so the retry of 5xx could send SMS twice
+	client, err := NewOutboundClient(ctx)
+	if err != nil {
+		return nil, E(op, ErrorCodeInternal, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, twilioAPIURL+ts.credentials.AccountSID+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeInternal, "failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(ts.credentials.AccountSID, ts.credentials.AuthToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeExternalAPI, "failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeExternalAPI, "failed to read response body: %w", err)
+	}
+
+	var message struct {
+		SID     string `json:"sid"`
+		Status  string `json:"status"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(respBody, &message)
+
+	if resp.StatusCode != http.StatusCreated {
+		code := ErrorCodeExternalAPI
+		if resp.StatusCode == http.StatusBadRequest {
+			// invalid or unreachable destination, the retry fails the same way
+			code = ErrorCodeInvalidArgument
+		}
+		return nil, Errorf(op, code, "Twilio rejected message with status %v: %v %v", resp.StatusCode, message.Code, message.Message)
+	}
+
+	return &SentMessage{ID: message.SID, Channel: channel, To: strings.TrimPrefix(to, whatsAppAddressPrefix), Status: message.Status}, nil
+}
+
+// StatusCallback - http handler of the Twilio delivery status callbacks, verifies the signature
+// with the StatusCallbackURL and calls handle. Returns 401 for invalid signatures and 500 if handle fails, so Twilio retries it
+func (ts *TwilioSender) StatusCallback(handle func(ctx context.Context, event *MessageStatusEvent) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		event, err := ts.ParseStatusCallback(r)
+		if err != nil {
+			LoggerFromContext(ctx).Warning("invalid message status callback", Fields{"error": err.Error()})
+			WriteError(w, err)
+			return
+		}
+
+		if err := handle(ctx, event); err != nil {
+			LoggerFromContext(ctx).Error("failed to handle message status", Fields{"message_id": event.MessageID, "error": err.Error()})
+			WriteError(w, E("TwilioSender.StatusCallback", 0, err))
+			return
+		}
+
+		WriteNoContent(w)
+	}
+}
+
+// ParseStatusCallback - verifies the X-Twilio-Signature of the callback request and parses its form
+func (ts *TwilioSender) ParseStatusCallback(r *http.Request) (*MessageStatusEvent, error) {
+	op := "TwilioSender.ParseStatusCallback"
+
+	r.Body = http.MaxBytesReader(nil, r.Body, maxTwilioCallbackBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		return nil, Errorf(op, ErrorCodeInvalidArgument, "failed to parse callback form: %w", err)
+	}
+
+	callbackURL := ts.credentials.StatusCallbackURL
+	if callbackURL == "" {
+		callbackURL = "https://" + r.Host + r.URL.RequestURI()
+	}
+	if !VerifyTwilioSignature(ts.credentials.AuthToken, callbackURL, r.PostForm, r.Header.Get(TwilioSignatureHeader)) {
+		return nil, Errorf(op, ErrorCodeUnauthenticated, "invalid Twilio signature")
+	}
+
+	to, from := r.PostForm.Get("To"), r.PostForm.Get("From")
+	channel := MessageChannelSMS
+	if strings.HasPrefix(to, whatsAppAddressPrefix) {
+		channel = MessageChannelWhatsApp
+	}
+
+	return &MessageStatusEvent{
+		MessageID:    r.PostForm.Get("MessageSid"),
+		Channel:      channel,
+		To:           strings.TrimPrefix(to, whatsAppAddressPrefix),
+		From:         strings.TrimPrefix(from, whatsAppAddressPrefix),
+		Status:       r.PostForm.Get("MessageStatus"),
+		ErrorCode:    r.PostForm.Get("ErrorCode"),
+		ErrorMessage: r.PostForm.Get("ErrorMessage"),
+	}, nil
+}
+
+// VerifyTwilioSignature - checks the base64 HMAC-SHA1 signature of the URL followed by the sorted POST params (name + value)
+func VerifyTwilioSignature(authToken, callbackURL string, params url.Values, signature string) bool {
+	expected, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || signature == "" {
+		return false
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(callbackURL))
+	for _, key := range keys {
+		for _, value := range params[key] {
+			mac.Write([]byte(key + value))
+		}
+	}
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
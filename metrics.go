@@ -0,0 +1,183 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	MetricKindCounter = "counter"
+	MetricKindTiming  = "timing"
+
+	// metricMessage - message of the metric entries, log-based metrics should filter by it
+	// ex: jsonPayload.message="metric" AND jsonPayload.fields.metric.name="orders_created"
+	metricMessage = "metric"
+)
+
+// Metric - business metric in the fixed schema, used for log-based metrics
+// value extractor: jsonPayload.fields.metric.value, labels: jsonPayload.fields.metric.labels.<key>
+type Metric struct {
+	Name      string            `json:"name"`
+	Kind      string            `json:"kind"`
+	Value     float64           `json:"value"`
+	Unit      string            `json:"unit,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// MetricWriter - additional destination of the metrics, ex: CloudMonitoringMetricWriter
+type MetricWriter interface {
+	WriteMetric(ctx context.Context, metric Metric) error
+}
+
+// Counter - emits counter metric entry, ex: logger.Counter(ctx, "orders_created", 1, map[string]string{"fc": fcID})
+// metrics are not affected by the minimum severity and sampling
+func (pl *Logger) Counter(ctx context.Context, name string, value float64, labels map[string]string) {
+	pl.emitMetric(ctx, Metric{
+		Name:      name,
+		Kind:      MetricKindCounter,
+		Value:     value,
+		Unit:      "1",
+		Labels:    labels,
+		Timestamp: time.Now(),
+	})
+}
+
+// Timing - emits timing metric entry in milliseconds, ex: defer logger.Timing(ctx, "ie_order_latency", time.Since(start), nil)
+func (pl *Logger) Timing(ctx context.Context, name string, duration time.Duration, labels map[string]string) {
+	pl.emitMetric(ctx, Metric{
+		Name:      name,
+		Kind:      MetricKindTiming,
+		Value:     float64(duration) / float64(time.Millisecond),
+		Unit:      "ms",
+		Labels:    labels,
+		Timestamp: time.Now(),
+	})
+}
+
+// WithMetricWriter - returns derived logger which also sends metrics to the writer
+func (pl *Logger) WithMetricWriter(writer MetricWriter) *Logger {
+	derived := *pl
+	derived.metricWriter = writer
+
+	return &derived
+}
+
+// emitMetric - writes metric entry and sends the metric to the metric writer
+func (pl *Logger) emitMetric(ctx context.Context, m Metric) {
+	pl.sendLogs(ctx, logging.Entry{
+		Payload: LogEntryPayload{
+			Invoker: pl.LoggerInvoker,
+			Message: metricMessage,
+			Fields:  pl.fields.merge(Fields{"metric": m}),
+		},
+		Severity: logging.Info,
+		Labels:   pl.labels,
+	})
+
+	if pl.metricWriter == nil {
+		return
+	}
+
+	err := pl.metricWriter.WriteMetric(ctx, m)
+	if err != nil {
+		LogWrite(LogTypeError2, ErrorCodeExternalAPI, fmt.Sprintf("failed to write metric '%v'. Error: %v", m.Name, err.Error()), "")
+	}
+}
+
+// CloudMonitoringMetricWriter - MetricWriter which writes metrics as custom.googleapis.com/<prefix><name> GAUGE points
+// of the global resource. Cloud Monitoring accepts one point per time series every 5 seconds,
+// so it's suitable for low frequency metrics, log-based metrics should be used otherwise
+type CloudMonitoringMetricWriter struct {
+	ProjectID string
+	Prefix    string
+
+	mu     sync.Mutex
+	client *monitoring.MetricClient
+}
+
+func NewCloudMonitoringMetricWriter(projectID, prefix string) *CloudMonitoringMetricWriter {
+	return &CloudMonitoringMetricWriter{
+		ProjectID: projectID,
+		Prefix:    prefix,
+	}
+}
+
+// WriteMetric - writes the metric point, client is created on the first call
+func (mw *CloudMonitoringMetricWriter) WriteMetric(ctx context.Context, m Metric) error {
+	client, err := mw.getClient()
+	if err != nil {
+		return err
+	}
+
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name: "projects/" + mw.ProjectID,
+		TimeSeries: []*monitoringpb.TimeSeries{{
+			Metric: &metric.Metric{
+				Type:   "custom.googleapis.com/" + mw.Prefix + m.Name,
+				Labels: m.Labels,
+			},
+			Resource: &monitoredres.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": mw.ProjectID},
+			},
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{
+					EndTime: timestamppb.New(m.Timestamp),
+				},
+				Value: &monitoringpb.TypedValue{
+					Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: m.Value},
+				},
+			}},
+		}},
+	}
+
+	err = client.CreateTimeSeries(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create time series. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// Close - closes the Cloud Monitoring client
+func (mw *CloudMonitoringMetricWriter) Close() error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.client == nil {
+		return nil
+	}
+
+	err := mw.client.Close()
+	mw.client = nil
+
+	return err
+}
+
+func (mw *CloudMonitoringMetricWriter) getClient() (*monitoring.MetricClient, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.client != nil {
+		return mw.client, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := monitoring.NewMetricClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create monitoring client. Error: %v", err.Error())
+	}
+	mw.client = client
+
+	return mw.client, nil
+}
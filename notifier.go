@@ -0,0 +1,113 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// Notification - log entry data passed to the notifiers
+type Notification struct {
+	Severity    logging.Severity
+	Message     string
+	Invoker     string
+	ExecutionID string
+	Trace       string
+	Fields      Fields
+	Labels      map[string]string
+	Timestamp   time.Time
+}
+
+// DedupKey - returns key which is the same for the same message of one execution,
+// used by incident management tools to group repeated notifications into one incident
+func (n Notification) DedupKey() string {
+	hash := sha256.Sum256([]byte(n.ExecutionID + ":" + n.Message))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Notifier - receives log entries with severity not lower than configured by Logger.WithNotifier,
+// ex: to open incidents or to post to the chat
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// WithNotifier - returns derived logger which sends entries with severity >= minSeverity to the notifier.
+// MultiNotifier can be used to send entries to several notifiers
+func (pl *Logger) WithNotifier(notifier Notifier, minSeverity logging.Severity) *Logger {
+	derived := *pl
+	derived.notifier = notifier
+	derived.notifierMinSeverity = minSeverity
+
+	return &derived
+}
+
+// notify - sends the entry to the notifier if it's configured and the severity is high enough
+func (pl *Logger) notify(ctx context.Context, entry logging.Entry) {
+	if pl.notifier == nil || entry.Severity < pl.notifierMinSeverity {
+		return
+	}
+
+	payload, _ := entry.Payload.(LogEntryPayload)
+	notification := Notification{
+		Severity:    entry.Severity,
+		Message:     payload.Message,
+		Invoker:     payload.Invoker,
+		ExecutionID: payload.ExecutionID,
+		Trace:       entry.Trace,
+		Fields:      payload.Fields,
+		Labels:      entry.Labels,
+		Timestamp:   time.Now(),
+	}
+
+	err := pl.notifier.Notify(ctx, notification)
+	if err != nil {
+		LogWrite(LogTypeError2, ErrorCodeExternalAPI, "failed to send log notification. Error: "+err.Error(), "")
+	}
+}
+
+// MultiNotifier - Notifier which forwards notifications to several notifiers,
+// each with its own minimum severity, ex: Slack at Error, PagerDuty at Emergency
+type MultiNotifier struct {
+	targets []notifierTarget
+}
+
+type notifierTarget struct {
+	notifier    Notifier
+	minSeverity logging.Severity
+}
+
+func NewMultiNotifier() *MultiNotifier {
+	return &MultiNotifier{}
+}
+
+// Add - adds the notifier which receives notifications with severity >= minSeverity
+func (mn *MultiNotifier) Add(notifier Notifier, minSeverity logging.Severity) *MultiNotifier {
+	mn.targets = append(mn.targets, notifierTarget{
+		notifier:    notifier,
+		minSeverity: minSeverity,
+	})
+
+	return mn
+}
+
+// Notify - forwards the notification to all matching notifiers, one failed notifier doesn't stop the others.
+// Returns joined errors of the failed notifiers
+func (mn *MultiNotifier) Notify(ctx context.Context, notification Notification) error {
+	var errs []error
+	for _, target := range mn.targets {
+		if notification.Severity < target.minSeverity {
+			continue
+		}
+
+		err := target.notifier.Notify(ctx, notification)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
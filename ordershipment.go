@@ -0,0 +1,284 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ShipmentStatusCreated - shipment is stored, not sent to the provider yet
+	ShipmentStatusCreated = "created"
+	// ShipmentStatusSubmitted - provider accepted the shipment
+	ShipmentStatusSubmitted = "submitted"
+	// ShipmentStatusInFulfillment - provider is producing or packing the shipment
+	ShipmentStatusInFulfillment = "in_fulfillment"
+	// ShipmentStatusShipped - shipment was handed over to the carrier
+	ShipmentStatusShipped = "shipped"
+	// ShipmentStatusDelivered - shipment was delivered, final status
+	ShipmentStatusDelivered = "delivered"
+	// ShipmentStatusFailed - shipment can't be fulfilled or delivered, final status
+	ShipmentStatusFailed = "failed"
+)
+
+var (
+	OrderShipmentsCollection string = "order_shipments"
+)
+
+// shipmentTransitions - allowed next statuses of the shipment status, statuses can be skipped
+// when the provider reports them late (ex: submitted shipment is reported shipped)
+var shipmentTransitions = map[string][]string{
+	ShipmentStatusCreated:       {ShipmentStatusSubmitted, ShipmentStatusFailed},
+	ShipmentStatusSubmitted:     {ShipmentStatusInFulfillment, ShipmentStatusShipped, ShipmentStatusFailed},
+	ShipmentStatusInFulfillment: {ShipmentStatusShipped, ShipmentStatusFailed},
+	ShipmentStatusShipped:       {ShipmentStatusDelivered, ShipmentStatusFailed},
+}
+
+// OrderShipment - shipment of the order in the OrderShipmentsCollection
+// Timestamps - time the shipment reached each status, by the status
+// History - transitions of the shipment, oldest first
+type OrderShipment struct {
+	ID                  string               `json:"id" firestore:"-"`
+	OrderID             string               `json:"order_id" firestore:"order_id"`
+	Provider            string               `json:"provider" firestore:"provider"`
+	FulfillmentCenterID string               `json:"fulfillment_center_id,omitempty" firestore:"fulfillment_center_id,omitempty"`
+	ProviderShipmentID  string               `json:"provider_shipment_id,omitempty" firestore:"provider_shipment_id,omitempty"`
+	Status              string               `json:"status" firestore:"status"`
+	Request             ShipmentRequest      `json:"request" firestore:"request"`
+	Carrier             string               `json:"carrier,omitempty" firestore:"carrier,omitempty"`
+	TrackingNumber      string               `json:"tracking_number,omitempty" firestore:"tracking_number,omitempty"`
+	TrackingURL         string               `json:"tracking_url,omitempty" firestore:"tracking_url,omitempty"`
+	FailureReason       string               `json:"failure_reason,omitempty" firestore:"failure_reason,omitempty"`
+	Timestamps          map[string]time.Time `json:"timestamps" firestore:"timestamps"`
+	History             []ShipmentTransition `json:"history" firestore:"history"`
+	CreatedAt           time.Time            `json:"created_at" firestore:"created_at"`
+	UpdatedAt           time.Time            `json:"updated_at" firestore:"updated_at"`
+}
+
+// ShipmentTransition - status change of the shipment
+type ShipmentTransition struct {
+	From        string    `json:"from" firestore:"from"`
+	To          string    `json:"to" firestore:"to"`
+	Reason      string    `json:"reason,omitempty" firestore:"reason,omitempty"`
+	ExecutionID string    `json:"execution_id,omitempty" firestore:"execution_id,omitempty"`
+	At          time.Time `json:"at" firestore:"at"`
+}
+
+// ShipmentTransitionHook - called after the transition is committed, errors of the hook are logged and don't fail the transition
+type ShipmentTransitionHook func(ctx context.Context, shipment *OrderShipment, transition ShipmentTransition) error
+
+// ShipmentStateMachine - guarded status transitions of the OrderShipment documents
+type ShipmentStateMachine struct {
+	fireclient *firestore.Client
+	hooks      []ShipmentTransitionHook
+	encryptor  *FieldEncryptor
+}
+
+// NewShipmentStateMachine - returns ShipmentStateMachine which calls the hooks after every transition in the given order
+func NewShipmentStateMachine(fireclient *firestore.Client, hooks ...ShipmentTransitionHook) *ShipmentStateMachine {
+	return &ShipmentStateMachine{fireclient: fireclient, hooks: hooks}
+}
+
+// WithFieldEncryptor - the secure fields of the shipments (shipping address) are stored encrypted with the encryptor,
+// the shipments stored before are read as is. Hooks get the decrypted shipment
+func (sm *ShipmentStateMachine) WithFieldEncryptor(encryptor *FieldEncryptor) *ShipmentStateMachine {
+	sm.encryptor = encryptor
+	return sm
+}
+
+// CanTransitionShipment - checks if the shipment in the from status can move to the to status
+func CanTransitionShipment(from, to string) bool {
+	return containsString(shipmentTransitions[from], to)
+}
+
+// IsFinalShipmentStatus - delivered and failed shipments don't change anymore
+func IsFinalShipmentStatus(shipmentStatus string) bool {
+	return shipmentStatus == ShipmentStatusDelivered || shipmentStatus == ShipmentStatusFailed
+}
+
+// Create - stores the shipment in the created status, the document ID is generated if shipment ID is empty
+func (sm *ShipmentStateMachine) Create(ctx context.Context, shipment *OrderShipment) error {
+	now := time.Now()
+	shipment.Status = ShipmentStatusCreated
+	shipment.Timestamps = map[string]time.Time{ShipmentStatusCreated: now}
+	shipment.History = []ShipmentTransition{{To: ShipmentStatusCreated, ExecutionID: ExecutionIDFromContext(ctx), At: now}}
+	shipment.CreatedAt = now
+	shipment.UpdatedAt = now
+
+	collection := sm.fireclient.Collection(OrderShipmentsCollection)
+	ref := collection.NewDoc()
+	if shipment.ID != "" {
+		ref = collection.Doc(shipment.ID)
+	}
+
+	stored := *shipment
+	if err := sm.encryptor.EncryptStruct(ctx, &stored); err != nil {
+		return E("ShipmentStateMachine.Create", ErrorCodeInternal, err)
+	}
+
+	if _, err := ref.Create(ctx, &stored); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return Errorf("ShipmentStateMachine.Create", ErrorCodeConflict, "shipment %v already exists", ref.ID)
+		}
+		return Errorf("ShipmentStateMachine.Create", ErrorCodeFirebase, "failed to create shipment: %w", err)
+	}
+	shipment.ID = ref.ID
+
+	sm.runHooks(ctx, shipment, shipment.History[0])
+
+	return nil
+}
+
+// Get - returns the shipment by ID
+func (sm *ShipmentStateMachine) Get(ctx context.Context, shipmentID string) (*OrderShipment, error) {
+	dsnap, err := sm.fireclient.Collection(OrderShipmentsCollection).Doc(shipmentID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrOrderNotFound.Errorf("ShipmentStateMachine.Get", "shipment %v not found", shipmentID)
+	}
+	if err != nil {
+		return nil, Errorf("ShipmentStateMachine.Get", ErrorCodeFirebase, "failed to get shipment %v: %w", shipmentID, err)
+	}
+
+	return sm.decode(ctx, dsnap)
+}
+
+// Transition - moves the shipment to the status in the transaction, update (can be nil) sets other fields of the shipment
+// (ex: tracking number). Transition to the current status is a no-op without the hooks, so the repeated provider
+// callbacks are safe. Not allowed transitions fail with Conflict AppError
+func (sm *ShipmentStateMachine) Transition(ctx context.Context, shipmentID, to, reason string, update func(shipment *OrderShipment)) (*OrderShipment, error) {
+	ref := sm.fireclient.Collection(OrderShipmentsCollection).Doc(shipmentID)
+
+	var shipment *OrderShipment
+	var transition ShipmentTransition
+	changed := false
+
+	err := sm.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		changed = false
+
+		dsnap, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrOrderNotFound.Errorf("ShipmentStateMachine.Transition", "shipment %v not found", shipmentID)
+		}
+		if err != nil {
+			return err
+		}
+
+		shipment, err = sm.decode(ctx, dsnap)
+		if err != nil {
+			return err
+		}
+		if shipment.Status == to {
+			return nil
+		}
+		if !CanTransitionShipment(shipment.Status, to) {
+			return Errorf("ShipmentStateMachine.Transition", ErrorCodeConflict, "shipment %v can't move from %v to %v", shipmentID, shipment.Status, to)
+		}
+
+		if update != nil {
+			update(shipment)
+		}
+
+		now := time.Now()
+		transition = ShipmentTransition{From: shipment.Status, To: to, Reason: reason, ExecutionID: ExecutionIDFromContext(ctx), At: now}
+		if shipment.Timestamps == nil {
+			shipment.Timestamps = map[string]time.Time{}
+		}
+		shipment.Timestamps[to] = now
+		shipment.History = append(shipment.History, transition)
+		shipment.Status = to
+		shipment.UpdatedAt = now
+		if to == ShipmentStatusFailed && reason != "" {
+			shipment.FailureReason = reason
+		}
+		changed = true
+
+		stored := *shipment
+		if err := sm.encryptor.EncryptStruct(ctx, &stored); err != nil {
+			return E("ShipmentStateMachine.Transition", ErrorCodeInternal, err)
+		}
+
+		return tx.Set(ref, &stored)
+	})
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return nil, appErr
+	}
+	if err != nil {
+		return nil, Errorf("ShipmentStateMachine.Transition", ErrorCodeFirebase, "failed to update shipment %v: %w", shipmentID, err)
+	}
+
+	if changed {
+		sm.runHooks(ctx, shipment, transition)
+	}
+
+	return shipment, nil
+}
+
+// runHooks - calls the transition hooks and logs their errors
+func (sm *ShipmentStateMachine) runHooks(ctx context.Context, shipment *OrderShipment, transition ShipmentTransition) {
+	for _, hook := range sm.hooks {
+		if err := hook(ctx, shipment, transition); err != nil {
+			LoggerFromContext(ctx).Error("shipment transition hook failed", Fields{
+				"shipment_id": shipment.ID,
+				"to":          transition.To,
+				"error":       err.Error(),
+			})
+		}
+	}
+}
+
+// NewShipmentNoticeHook - hook which logs every transition with the Notice severity
+func NewShipmentNoticeHook() ShipmentTransitionHook {
+	return func(ctx context.Context, shipment *OrderShipment, transition ShipmentTransition) error {
+		LoggerFromContext(ctx).Notice("shipment status changed", Fields{
+			"shipment_id": shipment.ID,
+			"order_id":    shipment.OrderID,
+			"from":        transition.From,
+			"to":          transition.To,
+			"reason":      transition.Reason,
+		})
+		return nil
+	}
+}
+
+// NewShipmentPubSubHook - hook which publishes the shipment to the topic with the status attributes,
+// order ID is the ordering key, so the consumers get the transitions of the order in order
+func NewShipmentPubSubHook(topicID string) ShipmentTransitionHook {
+	return func(ctx context.Context, shipment *OrderShipment, transition ShipmentTransition) error {
+		_, err := PublishJSONOrdered(ctx, topicID, shipment.OrderID, shipment, map[string]string{
+			"shipment_id": shipment.ID,
+			"order_id":    shipment.OrderID,
+			"from_status": transition.From,
+			"status":      transition.To,
+		})
+		return err
+	}
+}
+
+// decode - decodes and decrypts the shipment document
+func (sm *ShipmentStateMachine) decode(ctx context.Context, dsnap *firestore.DocumentSnapshot) (*OrderShipment, error) {
+	shipment, err := decodeOrderShipment(dsnap)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.encryptor.DecryptStruct(ctx, shipment); err != nil {
+		return nil, Errorf("ShipmentStateMachine", ErrorCodeInternal, "failed to decrypt shipment %v: %w", dsnap.Ref.ID, err)
+	}
+
+	return shipment, nil
+}
+
+// decodeOrderShipment - converts the document into OrderShipment
+func decodeOrderShipment(dsnap *firestore.DocumentSnapshot) (*OrderShipment, error) {
+	var shipment OrderShipment
+	if err := dsnap.DataTo(&shipment); err != nil {
+		return nil, Errorf("ShipmentStateMachine", ErrorCodeInternal, "failed to decode shipment %v: %w", dsnap.Ref.ID, err)
+	}
+	shipment.ID = dsnap.Ref.ID
+
+	return &shipment, nil
+}
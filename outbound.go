@@ -0,0 +1,263 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	defaultOutboundTimeout    = 30 * time.Second
+	defaultOutboundMaxRetries = 2
+
+	outboundInitialBackoff = 200 * time.Millisecond
+	outboundMaxBackoff     = 5 * time.Second
+)
+
+// OutboundClientOptions - options of the NewOutboundClientWithOptions
+// IDTokenAudience - when set, every request gets Google ID token of the function service account for this audience,
+// used for function-to-function calls (usually URL of the called function)
+// MaxRetries - retries of the requests failed with connection error or 5xx status, 2 if empty, negative to disable.
+// Only GET, HEAD, OPTIONS, PUT and DELETE requests and the requests with the Idempotency-Key header are retried,
+// since the POST accepted before the failure would be processed twice (ex: the email sent again)
+// Timeout - total timeout of the request including retries, 30s if empty
+// Logger - logger of the outbound requests, LoggerFromContext of the request context if empty
+// Transport - base transport, http.DefaultTransport if empty
+// MaxRetryAfter - longest Retry-After of the 429 response which is waited for before the retry, 30s if empty.
+// 429 responses which are not retried are returned as RateLimitedError
+// CircuitBreaker - circuit breaker of the target, shared GetCircuitBreaker of the request host if empty
+// DisableCircuitBreaker - requests are sent even if the target keeps failing
+type OutboundClientOptions struct {
+	IDTokenAudience       string
+	MaxRetries            int
+	Timeout               time.Duration
+	Logger                *Logger
+	Transport             http.RoundTripper
+	MaxRetryAfter         time.Duration
+	CircuitBreaker        *CircuitBreaker
+	DisableCircuitBreaker bool
+}
+
+// NewOutboundClient - returns http client which propagates trace context and execution ID of the request context,
+// retries connection errors and 5xx responses of the idempotent requests, waits for Retry-After of 429 responses, fails fast with ErrCircuitOpen while the target keeps failing
+// and logs every outbound request.
+// Requests should be created with http.NewRequestWithContext to be correlated with the incoming request
+func NewOutboundClient(ctx context.Context) (*http.Client, error) {
+	return NewOutboundClientWithOptions(ctx, OutboundClientOptions{})
+}
+
+// NewOutboundClientWithOptions - NewOutboundClient with the options, ex: Google ID token for calling other functions
+func NewOutboundClientWithOptions(ctx context.Context, options OutboundClientOptions) (*http.Client, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultOutboundTimeout
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = defaultOutboundMaxRetries
+	}
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	}
+	if options.Transport == nil {
+		options.Transport = http.DefaultTransport
+	}
+	if options.MaxRetryAfter <= 0 {
+		options.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if !options.DisableCircuitBreaker {
+		options.Transport = NewCircuitBreakerTransport(options.Transport, options.CircuitBreaker)
+	}
+
+	transport := &outboundTransport{
+		base:          options.Transport,
+		maxRetries:    options.MaxRetries,
+		maxRetryAfter: options.MaxRetryAfter,
+		logger:        options.Logger,
+	}
+
+	if options.IDTokenAudience != "" {
+		tokenSource, err := idtoken.NewTokenSource(ctx, options.IDTokenAudience)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ID token source. Error: %v", err.Error())
+		}
+		transport.tokenSource = oauth2.ReuseTokenSource(nil, tokenSource)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   options.Timeout,
+	}, nil
+}
+
+// outboundTransport - RoundTripper of the NewOutboundClient
+type outboundTransport struct {
+	base          http.RoundTripper
+	tokenSource   oauth2.TokenSource
+	maxRetries    int
+	maxRetryAfter time.Duration
+	logger        *Logger
+}
+
+// RoundTrip - sends the request with propagated headers and retries
+func (ot *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	req = req.Clone(ctx)
+	ot.injectHeaders(ctx, req)
+
+	if ot.tokenSource != nil && req.Header.Get("Authorization") == "" {
+		token, err := ot.tokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ID token. Error: %v", err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+
+	rl := ot.requestLogger(ctx)
+	backoff := outboundInitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := rewindRequestBody(req); err != nil {
+				return nil, err
+			}
+		}
+
+		start := time.Now()
+		resp, err := ot.base.RoundTrip(req)
+
+		fields := Fields{
+			"method":     req.Method,
+			"url":        req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+			"attempt":    attempt + 1,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else {
+			fields["status"] = resp.StatusCode
+		}
+
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+
+			retryAfter, hinted := ParseRetryAfter(resp.Header, time.Now())
+			rateLimitedErr := &RateLimitedError{Target: req.URL.Host}
+			if hinted {
+				rateLimitedErr.RetryAfter = retryAfter
+				fields["retry_after_ms"] = float64(retryAfter) / float64(time.Millisecond)
+			} else {
+				retryAfter = backoff
+			}
+
+			if attempt >= ot.maxRetries || !canRewindRequestBody(req) || !waitRetryAfter(ctx, retryAfter, ot.maxRetryAfter) {
+				rl.Warning("outbound request rate limited", fields)
+				return nil, rateLimitedErr
+			}
+			rl.Warning("outbound request rate limited, retried", fields)
+
+			backoff *= 2
+			if backoff > outboundMaxBackoff {
+				backoff = outboundMaxBackoff
+			}
+			continue
+		}
+
+		retryable := (err != nil && ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen)) || (err == nil && resp.StatusCode >= http.StatusInternalServerError)
+		if !retryable || !isIdempotentRequest(req) || attempt >= ot.maxRetries || !canRewindRequestBody(req) {
+			if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+				rl.Error("outbound request failed", fields)
+			} else {
+				rl.Debug("outbound request", fields)
+			}
+
+			return resp, err
+		}
+
+		rl.Warning("outbound request failed, retrying", fields)
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > outboundMaxBackoff {
+			backoff = outboundMaxBackoff
+		}
+	}
+}
+
+// injectHeaders - adds trace context (with the global propagator or traceparent of the incoming request)
+// execution ID and request ID headers
+func (ot *outboundTransport) injectHeaders(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if req.Header.Get("traceparent") == "" {
+		if traceContext, ok := extractTraceContext(ctx, nil); ok {
+			flags := "00"
+			if traceContext.Sampled {
+				flags = "01"
+			}
+			req.Header.Set("traceparent", "00-"+traceContext.TraceID+"-"+traceContext.SpanID+"-"+flags)
+		}
+	}
+
+	if executionID := ExecutionIDFromContext(ctx); executionID != "" && req.Header.Get(ExecutionIDHeader) == "" {
+		req.Header.Set(ExecutionIDHeader, executionID)
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" && req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+}
+
+// requestLogger - request logger of the outbound requests
+func (ot *outboundTransport) requestLogger(ctx context.Context) *RequestLogger {
+	if ot.logger != nil {
+		return ot.logger.ForRequest(ctx, nil)
+	}
+
+	return LoggerFromContext(ctx)
+}
+
+// isIdempotentRequest - the request can be sent again after the failure which could happen after it was processed:
+// the method is idempotent or the target deduplicates the request by the Idempotency-Key header.
+// 429 responses are retried regardless, the rate limited request wasn't processed
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return req.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// canRewindRequestBody - request without body or with GetBody can be sent again
+func canRewindRequestBody(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewindRequestBody - restores request body before the retry
+func rewindRequestBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return fmt.Errorf("failed to rewind request body. Error: %v", err.Error())
+	}
+	req.Body = body
+
+	return nil
+}
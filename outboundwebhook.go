@@ -0,0 +1,358 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// WebhookIDHeader - header with the delivery ID of the outbound webhook, the same in all attempts,
+	// so the partners can deduplicate the redeliveries
+	WebhookIDHeader = "X-Webhook-Id"
+	// WebhookEventHeader - header with the event type of the outbound webhook
+	WebhookEventHeader = "X-Webhook-Event"
+
+	// WebhookDeliveryStatusPending - delivery is being attempted
+	WebhookDeliveryStatusPending = "pending"
+	// WebhookDeliveryStatusDelivered - partner responded with 2xx
+	WebhookDeliveryStatusDelivered = "delivered"
+	// WebhookDeliveryStatusDeadLetter - all attempts failed or the partner rejected the payload, can be redelivered
+	WebhookDeliveryStatusDeadLetter = "dead_letter"
+
+	defaultWebhookMaxAttempts    = 5
+	defaultWebhookInitialBackoff = time.Second
+	defaultWebhookMaxBackoff     = 30 * time.Second
+	defaultWebhookAttemptTimeout = 10 * time.Second
+	maxWebhookResponseBytes      = 4 << 10
+	// webhookRecordTimeout - timeout of the attempt result write, which doesn't depend on the context of the caller
+	webhookRecordTimeout = 10 * time.Second
+)
+
+var (
+	WebhookDeliveriesCollection string = "webhook_deliveries"
+)
+
+// WebhookDelivery - outbound webhook delivery in the WebhookDeliveriesCollection, document ID is the delivery ID
+// Payload - JSON body of the webhook
+// LastStatusCode - HTTP status of the last attempt, 0 if the request failed
+// LastError - error or the response body of the last failed attempt
+type WebhookDelivery struct {
+	ID             string    `json:"id" firestore:"-"`
+	URL            string    `json:"url" firestore:"url"`
+	Event          string    `json:"event" firestore:"event"`
+	Payload        string    `json:"payload" firestore:"payload"`
+	Status         string    `json:"status" firestore:"status"`
+	Attempts       int       `json:"attempts" firestore:"attempts"`
+	LastStatusCode int       `json:"last_status_code,omitempty" firestore:"last_status_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty" firestore:"last_error,omitempty"`
+	ExecutionID    string    `json:"execution_id,omitempty" firestore:"execution_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" firestore:"updated_at"`
+	DeliveredAt    time.Time `json:"delivered_at,omitempty" firestore:"delivered_at,omitempty"`
+}
+
+// OutboundWebhookOptions - options of the NewOutboundWebhook
+// SecretName - Secret Manager secret with the signing secret shared with the partner
+// MaxAttempts - attempts before the delivery is dead-lettered, 5 if empty
+// InitialBackoff - delay before the second attempt, doubled for the next ones, 1s if empty
+// MaxBackoff - longest delay between the attempts (and the longest Retry-After waited for), 30s if empty
+// AttemptTimeout - timeout of the single attempt, 10s if empty
+type OutboundWebhookOptions struct {
+	SecretName     string
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	AttemptTimeout time.Duration
+}
+
+// OutboundWebhook - delivers JSON callbacks to the partner URLs signed the same way as the incoming webhooks
+// (WebhookSignatureHeader of "<timestamp>.<body>" and WebhookTimestampHeader, see VerifyWebhookSignature).
+// Failed attempts (connection errors, 408, 429 and 5xx) are retried with the exponential backoff,
+// the deliveries which failed all attempts or were rejected with 4xx are recorded as dead letters
+type OutboundWebhook struct {
+	fireclient *firestore.Client
+	client     *http.Client
+	options    OutboundWebhookOptions
+}
+
+// NewOutboundWebhook - returns OutboundWebhook which records the deliveries with the fireclient
+func NewOutboundWebhook(ctx context.Context, fireclient *firestore.Client, options OutboundWebhookOptions) (*OutboundWebhook, error) {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if options.AttemptTimeout <= 0 {
+		options.AttemptTimeout = defaultWebhookAttemptTimeout
+	}
+
+	// attempts are retried by Send, so the outbound client doesn't retry them itself
+	client, err := NewOutboundClientWithOptions(ctx, OutboundClientOptions{MaxRetries: -1, Timeout: options.AttemptTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboundWebhook{fireclient: fireclient, client: client, options: options}, nil
+}
+
+// SignWebhookPayload - returns "sha256=<hex HMAC-SHA256>" signature of "<timestamp>.<body>"
+func SignWebhookPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send - records the delivery and POSTs the payload to the URL until it's delivered or the attempts are exhausted.
+// Returns the delivery and ExternalAPI AppError if it was dead-lettered
+func (ow *OutboundWebhook) Send(ctx context.Context, url, event string, payload interface{}) (*WebhookDelivery, error) {
+	op := "OutboundWebhook.Send"
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeInvalidArgument, "failed to marshal webhook payload: %w", err)
+	}
+
+	now := time.Now()
+	delivery := &WebhookDelivery{
+		URL:         url,
+		Event:       event,
+		Payload:     string(body),
+		Status:      WebhookDeliveryStatusPending,
+		ExecutionID: ExecutionIDFromContext(ctx),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	ref := ow.fireclient.Collection(WebhookDeliveriesCollection).NewDoc()
+	if _, err := ref.Create(ctx, delivery); err != nil {
+		return nil, Errorf(op, ErrorCodeFirebase, "failed to record webhook delivery: %w", err)
+	}
+	delivery.ID = ref.ID
+
+	return delivery, ow.deliver(ctx, op, ref, delivery)
+}
+
+// Status - returns the delivery, NotFound AppError if it doesn't exist
+func (ow *OutboundWebhook) Status(ctx context.Context, deliveryID string) (*WebhookDelivery, error) {
+	dsnap, err := ow.fireclient.Collection(WebhookDeliveriesCollection).Doc(deliveryID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, Errorf("OutboundWebhook.Status", ErrorCodeNotFound, "webhook delivery %v not found", deliveryID)
+	}
+	if err != nil {
+		return nil, Errorf("OutboundWebhook.Status", ErrorCodeFirebase, "failed to get webhook delivery %v: %w", deliveryID, err)
+	}
+
+	return decodeWebhookDelivery(dsnap)
+}
+
+// Redeliver - attempts the dead-lettered delivery again with the same ID and payload, ex: after the partner fixed the endpoint.
+// Conflict AppError if the delivery is not dead-lettered or it's redelivered concurrently
+func (ow *OutboundWebhook) Redeliver(ctx context.Context, deliveryID string) (*WebhookDelivery, error) {
+	op := "OutboundWebhook.Redeliver"
+	ref := ow.fireclient.Collection(WebhookDeliveriesCollection).Doc(deliveryID)
+	dsnap, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, Errorf(op, ErrorCodeNotFound, "webhook delivery %v not found", deliveryID)
+	}
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeFirebase, "failed to get webhook delivery %v: %w", deliveryID, err)
+	}
+
+	delivery, err := decodeWebhookDelivery(dsnap)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.Status != WebhookDeliveryStatusDeadLetter {
+		return nil, Errorf(op, ErrorCodeConflict, "webhook delivery %v is %v", deliveryID, delivery.Status)
+	}
+
+	// the precondition fails if the delivery was changed after the read, so only one of the concurrent calls redelivers
+	delivery.Status = WebhookDeliveryStatusPending
+	delivery.UpdatedAt = time.Now()
+	_, err = ref.Update(ctx, []firestore.Update{{Path: "status", Value: delivery.Status}, {Path: "updated_at", Value: delivery.UpdatedAt}},
+		firestore.LastUpdateTime(dsnap.UpdateTime))
+	if status.Code(err) == codes.FailedPrecondition {
+		return nil, Errorf(op, ErrorCodeConflict, "webhook delivery %v was changed concurrently", deliveryID)
+	}
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeFirebase, "failed to update webhook delivery %v: %w", deliveryID, err)
+	}
+
+	return delivery, ow.deliver(ctx, op, ref, delivery)
+}
+
+// ListDeadLetters - returns up to limit (100 if empty) dead-lettered deliveries, oldest first.
+// Query needs composite index on status and created_at of the WebhookDeliveriesCollection
+func (ow *OutboundWebhook) ListDeadLetters(ctx context.Context, limit int) ([]*WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := ow.fireclient.Collection(WebhookDeliveriesCollection).
+		Where("status", "==", WebhookDeliveryStatusDeadLetter).
+		OrderBy("created_at", firestore.Asc)
+
+	deliveries := []*WebhookDelivery{}
+	err := NewQueryRunner(ctx, query, QueryRunnerOptions{Limit: limit, Name: "webhook_dead_letters"}).ForEach(func(dsnap *firestore.DocumentSnapshot) error {
+		delivery, err := decodeWebhookDelivery(dsnap)
+		if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, Errorf("OutboundWebhook.ListDeadLetters", ErrorCodeFirebase, "failed to list dead-lettered webhooks: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// deliver - runs the attempts of the delivery and records the result of every attempt. The delivery interrupted by
+// the cancelled ctx is dead-lettered, so it can be redelivered instead of staying pending
+func (ow *OutboundWebhook) deliver(ctx context.Context, op string, ref *firestore.DocumentRef, delivery *WebhookDelivery) error {
+	secret, err := webhookSecret(ctx, ow.options.SecretName)
+	if err != nil {
+		delivery.Status = WebhookDeliveryStatusDeadLetter
+		delivery.LastError = err.Error()
+		delivery.UpdatedAt = time.Now()
+		recordWebhookDelivery(ctx, ref, delivery)
+		return Errorf(op, ErrorCodeInternal, "failed to get webhook signing secret: %w", err)
+	}
+
+	backoff := ow.options.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, retryAfter, attemptErr := ow.attempt(ctx, secret, delivery)
+
+		delivery.Attempts++
+		delivery.LastStatusCode = statusCode
+		delivery.UpdatedAt = time.Now()
+		delivery.LastError = ""
+		retryable := false
+		switch {
+		case attemptErr == nil:
+			delivery.Status = WebhookDeliveryStatusDelivered
+			delivery.DeliveredAt = delivery.UpdatedAt
+		default:
+			delivery.LastError = attemptErr.Error()
+			retryable = isRetryableWebhookStatus(statusCode) && attempt < ow.options.MaxAttempts && ctx.Err() == nil
+			if !retryable {
+				delivery.Status = WebhookDeliveryStatusDeadLetter
+			}
+		}
+
+		recordWebhookDelivery(ctx, ref, delivery)
+
+		if delivery.Status == WebhookDeliveryStatusDelivered {
+			LoggerFromContext(ctx).Info("webhook delivered", Fields{"delivery_id": delivery.ID, "event": delivery.Event, "attempts": delivery.Attempts})
+			return nil
+		}
+		if !retryable {
+			LoggerFromContext(ctx).Error("webhook dead-lettered", Fields{
+				"delivery_id": delivery.ID,
+				"event":       delivery.Event,
+				"attempts":    delivery.Attempts,
+				"status":      statusCode,
+				"error":       delivery.LastError,
+			})
+			return Errorf(op, ErrorCodeExternalAPI, "webhook %v was not delivered after %d attempts: %v", delivery.ID, attempt, delivery.LastError)
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > ow.options.MaxBackoff {
+			wait = ow.options.MaxBackoff
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > ow.options.MaxBackoff {
+			backoff = ow.options.MaxBackoff
+		}
+	}
+}
+
+// recordWebhookDelivery - saves the delivery with the detached context, so the result of the attempt interrupted
+// by the cancelled request is still recorded
+func recordWebhookDelivery(ctx context.Context, ref *firestore.DocumentRef, delivery *WebhookDelivery) {
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webhookRecordTimeout)
+	defer cancel()
+
+	if _, err := ref.Set(recordCtx, delivery); err != nil {
+		LoggerFromContext(ctx).Error("failed to record webhook attempt", Fields{"delivery_id": delivery.ID, "error": err.Error()})
+	}
+}
+
+// attempt - sends the signed payload once, returns the status code (0 if the request failed), the Retry-After hint
+// and the error if the partner didn't respond with 2xx
+func (ow *OutboundWebhook) attempt(ctx context.Context, secret []byte, delivery *WebhookDelivery) (int, time.Duration, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create request. Error: %v", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, timestamp, body))
+
+	resp, err := ow.client.Do(req)
+	if err != nil {
+		if retryAfter, ok := RetryAfterFromError(err); ok || errors.Is(err, ErrRateLimited) {
+			return http.StatusTooManyRequests, retryAfter, err
+		}
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp.StatusCode, 0, nil
+	}
+
+	responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBytes))
+	return resp.StatusCode, 0, fmt.Errorf("partner responded with status %d: %v", resp.StatusCode, string(responseBody))
+}
+
+// isRetryableWebhookStatus - connection errors, timeouts, rate limits and server errors are retried
+func isRetryableWebhookStatus(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// decodeWebhookDelivery - converts the document into WebhookDelivery
+func decodeWebhookDelivery(dsnap *firestore.DocumentSnapshot) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := dsnap.DataTo(&delivery); err != nil {
+		return nil, Errorf("OutboundWebhook", ErrorCodeInternal, "failed to decode webhook delivery %v: %w", dsnap.Ref.ID, err)
+	}
+	delivery.ID = dsnap.Ref.ID
+
+	return &delivery, nil
+}
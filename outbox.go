@@ -0,0 +1,213 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// OutboxEventIDAttribute - message attribute with the outbox event ID, consumers can use it for the deduplication
+	// since the event can be published more than once if marking it sent fails
+	OutboxEventIDAttribute = "outbox_event_id"
+
+	// OutboxStatusPending - event is waiting for the dispatcher
+	OutboxStatusPending = "pending"
+	// OutboxStatusSent - event was published
+	OutboxStatusSent = "sent"
+
+	defaultOutboxDispatchLimit = 100
+	outboxDispatchLockTTL      = time.Minute
+)
+
+var (
+	OutboxCollection string = "outbox"
+)
+
+// OutboxMessage - message which is published after the transaction of WriteWithOutbox commits
+// Topic - Pub/Sub topic ID
+// OrderingKey - optional ordering key, events of the key are dispatched in the creation order
+// Payload - message payload, marshalled to JSON
+type OutboxMessage struct {
+	Topic       string
+	OrderingKey string
+	Payload     interface{}
+	Attributes  map[string]string
+}
+
+// OutboxEvent - stored outbox event in the OutboxCollection
+type OutboxEvent struct {
+	ID          string            `json:"id" firestore:"-"`
+	Topic       string            `json:"topic" firestore:"topic"`
+	OrderingKey string            `json:"ordering_key" firestore:"ordering_key"`
+	Data        []byte            `json:"data" firestore:"data"`
+	Attributes  map[string]string `json:"attributes" firestore:"attributes"`
+	Status      string            `json:"status" firestore:"status"`
+	ExecutionID string            `json:"execution_id" firestore:"execution_id"`
+	CreatedAt   time.Time         `json:"created_at" firestore:"created_at"`
+	SentAt      time.Time         `json:"sent_at,omitempty" firestore:"sent_at,omitempty"`
+	MessageID   string            `json:"message_id,omitempty" firestore:"message_id,omitempty"`
+	Attempts    int               `json:"attempts" firestore:"attempts"`
+	LastError   string            `json:"last_error,omitempty" firestore:"last_error,omitempty"`
+}
+
+// WriteWithOutbox - runs the write function and appends the outbox events of the messages in the same transaction,
+// so the events exist only if the write is committed. Events are published later by DispatchOutbox.
+// ex: WriteWithOutbox(ctx, fireclient, func(ctx context.Context, tx *firestore.Transaction) error { return tx.Set(ref, user) },
+// OutboxMessage{Topic: "user-updated", Payload: user})
+func WriteWithOutbox(ctx context.Context, fireclient *firestore.Client, write func(ctx context.Context, tx *firestore.Transaction) error, messages ...OutboxMessage) error {
+	events := make([]OutboxEvent, 0, len(messages))
+	for _, message := range messages {
+		data, err := json.Marshal(message.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal outbox payload. Error: %v", err.Error())
+		}
+
+		events = append(events, OutboxEvent{
+			Topic:       message.Topic,
+			OrderingKey: message.OrderingKey,
+			Data:        data,
+			Attributes:  message.Attributes,
+			Status:      OutboxStatusPending,
+			ExecutionID: ExecutionIDFromContext(ctx),
+		})
+	}
+
+	collection := fireclient.Collection(OutboxCollection)
+	err := fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := write(ctx, tx); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, event := range events {
+			event.CreatedAt = now
+			if err := tx.Create(collection.NewDoc(), event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write with outbox. Error: %v", err.Error())
+	}
+
+	return nil
+}
+
+// DispatchOutbox - publishes up to limit pending outbox events (100 if limit is 0) in the creation order
+// and marks them sent, returns the number of published events. Failed event is kept pending with the error
+// and the later events of its ordering key are not published in this run.
+// Concurrent dispatchers are serialized by the lock, the run is skipped if another dispatcher holds it.
+// Query needs composite index on status and created_at of the OutboxCollection
+func DispatchOutbox(ctx context.Context, fireclient *firestore.Client, limit int) (int, error) {
+	if limit <= 0 {
+		limit = defaultOutboxDispatchLimit
+	}
+
+	lock, err := AcquireLock(ctx, fireclient, "outbox_dispatch", outboxDispatchLockTTL)
+	if errors.Is(err, ErrLockHeld) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release(ctx)
+
+	query := fireclient.Collection(OutboxCollection).
+		Where("status", "==", OutboxStatusPending).
+		OrderBy("created_at", firestore.Asc)
+	runner := NewQueryRunner(ctx, query, QueryRunnerOptions{Limit: limit, Name: "pending_outbox_events"})
+	defer runner.Stop()
+
+	sent := 0
+	failedKeys := map[string]bool{}
+	var errs []error
+	for {
+		dsnap, err := runner.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return sent, fmt.Errorf("failed to read outbox. Error: %v", err.Error())
+		}
+
+		var event OutboxEvent
+		if err := dsnap.DataTo(&event); err != nil {
+			errs = append(errs, fmt.Errorf("failed to read outbox event '%v'. Error: %v", dsnap.Ref.ID, err.Error()))
+			continue
+		}
+		event.ID = dsnap.Ref.ID
+
+		if event.OrderingKey != "" && failedKeys[event.OrderingKey] {
+			continue
+		}
+
+		if err := dispatchOutboxEvent(ctx, dsnap.Ref, &event); err != nil {
+			if event.OrderingKey != "" {
+				failedKeys[event.OrderingKey] = true
+			}
+			errs = append(errs, err)
+			continue
+		}
+		sent++
+	}
+
+	return sent, errors.Join(errs...)
+}
+
+// OutboxDispatchJob - DispatchOutbox as the JobFunc for the ScheduledJob
+func OutboxDispatchJob(fireclient *firestore.Client, limit int) JobFunc {
+	return func(ctx context.Context) error {
+		_, err := DispatchOutbox(ctx, fireclient, limit)
+		return err
+	}
+}
+
+// dispatchOutboxEvent - publishes the event and marks it sent, or stores the publish error
+func dispatchOutboxEvent(ctx context.Context, ref *firestore.DocumentRef, event *OutboxEvent) error {
+	attributes := make(map[string]string, len(event.Attributes)+2)
+	for key, value := range event.Attributes {
+		attributes[key] = value
+	}
+	attributes[OutboxEventIDAttribute] = event.ID
+	if event.ExecutionID != "" {
+		// correlate the message with the execution which created the event rather than the dispatcher
+		attributes[ExecutionIDAttribute] = event.ExecutionID
+	}
+
+	messageID, err := Publish(ctx, event.Topic, &pubsub.Message{
+		Data:        event.Data,
+		Attributes:  attributes,
+		OrderingKey: event.OrderingKey,
+	})
+	if err != nil {
+		_, updateErr := ref.Update(ctx, []firestore.Update{
+			{Path: "attempts", Value: firestore.Increment(1)},
+			{Path: "last_error", Value: err.Error()},
+		})
+		if updateErr != nil {
+			LoggerFromContext(ctx).Error("failed to store outbox error", Fields{"event_id": event.ID, "error": updateErr.Error()})
+		}
+		return fmt.Errorf("failed to dispatch outbox event '%v'. Error: %v", event.ID, err.Error())
+	}
+
+	_, err = ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: OutboxStatusSent},
+		{Path: "sent_at", Value: time.Now()},
+		{Path: "message_id", Value: messageID},
+		{Path: "attempts", Value: firestore.Increment(1)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox event '%v' sent. Error: %v", event.ID, err.Error())
+	}
+
+	return nil
+}
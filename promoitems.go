@@ -0,0 +1,266 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	PromoRedemptionsCollection string = "promo_redemptions"
+)
+
+// PromoItem - document of the PromoItemsCollection
+// Stock - items left to redeem, decremented by Redeem
+// StartsAt, ExpiresAt - redemption period, no limit if zero
+// MaxPerUser - max items redeemed by the single user, no limit if 0
+type PromoItem struct {
+	ID          string    `firestore:"-" json:"id"`
+	Title       string    `firestore:"title" json:"title" validate:"required,max=200"`
+	Description string    `firestore:"description" json:"description"`
+	SKU         string    `firestore:"sku,omitempty" json:"sku,omitempty"`
+	Stock       int       `firestore:"stock" json:"stock" validate:"min=0"`
+	MaxPerUser  int       `firestore:"max_per_user" json:"max_per_user" validate:"min=0"`
+	Active      bool      `firestore:"active" json:"active"`
+	StartsAt    time.Time `firestore:"starts_at" json:"starts_at"`
+	ExpiresAt   time.Time `firestore:"expires_at" json:"expires_at"`
+	CreatedAt   time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// Expired - redemption period of the promo is over
+func (p *PromoItem) Expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+// AvailableAt - promo is active, in the redemption period and in stock
+func (p *PromoItem) AvailableAt(now time.Time) bool {
+	return p.Active && !p.Expired(now) && !now.Before(p.StartsAt) && p.Stock > 0
+}
+
+// PromoRedemption - document of the PromoRedemptionsCollection, created by Redeem
+type PromoRedemption struct {
+	ID          string    `firestore:"-" json:"id"`
+	PromoID     string    `firestore:"promo_id" json:"promo_id"`
+	UID         string    `firestore:"uid" json:"uid"`
+	Quantity    int       `firestore:"quantity" json:"quantity"`
+	ExecutionID string    `firestore:"execution_id,omitempty" json:"-"`
+	RedeemedAt  time.Time `firestore:"redeemed_at" json:"redeemed_at"`
+}
+
+// PromoRepository - typed accessors of the PromoItemsCollection and the redemptions
+type PromoRepository struct {
+	fireclient *firestore.Client
+}
+
+func NewPromoRepository(fireclient *firestore.Client) *PromoRepository {
+	return &PromoRepository{fireclient: fireclient}
+}
+
+// Get - returns the promo, ErrPromoNotFound if the document doesn't exist
+func (pr *PromoRepository) Get(ctx context.Context, promoID string) (*PromoItem, error) {
+	dsnap, err := pr.fireclient.Collection(PromoItemsCollection).Doc(promoID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrPromoNotFound.Errorf("PromoRepository.Get", "promo %v not found", promoID)
+	}
+	if err != nil {
+		return nil, Errorf("PromoRepository.Get", ErrorCodeFirebase, "failed to get promo %v: %w", promoID, err)
+	}
+
+	return decodePromoItem(dsnap)
+}
+
+// Create - adds the promo and sets its ID
+func (pr *PromoRepository) Create(ctx context.Context, promo *PromoItem) error {
+	op := "PromoRepository.Create"
+	if err := ValidateStruct(promo); err != nil {
+		return E(op, ErrorCodeValidation, err)
+	}
+	if !promo.ExpiresAt.IsZero() && !promo.ExpiresAt.After(promo.StartsAt) {
+		return Errorf(op, ErrorCodeInvalidArgument, "promo expires before it starts").WithMessage("expires_at must be after starts_at")
+	}
+
+	now := time.Now().UTC()
+	promo.CreatedAt, promo.UpdatedAt = now, now
+
+	ref := pr.fireclient.Collection(PromoItemsCollection).NewDoc()
+	if promo.ID != "" {
+		ref = pr.fireclient.Collection(PromoItemsCollection).Doc(promo.ID)
+	}
+
+	if _, err := ref.Create(ctx, promo); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return Errorf(op, ErrorCodeConflict, "promo %v already exists", ref.ID).WithMessage("promo already exists")
+		}
+		return Errorf(op, ErrorCodeFirebase, "failed to create promo: %w", err)
+	}
+	promo.ID = ref.ID
+
+	return nil
+}
+
+// ListActivePromos - returns active promos which are in the redemption period and in stock, ordered by expiry.
+// Requires the composite index of the active and expires_at fields
+func (pr *PromoRepository) ListActivePromos(ctx context.Context) ([]*PromoItem, error) {
+	now := time.Now().UTC()
+
+	// promos without expiry have zero expires_at, so they can't be filtered by the range and are queried separately
+	queries := []firestore.Query{
+		pr.fireclient.Collection(PromoItemsCollection).Where("active", "==", true).Where("expires_at", ">", now).OrderBy("expires_at", firestore.Asc),
+		pr.fireclient.Collection(PromoItemsCollection).Where("active", "==", true).Where("expires_at", "==", time.Time{}),
+	}
+
+	promos := []*PromoItem{}
+	for _, query := range queries {
+		dsnaps, err := NewQueryRunner(ctx, query, QueryRunnerOptions{Name: "active_promos"}).GetAll()
+		if err != nil {
+			return nil, Errorf("PromoRepository.ListActivePromos", ErrorCodeFirebase, "failed to list promos: %w", err)
+		}
+
+		for _, dsnap := range dsnaps {
+			promo, err := decodePromoItem(dsnap)
+			if err != nil {
+				return nil, err
+			}
+			if promo.AvailableAt(now) {
+				promos = append(promos, promo)
+			}
+		}
+	}
+
+	return promos, nil
+}
+
+// Redeem - atomically decrements the promo stock and records the redemption of the user.
+// Returns ErrPromoNotFound for missing or inactive promos, ErrPromoOutOfStock if there are not enough items
+// and ErrPromoUnavailable if the promo is expired, not started or the user reached MaxPerUser
+func (pr *PromoRepository) Redeem(ctx context.Context, promoID, uid string, quantity int) (*PromoRedemption, error) {
+	op := "PromoRepository.Redeem"
+	if uid == "" || quantity <= 0 {
+		return nil, Errorf(op, ErrorCodeInvalidArgument, "redemption has no user or quantity")
+	}
+
+	promoRef := pr.fireclient.Collection(PromoItemsCollection).Doc(promoID)
+	redemptionRef := pr.fireclient.Collection(PromoRedemptionsCollection).NewDoc()
+	redemption := &PromoRedemption{
+		ID:          redemptionRef.ID,
+		PromoID:     promoID,
+		UID:         uid,
+		Quantity:    quantity,
+		ExecutionID: ExecutionIDFromContext(ctx),
+	}
+
+	err := pr.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(promoRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrPromoNotFound.Errorf(op, "promo %v not found", promoID)
+		}
+		if err != nil {
+			return err
+		}
+
+		promo, err := decodePromoItem(dsnap)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		switch {
+		case !promo.Active:
+			return ErrPromoNotFound.Errorf(op, "promo %v is not active", promoID)
+		case promo.Expired(now):
+			return ErrPromoUnavailable.Errorf(op, "promo %v expired at %v", promoID, promo.ExpiresAt.Format(time.RFC3339)).WithMessage("promo has expired")
+		case now.Before(promo.StartsAt):
+			return ErrPromoUnavailable.Errorf(op, "promo %v starts at %v", promoID, promo.StartsAt.Format(time.RFC3339)).WithMessage("promo has not started")
+		case promo.Stock < quantity:
+			return ErrPromoOutOfStock.Errorf(op, "promo %v has %v items left, %v requested", promoID, promo.Stock, quantity)
+		}
+
+		if promo.MaxPerUser > 0 {
+			redeemed, err := pr.redeemedQuantity(tx, promoID, uid)
+			if err != nil {
+				return err
+			}
+			if redeemed+quantity > promo.MaxPerUser {
+				return ErrPromoUnavailable.Errorf(op, "user %v redeemed %v of %v items of promo %v", uid, redeemed, promo.MaxPerUser, promoID).
+					WithMessage("promo redemption limit reached")
+			}
+		}
+
+		redemption.RedeemedAt = now
+		if err := tx.Update(promoRef, []firestore.Update{
+			{Path: "stock", Value: firestore.Increment(-quantity)},
+			{Path: "updated_at", Value: now},
+		}); err != nil {
+			return err
+		}
+
+		return tx.Create(redemptionRef, redemption)
+	})
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return nil, appErr
+	}
+	if err != nil {
+		return nil, Errorf(op, ErrorCodeFirebase, "failed to redeem promo %v: %w", promoID, err)
+	}
+
+	LoggerFromContext(ctx).Info("promo redeemed", Fields{"promo_id": promoID, "uid": uid, "quantity": quantity})
+
+	return redemption, nil
+}
+
+// ListRedemptions - returns redemptions of the user, newest first
+func (pr *PromoRepository) ListRedemptions(ctx context.Context, uid string) ([]*PromoRedemption, error) {
+	query := pr.fireclient.Collection(PromoRedemptionsCollection).Where("uid", "==", uid).OrderBy("redeemed_at", firestore.Desc)
+	dsnaps, err := NewQueryRunner(ctx, query, QueryRunnerOptions{Name: "promo_redemptions_by_uid"}).GetAll()
+	if err != nil {
+		return nil, Errorf("PromoRepository.ListRedemptions", ErrorCodeFirebase, "failed to list redemptions: %w", err)
+	}
+
+	redemptions := make([]*PromoRedemption, 0, len(dsnaps))
+	for _, dsnap := range dsnaps {
+		redemption := &PromoRedemption{}
+		if err := dsnap.DataTo(redemption); err != nil {
+			return nil, Errorf("PromoRepository.ListRedemptions", ErrorCodeInternal, "failed to decode redemption %v: %w", dsnap.Ref.ID, err)
+		}
+		redemption.ID = dsnap.Ref.ID
+		redemptions = append(redemptions, redemption)
+	}
+
+	return redemptions, nil
+}
+
+// redeemedQuantity - items of the promo redeemed by the user, read in the transaction
+func (pr *PromoRepository) redeemedQuantity(tx *firestore.Transaction, promoID, uid string) (int, error) {
+	query := pr.fireclient.Collection(PromoRedemptionsCollection).Where("promo_id", "==", promoID).Where("uid", "==", uid)
+
+	dsnaps, err := tx.Documents(query).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, dsnap := range dsnaps {
+		if quantity, ok := dsnap.Data()["quantity"].(int64); ok {
+			total += int(quantity)
+		}
+	}
+
+	return total, nil
+}
+
+// decodePromoItem - decodes the promo document
+func decodePromoItem(dsnap *firestore.DocumentSnapshot) (*PromoItem, error) {
+	promo := &PromoItem{}
+	if err := dsnap.DataTo(promo); err != nil {
+		return nil, Errorf("PromoRepository", ErrorCodeInternal, "failed to decode promo %v: %w", dsnap.Ref.ID, err)
+	}
+	promo.ID = dsnap.Ref.ID
+
+	return promo, nil
+}
@@ -0,0 +1,200 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ExecutionIDAttribute - message attribute with the execution ID of the publisher, used for the log correlation
+	ExecutionIDAttribute = "execution_id"
+
+	pubSubPublishRetries = 3
+	pubSubInitialBackoff = 200 * time.Millisecond
+	pubSubMaxBackoff     = 5 * time.Second
+	pubSubDelayThreshold = 5 * time.Millisecond
+	pubSubPublishTimeout = 15 * time.Second
+	pubSubCountThreshold = 100
+)
+
+var (
+	// cachedPubSubClient - process-level Pub/Sub client, use GetPubSubClient to get it
+	cachedPubSubClient *pubsub.Client
+	cachedPubSubTopics = map[string]*pubsub.Topic{}
+	cachedPubSubMu     sync.Mutex
+)
+
+// GetPubSubClient - returns process-level cached Pub/Sub client of the GCLOUD_PROJECT project.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetPubSubClient(ctx context.Context) (*pubsub.Client, error) {
+	cachedPubSubMu.Lock()
+	defer cachedPubSubMu.Unlock()
+
+	return getPubSubClientLocked()
+}
+
+// getPubSubClientLocked - GetPubSubClient for the callers which hold cachedPubSubMu
+func getPubSubClientLocked() (*pubsub.Client, error) {
+	if cachedPubSubClient != nil {
+		return cachedPubSubClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := pubsub.NewClient(context.Background(), packageConfig().ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client. Error: %v", err.Error())
+	}
+	cachedPubSubClient = client
+
+	return cachedPubSubClient, nil
+}
+
+// getPubSubTopic - returns cached topic with the publish settings tuned for short-lived functions:
+// small batching delay since the function usually waits for the publish result, and message ordering enabled
+func getPubSubTopic(topicID string) (*pubsub.Topic, error) {
+	cachedPubSubMu.Lock()
+	defer cachedPubSubMu.Unlock()
+
+	if topic, ok := cachedPubSubTopics[topicID]; ok {
+		return topic, nil
+	}
+
+	client, err := getPubSubClientLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	topic := client.Topic(topicID)
+	if project, id, ok := parsePubSubTopicName(topicID); ok {
+		topic = client.TopicInProject(id, project)
+	}
+	topic.EnableMessageOrdering = true
+	topic.PublishSettings.DelayThreshold = pubSubDelayThreshold
+	topic.PublishSettings.CountThreshold = pubSubCountThreshold
+	topic.PublishSettings.Timeout = pubSubPublishTimeout
+	cachedPubSubTopics[topicID] = topic
+
+	return topic, nil
+}
+
+// parsePubSubTopicName - project and topic ID of the full topic name: projects/<project>/topics/<topic>
+func parsePubSubTopicName(name string) (string, string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || parts[1] == "" || parts[3] == "" {
+		return "", "", false
+	}
+
+	return parts[1], parts[3], true
+}
+
+// PublishJSON - publishes payload as JSON message with the attributes to the topic (topic ID or full topic name, see Publish),
+// waits for the result and returns the message ID. Transient errors are retried with backoff
+func PublishJSON(ctx context.Context, topicID string, payload interface{}, attributes map[string]string) (string, error) {
+	return PublishJSONOrdered(ctx, topicID, "", payload, attributes)
+}
+
+// PublishJSONOrdered - PublishJSON with the ordering key, messages with the same key are delivered in the publish order
+// to the subscriptions with message ordering enabled
+func PublishJSONOrdered(ctx context.Context, topicID, orderingKey string, payload interface{}, attributes map[string]string) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pubsub message. Error: %v", err.Error())
+	}
+
+	return Publish(ctx, topicID, &pubsub.Message{
+		Data:        data,
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
+	})
+}
+
+// Publish - publishes the message to the topic with retries of the transient errors, returns the message ID.
+// topicID is the topic of the GCLOUD_PROJECT project or the full topic name (projects/<project>/topics/<topic>).
+// Execution ID of the context is added to the ExecutionIDAttribute
+func Publish(ctx context.Context, topicID string, message *pubsub.Message) (string, error) {
+	topic, err := getPubSubTopic(topicID)
+	if err != nil {
+		return "", err
+	}
+
+	if executionID := ExecutionIDFromContext(ctx); executionID != "" {
+		attributes := make(map[string]string, len(message.Attributes)+1)
+		for key, value := range message.Attributes {
+			attributes[key] = value
+		}
+		if _, ok := attributes[ExecutionIDAttribute]; !ok {
+			attributes[ExecutionIDAttribute] = executionID
+		}
+		message.Attributes = attributes
+	}
+
+	backoff := pubSubInitialBackoff
+	for attempt := 0; ; attempt++ {
+		messageID, err := topic.Publish(ctx, message).Get(ctx)
+		if err == nil {
+			return messageID, nil
+		}
+
+		if message.OrderingKey != "" {
+			// publishing of the key is paused after the error until it's resumed
+			topic.ResumePublish(message.OrderingKey)
+		}
+
+		if attempt >= pubSubPublishRetries || !IsRetryablePubSubError(err) {
+			return "", fmt.Errorf("failed to publish message to '%v'. Error: %v", topicID, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("failed to publish message to '%v'. Error: %v", topicID, ctx.Err().Error())
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > pubSubMaxBackoff {
+			backoff = pubSubMaxBackoff
+		}
+	}
+}
+
+// IsRetryablePubSubError - checks if the publish error is transient (unavailable, deadline exceeded, quota, aborted, internal)
+func IsRetryablePubSubError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClosePubSubClient - flushes pending messages of the cached topics and closes the cached client,
+// ex: RegisterShutdown("pubsub", ClosePubSubClient)
+func ClosePubSubClient(ctx context.Context) error {
+	cachedPubSubMu.Lock()
+	defer cachedPubSubMu.Unlock()
+
+	for topicID, topic := range cachedPubSubTopics {
+		topic.Stop()
+		delete(cachedPubSubTopics, topicID)
+	}
+
+	if cachedPubSubClient == nil {
+		return nil
+	}
+
+	err := cachedPubSubClient.Close()
+	cachedPubSubClient = nil
+	if err != nil {
+		return fmt.Errorf("failed to close pubsub client. Error: %v", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxPubSubPushBytes - size limit of the push request (Pub/Sub message limit is 10 MB, base64 adds a third)
+const maxPubSubPushBytes = 14 << 20
+
+// PubSubMessage - message of the Pub/Sub push request, Data is decoded from base64
+type PubSubMessage struct {
+	ID          string            `json:"messageId"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	PublishTime time.Time         `json:"publishTime"`
+	OrderingKey string            `json:"orderingKey"`
+}
+
+// PubSubPush - Pub/Sub push request envelope
+// DeliveryAttempt - set only for the subscriptions with dead letter policy
+type PubSubPush struct {
+	Message         PubSubMessage `json:"message"`
+	Subscription    string        `json:"subscription"`
+	DeliveryAttempt int           `json:"deliveryAttempt"`
+}
+
+// DecodeJSON - unmarshals JSON message data into dst
+func (m *PubSubMessage) DecodeJSON(dst interface{}) error {
+	if err := json.Unmarshal(m.Data, dst); err != nil {
+		return Errorf("PubSubMessage.DecodeJSON", ErrorCodeInvalidArgument, "failed to unmarshal message %v data: %w", m.ID, err)
+	}
+
+	return nil
+}
+
+// ExecutionID - returns execution ID of the publisher (ExecutionIDAttribute set by Publish)
+func (m *PubSubMessage) ExecutionID() string {
+	return m.Attributes[ExecutionIDAttribute]
+}
+
+// ParsePubSubPush - verifies Google-signed OIDC token of the push subscription (audience and optionally
+// the push service account emails, same as VerifyGoogleIDToken) and decodes the push envelope.
+// Returns AppError with 401/403 status for invalid tokens and 400 for malformed envelopes.
+// The handler should return 2xx to acknowledge the message, other statuses make Pub/Sub redeliver it
+func ParsePubSubPush(r *http.Request, audience string, allowedEmails ...string) (*PubSubPush, error) {
+	_, statusCode := verifyGoogleIDTokenRequest(r.Context(), r, audience, allowedEmails)
+	if statusCode != http.StatusOK {
+		appErr := Errorf("ParsePubSubPush", ErrorCodeUnauthenticated, "push token verification failed with status %v", statusCode)
+		appErr.HTTPStatus = statusCode
+		appErr.Msg = http.StatusText(statusCode)
+		return nil, appErr
+	}
+
+	return DecodePubSubPush(r)
+}
+
+// DecodePubSubPush - decodes the push envelope without the token verification,
+// for the subscriptions which are verified by the platform (ex: Cloud Run with IAM invoker check)
+func DecodePubSubPush(r *http.Request) (*PubSubPush, error) {
+	var push PubSubPush
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxPubSubPushBytes))
+	if err := decoder.Decode(&push); err != nil {
+		return nil, Errorf("DecodePubSubPush", ErrorCodeInvalidArgument, "failed to decode push envelope: %w", err).
+			WithMessage("malformed Pub/Sub push envelope")
+	}
+
+	if push.Message.ID == "" {
+		return nil, Errorf("DecodePubSubPush", ErrorCodeInvalidArgument, "push envelope has no message ID").
+			WithMessage("malformed Pub/Sub push envelope")
+	}
+
+	return &push, nil
+}
+
+// String - short description of the push for the logs
+func (p *PubSubPush) String() string {
+	return fmt.Sprintf("message %v of %v (attempt %v)", p.Message.ID, p.Subscription, p.DeliveryAttempt)
+}
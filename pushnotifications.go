@@ -0,0 +1,358 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+)
+
+const (
+	// PushPriorityNormal - delivered when the device is awake, default
+	PushPriorityNormal = "normal"
+	// PushPriorityHigh - wakes the device, for the user visible notifications only
+	PushPriorityHigh = "high"
+
+	maxMulticastTokens      = 500
+	defaultPushConcurrency  = 20
+	pushTokenPruneBatchSize = 30
+)
+
+var (
+	// UserDeviceTokensField - array field of the UsersCollection documents with the FCM registration tokens of the user devices
+	UserDeviceTokensField string = "fcm_tokens"
+
+	// cachedMessagingClient - process-level Firebase Cloud Messaging client, use GetFirebaseMessagingClient to get it
+	cachedMessagingClient   *messaging.Client
+	cachedMessagingClientMu sync.Mutex
+)
+
+// PushNotification - notification displayed by the device
+type PushNotification struct {
+	Title    string `json:"title" validate:"required"`
+	Body     string `json:"body"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// PushMessage - push message of the SendToToken, SendToTopic and SendMulticast
+// Notification - displayed notification, data-only message if empty
+// Data - typed payload handled by the app: map[string]string or a struct/map encoded by json tags,
+// non-string values are sent as JSON since FCM data values are strings
+// Priority - PushPriorityNormal or PushPriorityHigh, normal if empty
+// TTL - time FCM keeps the message for the offline device, FCM default (4 weeks) if empty
+// CollapseKey - newer message with the same key replaces the undelivered one, ex: order ID of the shipping updates
+type PushMessage struct {
+	Notification *PushNotification
+	Data         interface{}
+	Priority     string
+	TTL          time.Duration
+	CollapseKey  string
+}
+
+// PushSendResult - result of the single token of the SendMulticast
+// Invalid - token is not registered anymore and was removed from the users
+type PushSendResult struct {
+	Token     string `json:"token"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     error  `json:"-"`
+	Invalid   bool   `json:"invalid,omitempty"`
+}
+
+// PushBatchResult - result of the SendMulticast, Results are in the order of the tokens
+type PushBatchResult struct {
+	SuccessCount int              `json:"success_count"`
+	FailureCount int              `json:"failure_count"`
+	Results      []PushSendResult `json:"results"`
+}
+
+// RetryableTokens - failed tokens which are still valid (FCM unavailable, quota), to be sent again later
+func (r *PushBatchResult) RetryableTokens() []string {
+	tokens := []string{}
+	for _, result := range r.Results {
+		if result.Error != nil && !result.Invalid {
+			tokens = append(tokens, result.Token)
+		}
+	}
+
+	return tokens
+}
+
+// GetFirebaseMessagingClient - returns process-level Firebase Cloud Messaging client
+func GetFirebaseMessagingClient(ctx context.Context) (*messaging.Client, error) {
+	cachedMessagingClientMu.Lock()
+	defer cachedMessagingClientMu.Unlock()
+
+	if cachedMessagingClient != nil {
+		return cachedMessagingClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	fireapp, err := firebase.NewApp(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fireapp. Error: %v", err.Error())
+	}
+
+	client, err := fireapp.Messaging(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messaging client. Error: %v", err.Error())
+	}
+	cachedMessagingClient = client
+
+	return cachedMessagingClient, nil
+}
+
+// PushSender - sends FCM push messages and removes the unregistered tokens from the users
+type PushSender struct {
+	client     *messaging.Client
+	fireclient *firestore.Client
+}
+
+// NewPushSender - returns PushSender, fireclient is used for the token pruning
+func NewPushSender(ctx context.Context, fireclient *firestore.Client) (*PushSender, error) {
+	client, err := GetFirebaseMessagingClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushSender{client: client, fireclient: fireclient}, nil
+}
+
+// SendToToken - sends the message to the single device and returns the FCM message ID.
+// Unregistered token is removed from the users and NotFound AppError is returned
+func (ps *PushSender) SendToToken(ctx context.Context, token string, message PushMessage) (string, error) {
+	op := "PushSender.SendToToken"
+	fcmMessage, err := newFCMMessage(message)
+	if err != nil {
+		return "", E(op, ErrorCodeInvalidArgument, err)
+	}
+	fcmMessage.Token = token
+
+	id, err := ps.client.Send(ctx, fcmMessage)
+	if err != nil {
+		if messaging.IsRegistrationTokenNotRegistered(err) {
+			if pruneErr := ps.PruneTokens(ctx, []string{token}); pruneErr != nil {
+				LoggerFromContext(ctx).Error("failed to prune device token", Fields{"error": pruneErr.Error()})
+			}
+			return "", Errorf(op, ErrorCodeNotFound, "device token is not registered: %w", err)
+		}
+		return "", Errorf(op, pushErrorCode(err), "failed to send push message: %w", err)
+	}
+
+	return id, nil
+}
+
+// SendToTopic - sends the message to the devices subscribed to the topic and returns the FCM message ID
+func (ps *PushSender) SendToTopic(ctx context.Context, topic string, message PushMessage) (string, error) {
+	op := "PushSender.SendToTopic"
+	fcmMessage, err := newFCMMessage(message)
+	if err != nil {
+		return "", E(op, ErrorCodeInvalidArgument, err)
+	}
+	fcmMessage.Topic = topic
+
+	id, err := ps.client.Send(ctx, fcmMessage)
+	if err != nil {
+		return "", Errorf(op, pushErrorCode(err), "failed to send push message to topic %v: %w", topic, err)
+	}
+
+	return id, nil
+}
+
+// SendMulticast - sends the message to every token in batches of 500, failures of the single tokens don't stop the send.
+// Messages are sent one by one with the bounded concurrency, since the FCM batch endpoint was retired.
+// Unregistered tokens are removed from the users. Error is returned only if the message is invalid
+func (ps *PushSender) SendMulticast(ctx context.Context, tokens []string, message PushMessage) (*PushBatchResult, error) {
+	result := &PushBatchResult{Results: make([]PushSendResult, len(tokens))}
+	if len(tokens) == 0 {
+		return result, nil
+	}
+
+	if _, err := newFCMMessage(message); err != nil {
+		return nil, E("PushSender.SendMulticast", ErrorCodeInvalidArgument, err)
+	}
+
+	for start := 0; start < len(tokens); start += maxMulticastTokens {
+		end := start + maxMulticastTokens
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		ps.sendBatch(ctx, tokens[start:end], message, result.Results[start:end])
+	}
+
+	invalid := []string{}
+	for _, sent := range result.Results {
+		switch {
+		case sent.Error == nil:
+			result.SuccessCount++
+		case sent.Invalid:
+			result.FailureCount++
+			invalid = append(invalid, sent.Token)
+		default:
+			result.FailureCount++
+		}
+	}
+
+	if len(invalid) > 0 {
+		if err := ps.PruneTokens(ctx, invalid); err != nil {
+			LoggerFromContext(ctx).Error("failed to prune device tokens", Fields{"error": err.Error()})
+		}
+	}
+	LoggerFromContext(ctx).Info("push messages sent", Fields{"total": len(tokens), "succeeded": result.SuccessCount, "failed": result.FailureCount, "invalid": len(invalid)})
+
+	return result, nil
+}
+
+// PruneTokens - removes the tokens from the UserDeviceTokensField of all users having them
+func (ps *PushSender) PruneTokens(ctx context.Context, tokens []string) error {
+	for start := 0; start < len(tokens); start += pushTokenPruneBatchSize {
+		end := start + pushTokenPruneBatchSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		batch := tokens[start:end]
+
+		values := make([]interface{}, len(batch))
+		for i, token := range batch {
+			values[i] = token
+		}
+
+		query := ps.fireclient.Collection(UsersCollection).Where(UserDeviceTokensField, "array-contains-any", batch)
+		dsnaps, err := NewQueryRunner(ctx, query, QueryRunnerOptions{Name: "users_by_device_tokens"}).GetAll()
+		if err != nil {
+			return Errorf("PushSender.PruneTokens", ErrorCodeFirebase, "failed to find users with device tokens: %w", err)
+		}
+
+		for _, dsnap := range dsnaps {
+			if _, err := dsnap.Ref.Update(ctx, []firestore.Update{{Path: UserDeviceTokensField, Value: firestore.ArrayRemove(values...)}}); err != nil {
+				return Errorf("PushSender.PruneTokens", ErrorCodeFirebase, "failed to remove device tokens of user %v: %w", dsnap.Ref.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendBatch - sends the message to the tokens with the bounded concurrency and fills the results
+func (ps *PushSender) sendBatch(ctx context.Context, tokens []string, message PushMessage, results []PushSendResult) {
+	semaphore := make(chan struct{}, defaultPushConcurrency)
+
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		results[i] = PushSendResult{Token: token}
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Error = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *PushSendResult) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			// message was validated by SendMulticast
+			fcmMessage, _ := newFCMMessage(message)
+			fcmMessage.Token = result.Token
+
+			result.MessageID, result.Error = ps.client.Send(ctx, fcmMessage)
+			result.Invalid = result.Error != nil && messaging.IsRegistrationTokenNotRegistered(result.Error)
+		}(&results[i])
+	}
+	wg.Wait()
+}
+
+// newFCMMessage - converts PushMessage to the FCM message without the target
+func newFCMMessage(message PushMessage) (*messaging.Message, error) {
+	if message.Notification == nil && message.Data == nil {
+		return nil, fmt.Errorf("push message has no notification or data")
+	}
+
+	fcmMessage := &messaging.Message{Android: &messaging.AndroidConfig{CollapseKey: message.CollapseKey}}
+	if message.Notification != nil {
+		if err := ValidateStruct(message.Notification); err != nil {
+			return nil, err
+		}
+		fcmMessage.Notification = &messaging.Notification{
+			Title:    message.Notification.Title,
+			Body:     message.Notification.Body,
+			ImageURL: message.Notification.ImageURL,
+		}
+	}
+
+	data, err := pushData(message.Data)
+	if err != nil {
+		return nil, err
+	}
+	fcmMessage.Data = data
+
+	headers := map[string]string{}
+	if message.Priority == PushPriorityHigh {
+		fcmMessage.Android.Priority = PushPriorityHigh
+		headers["apns-priority"] = "10"
+	}
+	if message.TTL > 0 {
+		ttl := message.TTL
+		fcmMessage.Android.TTL = &ttl
+		headers["apns-expiration"] = strconv.FormatInt(time.Now().Add(message.TTL).Unix(), 10)
+	}
+	if message.CollapseKey != "" {
+		headers["apns-collapse-id"] = message.CollapseKey
+	}
+	if len(headers) > 0 {
+		fcmMessage.APNS = &messaging.APNSConfig{Headers: headers}
+	}
+
+	return fcmMessage, nil
+}
+
+// pushData - converts the typed payload into FCM data, values which are not strings are JSON encoded
+func pushData(payload interface{}) (map[string]string, error) {
+	switch data := payload.(type) {
+	case nil:
+		return nil, nil
+	case map[string]string:
+		return data, nil
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode push data. Error: %v", err.Error())
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, fmt.Errorf("push data must be an object. Error: %v", err.Error())
+	}
+
+	data := make(map[string]string, len(fields))
+	for key, value := range fields {
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			data[key] = text
+			continue
+		}
+		data[key] = string(value)
+	}
+
+	return data, nil
+}
+
+// pushErrorCode - AppError code of the FCM send error
+func pushErrorCode(err error) int {
+	switch {
+	case messaging.IsInvalidArgument(err):
+		return ErrorCodeInvalidArgument
+	case messaging.IsMessageRateExceeded(err):
+		return ErrorCodeResourceExhausted
+	default:
+		return ErrorCodeExternalAPI
+	}
+}
@@ -0,0 +1,229 @@
+package cloudfunctions_go_utils
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// QueryTag - struct tag with the query parameter name used by BindQuery, ex: `query:"page_size"`
+	QueryTag = "query"
+	// QueryLayoutTag - struct tag with time layout of the time.Time fields used by BindQuery, time.RFC3339 if empty
+	QueryLayoutTag = "layout"
+)
+
+var uuidType = reflect.TypeOf(uuid.UUID{})
+var timeType = reflect.TypeOf(time.Time{})
+
+// GetQueryInt - returns query parameter as int or defaultValue if the parameter is missing
+func GetQueryInt(r *http.Request, queryKey string, defaultValue int) (int, error) {
+	param := GetURLParameter(r, queryKey, "")
+	if param == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(param)
+	if err != nil {
+		return defaultValue, Errorf("GetQueryInt", ErrorCodeInvalidArgument, "invalid %v query parameter: %w", queryKey, err).
+			WithMessage(queryKey + " must be an integer")
+	}
+
+	return value, nil
+}
+
+// GetQueryBool - returns query parameter as bool (1, t, true, 0, f, false) or defaultValue if the parameter is missing
+func GetQueryBool(r *http.Request, queryKey string, defaultValue bool) (bool, error) {
+	param := GetURLParameter(r, queryKey, "")
+	if param == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseBool(param)
+	if err != nil {
+		return defaultValue, Errorf("GetQueryBool", ErrorCodeInvalidArgument, "invalid %v query parameter: %w", queryKey, err).
+			WithMessage(queryKey + " must be a boolean")
+	}
+
+	return value, nil
+}
+
+// GetQueryTime - returns query parameter parsed with the layout (ex: time.RFC3339) or defaultValue if the parameter is missing
+func GetQueryTime(r *http.Request, queryKey string, layout string, defaultValue time.Time) (time.Time, error) {
+	param := GetURLParameter(r, queryKey, "")
+	if param == "" {
+		return defaultValue, nil
+	}
+
+	value, err := time.Parse(layout, param)
+	if err != nil {
+		return defaultValue, Errorf("GetQueryTime", ErrorCodeInvalidArgument, "invalid %v query parameter: %w", queryKey, err).
+			WithMessage(queryKey + " must be a time in " + layout + " format")
+	}
+
+	return value, nil
+}
+
+// GetQueryUUID - returns query parameter as UUID or uuid.Nil if the parameter is missing
+func GetQueryUUID(r *http.Request, queryKey string) (uuid.UUID, error) {
+	param := GetURLParameter(r, queryKey, "")
+	if param == "" {
+		return uuid.Nil, nil
+	}
+
+	value, err := uuid.Parse(param)
+	if err != nil {
+		return uuid.Nil, Errorf("GetQueryUUID", ErrorCodeInvalidArgument, "invalid %v query parameter: %w", queryKey, err).
+			WithMessage(queryKey + " must be a UUID")
+	}
+
+	return value, nil
+}
+
+// BindQuery - populates dst struct pointer from the query parameters by `query` tags (json name or field name if missing)
+// and validates it with ValidateStruct. Supported field types: string, bool, ints, uints, floats, time.Time (`layout` tag),
+// uuid.UUID and slices of them (repeated or comma separated parameter).
+// On failure 422 VALIDATION_FAILED JSON error with all parse and validation field errors in details is written to w
+// and AppError is returned
+func BindQuery(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	value := reflect.ValueOf(dst)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return Errorf("BindQuery", ErrorCodeInternal, "dst must be a pointer to struct")
+	}
+
+	var fieldErrors []FieldError
+	query := r.URL.Query()
+	value = value.Elem()
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Tag.Get(QueryTag)
+		if name == "" {
+			name = fieldName(field)
+		}
+		if name == "-" {
+			continue
+		}
+
+		params, ok := query[name]
+		if !ok || len(params) == 0 || params[0] == "" {
+			continue
+		}
+
+		if err := setQueryField(value.Field(i), field, params); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "type", Message: err.Error()})
+		}
+	}
+
+	if err := ValidateStruct(dst); err != nil {
+		var validationError *ValidationError
+		if errors.As(err, &validationError) {
+			fieldErrors = append(fieldErrors, validationError.Errors...)
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		appErr := Errorf("BindQuery", ErrorCodeValidation, "invalid query parameters: %w", &ValidationError{Errors: fieldErrors}).
+			WithMessage("invalid query parameters")
+		WriteError(w, appErr)
+		return appErr
+	}
+
+	return nil
+}
+
+// setQueryField - parses the query parameter values into the field
+func setQueryField(fieldValue reflect.Value, field reflect.StructField, params []string) error {
+	if fieldValue.Kind() == reflect.Slice && fieldValue.Type() != reflect.TypeOf([]byte{}) {
+		var values []string
+		for _, param := range params {
+			values = append(values, strings.Split(param, ",")...)
+		}
+
+		slice := reflect.MakeSlice(fieldValue.Type(), len(values), len(values))
+		for i, param := range values {
+			if err := setQueryValue(slice.Index(i), field, strings.TrimSpace(param)); err != nil {
+				return err
+			}
+		}
+		fieldValue.Set(slice)
+
+		return nil
+	}
+
+	return setQueryValue(fieldValue, field, params[0])
+}
+
+// setQueryValue - parses single query parameter value into the value of the supported kind
+func setQueryValue(value reflect.Value, field reflect.StructField, param string) error {
+	switch value.Type() {
+	case timeType:
+		layout := field.Tag.Get(QueryLayoutTag)
+		if layout == "" {
+			layout = time.RFC3339
+		}
+
+		parsed, err := time.Parse(layout, param)
+		if err != nil {
+			return errors.New("must be a time in " + layout + " format")
+		}
+		value.Set(reflect.ValueOf(parsed))
+		return nil
+	case uuidType:
+		parsed, err := uuid.Parse(param)
+		if err != nil {
+			return errors.New("must be a UUID")
+		}
+		value.Set(reflect.ValueOf(parsed))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(param)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(param)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(param, 10, value.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(param, 10, value.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive integer")
+		}
+		value.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(param, value.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		value.SetFloat(parsed)
+	case reflect.Ptr:
+		ptr := reflect.New(value.Type().Elem())
+		if err := setQueryValue(ptr.Elem(), field, param); err != nil {
+			return err
+		}
+		value.Set(ptr)
+	default:
+		return errors.New("unsupported field type " + value.Type().String())
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+const (
+	// QueryReadsMetric - counter metric of the billed document reads of the query, labels: endpoint, query
+	QueryReadsMetric = "firestore_query_reads"
+	// QueryLatencyMetric - timing metric of the query round trips, labels: endpoint, query
+	QueryLatencyMetric = "firestore_query_latency"
+
+	// queryProfileContextKey - context key of the request query profile
+	queryProfileContextKey contextKey = "query_profile"
+
+	defaultQueryName = "unnamed"
+)
+
+// QueryProfilingEnabled - query profiling is the debug mode, enabled by the FIRESTORE_QUERY_PROFILING env variable set to true
+func QueryProfilingEnabled() bool {
+	return packageConfig().FirestoreQueryProfiling
+}
+
+// QueryStats - totals of the query within the request
+// Reads - billed document reads, the query returning no documents is billed as one read
+// Bytes - estimated size of the returned documents by the Firestore storage size rules
+// DurationMs - time spent waiting for Firestore, without the processing of the documents
+type QueryStats struct {
+	Name       string  `json:"name"`
+	Executions int     `json:"executions"`
+	Documents  int     `json:"documents"`
+	Reads      int     `json:"reads"`
+	Bytes      int     `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// queryProfile - query stats of the single request
+type queryProfile struct {
+	mu      sync.Mutex
+	queries map[string]*QueryStats
+}
+
+// QueryProfilingOptions - options of the ProfileQueries
+// Endpoint - label of the request in the metrics and the logs, method and path if empty,
+// should be set for the paths with IDs, ex: func(r) string { return "GET /orders/{id}" }
+// MinReads - the profile is logged only for the requests with at least MinReads reads, every request if empty
+type QueryProfilingOptions struct {
+	Endpoint func(r *http.Request) string
+	MinReads int
+}
+
+// ProfileQueries - http middleware which collects the stats of the QueryRunner queries of the request (QueryRunnerOptions.Name
+// is used as the query name) and logs them sorted by the reads after the request, metrics are emitted per endpoint and query.
+// Does nothing unless QueryProfilingEnabled, so it can be left in the chain
+func ProfileQueries(logger *Logger, options QueryProfilingOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.Endpoint == nil {
+		options.Endpoint = func(r *http.Request) string { return r.Method + " " + r.URL.Path }
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !QueryProfilingEnabled() {
+			next(w, r)
+			return
+		}
+
+		profile := &queryProfile{queries: map[string]*QueryStats{}}
+		r = r.WithContext(context.WithValue(r.Context(), queryProfileContextKey, profile))
+
+		next(w, r)
+
+		endpoint := options.Endpoint(r)
+		queries := profile.stats()
+
+		total := QueryStats{Name: endpoint}
+		for _, stats := range queries {
+			logger.Counter(r.Context(), QueryReadsMetric, float64(stats.Reads), map[string]string{"endpoint": endpoint, "query": stats.Name})
+			logger.Timing(r.Context(), QueryLatencyMetric, time.Duration(stats.DurationMs*float64(time.Millisecond)), map[string]string{"endpoint": endpoint, "query": stats.Name})
+
+			total.Executions += stats.Executions
+			total.Documents += stats.Documents
+			total.Reads += stats.Reads
+			total.Bytes += stats.Bytes
+			total.DurationMs += stats.DurationMs
+		}
+
+		if len(queries) == 0 || total.Reads < options.MinReads {
+			return
+		}
+		logger.Info(r.Context(), r, "firestore query profile", Fields{"endpoint": endpoint, "total": total, "queries": queries})
+	}
+}
+
+// RecordQuery - adds the stats of the query to the profile of the request, for the reads not done by QueryRunner,
+// ex: fireclient.GetAll of the document refs. Does nothing if the request is not profiled
+func RecordQuery(ctx context.Context, stats QueryStats) {
+	profile, _ := ctx.Value(queryProfileContextKey).(*queryProfile)
+	if profile == nil {
+		return
+	}
+	if stats.Name == "" {
+		stats.Name = defaultQueryName
+	}
+
+	profile.mu.Lock()
+	defer profile.mu.Unlock()
+
+	current, ok := profile.queries[stats.Name]
+	if !ok {
+		current = &QueryStats{Name: stats.Name}
+		profile.queries[stats.Name] = current
+	}
+	current.Executions += stats.Executions
+	current.Documents += stats.Documents
+	current.Reads += stats.Reads
+	current.Bytes += stats.Bytes
+	current.DurationMs += stats.DurationMs
+}
+
+// queryProfiled - the request of the context is profiled
+func queryProfiled(ctx context.Context) bool {
+	profile, _ := ctx.Value(queryProfileContextKey).(*queryProfile)
+	return profile != nil
+}
+
+// stats - query stats sorted by the reads, the most expensive first
+func (qp *queryProfile) stats() []QueryStats {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	stats := make([]QueryStats, 0, len(qp.queries))
+	for _, query := range qp.queries {
+		stats = append(stats, *query)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Reads != stats[j].Reads {
+			return stats[i].Reads > stats[j].Reads
+		}
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// documentSize - estimated storage size of the document: name, fields and 32 bytes of the overhead
+func documentSize(dsnap *firestore.DocumentSnapshot) int {
+	if dsnap == nil || !dsnap.Exists() {
+		return 0
+	}
+
+	return documentNameSize(dsnap.Ref) + mapValueSize(dsnap.Data()) + 32
+}
+
+// documentNameSize - size of the document path segments and 16 bytes of the overhead
+func documentNameSize(ref *firestore.DocumentRef) int {
+	size := 16
+	for ref != nil {
+		size += len(ref.ID) + 1
+		if ref.Parent == nil {
+			break
+		}
+		size += len(ref.Parent.ID) + 1
+		ref = ref.Parent.Parent
+	}
+
+	return size
+}
+
+// mapValueSize - size of the field names and the values of the map
+func mapValueSize(fields map[string]interface{}) int {
+	size := 0
+	for name, value := range fields {
+		size += len(name) + 1 + fieldValueSize(value)
+	}
+
+	return size
+}
+
+// fieldValueSize - size of the field value by the Firestore storage size rules
+func fieldValueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil, bool:
+		return 1
+	case int64, float64, time.Time:
+		return 8
+	case string:
+		return len(v) + 1
+	case []byte:
+		return len(v) + 1
+	case *latlng.LatLng:
+		return 16
+	case *firestore.DocumentRef:
+		return documentNameSize(v)
+	case []interface{}:
+		size := 0
+		for _, item := range v {
+			size += fieldValueSize(item)
+		}
+		return size
+	case map[string]interface{}:
+		return mapValueSize(v)
+	default:
+		return 8
+	}
+}
@@ -0,0 +1,188 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultQueryRunnerMaxRetries = 3
+	defaultQueryRunnerBackoff    = 200 * time.Millisecond
+	queryRunnerMaxBackoff        = 5 * time.Second
+)
+
+// QueryRunnerOptions - options of the NewQueryRunner
+// MaxRetries - max re-executions of the query after the stream failures in a row, 3 if empty
+// InitialBackoff - delay before the first re-execution, doubled for the next ones, 200ms if empty
+// Limit - max documents returned in total, should be used instead of the Limit of the query,
+// since the resumed query would return Limit documents after the cursor again. No limit if empty
+// Name - name of the query in the ProfileQueries profile, ex: "users_by_email"
+type QueryRunnerOptions struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	Limit          int
+	Name           string
+}
+
+// QueryRunner - DocumentIterator replacement which survives the broken streams: when iteration fails
+// with the transient error (unavailable, closing transport) the query is executed again starting after the last returned
+// document, so no documents are returned twice or skipped. The query should have a stable order (OrderBy or the default
+// document ID order), ex:
+// runner := NewQueryRunner(ctx, fireclient.Collection(UsersCollection).OrderBy("created_at", firestore.Asc), QueryRunnerOptions{})
+// defer runner.Stop()
+type QueryRunner struct {
+	ctx     context.Context
+	query   firestore.Query
+	options QueryRunnerOptions
+
+	iter     *firestore.DocumentIterator
+	last     *firestore.DocumentSnapshot
+	returned int
+	retries  int
+	done     bool
+
+	profiled bool
+	stats    QueryStats
+}
+
+// NewQueryRunner - returns QueryRunner of the query, the query is executed on the first Next
+func NewQueryRunner(ctx context.Context, query firestore.Query, options QueryRunnerOptions) *QueryRunner {
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = defaultQueryRunnerMaxRetries
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = defaultQueryRunnerBackoff
+	}
+
+	qr := &QueryRunner{ctx: ctx, query: query, options: options, profiled: queryProfiled(ctx)}
+	qr.stats.Name = options.Name
+
+	return qr
+}
+
+// Next - returns the next document or iterator.Done after the last one
+func (qr *QueryRunner) Next() (*firestore.DocumentSnapshot, error) {
+	if qr.done {
+		return nil, iterator.Done
+	}
+	if qr.options.Limit > 0 && qr.returned >= qr.options.Limit {
+		qr.Stop()
+		return nil, iterator.Done
+	}
+
+	backoff := qr.options.InitialBackoff
+	for {
+		if qr.iter == nil {
+			qr.iter = qr.resumedQuery().Documents(qr.ctx)
+			qr.stats.Executions++
+		}
+
+		start := time.Now()
+		dsnap, err := qr.iter.Next()
+		if qr.profiled {
+			qr.stats.DurationMs += float64(time.Since(start)) / float64(time.Millisecond)
+		}
+		if err == nil {
+			qr.last = dsnap
+			qr.returned++
+			qr.retries = 0
+			if qr.profiled {
+				qr.stats.Documents++
+				qr.stats.Reads++
+				qr.stats.Bytes += documentSize(dsnap)
+			}
+			return dsnap, nil
+		}
+		if err == iterator.Done {
+			qr.Stop()
+			return nil, iterator.Done
+		}
+
+		qr.iter.Stop()
+		qr.iter = nil
+		if !IsRetryableFirestoreError(err) || qr.retries >= qr.options.MaxRetries || qr.ctx.Err() != nil {
+			qr.Stop()
+			return nil, fmt.Errorf("failed to iterate documents after %d retries: %w", qr.retries, err)
+		}
+		qr.retries++
+
+		LogWrite(LogTypeInfo, ErrorCodeFirebase, fmt.Sprintf("query stream failed after %d documents, resuming. Error: %v", qr.returned, err.Error()), "")
+
+		select {
+		case <-time.After(backoff):
+		case <-qr.ctx.Done():
+			qr.Stop()
+			return nil, fmt.Errorf("failed to iterate documents: %w", qr.ctx.Err())
+		}
+		backoff *= 2
+		if backoff > queryRunnerMaxBackoff {
+			backoff = queryRunnerMaxBackoff
+		}
+	}
+}
+
+// Stop - stops the underlying iterator, should be called if the iteration is not finished
+func (qr *QueryRunner) Stop() {
+	if qr.iter != nil {
+		qr.iter.Stop()
+		qr.iter = nil
+	}
+	if !qr.done && qr.profiled && qr.stats.Executions > 0 {
+		// the query returning no documents is billed as one read
+		if qr.stats.Reads == 0 {
+			qr.stats.Reads = 1
+		}
+		RecordQuery(qr.ctx, qr.stats)
+	}
+	qr.done = true
+}
+
+// ForEach - calls fn for every document until the end of the query or the error of fn
+func (qr *QueryRunner) ForEach(fn func(dsnap *firestore.DocumentSnapshot) error) error {
+	defer qr.Stop()
+
+	for {
+		dsnap, err := qr.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(dsnap); err != nil {
+			return err
+		}
+	}
+}
+
+// GetAll - returns all documents of the query
+func (qr *QueryRunner) GetAll() ([]*firestore.DocumentSnapshot, error) {
+	dsnaps := []*firestore.DocumentSnapshot{}
+	err := qr.ForEach(func(dsnap *firestore.DocumentSnapshot) error {
+		dsnaps = append(dsnaps, dsnap)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dsnaps, nil
+}
+
+// resumedQuery - the query starting after the last returned document with the remaining limit
+func (qr *QueryRunner) resumedQuery() firestore.Query {
+	query := qr.query
+	if qr.last != nil {
+		query = query.StartAfter(qr.last)
+	}
+	if qr.options.Limit > 0 {
+		query = query.Limit(qr.options.Limit - qr.returned)
+	}
+
+	return query
+}
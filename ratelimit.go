@@ -0,0 +1,246 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	RateLimitsCollection string = "rate_limits"
+)
+
+// RateLimitResult - result of the rate limit check
+// Allowed - request is within the limit
+// Remaining - requests left in the current window
+// ResetAt - end of the current window
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	ResetAt   time.Time
+}
+
+// RateLimitStore - counter storage used by RateLimit middleware (fixed window per key).
+// MemoryRateLimitStore limits requests of the single instance, FirestoreRateLimitStore is shared by all instances,
+// other storages (ex: Redis) can be plugged by implementing the interface
+type RateLimitStore interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// rateLimitWindow - window start and end of the time
+func rateLimitWindow(now time.Time, window time.Duration) (time.Time, time.Time) {
+	start := now.Truncate(window)
+	return start, start.Add(window)
+}
+
+// MemoryRateLimitStore - in-memory RateLimitStore of the single function instance
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	counters map[string]memoryRateLimitCounter
+}
+
+type memoryRateLimitCounter struct {
+	count   int
+	resetAt time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: map[string]memoryRateLimitCounter{}}
+}
+
+// Allow - increments counter of the key in the current window
+func (s *MemoryRateLimitStore) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.resetAt) {
+		_, resetAt := rateLimitWindow(now, window)
+		counter = memoryRateLimitCounter{resetAt: resetAt}
+
+		// drop counters of the previous windows, so the map doesn't grow with the unique keys
+		for counterKey, c := range s.counters {
+			if !now.Before(c.resetAt) {
+				delete(s.counters, counterKey)
+			}
+		}
+	}
+
+	return s.increment(key, counter, limit), nil
+}
+
+// increment - counts the request if it's allowed
+func (s *MemoryRateLimitStore) increment(key string, counter memoryRateLimitCounter, limit int) RateLimitResult {
+	if counter.count >= limit {
+		s.counters[key] = counter
+		return RateLimitResult{Allowed: false, Remaining: 0, ResetAt: counter.resetAt}
+	}
+
+	counter.count++
+	s.counters[key] = counter
+
+	return RateLimitResult{Allowed: true, Remaining: limit - counter.count, ResetAt: counter.resetAt}
+}
+
+// FirestoreRateLimitStore - RateLimitStore shared by all instances, counter of each key and window
+// is the document of the RateLimitsCollection updated in the transaction.
+// Firestore TTL policy can be configured on the expires_at field to delete old counters
+type FirestoreRateLimitStore struct {
+	fireclient *firestore.Client
+}
+
+func NewFirestoreRateLimitStore(fireclient *firestore.Client) *FirestoreRateLimitStore {
+	return &FirestoreRateLimitStore{fireclient: fireclient}
+}
+
+// Allow - increments counter document of the key in the current window
+func (s *FirestoreRateLimitStore) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	windowStart, resetAt := rateLimitWindow(time.Now(), window)
+	hash := sha256.Sum256([]byte(key))
+	ref := s.fireclient.Collection(RateLimitsCollection).Doc(hex.EncodeToString(hash[:]) + "_" + strconv.FormatInt(windowStart.Unix(), 10))
+
+	var result RateLimitResult
+	err := s.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		count := 0
+
+		dsnap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if value, ok := dsnap.Data()["count"].(int64); ok {
+				count = int(value)
+			}
+		}
+
+		if count >= limit {
+			result = RateLimitResult{Allowed: false, Remaining: 0, ResetAt: resetAt}
+			return nil
+		}
+
+		result = RateLimitResult{Allowed: true, Remaining: limit - count - 1, ResetAt: resetAt}
+		return tx.Set(ref, map[string]interface{}{
+			"key":        key,
+			"count":      count + 1,
+			"expires_at": resetAt,
+		})
+	})
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("failed to update rate limit counter. Error: %v", err.Error())
+	}
+
+	return result, nil
+}
+
+// RateLimitOptions - options of the RateLimit middleware
+// Limit - requests allowed per window for one identity, must be positive
+// Window - length of the window, 1 minute if empty
+// Key - identity of the request, RateLimitKey if empty
+// Prefix - prefix of the counter keys, so different endpoints with the same store have separate limits
+type RateLimitOptions struct {
+	Limit  int
+	Window time.Duration
+	Key    func(r *http.Request) string
+	Prefix string
+}
+
+// RateLimit - http middleware which limits requests per identity and window, writes 429 JSON error
+// with Retry-After header when the limit is exceeded. X-RateLimit-Limit, X-RateLimit-Remaining headers are added
+// to the responses. Requests are allowed if the store fails, so the store outage doesn't block the endpoint.
+// Panics if the Limit is not positive, since such middleware would reject every request
+func RateLimit(store RateLimitStore, options RateLimitOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.Limit <= 0 {
+		panic(fmt.Sprintf("rate limit must be positive, got %v", options.Limit))
+	}
+	if options.Window <= 0 {
+		options.Window = time.Minute
+	}
+	if options.Key == nil {
+		options.Key = RateLimitKey
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		result, err := store.Allow(ctx, options.Prefix+options.Key(r), options.Limit, options.Window)
+		if err != nil {
+			LoggerFromContext(ctx).Error("failed to check rate limit", Fields{"error": err.Error()})
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(options.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(time.Until(result.ResetAt).Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			WriteError(w, Errorf("RateLimit", ErrorCodeResourceExhausted, "rate limit of %v requests per %v exceeded", options.Limit, options.Window).
+				WithMessage("too many requests"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// RateLimitKey - identity of the request: Firebase UID (RequireFirebaseAuth), API key ID (RequireAPIKey)
+// or client IP address, so the auth middlewares should be applied before RateLimit
+func RateLimitKey(r *http.Request) string {
+	if uid := UIDFromContext(r.Context()); uid != "" {
+		return "uid:" + uid
+	}
+
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return "api_key:" + key.ID
+	}
+
+	return "ip:" + ClientIP(r)
+}
+
+// ClientIPTrustedProxies - proxies of the deployment which append to X-Forwarded-For after Google front end
+// (ex: 1 for the load balancer in front of the function), 0 if the requests come from Google front end directly
+var ClientIPTrustedProxies = 0
+
+// ClientIP - returns client IP address from X-Forwarded-For or RemoteAddr. The entries before the one appended by
+// Google front end come from the client and can be forged, so the entry ClientIPTrustedProxies from the end is used
+func ClientIP(r *http.Request) string {
+	var entries []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if index := len(entries) - 1 - ClientIPTrustedProxies; index >= 0 && index < len(entries) {
+		if ip := net.ParseIP(entries[index]); ip != nil {
+			return ip.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
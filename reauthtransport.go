@@ -0,0 +1,114 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxReauthInspectBytes - size limit of the 200 response body which is inspected for the unauthenticated GraphQL errors
+const maxReauthInspectBytes = 1 << 20
+
+// ReauthTransport - RoundTripper which authorizes requests with the token of the TokenManager and when the token
+// is rejected (401 status or GraphQL error with UNAUTHENTICATED code) forces the token refresh and retries the request once
+type ReauthTransport struct {
+	Base    http.RoundTripper
+	Manager *TokenManager
+}
+
+// NewReauthClient - returns http client of the TokenManager, base is http.DefaultTransport if nil
+func NewReauthClient(manager *TokenManager, base http.RoundTripper) *http.Client {
+	return &http.Client{Transport: &ReauthTransport{Base: base, Manager: manager}}
+}
+
+// RoundTrip - sends the request with the token, retries once with the refreshed token if it was rejected
+func (t *ReauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	token, err := t.Manager.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := base.RoundTrip(authorizedRequest(req, token))
+	if err != nil {
+		return nil, err
+	}
+
+	rejected, err := tokenRejected(resp)
+	if err != nil || !rejected || !canRewindRequestBody(req) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	LoggerFromContext(ctx).Warning("access token was rejected, refreshing", Fields{"url": req.URL.Host + req.URL.Path, "status": resp.StatusCode})
+
+	refreshed, err := t.Manager.ForceRefresh(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh rejected token. Error: %v", err.Error())
+	}
+
+	retry := authorizedRequest(req, refreshed.AccessToken)
+	if err := rewindRequestBody(retry); err != nil {
+		return nil, err
+	}
+
+	return base.RoundTrip(retry)
+}
+
+// authorizedRequest - clone of the request with the Bearer token
+func authorizedRequest(req *http.Request, token string) *http.Request {
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+
+	return authorized
+}
+
+// tokenRejected - checks for 401 status or GraphQL errors with UNAUTHENTICATED extensions code in the 200 response,
+// body of the inspected response is restored. Messages aren't matched, since the authorization failures and other
+// errors mentioning "unauthorized" would force the refresh and the replay of the request
+func tokenRejected(resp *http.Response) (bool, error) {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReauthInspectBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("failed to read response body. Error: %v", err.Error())
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) > maxReauthInspectBytes {
+		// body was truncated, restore it as is without the inspection
+		return false, nil
+	}
+
+	var out struct {
+		Errors []struct {
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return false, nil
+	}
+
+	for _, item := range out.Errors {
+		if strings.EqualFold(item.Extensions.Code, "UNAUTHENTICATED") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
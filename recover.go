@@ -0,0 +1,56 @@
+package cloudfunctions_go_utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover - http middleware which catches panics of the handler, logs Critical entry with the stack trace
+// (execution ID is taken from the request, notifier of the logger is triggered) and writes 500 INTERNAL error response.
+// Panics with the AppError value (ex: panic(ErrOrderNotFound.E(op, err)) deep in the helpers) are written with WriteError
+// as if the handler returned them. If the handler already started the response, the panic is only logged
+func Recover(logger *Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := newResponseRecorder(w, 0)
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// http.ErrAbortHandler is used to abort the response intentionally
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			if err, ok := recovered.(error); ok {
+				var appErr *AppError
+				if errors.As(err, &appErr) {
+					logger.LogError(r.Context(), r, err)
+					if !recorder.wroteHeader {
+						WriteError(w, err)
+					}
+					return
+				}
+			}
+
+			logger.Critical(r.Context(), r, fmt.Sprintf("panic: %v", recovered), Fields{
+				"panic":        fmt.Sprintf("%v", recovered),
+				"stack_trace":  string(debug.Stack()),
+				"method":       r.Method,
+				"path":         r.URL.Path,
+				"wrote_header": recorder.wroteHeader,
+			})
+
+			// headers and part of the body were sent, the error response would be appended to them
+			if !recorder.wroteHeader {
+				WriteError(w, Errorf("Recover", ErrorCodeInternal, "panic: %v", recovered))
+			}
+		}()
+
+		next(recorder, r)
+	}
+}
@@ -0,0 +1,172 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// RedactedValue - default replacement of the redacted data
+const RedactedValue = "[REDACTED]"
+
+var (
+	// DefaultRedactedFieldPatterns - field names containing any of these case-insensitive substrings are redacted
+	DefaultRedactedFieldPatterns = []string{"password", "secret", "token", "authorization", "api_key", "apikey", "cookie"}
+	// DefaultRedactedValuePatterns - matches of these regexps are redacted in all string values and messages
+	DefaultRedactedValuePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)bearer\s+[a-z0-9\-._~+/]+=*`),
+		regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`),
+	}
+
+	// cardNumberPattern - 13-19 digits runs, redacted only if they pass the Luhn check
+	cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+)
+
+// Redactor - removes sensitive data from the log entries before they are sent
+// FieldPatterns - case-insensitive substrings of the field names which values are fully redacted
+// ValuePatterns - regexps which matches are redacted in the string values
+// CardNumbers - 13-19 digit numbers which pass the Luhn check are redacted, so order IDs and timestamps are kept
+// Replacement - value used instead of the redacted data, RedactedValue if empty
+type Redactor struct {
+	FieldPatterns []string
+	ValuePatterns []*regexp.Regexp
+	CardNumbers   bool
+	Replacement   string
+}
+
+// NewDefaultRedactor - returns Redactor for passwords, tokens, authorization headers, emails and credit card numbers
+func NewDefaultRedactor() *Redactor {
+	return &Redactor{
+		FieldPatterns: DefaultRedactedFieldPatterns,
+		ValuePatterns: DefaultRedactedValuePatterns,
+		CardNumbers:   true,
+		Replacement:   RedactedValue,
+	}
+}
+
+// RedactString - redacts ValuePatterns matches and card numbers in the string
+func (rd *Redactor) RedactString(value string) string {
+	for _, pattern := range rd.ValuePatterns {
+		value = pattern.ReplaceAllString(value, rd.replacement())
+	}
+	if rd.CardNumbers {
+		value = cardNumberPattern.ReplaceAllStringFunc(value, func(match string) string {
+			if !luhnValid(match) {
+				return match
+			}
+			return rd.replacement()
+		})
+	}
+
+	return value
+}
+
+// luhnValid - checks the Luhn checksum of the digits, spaces and dashes are skipped
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// Redact - returns redacted copy of any JSON serializable value. Structs are converted to their JSON representation,
+// so json tags are used as the field names. Values which can't be marshaled are returned as a redacted string
+func (rd *Redactor) Redact(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return rd.RedactString(typed)
+	case bool, int, int32, int64, float32, float64:
+		return typed
+	}
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return rd.replacement()
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(valueBytes, &generic)
+	if err != nil {
+		return rd.replacement()
+	}
+
+	return rd.redactGeneric(generic)
+}
+
+// RedactFields - returns redacted copy of the fields
+func (rd *Redactor) RedactFields(fields Fields) Fields {
+	if fields == nil {
+		return nil
+	}
+
+	redacted := make(Fields, len(fields))
+	for key, value := range fields {
+		if rd.isSensitiveField(key) {
+			redacted[key] = rd.replacement()
+			continue
+		}
+		redacted[key] = rd.Redact(value)
+	}
+
+	return redacted
+}
+
+// redactGeneric - redacts value decoded from JSON
+func (rd *Redactor) redactGeneric(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return rd.RedactString(typed)
+	case []interface{}:
+		for i := range typed {
+			typed[i] = rd.redactGeneric(typed[i])
+		}
+		return typed
+	case map[string]interface{}:
+		for key, item := range typed {
+			if rd.isSensitiveField(key) {
+				typed[key] = rd.replacement()
+				continue
+			}
+			typed[key] = rd.redactGeneric(item)
+		}
+		return typed
+	}
+
+	return value
+}
+
+func (rd *Redactor) isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range rd.FieldPatterns {
+		if strings.Contains(name, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rd *Redactor) replacement() string {
+	if rd.Replacement == "" {
+		return RedactedValue
+	}
+
+	return rd.Replacement
+}
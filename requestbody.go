@@ -0,0 +1,106 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxJSONBodyBytes - default size limit of the decoded request body (1 MB)
+const defaultMaxJSONBodyBytes = 1 << 20
+
+// DecodeJSONOptions - options of the DecodeJSONBody
+// MaxBodyBytes - size limit of the request body, 1 MB if empty
+// DisallowUnknownFields - fails when the body has fields which are missing in the destination struct
+// SkipValidation - doesn't run ValidateStruct for the decoded value
+type DecodeJSONOptions struct {
+	MaxBodyBytes          int64
+	DisallowUnknownFields bool
+	SkipValidation        bool
+}
+
+// DecodeJSONBody - decodes JSON request body into dst and validates it with ValidateStruct.
+// On failure the error envelope is written to w (INVALID_ARGUMENT with 415 for missing or not JSON Content-Type, 413 for too large body, 400 for malformed body,
+// 422 VALIDATION_FAILED with all field errors in details for validation errors) and AppError is returned,
+// so the handler should just return, ex: if err := DecodeJSONBody(w, r, &request, DecodeJSONOptions{}); err != nil { return }
+func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}, options DecodeJSONOptions) error {
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = defaultMaxJSONBodyBytes
+	}
+
+	// missing Content-Type is rejected too, otherwise the check is bypassed by omitting the header
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		appErr := Errorf("DecodeJSONBody", ErrorCodeInvalidArgument, "unsupported Content-Type '%v'", contentType).
+			WithMessage("Content-Type header is not application/json")
+		appErr.HTTPStatus = http.StatusUnsupportedMediaType
+		WriteError(w, appErr)
+		return appErr
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, options.MaxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	if options.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+
+	if err := decoder.Decode(dst); err != nil {
+		appErr := Errorf("DecodeJSONBody", ErrorCodeInvalidArgument, "failed to decode request body: %w", err).WithMessage(decodeErrorMessage(err))
+
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			appErr.HTTPStatus = http.StatusRequestEntityTooLarge
+		}
+
+		WriteError(w, appErr)
+		return appErr
+	}
+
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		appErr := Errorf("DecodeJSONBody", ErrorCodeInvalidArgument, "request body has extra data").
+			WithMessage("request body must contain a single JSON object")
+		WriteError(w, appErr)
+		return appErr
+	}
+
+	if options.SkipValidation {
+		return nil
+	}
+
+	if err := ValidateStruct(dst); err != nil {
+		appErr := Errorf("DecodeJSONBody", ErrorCodeValidation, "invalid request body: %w", err).WithMessage("invalid request body")
+		WriteError(w, appErr)
+		return appErr
+	}
+
+	return nil
+}
+
+// decodeErrorMessage - caller safe message of the json decoding error
+func decodeErrorMessage(err error) string {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Sprintf("request body contains malformed JSON (at position %v)", syntaxError.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body contains malformed JSON"
+	case errors.As(err, &typeError):
+		return fmt.Sprintf("request body contains invalid value for the field %q", typeError.Field)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "request body contains unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	case errors.Is(err, io.EOF):
+		return "request body must not be empty"
+	case errors.As(err, &maxBytesError):
+		return fmt.Sprintf("request body must not be larger than %v bytes", maxBytesError.Limit)
+	default:
+		return "failed to decode request body"
+	}
+}
@@ -0,0 +1,67 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RequestIDHeader - header with the correlation ID of the request chain, echoed in the responses
+	RequestIDHeader = "X-Request-Id"
+
+	// requestIDContextKey - context key of the request ID
+	requestIDContextKey contextKey = "request_id"
+
+	maxRequestIDLength = 128
+)
+
+// ContextWithRequestID - returns copy of ctx with the request ID, generates UUID if requestID is empty or invalid.
+// Can be used by Pub/Sub-triggered functions to continue the chain of the publisher
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	if !validRequestID(requestID) {
+		requestID = uuid.NewString()
+	}
+
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// RequestIDFromContext - returns the request ID stored by ContextWithRequestID or WithRequestID middleware
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// WithRequestID - http middleware which stores X-Request-Id header value in the request context
+// or generates UUID if the header is missing, and sets the header of the response.
+// The request ID is added to the log entries (request_id) and to the requests of the NewOutboundClient and EnqueueTask,
+// so the calls of the chained functions share it
+func WithRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithRequestID(r.Context(), r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, RequestIDFromContext(ctx))
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// validRequestID - checks that the caller request ID is not empty, not too long and has printable ASCII characters only,
+// so it can't be used to inject log lines or headers
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,97 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/logging"
+)
+
+// RequestLogger - Logger bound to the request context and http request, created by Logger.ForRequest
+type RequestLogger struct {
+	logger      *Logger
+	ctx         context.Context
+	httpRequest *http.Request
+}
+
+// Debug - logs with 100(DEBUG) severity
+func (rl *RequestLogger) Debug(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Debug, rl.httpRequest, message, dataObject)
+}
+
+// Info - logs with 200(INFO) severity
+func (rl *RequestLogger) Info(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Info, rl.httpRequest, message, dataObject)
+}
+
+// Notice - logs with 300(NOTICE) severity
+func (rl *RequestLogger) Notice(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Notice, rl.httpRequest, message, dataObject)
+}
+
+// Warning - logs with 400(WARNING) severity
+func (rl *RequestLogger) Warning(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Warning, rl.httpRequest, message, dataObject)
+}
+
+// Error - logs with 500(ERROR) severity
+func (rl *RequestLogger) Error(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Error, rl.httpRequest, message, dataObject)
+}
+
+// Critical - logs with 600(CRITICAL) severity
+func (rl *RequestLogger) Critical(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Critical, rl.httpRequest, message, dataObject)
+}
+
+// Emergency - logs with 800(EMERGENCY) severity
+func (rl *RequestLogger) Emergency(message string, dataObject ...interface{}) {
+	rl.logger.log(rl.ctx, logging.Emergency, rl.httpRequest, message, dataObject)
+}
+
+// With - returns derived request logger which adds the fields to every entry
+func (rl *RequestLogger) With(fields Fields) *RequestLogger {
+	derived := *rl
+	derived.logger = rl.logger.With(fields)
+
+	return &derived
+}
+
+// WithLabels - returns derived request logger which adds the labels to every entry
+func (rl *RequestLogger) WithLabels(labels map[string]string) *RequestLogger {
+	derived := *rl
+	derived.logger = rl.logger.WithLabels(labels)
+
+	return &derived
+}
+
+const (
+	// requestLoggerContextKey - context key of the *RequestLogger
+	requestLoggerContextKey contextKey = "request_logger"
+)
+
+var (
+	defaultLogger     *Logger
+	defaultLoggerOnce sync.Once
+)
+
+// NewLoggerContext - returns copy of ctx with the request logger, so nested code can log with request correlation
+// without passing the logger through every function
+func NewLoggerContext(ctx context.Context, rl *RequestLogger) context.Context {
+	return context.WithValue(ctx, requestLoggerContextKey, rl)
+}
+
+// LoggerFromContext - returns the request logger stored by NewLoggerContext.
+// If there is no logger in ctx, request logger of the default logger (GCLOUD_PROJECT project, K_SERVICE invoker) is returned
+func LoggerFromContext(ctx context.Context) *RequestLogger {
+	if rl, ok := ctx.Value(requestLoggerContextKey).(*RequestLogger); ok && rl != nil {
+		return rl
+	}
+
+	defaultLoggerOnce.Do(func() {
+		defaultLogger = NewLogger(packageConfig().ProjectID, packageConfig().Service, "cloudfunctions")
+	})
+
+	return defaultLogger.ForRequest(ctx, nil)
+}
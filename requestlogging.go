@@ -0,0 +1,106 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultMaxLoggedBodyBytes - default size cap of the logged request and response bodies
+const defaultMaxLoggedBodyBytes = 4096
+
+// RequestLoggingOptions - options of the LogRequests middleware
+// CaptureBodies - logs copy of the request and response bodies at Debug level
+// MaxBodyBytes - size cap of the logged bodies, 4096 if empty
+// Redactor - applied to the logged bodies, NewDefaultRedactor if empty
+type RequestLoggingOptions struct {
+	CaptureBodies bool
+	MaxBodyBytes  int
+	Redactor      *Redactor
+}
+
+// LogRequests - http middleware which logs method, path, status, latency and response size of every request
+// (Info for status < 500, Error otherwise) and optionally the bodies at Debug level.
+// RequestLogger of the request is stored in the context, so handlers can get it with LoggerFromContext
+func LogRequests(logger *Logger, options RequestLoggingOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = defaultMaxLoggedBodyBytes
+	}
+	if options.Redactor == nil {
+		options.Redactor = NewDefaultRedactor()
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		var requestBody []byte
+		if options.CaptureBodies && r.Body != nil {
+			requestBody = captureRequestBody(r, options.MaxBodyBytes)
+		}
+
+		maxResponseBytes := 0
+		if options.CaptureBodies {
+			maxResponseBytes = options.MaxBodyBytes
+		}
+		recorder := newResponseRecorder(w, maxResponseBytes)
+
+		rl := logger.ForRequest(r.Context(), r)
+		r = r.WithContext(NewLoggerContext(r.Context(), rl))
+		rl.ctx = r.Context()
+
+		next(recorder, r)
+
+		fields := Fields{
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			"status":        recorder.statusCode,
+			"latency_ms":    float64(time.Since(start)) / float64(time.Millisecond),
+			"response_size": recorder.size,
+			"user_agent":    r.UserAgent(),
+		}
+
+		if recorder.statusCode >= http.StatusInternalServerError {
+			rl.Error("request completed", fields)
+		} else {
+			rl.Info("request completed", fields)
+		}
+
+		if options.CaptureBodies {
+			rl.Debug("request bodies", Fields{
+				"request_body":  redactBody(options.Redactor, requestBody),
+				"response_body": redactBody(options.Redactor, recorder.body.Bytes()),
+			})
+		}
+	}
+}
+
+// redactBody - redacts JSON bodies by the field names and values, other bodies only by the values
+func redactBody(redactor *Redactor, body []byte) interface{} {
+	var decoded interface{}
+	if json.Unmarshal(body, &decoded) == nil {
+		return redactor.Redact(decoded)
+	}
+
+	return redactor.RedactString(string(body))
+}
+
+// captureRequestBody - returns first maxBytes of the request body and restores the body for the handler
+func captureRequestBody(r *http.Request, maxBytes int) []byte {
+	captured, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)))
+	if err != nil {
+		return nil
+	}
+
+	// the rest of the body is read by the handler from the original reader
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(captured), r.Body),
+		Closer: r.Body,
+	}
+
+	return captured
+}
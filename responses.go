@@ -0,0 +1,107 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var (
+	// errorCodeNames - stable machine-readable names of the ErrorCode values returned in the error responses
+	errorCodeNames = map[int]string{
+		ErrorCodeExternalAPI:       "EXTERNAL_API_ERROR",
+		ErrorCodeInternal:          "INTERNAL",
+		ErrorCodeFirebase:          "DATABASE_ERROR",
+		ErrorCodeInvalidArgument:   "INVALID_ARGUMENT",
+		ErrorCodeUnauthenticated:   "UNAUTHENTICATED",
+		ErrorCodePermissionDenied:  "PERMISSION_DENIED",
+		ErrorCodeNotFound:          "NOT_FOUND",
+		ErrorCodeConflict:          "CONFLICT",
+		ErrorCodeValidation:        "VALIDATION_FAILED",
+		ErrorCodeResourceExhausted: "RESOURCE_EXHAUSTED",
+		ErrorCodeUnavailable:       "UNAVAILABLE",
+		ErrorCodeDeadlineExceeded:  "DEADLINE_EXCEEDED",
+	}
+)
+
+// ResponseEnvelope - standard shape of the JSON responses, only one of Data and Error is set
+type ResponseEnvelope struct {
+	Data  interface{}            `json:"data,omitempty"`
+	Error *ResponseError         `json:"error,omitempty"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+}
+
+// ResponseError - error part of the ResponseEnvelope
+// Code - stable code of the error codes catalog (ex: ORDER_NOT_FOUND) or name of the ErrorCode (ex: NOT_FOUND),
+// the clients should branch on it instead of the message
+// Message - caller safe message
+// Details - optional details, ex: field errors of the ValidationError
+type ResponseError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// ErrorCodeName - returns stable name of the ErrorCode, INTERNAL for unknown codes
+func ErrorCodeName(code int) string {
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+
+	return errorCodeNames[ErrorCodeInternal]
+}
+
+// WriteJSON - writes payload as JSON response with the status
+func WriteJSON(w http.ResponseWriter, statusCode int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		LogWrite(LogTypeError2, ErrorCodeInternal, "failed to encode JSON response. Error: "+err.Error(), "")
+	}
+}
+
+// WriteData - writes data in the ResponseEnvelope, meta is optional (ex: pagination cursor)
+func WriteData(w http.ResponseWriter, statusCode int, data interface{}, meta map[string]interface{}) {
+	WriteJSON(w, statusCode, ResponseEnvelope{Data: data, Meta: meta})
+}
+
+// WriteError - writes the error in the ResponseEnvelope with HTTP status, stable code (catalog Reason or ErrorCode name)
+// and caller safe message of the AppError.
+// ValidationError field errors are returned in details, other errors are written as 500 INTERNAL without the error text
+func WriteError(w http.ResponseWriter, err error) {
+	status, envelope := errorResponse(err)
+	WriteJSON(w, status, envelope)
+}
+
+// WriteNoContent - writes 204 response without body
+func WriteNoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errorResponse - HTTP status and ResponseEnvelope of the error
+func errorResponse(err error) (int, ResponseEnvelope) {
+	responseError := &ResponseError{
+		Code:    ErrorCodeName(ErrorCodeInternal),
+		Message: http.StatusText(http.StatusInternalServerError),
+	}
+	status := http.StatusInternalServerError
+
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		status = appErr.HTTPStatus
+		responseError.Code = errorReason(appErr)
+		responseError.Message = appErr.Msg
+	}
+
+	var validationError *ValidationError
+	if errors.As(err, &validationError) {
+		if appErr == nil {
+			status = http.StatusUnprocessableEntity
+			responseError.Code = ErrorCodeName(ErrorCodeValidation)
+			responseError.Message = "invalid request"
+		}
+		responseError.Details = validationError.Errors
+	}
+
+	return status, ResponseEnvelope{Error: responseError}
+}
@@ -0,0 +1,66 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseRecorder - http.ResponseWriter wrapper which records status code, size
+// and optionally first maxBodyBytes of the response body (whole body if maxBodyBytes is negative)
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode   int
+	size         int
+	wroteHeader  bool
+	maxBodyBytes int
+	body         bytes.Buffer
+}
+
+func newResponseRecorder(w http.ResponseWriter, maxBodyBytes int) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+		maxBodyBytes:   maxBodyBytes,
+	}
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.wroteHeader {
+		return
+	}
+	rr.wroteHeader = true
+	rr.statusCode = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	if !rr.wroteHeader {
+		rr.WriteHeader(http.StatusOK)
+	}
+
+	if rr.maxBodyBytes < 0 {
+		rr.body.Write(data)
+	} else if remaining := rr.maxBodyBytes - rr.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		rr.body.Write(data[:remaining])
+	}
+
+	n, err := rr.ResponseWriter.Write(data)
+	rr.size += n
+
+	return n, err
+}
+
+// Flush - supports streaming responses of the wrapped writer
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap - used by http.ResponseController to access the wrapped writer
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
@@ -0,0 +1,110 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxRetryAfter - longest Retry-After the clients sleep for, longer hints are returned as RateLimitedError
+	defaultMaxRetryAfter = 30 * time.Second
+)
+
+// ErrRateLimited - external API rejected the request with 429, errors.Is matches every RateLimitedError
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitedError - 429 response which was not retried because the hint is longer than the context deadline
+// or the retries are used up
+// Target - host of the request or GraphQL operation name
+// RetryAfter - retry hint of the response, 0 if the response had none
+type RateLimitedError struct {
+	Target     string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v is rate limited, retry after %v", e.Target, e.RetryAfter)
+	}
+
+	return fmt.Sprintf("%v is rate limited", e.Target)
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterFromError - retry hint of the RateLimitedError in the error chain
+func RetryAfterFromError(err error) (time.Duration, bool) {
+	var rateLimitedErr *RateLimitedError
+	if !errors.As(err, &rateLimitedErr) {
+		return 0, false
+	}
+
+	return rateLimitedErr.RetryAfter, true
+}
+
+// ParseRetryAfter - returns retry hint of the response headers: Retry-After (seconds or HTTP date),
+// then the provider headers RateLimit-Reset / X-RateLimit-Reset-After (seconds) and X-RateLimit-Reset (unix time or seconds)
+func ParseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if value := strings.TrimSpace(header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return nonNegativeDuration(date.Sub(now)), true
+		}
+	}
+
+	for _, name := range []string{"RateLimit-Reset", "X-RateLimit-Reset-After"} {
+		if seconds, err := strconv.ParseFloat(strings.TrimSpace(header.Get(name)), 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+	}
+
+	if reset, err := strconv.ParseInt(strings.TrimSpace(header.Get("X-RateLimit-Reset")), 10, 64); err == nil && reset >= 0 {
+		// values after 2001 are unix times, smaller values are the seconds to wait
+		if reset > 1e9 {
+			return nonNegativeDuration(time.Unix(reset, 0).Sub(now)), true
+		}
+		return time.Duration(reset) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// waitRetryAfter - sleeps for the hint if it's shorter than maxWait and the remaining time of the context,
+// returns false without sleeping otherwise
+func waitRetryAfter(ctx context.Context, retryAfter, maxWait time.Duration) bool {
+	if retryAfter > maxWait {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= retryAfter {
+		return false
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(retryAfter):
+		return true
+	}
+}
+
+func nonNegativeDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
@@ -0,0 +1,185 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// pathParamsContextKey - context key of the path params matched by Router
+	pathParamsContextKey contextKey = "path_params"
+)
+
+// Middleware - http middleware, ex: RequireFirebaseAuth, WithExecutionID.
+// Middlewares with options can be adapted with closure, ex: func(next http.HandlerFunc) http.HandlerFunc { return CORS(options, next) }
+type Middleware func(next http.HandlerFunc) http.HandlerFunc
+
+// Chain - wraps handler with the middlewares, the first middleware is the outermost one
+func Chain(handler http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// route - registered Router route
+type route struct {
+	method   string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+// Router - request multiplexer for functions which serve several operations on one HTTPS endpoint.
+// Routes are matched by method and path pattern with the path params, ex: "/orders/{id}" (path is relative to the function URL).
+// NotFound and MethodNotAllowed handlers write JSON error responses by default
+type Router struct {
+	routes      []route
+	middlewares []Middleware
+
+	NotFound         http.HandlerFunc
+	MethodNotAllowed http.HandlerFunc
+}
+
+// NewRouter - returns empty router. Router can be used as the function entrypoint: func Entrypoint(w, r) { router.ServeHTTP(w, r) }
+func NewRouter() *Router {
+	return &Router{
+		NotFound:         defaultNotFoundHandler,
+		MethodNotAllowed: defaultMethodNotAllowedHandler,
+	}
+}
+
+// Use - adds middlewares which are applied to every request before the route matching, ex: CORS, LogRequests
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+}
+
+// Handle - registers handler for the method and path pattern with the route middlewares, ex: RequireFirebaseAuth
+func (rt *Router) Handle(method, pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.routes = append(rt.routes, route{
+		method:   strings.ToUpper(method),
+		segments: splitPath(pattern),
+		handler:  Chain(handler, middlewares...),
+	})
+}
+
+// GET - registers GET handler
+func (rt *Router) GET(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.Handle(http.MethodGet, pattern, handler, middlewares...)
+}
+
+// POST - registers POST handler
+func (rt *Router) POST(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.Handle(http.MethodPost, pattern, handler, middlewares...)
+}
+
+// PUT - registers PUT handler
+func (rt *Router) PUT(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.Handle(http.MethodPut, pattern, handler, middlewares...)
+}
+
+// PATCH - registers PATCH handler
+func (rt *Router) PATCH(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.Handle(http.MethodPatch, pattern, handler, middlewares...)
+}
+
+// DELETE - registers DELETE handler
+func (rt *Router) DELETE(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	rt.Handle(http.MethodDelete, pattern, handler, middlewares...)
+}
+
+// ServeHTTP - dispatches the request to the matched route through the router middlewares
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Chain(rt.dispatch, rt.middlewares...)(w, r)
+}
+
+// dispatch - calls handler of the matched route, NotFound or MethodNotAllowed
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+
+	var allowedMethods []string
+	for _, rte := range rt.routes {
+		params, ok := matchPath(rte.segments, segments)
+		if !ok {
+			continue
+		}
+
+		if rte.method != r.Method {
+			allowedMethods = append(allowedMethods, rte.method)
+			continue
+		}
+
+		if len(params) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), pathParamsContextKey, params))
+		}
+
+		rte.handler(w, r)
+		return
+	}
+
+	if len(allowedMethods) > 0 {
+		sort.Strings(allowedMethods)
+		w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		rt.MethodNotAllowed(w, r)
+		return
+	}
+
+	rt.NotFound(w, r)
+}
+
+// PathParam - returns path param of the matched Router route, ex: PathParam(r, "id") for "/orders/{id}"
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsContextKey).(map[string]string)
+	return params[name]
+}
+
+// splitPath - splits path into segments without empty ones
+func splitPath(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments
+}
+
+// matchPath - matches path segments against the pattern segments, returns path params
+func matchPath(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, segment := range pattern {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[segment[1:len(segment)-1]] = path[i]
+			continue
+		}
+
+		if segment != path[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// defaultNotFoundHandler - writes 404 JSON error
+func defaultNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, Errorf("Router", ErrorCodeNotFound, "route %v %v not found", r.Method, r.URL.Path))
+}
+
+// defaultMethodNotAllowedHandler - writes 405 JSON error
+func defaultMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusMethodNotAllowed, ResponseEnvelope{Error: &ResponseError{
+		Code:    "METHOD_NOT_ALLOWED",
+		Message: http.StatusText(http.StatusMethodNotAllowed),
+	}})
+}
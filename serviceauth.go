@@ -0,0 +1,105 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	// googleIDTokenContextKey - context key of the verified *idtoken.Payload
+	googleIDTokenContextKey contextKey = "google_id_token"
+)
+
+// GoogleIDTokenIssuers - allowed issuers of Google-signed identity tokens
+var GoogleIDTokenIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// VerifyGoogleIDToken - http middleware for functions invoked by Cloud Scheduler, Pub/Sub push or other services
+// with Google-signed OIDC identity tokens. Validates the token signature, audience and issuer,
+// and optionally checks that the token was issued for one of the allowedEmails service accounts.
+// audience is usually the URL of the function, GOOGLE_ID_TOKEN_AUDIENCE env variable is used if empty.
+// Stores the verified *idtoken.Payload in the request context (GoogleIDTokenFromContext)
+func VerifyGoogleIDToken(next http.HandlerFunc, audience string, allowedEmails ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		payload, statusCode := verifyGoogleIDTokenRequest(ctx, r, audience, allowedEmails)
+		if statusCode != http.StatusOK {
+			WriteError(w, googleIDTokenError("VerifyGoogleIDToken", statusCode))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, googleIDTokenContextKey, payload)))
+	}
+}
+
+// GoogleIDTokenFromContext - returns the Google ID token payload stored by VerifyGoogleIDToken middleware
+func GoogleIDTokenFromContext(ctx context.Context) (*idtoken.Payload, bool) {
+	payload, ok := ctx.Value(googleIDTokenContextKey).(*idtoken.Payload)
+	return payload, ok && payload != nil
+}
+
+// verifyGoogleIDTokenRequest - verifies the request Bearer token as Google-signed identity token
+// returns verified payload and http.StatusOK or nil and the status code which should be returned to the caller
+func verifyGoogleIDTokenRequest(ctx context.Context, r *http.Request, audience string, allowedEmails []string) (*idtoken.Payload, int) {
+	if audience == "" {
+		audience = packageConfig().GoogleIDTokenAudience
+	}
+	if audience == "" {
+		LogWrite(LogTypeError2, ErrorCodeInternal, "GOOGLE_ID_TOKEN_AUDIENCE is empty", "")
+		return nil, http.StatusInternalServerError
+	}
+
+	rawToken, ok := getBearerToken(r)
+	if !ok {
+		return nil, http.StatusUnauthorized
+	}
+
+	payload, err := idtoken.Validate(ctx, rawToken, audience)
+	if err != nil {
+		LogWrite(LogTypeInfo, 0, fmt.Sprintf("idtoken.Validate error: %v", err.Error()), "")
+		return nil, http.StatusUnauthorized
+	}
+
+	if !containsString(GoogleIDTokenIssuers, payload.Issuer) {
+		LogWrite(LogTypeInfo, 0, fmt.Sprintf("unexpected ID token issuer: %v", payload.Issuer), "")
+		return nil, http.StatusUnauthorized
+	}
+
+	if len(allowedEmails) > 0 {
+		email, _ := payload.Claims["email"].(string)
+		verified, _ := payload.Claims["email_verified"].(bool)
+		if !verified || !containsString(allowedEmails, email) {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("ID token email '%v' is not allowed", email), "")
+			return nil, http.StatusForbidden
+		}
+	}
+
+	return payload, http.StatusOK
+}
+
+// googleIDTokenError - AppError of the verifyGoogleIDTokenRequest status: Unauthenticated for 401,
+// PermissionDenied for 403 and Internal for the missing audience
+func googleIDTokenError(op string, statusCode int) *AppError {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return Errorf(op, ErrorCodeUnauthenticated, "invalid Google ID token")
+	case http.StatusForbidden:
+		return Errorf(op, ErrorCodePermissionDenied, "Google ID token email is not allowed")
+	default:
+		return Errorf(op, ErrorCodeInternal, "failed to verify Google ID token, status %v", statusCode)
+	}
+}
+
+// containsString - checks if the slice contains the value
+func containsString(slice []string, value string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
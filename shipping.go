@@ -0,0 +1,260 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/diegosz/go-graphql-client"
+)
+
+const (
+	// shippingRatesCacheTTL - time the rates of the identical request are reused, short since the rates change
+	shippingRatesCacheTTL = 5 * time.Minute
+	// shippingRatesCacheSize - max cached rate requests
+	shippingRatesCacheSize = 1000
+)
+
+// shippingRatesCache - cached rates of GetShippingRates by the provider instance and the request hash
+var shippingRatesCache = newBoundedTTLCache(shippingRatesCacheTTL, shippingRatesCacheSize)
+
+// ShippingProvider - fulfillment provider used by the order functions, IEClient is the Imprint Engine implementation
+// CreateShipment - creates the fulfillment order of the shipment request
+// GetRates - returns rate options for the destination and items
+// GetTracking - returns tracking events of the shipment, oldest first
+// CancelShipment - cancels the shipment which is not shipped yet
+type ShippingProvider interface {
+	Name() string
+	CreateShipment(ctx context.Context, request ShipmentRequest) (*Shipment, error)
+	GetRates(ctx context.Context, request RateRequest) ([]ShippingRate, error)
+	GetTracking(ctx context.Context, shipmentID string) ([]TrackingEvent, error)
+	CancelShipment(ctx context.Context, shipmentID string) error
+}
+
+// ShippingProviderInstance - provider with several instances of the same Name (ex: IEClient of every fulfillment center
+// and organization), InstanceKey identifies the instance, so the rates of one instance aren't returned by another
+type ShippingProviderInstance interface {
+	InstanceKey() string
+}
+
+// ShippingAddress - destination of the shipment
+type ShippingAddress struct {
+	Name       string `json:"name" firestore:"name" validate:"required" secure:"true"`
+	Company    string `json:"company,omitempty" firestore:"company,omitempty" secure:"true"`
+	Street1    string `json:"street1" firestore:"street1" validate:"required" secure:"true"`
+	Street2    string `json:"street2,omitempty" firestore:"street2,omitempty" secure:"true"`
+	City       string `json:"city" firestore:"city" validate:"required"`
+	State      string `json:"state,omitempty" firestore:"state,omitempty"`
+	PostalCode string `json:"postal_code" firestore:"postal_code" validate:"required"`
+	Country    string `json:"country" firestore:"country" validate:"required,min=2,max=2"`
+	Phone      string `json:"phone,omitempty" firestore:"phone,omitempty" secure:"true"`
+	Email      string `json:"email,omitempty" firestore:"email,omitempty" secure:"true"`
+}
+
+// ShipmentItem - item of the shipment
+type ShipmentItem struct {
+	SKU      string `json:"sku" firestore:"sku" validate:"required"`
+	Quantity int    `json:"quantity" firestore:"quantity" validate:"min=1"`
+}
+
+// ShipmentRequest - request of the CreateShipment
+// OrderID - our order ID, providers use it to reject duplicates
+// ServiceLevel - service level of the chosen ShippingRate, provider default if empty
+type ShipmentRequest struct {
+	OrderID      string          `json:"order_id" firestore:"order_id" validate:"required"`
+	ServiceLevel string          `json:"service_level,omitempty" firestore:"service_level,omitempty"`
+	Address      ShippingAddress `json:"address" firestore:"address"`
+	Items        []ShipmentItem  `json:"items" firestore:"items" validate:"required"`
+}
+
+// Shipment - shipment created by the provider
+type Shipment struct {
+	ID        string    `json:"id"`
+	OrderID   string    `json:"order_id"`
+	Provider  string    `json:"provider"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RateRequest - request of the GetRates
+type RateRequest struct {
+	Address ShippingAddress `json:"address"`
+	Items   []ShipmentItem  `json:"items" validate:"required"`
+}
+
+// ShippingRate - rate option of the provider
+// Cost - cost in the minor units of the currency (cents)
+// EstimatedDays - estimated business days of the delivery, 0 if unknown
+type ShippingRate struct {
+	ServiceLevel  string `json:"service_level"`
+	Carrier       string `json:"carrier"`
+	Cost          int64  `json:"cost"`
+	Currency      string `json:"currency"`
+	EstimatedDays int    `json:"estimated_days"`
+}
+
+// ShippingRatesInput - shippingRates query input of the Imprint Engine schema
+type ShippingRatesInput struct {
+	Address AddressInput     `json:"address"`
+	Items   []OrderItemInput `json:"items"`
+}
+
+var (
+	_ ShippingProvider         = (*IEClient)(nil)
+	_ ShippingProviderInstance = (*IEClient)(nil)
+)
+
+// GetShippingRates - validates the request and returns the provider rates sorted by the cost (cheapest first).
+// Rates of the identical request to the same ShippingProviderInstance are cached for 5 minutes, so the checkout page
+// doesn't query the provider on every render. Rates of the providers which don't implement ShippingProviderInstance
+// aren't cached
+func GetShippingRates(ctx context.Context, provider ShippingProvider, request RateRequest) ([]ShippingRate, error) {
+	if err := ValidateStruct(request); err != nil {
+		return nil, err
+	}
+
+	cacheKey := ""
+	if instance, ok := provider.(ShippingProviderInstance); ok {
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return nil, Errorf("GetShippingRates", ErrorCodeInternal, "failed to marshal rate request: %w", err)
+		}
+		hash := sha256.Sum256(payload)
+		cacheKey = provider.Name() + ":" + instance.InstanceKey() + ":" + hex.EncodeToString(hash[:])
+
+		if cached, ok := shippingRatesCache.get(cacheKey); ok {
+			return copyShippingRates(cached.([]ShippingRate)), nil
+		}
+	}
+
+	rates, err := provider.GetRates(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rates, func(i, j int) bool { return rates[i].Cost < rates[j].Cost })
+
+	if cacheKey != "" {
+		shippingRatesCache.set(cacheKey, copyShippingRates(rates))
+	}
+
+	return rates, nil
+}
+
+// copyShippingRates - copy of the rates, so the callers can't change the cached ones
+func copyShippingRates(rates []ShippingRate) []ShippingRate {
+	return append([]ShippingRate(nil), rates...)
+}
+
+// Name - provider name of the Imprint Engine
+func (c *IEClient) Name() string {
+	return "imprint_engine"
+}
+
+// InstanceKey - GraphQL endpoint, app and organization of the client
+func (c *IEClient) InstanceKey() string {
+	if c.sandbox != nil {
+		return fmt.Sprintf("sandbox:%p", c.sandbox)
+	}
+
+	return c.endpoint + ":" + strconv.FormatInt(c.appID, 10) + ":" + strconv.FormatInt(c.externalID, 10)
+}
+
+// CreateShipment - creates Imprint Engine order of the shipment
+func (c *IEClient) CreateShipment(ctx context.Context, request ShipmentRequest) (*Shipment, error) {
+	order, err := c.CreateOrder(ctx, OrderInput{
+		ExternalOrderID: request.OrderID,
+		ShippingMethod:  request.ServiceLevel,
+		Address:         ieAddressInput(request.Address),
+		Items:           ieOrderItemInputs(request.Items),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Shipment{
+		ID:        order.ID,
+		OrderID:   order.ExternalOrderID,
+		Provider:  c.Name(),
+		Status:    order.Status,
+		CreatedAt: order.CreatedAt,
+	}, nil
+}
+
+// GetRates - returns Imprint Engine rates of the destination and items
+func (c *IEClient) GetRates(ctx context.Context, request RateRequest) ([]ShippingRate, error) {
+	if c.sandbox != nil {
+		return c.sandbox.rates(), nil
+	}
+
+	var query struct {
+		ShippingRates []struct {
+			ServiceLevel  string  `graphql:"serviceLevel"`
+			Carrier       string  `graphql:"carrier"`
+			Cost          float64 `graphql:"cost"`
+			Currency      string  `graphql:"currency"`
+			EstimatedDays int     `graphql:"estimatedDays"`
+		} `graphql:"shippingRates(appId: $appId, input: $input)"`
+	}
+	variables := map[string]interface{}{
+		"appId": graphql.Int(c.appID),
+		"input": ShippingRatesInput{
+			Address: ieAddressInput(request.Address),
+			Items:   ieOrderItemInputs(request.Items),
+		},
+	}
+
+	if err := c.graphql.Query(ctx, "GetRates", &query, variables); err != nil {
+		return nil, Errorf("IEClient.GetRates", ErrorCodeExternalAPI, "failed to get shipping rates: %w", err)
+	}
+
+	rates := make([]ShippingRate, 0, len(query.ShippingRates))
+	for _, rate := range query.ShippingRates {
+		rates = append(rates, ShippingRate{
+			ServiceLevel: rate.ServiceLevel,
+			Carrier:      rate.Carrier,
+			// Imprint Engine returns the cost in the major units
+			Cost:          int64(rate.Cost*100 + 0.5),
+			Currency:      rate.Currency,
+			EstimatedDays: rate.EstimatedDays,
+		})
+	}
+
+	return rates, nil
+}
+
+// CancelShipment - cancels Imprint Engine order of the shipment
+func (c *IEClient) CancelShipment(ctx context.Context, shipmentID string) error {
+	_, err := c.CancelOrder(ctx, shipmentID)
+	return err
+}
+
+// ieAddressInput - converts the address into the Imprint Engine input
+func ieAddressInput(address ShippingAddress) AddressInput {
+	return AddressInput{
+		Name:       address.Name,
+		Company:    address.Company,
+		Street1:    address.Street1,
+		Street2:    address.Street2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+		Email:      address.Email,
+	}
+}
+
+// ieOrderItemInputs - converts the items into the Imprint Engine inputs
+func ieOrderItemInputs(items []ShipmentItem) []OrderItemInput {
+	inputs := make([]OrderItemInput, 0, len(items))
+	for _, item := range items {
+		inputs = append(inputs, OrderItemInput{SKU: item.SKU, Quantity: item.Quantity})
+	}
+
+	return inputs
+}
@@ -0,0 +1,216 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShippingSandbox - canned Imprint Engine responses of the sandbox mode, no network calls are made.
+// Order ID carries its creation time, so the orders created by another function instance are answered the same way,
+// only the cancellations are kept in memory of the instance
+// OrderIDPrefix - prefix of the created order IDs, "sandbox_" if empty
+// TrackingStatuses - Imprint Engine tracking statuses the order goes through, LABEL_CREATED, IN_TRANSIT, OUT_FOR_DELIVERY, DELIVERED if empty
+// StepInterval - time of the single tracking status, the order stays at the first status (and can be cancelled) if empty
+// Carrier - carrier of the shipments, "SANDBOX" if empty
+// Rates - rates returned by GetRates, single standard rate if empty
+// Warehouses - warehouses returned by ListWarehouses
+type ShippingSandbox struct {
+	OrderIDPrefix    string
+	TrackingStatuses []string
+	StepInterval     time.Duration
+	Carrier          string
+	Rates            []ShippingRate
+	Warehouses       []IEWarehouse
+
+	mu        sync.Mutex
+	cancelled map[string]time.Time
+}
+
+// DefaultShippingSandbox - sandbox used by NewIEClient in the IE_SANDBOX mode, can be configured in the init of the function
+var DefaultShippingSandbox = &ShippingSandbox{}
+
+// IsShippingSandbox - IE_SANDBOX env is true, shipping clients return canned responses instead of calling Imprint Engine
+func IsShippingSandbox() bool {
+	return packageConfig().IESandbox
+}
+
+// NewSandboxIEClient - returns IEClient answered by the sandbox, DefaultShippingSandbox if nil
+func NewSandboxIEClient(sandbox *ShippingSandbox) *IEClient {
+	if sandbox == nil {
+		sandbox = DefaultShippingSandbox
+	}
+
+	return &IEClient{sandbox: sandbox}
+}
+
+// createOrder - returns the order with the ID of the external order ID and the creation time
+func (s *ShippingSandbox) createOrder(ctx context.Context, input OrderInput) (*IEOrder, error) {
+	if input.ExternalOrderID == "" {
+		return nil, Errorf("IEClient.CreateOrder", ErrorCodeInvalidArgument, "sandbox order has no external order ID")
+	}
+
+	// order ID keeps the seconds only
+	now := time.Now().UTC().Truncate(time.Second)
+	order := &IEOrder{
+		ID:              s.orderIDPrefix() + strconv.FormatInt(now.Unix(), 10) + "-" + input.ExternalOrderID,
+		ExternalOrderID: input.ExternalOrderID,
+		Status:          IEOrderStatusCreated,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	LoggerFromContext(ctx).Debug("sandbox order created", Fields{"order_id": order.ID})
+
+	return order, nil
+}
+
+// getOrder - returns the order of the sandbox order ID with the status of the reached tracking step
+func (s *ShippingSandbox) getOrder(orderID string) (*IEOrder, error) {
+	createdAt, externalOrderID, ok := s.parseOrderID(orderID)
+	if !ok {
+		return nil, Errorf("IEClient.GetOrderStatus", ErrorCodeNotFound, "sandbox order %v not found", orderID)
+	}
+
+	order := &IEOrder{
+		ID:              orderID,
+		ExternalOrderID: externalOrderID,
+		Status:          IEOrderStatusCreated,
+		CreatedAt:       createdAt,
+		UpdatedAt:       createdAt,
+	}
+
+	s.mu.Lock()
+	cancelledAt, cancelled := s.cancelled[orderID]
+	s.mu.Unlock()
+
+	switch {
+	case cancelled:
+		order.Status = IEOrderStatusCancelled
+		order.UpdatedAt = cancelledAt
+	case s.reachedSteps(createdAt) > 1:
+		order.Status = IEOrderStatusShipped
+		order.UpdatedAt = createdAt.Add(s.StepInterval)
+	}
+
+	return order, nil
+}
+
+// cancelOrder - cancels the order which did not reach the second tracking step
+func (s *ShippingSandbox) cancelOrder(orderID string) (*IEOrder, error) {
+	order, err := s.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == IEOrderStatusShipped {
+		return nil, Errorf("IEClient.CancelOrder", ErrorCodeConflict, "sandbox order %v is already shipped", orderID)
+	}
+
+	s.mu.Lock()
+	if s.cancelled == nil {
+		s.cancelled = map[string]time.Time{}
+	}
+	if _, ok := s.cancelled[orderID]; !ok {
+		s.cancelled[orderID] = time.Now().UTC()
+	}
+	s.mu.Unlock()
+
+	return s.getOrder(orderID)
+}
+
+// tracking - returns events of the reached tracking steps, cancelled orders have no events
+func (s *ShippingSandbox) tracking(orderID string) ([]TrackingEvent, error) {
+	order, err := s.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == IEOrderStatusCancelled {
+		return []TrackingEvent{}, nil
+	}
+
+	carrier := s.Carrier
+	if carrier == "" {
+		carrier = "SANDBOX"
+	}
+	trackingNumber := "SANDBOX" + strconv.FormatInt(order.CreatedAt.Unix(), 10)
+
+	statuses := s.trackingStatuses()
+	events := []TrackingEvent{}
+	for i := 0; i < s.reachedSteps(order.CreatedAt); i++ {
+		events = append(events, TrackingEvent{
+			Carrier:        carrier,
+			TrackingNumber: trackingNumber,
+			Status:         normalizeIETrackingStatus(statuses[i]),
+			CarrierStatus:  statuses[i],
+			Description:    "sandbox " + strings.ToLower(statuses[i]),
+			OccurredAt:     order.CreatedAt.Add(time.Duration(i) * s.StepInterval),
+		})
+	}
+
+	return events, nil
+}
+
+// rates - configured rates or the single standard rate
+func (s *ShippingSandbox) rates() []ShippingRate {
+	if len(s.Rates) == 0 {
+		return []ShippingRate{{ServiceLevel: "standard", Carrier: "SANDBOX", Cost: 500, Currency: "USD", EstimatedDays: 5}}
+	}
+
+	rates := make([]ShippingRate, len(s.Rates))
+	copy(rates, s.Rates)
+
+	return rates
+}
+
+// reachedSteps - number of the tracking statuses reached since the order creation, the first one without StepInterval
+func (s *ShippingSandbox) reachedSteps(createdAt time.Time) int {
+	statuses := s.trackingStatuses()
+	if s.StepInterval <= 0 {
+		return 1
+	}
+
+	steps := int(time.Since(createdAt)/s.StepInterval) + 1
+	if steps > len(statuses) {
+		return len(statuses)
+	}
+
+	return steps
+}
+
+// trackingStatuses - configured statuses or the successful delivery
+func (s *ShippingSandbox) trackingStatuses() []string {
+	if len(s.TrackingStatuses) == 0 {
+		return []string{"LABEL_CREATED", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"}
+	}
+
+	return s.TrackingStatuses
+}
+
+// orderIDPrefix - configured prefix or "sandbox_"
+func (s *ShippingSandbox) orderIDPrefix() string {
+	if s.OrderIDPrefix == "" {
+		return "sandbox_"
+	}
+
+	return s.OrderIDPrefix
+}
+
+// parseOrderID - returns creation time and external order ID of the "<prefix><unix>-<external order ID>" order ID
+func (s *ShippingSandbox) parseOrderID(orderID string) (time.Time, string, bool) {
+	rest, ok := strings.CutPrefix(orderID, s.orderIDPrefix())
+	if !ok {
+		return time.Time{}, "", false
+	}
+
+	unix, externalOrderID, ok := strings.Cut(rest, "-")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	return time.Unix(seconds, 0).UTC(), externalOrderID, true
+}
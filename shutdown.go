@@ -0,0 +1,110 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownFunc - cleanup function of the component called by the Drain
+type ShutdownFunc func(ctx context.Context) error
+
+// shutdownHook - registered ShutdownFunc
+type shutdownHook struct {
+	name string
+	fn   ShutdownFunc
+}
+
+// ShutdownRegistry - list of the components cleanup functions (loggers, clients, notifier queues, metric writers)
+// which should be called before the instance terminates, so buffered logs and pending writes aren't lost
+type ShutdownRegistry struct {
+	mu      sync.Mutex
+	hooks   []shutdownHook
+	drained bool
+}
+
+// DefaultShutdownRegistry - registry used by RegisterShutdown, Drain and DrainOnSignal
+var DefaultShutdownRegistry = &ShutdownRegistry{}
+
+// Register - adds cleanup function, functions are called in the reverse order of the registration
+func (sr *ShutdownRegistry) Register(name string, fn ShutdownFunc) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sr.hooks = append(sr.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// RegisterCloser - adds Close of the io.Closer (ex: *firestore.Client, *Logger, *CloudMonitoringMetricWriter)
+func (sr *ShutdownRegistry) RegisterCloser(name string, closer io.Closer) {
+	sr.Register(name, func(ctx context.Context) error {
+		return closer.Close()
+	})
+}
+
+// Drain - calls registered functions once in the reverse order (components registered later may use earlier ones,
+// ex: client which logs to the logger), returns joined errors of the failed functions
+func (sr *ShutdownRegistry) Drain(ctx context.Context) error {
+	sr.mu.Lock()
+	if sr.drained {
+		sr.mu.Unlock()
+		return nil
+	}
+	sr.drained = true
+	hooks := sr.hooks
+	sr.mu.Unlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shutdown %v. Error: %v", hooks[i].name, err.Error()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RegisterShutdown - adds cleanup function to the DefaultShutdownRegistry,
+// ex: RegisterShutdown("notifier", asyncNotifier.Close)
+func RegisterShutdown(name string, fn ShutdownFunc) {
+	DefaultShutdownRegistry.Register(name, fn)
+}
+
+// RegisterCloser - adds Close of the io.Closer to the DefaultShutdownRegistry, ex: RegisterCloser("logger", logger)
+func RegisterCloser(name string, closer io.Closer) {
+	DefaultShutdownRegistry.RegisterCloser(name, closer)
+}
+
+// Drain - calls cleanup functions of the DefaultShutdownRegistry
+func Drain(ctx context.Context) error {
+	return DefaultShutdownRegistry.Drain(ctx)
+}
+
+// DrainOnSignal - calls Drain with the timeout when the instance receives SIGTERM (sent by Cloud Functions gen2 / Cloud Run
+// before the instance is stopped) or SIGINT (local funcframework runs), should be called once in the function init
+func DrainOnSignal(timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := Drain(ctx); err != nil {
+			LogWrite(LogTypeError2, ErrorCodeInternal, fmt.Sprintf("failed to drain on %v. Error: %v", sig, err.Error()), "")
+		}
+
+		// signal handling was restored by signal.Stop, so the resent signal terminates the process as usual
+		if process, err := os.FindProcess(os.Getpid()); err == nil {
+			process.Signal(sig)
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package cloudfunctions_go_utils
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/logging"
+)
+
+// stdoutLogBackend - logBackend which writes entries as structured-log JSON lines, parsed by Cloud Logging agent
+// of Cloud Functions gen2 / Cloud Run. Payload keys are placed at the top level with the special fields:
+// severity, message, logging.googleapis.com/trace, logging.googleapis.com/spanId,
+// logging.googleapis.com/trace_sampled, logging.googleapis.com/labels, logging.googleapis.com/sourceLocation
+type stdoutLogBackend struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// stdoutLoggingEnabled - checks LOG_STDOUT env variable, used by NewLogger
+func stdoutLoggingEnabled() bool {
+	return packageConfig().LogStdout
+}
+
+// WithStdout - returns derived logger which writes canonical structured-log JSON lines to the writer (os.Stdout if nil)
+// instead of calling Cloud Logging API, so severity and trace correlation work for stdout-only deployments.
+// NewLogger enables it automatically if LOG_STDOUT env variable is set to true
+func (pl *Logger) WithStdout(writer io.Writer) *Logger {
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	derived := *pl
+	derived.backend = &stdoutLogBackend{writer: writer}
+
+	return &derived
+}
+
+func (b *stdoutLogBackend) log(projectID, logName string, entry logging.Entry) {
+	line := structuredLogLine(entry)
+
+	lineBytes, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("Failed to marshal log entry: %v", err)
+		return
+	}
+	lineBytes = append(lineBytes, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writer.Write(lineBytes)
+}
+
+func (b *stdoutLogBackend) flush() error {
+	return nil
+}
+
+func (b *stdoutLogBackend) close() error {
+	return nil
+}
+
+// structuredLogLine - converts the entry to the structured-log JSON object
+func structuredLogLine(entry logging.Entry) map[string]interface{} {
+	line := map[string]interface{}{}
+
+	// payload fields are moved to the top level, so they land in the jsonPayload
+	payloadBytes, err := json.Marshal(entry.Payload)
+	if err == nil {
+		json.Unmarshal(payloadBytes, &line)
+	}
+	if _, ok := line["message"]; !ok {
+		line["message"] = ""
+	}
+
+	if entry.Severity != logging.Default {
+		line["severity"] = entry.Severity.String()
+	}
+	if entry.Trace != "" {
+		line["logging.googleapis.com/trace"] = entry.Trace
+	}
+	if entry.SpanID != "" {
+		line["logging.googleapis.com/spanId"] = entry.SpanID
+	}
+	if entry.TraceSampled {
+		line["logging.googleapis.com/trace_sampled"] = true
+	}
+	if len(entry.Labels) > 0 {
+		line["logging.googleapis.com/labels"] = entry.Labels
+	}
+	if entry.SourceLocation != nil {
+		line["logging.googleapis.com/sourceLocation"] = map[string]interface{}{
+			"file":     entry.SourceLocation.File,
+			"line":     strconv.FormatInt(entry.SourceLocation.Line, 10),
+			"function": entry.SourceLocation.Function,
+		}
+	}
+
+	return line
+}
@@ -0,0 +1,168 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	gax "github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	storageInitialBackoff = 500 * time.Millisecond
+	storageMaxBackoff     = 10 * time.Second
+)
+
+// ErrObjectNotFound - returned by DownloadObject if the object doesn't exist
+var ErrObjectNotFound = errors.New("object not found")
+
+var (
+	// cachedStorageClient - process-level Cloud Storage client, use GetStorageClient to get it
+	cachedStorageClient   *storage.Client
+	cachedStorageClientMu sync.Mutex
+)
+
+// GetStorageClient - returns process-level cached Cloud Storage client.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetStorageClient(ctx context.Context) (*storage.Client, error) {
+	cachedStorageClientMu.Lock()
+	defer cachedStorageClientMu.Unlock()
+
+	if cachedStorageClient != nil {
+		return cachedStorageClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client. Error: %v", err.Error())
+	}
+	cachedStorageClient = client
+
+	return cachedStorageClient, nil
+}
+
+// GenerateSignedURL - returns V4 signed URL of the object for the method (GET if empty) which expires after the expiry.
+// In Cloud Functions the URL is signed with the function service account by IAM signBlob
+// (service account needs roles/iam.serviceAccountTokenCreator on itself)
+func GenerateSignedURL(ctx context.Context, bucket, object, method string, expiry time.Duration) (string, error) {
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	url, err := client.Bucket(bucket).SignedURL(object, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  method,
+		Expires: time.Now().Add(expiry),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL of '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+
+	return url, nil
+}
+
+// storageObject - object handle which retries all transient errors with exponential backoff,
+// used by the helpers since their operations overwrite or delete whole objects and are safe to repeat
+func storageObject(client *storage.Client, bucket, object string) *storage.ObjectHandle {
+	return client.Bucket(bucket).Object(object).Retryer(
+		storage.WithBackoff(gax.Backoff{Initial: storageInitialBackoff, Max: storageMaxBackoff}),
+		storage.WithPolicy(storage.RetryAlways),
+	)
+}
+
+// UploadObject - uploads data to the bucket object with the content type (detected by the content if empty)
+func UploadObject(ctx context.Context, bucket, object string, data []byte, contentType string) error {
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	writer := storageObject(client, bucket, object).NewWriter(ctx)
+	writer.ContentType = contentType
+	writer.ChunkSize = 0 // single request upload, data is already in memory
+
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+
+	return nil
+}
+
+// DownloadObject - returns data of the bucket object, ErrObjectNotFound if the object doesn't exist
+func DownloadObject(ctx context.Context, bucket, object string) ([]byte, error) {
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := storageObject(client, bucket, object).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+
+	return data, nil
+}
+
+// DeleteObject - deletes the bucket object, missing object is not an error
+func DeleteObject(ctx context.Context, bucket, object string) error {
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = storageObject(client, bucket, object).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete '%v/%v'. Error: %v", bucket, object, err.Error())
+	}
+
+	return nil
+}
+
+// ListObjects - returns page of the bucket objects with the prefix and token of the next page (empty for the last page).
+// pageToken is empty for the first page
+func ListObjects(ctx context.Context, bucket, prefix string, pageSize int, pageToken string) ([]*storage.ObjectAttrs, string, error) {
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	iter := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+
+	var objects []*storage.ObjectAttrs
+	nextPageToken, err := iterator.NewPager(iter, pageSize, pageToken).NextPage(&objects)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list objects of '%v/%v'. Error: %v", bucket, prefix, err.Error())
+	}
+
+	return objects, nextPageToken, nil
+}
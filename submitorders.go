@@ -0,0 +1,161 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// OrderSubmitSucceeded - shipment was created
+	OrderSubmitSucceeded = "succeeded"
+	// OrderSubmitFailed - order was rejected (invalid order, unknown SKU), submitting it again fails the same way
+	OrderSubmitFailed = "failed"
+	// OrderSubmitRetryable - order failed with the transient error (timeout, 429, 5xx, open circuit) or wasn't submitted
+	// before the context was done, it should be submitted again later
+	OrderSubmitRetryable = "retryable"
+
+	defaultSubmitConcurrency       = 5
+	defaultSubmitRequestsPerSecond = 5
+)
+
+// SubmitOrdersOptions - options of the SubmitOrders
+// Concurrency - max orders submitted at the same time, 5 if empty
+// RequestsPerSecond - max shipments created per second to stay under the provider rate limit, 5 if empty
+type SubmitOrdersOptions struct {
+	Concurrency       int
+	RequestsPerSecond float64
+}
+
+// OrderSubmitResult - result of the single order of the SubmitOrders
+// Status - OrderSubmitSucceeded, OrderSubmitFailed or OrderSubmitRetryable
+// Shipment - created shipment of the succeeded order
+type OrderSubmitResult struct {
+	Request  ShipmentRequest `json:"request"`
+	Status   string          `json:"status"`
+	Shipment *Shipment       `json:"shipment,omitempty"`
+	Error    error           `json:"-"`
+}
+
+// SubmitOrders - validates and submits the orders to the provider with the bounded concurrency and rate,
+// returns the result of every order in the order of the input. Single order failures don't stop the batch
+func SubmitOrders(ctx context.Context, provider ShippingProvider, orders []ShipmentRequest, options SubmitOrdersOptions) []OrderSubmitResult {
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultSubmitConcurrency
+	}
+	if options.RequestsPerSecond <= 0 {
+		options.RequestsPerSecond = defaultSubmitRequestsPerSecond
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(options.RequestsPerSecond), 1)
+	semaphore := make(chan struct{}, options.Concurrency)
+	results := make([]OrderSubmitResult, len(orders))
+
+	var wg sync.WaitGroup
+	for i, order := range orders {
+		results[i] = OrderSubmitResult{Request: order}
+
+		if err := ValidateStruct(order); err != nil {
+			results[i].Status = OrderSubmitFailed
+			results[i].Error = err
+			continue
+		}
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Status = OrderSubmitRetryable
+			results[i].Error = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *OrderSubmitResult) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			submitOrder(ctx, provider, limiter, result)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	logSubmitResults(ctx, provider, results)
+
+	return results
+}
+
+// RetryableOrders - requests of the retryable results, to be requeued by the batch function
+func RetryableOrders(results []OrderSubmitResult) []ShipmentRequest {
+	orders := []ShipmentRequest{}
+	for _, result := range results {
+		if result.Status == OrderSubmitRetryable {
+			orders = append(orders, result.Request)
+		}
+	}
+
+	return orders
+}
+
+// IsRetryableShippingError - checks if the provider call failed with the transient error
+func IsRetryableShippingError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+
+	var graphQLErr *GraphQLError
+	if errors.As(err, &graphQLErr) {
+		return isRetryableGraphQLError(graphQLErr)
+	}
+
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.Code == ErrorCodeResourceExhausted || appErr.Code == ErrorCodeDeadlineExceeded
+	}
+
+	return false
+}
+
+// submitOrder - creates the shipment of the result request after the limiter allows it
+func submitOrder(ctx context.Context, provider ShippingProvider, limiter *rate.Limiter, result *OrderSubmitResult) {
+	if err := limiter.Wait(ctx); err != nil {
+		result.Status = OrderSubmitRetryable
+		result.Error = err
+		return
+	}
+
+	shipment, err := provider.CreateShipment(ctx, result.Request)
+	switch {
+	case err == nil:
+		result.Status = OrderSubmitSucceeded
+		result.Shipment = shipment
+	case IsRetryableShippingError(err) || ctx.Err() != nil:
+		result.Status = OrderSubmitRetryable
+		result.Error = err
+	default:
+		result.Status = OrderSubmitFailed
+		result.Error = err
+	}
+}
+
+// logSubmitResults - logs summary of the batch and the failed orders
+func logSubmitResults(ctx context.Context, provider ShippingProvider, results []OrderSubmitResult) {
+	logger := LoggerFromContext(ctx)
+	counts := map[string]int{}
+
+	for _, result := range results {
+		counts[result.Status]++
+		if result.Error != nil {
+			logger.Warning("order submit failed", Fields{"order_id": result.Request.OrderID, "status": result.Status, "error": result.Error.Error()})
+		}
+	}
+
+	logger.Info("orders submitted", Fields{
+		"provider":  provider.Name(),
+		"total":     len(results),
+		"succeeded": counts[OrderSubmitSucceeded],
+		"failed":    counts[OrderSubmitFailed],
+		"retryable": counts[OrderSubmitRetryable],
+	})
+}
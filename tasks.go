@@ -0,0 +1,274 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	"cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// cloudTaskContextKey - context key of the *CloudTaskInfo
+	cloudTaskContextKey contextKey = "cloud_task"
+)
+
+// ErrTaskAlreadyExists - returned by EnqueueTask when the task with the same name was already created
+// (deduplicated, task names are reserved for ~1 hour after the task is deleted or executed)
+var ErrTaskAlreadyExists = errors.New("task already exists")
+
+// DefaultTaskRetryConfig - retry config applied by ConfigureTaskQueue if the config is empty
+var DefaultTaskRetryConfig = &cloudtaskspb.RetryConfig{
+	MaxAttempts:  10,
+	MinBackoff:   durationpb.New(10 * time.Second),
+	MaxBackoff:   durationpb.New(10 * time.Minute),
+	MaxDoublings: 5,
+}
+
+var (
+	// cachedTasksClient - process-level Cloud Tasks client, use GetTasksClient to get it
+	cachedTasksClient   *cloudtasks.Client
+	cachedTasksClientMu sync.Mutex
+)
+
+// GetTasksClient - returns process-level cached Cloud Tasks client.
+// Client is created lazily on the first call, failed creation is retried on the next call
+func GetTasksClient(ctx context.Context) (*cloudtasks.Client, error) {
+	cachedTasksClientMu.Lock()
+	defer cachedTasksClientMu.Unlock()
+
+	if cachedTasksClient != nil {
+		return cachedTasksClient, nil
+	}
+
+	// background context is used since the client outlives the request
+	client, err := cloudtasks.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloud tasks client. Error: %v", err.Error())
+	}
+	cachedTasksClient = client
+
+	return cachedTasksClient, nil
+}
+
+// TaskOptions - options of the EnqueueTask
+// Queue - queue ID or full queue name (projects/<project>/locations/<location>/queues/<queue>)
+// Location - location of the queue ID, CLOUD_TASKS_LOCATION or FUNCTION_REGION env variable if empty
+// URL - URL of the target function
+// Method - http method, POST if empty
+// Headers - additional request headers
+// ServiceAccountEmail - service account of the OIDC token, CLOUD_TASKS_SERVICE_ACCOUNT env variable if empty
+// Audience - audience of the OIDC token, URL if empty
+// Name - task ID used for the deduplication, generated if empty
+// ScheduleTime - time of the task dispatch, immediately if empty
+// DispatchDeadline - time the target has to respond, 10 minutes (Cloud Tasks default) if empty
+type TaskOptions struct {
+	Queue               string
+	Location            string
+	URL                 string
+	Method              string
+	Headers             map[string]string
+	ServiceAccountEmail string
+	Audience            string
+	Name                string
+	ScheduleTime        time.Time
+	DispatchDeadline    time.Duration
+}
+
+// TaskQueueName - returns full queue name of the queue ID in the location of the GCLOUD_PROJECT project
+func TaskQueueName(location, queue string) string {
+	if strings.HasPrefix(queue, "projects/") {
+		return queue
+	}
+
+	if location == "" {
+		location = packageConfig().TasksLocation
+	}
+	if location == "" {
+		location = packageConfig().FunctionRegion
+	}
+
+	return "projects/" + packageConfig().ProjectID + "/locations/" + location + "/queues/" + queue
+}
+
+// EnqueueTask - creates HTTP target task with the JSON payload and OIDC token of the service account,
+// so the target can verify it with VerifyCloudTask. Returns ErrTaskAlreadyExists for the duplicated Name
+func EnqueueTask(ctx context.Context, options TaskOptions, payload interface{}) (*cloudtaskspb.Task, error) {
+	client, err := GetTasksClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal task payload. Error: %v", err.Error())
+	}
+
+	method := cloudtaskspb.HttpMethod_POST
+	if options.Method != "" {
+		value, ok := cloudtaskspb.HttpMethod_value[strings.ToUpper(options.Method)]
+		if !ok {
+			return nil, fmt.Errorf("failed to create task. Error: unsupported method %v", options.Method)
+		}
+		method = cloudtaskspb.HttpMethod(value)
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for key, value := range options.Headers {
+		headers[key] = value
+	}
+	if executionID := ExecutionIDFromContext(ctx); executionID != "" {
+		headers[ExecutionIDHeader] = executionID
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		headers[RequestIDHeader] = requestID
+	}
+
+	httpRequest := &cloudtaskspb.HttpRequest{
+		Url:        options.URL,
+		HttpMethod: method,
+		Headers:    headers,
+		Body:       body,
+	}
+
+	serviceAccountEmail := options.ServiceAccountEmail
+	if serviceAccountEmail == "" {
+		serviceAccountEmail = packageConfig().TasksServiceAccount
+	}
+	if serviceAccountEmail != "" {
+		audience := options.Audience
+		if audience == "" {
+			audience = options.URL
+		}
+
+		httpRequest.AuthorizationHeader = &cloudtaskspb.HttpRequest_OidcToken{
+			OidcToken: &cloudtaskspb.OidcToken{
+				ServiceAccountEmail: serviceAccountEmail,
+				Audience:            audience,
+			},
+		}
+	}
+
+	queueName := TaskQueueName(options.Location, options.Queue)
+	task := &cloudtaskspb.Task{
+		MessageType: &cloudtaskspb.Task_HttpRequest{HttpRequest: httpRequest},
+	}
+	if options.Name != "" {
+		task.Name = queueName + "/tasks/" + options.Name
+	}
+	if !options.ScheduleTime.IsZero() {
+		task.ScheduleTime = timestamppb.New(options.ScheduleTime)
+	}
+	if options.DispatchDeadline > 0 {
+		task.DispatchDeadline = durationpb.New(options.DispatchDeadline)
+	}
+
+	created, err := client.CreateTask(ctx, &cloudtaskspb.CreateTaskRequest{Parent: queueName, Task: task})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil, ErrTaskAlreadyExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create task in '%v'. Error: %v", queueName, err.Error())
+	}
+
+	return created, nil
+}
+
+// ConfigureTaskQueue - sets retry config of the queue (DefaultTaskRetryConfig if empty), other settings of the queue
+// (ex: rate limits) are kept. Should be called from the deployment scripts rather than from every request
+func ConfigureTaskQueue(ctx context.Context, location, queue string, retryConfig *cloudtaskspb.RetryConfig) error {
+	client, err := GetTasksClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if retryConfig == nil {
+		retryConfig = DefaultTaskRetryConfig
+	}
+
+	queueName := TaskQueueName(location, queue)
+	_, err = client.UpdateQueue(ctx, &cloudtaskspb.UpdateQueueRequest{
+		Queue: &cloudtaskspb.Queue{
+			Name:        queueName,
+			RetryConfig: retryConfig,
+		},
+		// empty mask would reset all other fields of the queue
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"retry_config"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update queue '%v'. Error: %v", queueName, err.Error())
+	}
+
+	return nil
+}
+
+// CloudTaskInfo - Cloud Tasks headers of the task request
+type CloudTaskInfo struct {
+	QueueName        string
+	TaskName         string
+	RetryCount       int
+	ExecutionCount   int
+	ETA              time.Time
+	PreviousResponse int
+	RetryReason      string
+}
+
+// VerifyCloudTask - http middleware for the task targets: verifies OIDC token of the task (audience and optionally
+// the service account emails, same as VerifyGoogleIDToken), checks the X-CloudTasks-QueueName header
+// against the queues (queue IDs, any queue if empty) and stores *CloudTaskInfo in the request context (CloudTaskFromContext)
+func VerifyCloudTask(next http.HandlerFunc, audience string, queues []string, allowedEmails ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		_, statusCode := verifyGoogleIDTokenRequest(ctx, r, audience, allowedEmails)
+		if statusCode != http.StatusOK {
+			WriteError(w, googleIDTokenError("VerifyCloudTask", statusCode))
+			return
+		}
+
+		task := cloudTaskInfoFromHeaders(r.Header)
+		if task.TaskName == "" || (len(queues) > 0 && !containsString(queues, task.QueueName)) {
+			LogWrite(LogTypeInfo, 0, fmt.Sprintf("unexpected task queue '%v'", task.QueueName), "")
+			WriteError(w, Errorf("VerifyCloudTask", ErrorCodePermissionDenied, "unexpected task queue '%v'", task.QueueName))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, cloudTaskContextKey, task)))
+	}
+}
+
+// CloudTaskFromContext - returns task info stored by VerifyCloudTask middleware
+func CloudTaskFromContext(ctx context.Context) (*CloudTaskInfo, bool) {
+	task, ok := ctx.Value(cloudTaskContextKey).(*CloudTaskInfo)
+	return task, ok && task != nil
+}
+
+// cloudTaskInfoFromHeaders - parses X-CloudTasks-* headers
+func cloudTaskInfoFromHeaders(header http.Header) *CloudTaskInfo {
+	task := &CloudTaskInfo{
+		QueueName:   header.Get("X-CloudTasks-QueueName"),
+		TaskName:    header.Get("X-CloudTasks-TaskName"),
+		RetryReason: header.Get("X-CloudTasks-TaskRetryReason"),
+	}
+
+	task.RetryCount, _ = strconv.Atoi(header.Get("X-CloudTasks-TaskRetryCount"))
+	task.ExecutionCount, _ = strconv.Atoi(header.Get("X-CloudTasks-TaskExecutionCount"))
+	task.PreviousResponse, _ = strconv.Atoi(header.Get("X-CloudTasks-TaskPreviousResponse"))
+	if eta, err := strconv.ParseFloat(header.Get("X-CloudTasks-TaskETA"), 64); err == nil {
+		task.ETA = time.Unix(0, int64(eta*float64(time.Second)))
+	}
+
+	return task
+}
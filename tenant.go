@@ -0,0 +1,262 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"github.com/fatih/structs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// tenantContextKey - context key of the tenant ID
+	tenantContextKey contextKey = "tenant_id"
+
+	// TenantClaim - custom claim with the tenant ID of the user, ex: {"tenant_id": "acme"}
+	TenantClaim = "tenant_id"
+	// TenantHeader - request header with the tenant ID of the trusted service calls
+	TenantHeader = "X-Tenant-ID"
+	// TenantIDField - document field with the tenant ID of the TenantScopeField repositories
+	TenantIDField = "tenant_id"
+)
+
+// TenantScope - how TenantRepository separates the documents of the tenants
+type TenantScope int
+
+const (
+	// TenantScopePath - documents are stored in the tenant subcollection: tenants/<tenant ID>/<collection>
+	TenantScopePath TenantScope = iota
+	// TenantScopeField - documents are stored in the shared collection with the TenantIDField
+	TenantScopeField
+)
+
+var (
+	TenantsCollection string = "tenants"
+)
+
+// ErrNoTenant - returned by TenantRepository when there is no tenant in the context
+var ErrNoTenant = errors.New("tenant is not set")
+
+// ContextWithTenant - returns context with the tenant ID, ex: for the background jobs processing a tenant
+func ContextWithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenantID)
+}
+
+// TenantFromContext - returns tenant ID stored by WithTenant middleware or ContextWithTenant
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantContextKey).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// TenantOptions - options of the WithTenant middleware
+// AllowHeader - accepts X-Tenant-ID header if the verified user token has no tenant,
+// only for the functions which are called by trusted services (ex: behind VerifyGoogleIDToken or RequireAPIKey)
+// Optional - requests without tenant are passed to next, otherwise they are rejected with 403
+type TenantOptions struct {
+	AllowHeader bool
+	Optional    bool
+}
+
+// WithTenant - http middleware which resolves the tenant ID of the request and stores it in the context.
+// Tenant is taken from the TenantClaim custom claim or the Identity Platform tenant of the verified user token
+// (so it should be chained after the Firebase auth middleware), then from the X-Tenant-ID header if allowed.
+// Header which doesn't match the token tenant is rejected with 403
+func WithTenant(next http.HandlerFunc, options TenantOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		tenantID := ""
+		if token, ok := UserFromContext(ctx); ok {
+			if claim, ok := token.Claims[TenantClaim].(string); ok {
+				tenantID = claim
+			} else {
+				tenantID = token.Firebase.Tenant
+			}
+		}
+
+		if header := r.Header.Get(TenantHeader); header != "" {
+			if tenantID != "" && header != tenantID {
+				WriteError(w, Errorf("WithTenant", ErrorCodePermissionDenied, "tenant header %v doesn't match token tenant %v", header, tenantID))
+				return
+			}
+			if options.AllowHeader {
+				tenantID = header
+			}
+		}
+
+		if tenantID == "" {
+			if options.Optional {
+				next(w, r)
+				return
+			}
+
+			WriteError(w, Errorf("WithTenant", ErrorCodePermissionDenied, "request has no tenant").WithMessage("tenant is required"))
+			return
+		}
+
+		next(w, r.WithContext(ContextWithTenant(ctx, tenantID)))
+	}
+}
+
+// TenantRepository - tenant-aware wrapper of the entity helpers for the collection, the tenant is taken from the context
+// of every call. TenantScopePath repository reads and writes tenants/<tenant ID>/<collection>,
+// TenantScopeField repository sets TenantIDField on writes and hides documents of other tenants (NotFound AppError)
+type TenantRepository struct {
+	fireclient     *firestore.Client
+	collectionName string
+	scope          TenantScope
+	audit          EntityAudit
+}
+
+func NewTenantRepository(fireclient *firestore.Client, collectionName string, scope TenantScope) *TenantRepository {
+	return &TenantRepository{fireclient: fireclient, collectionName: collectionName, scope: scope}
+}
+
+// WithAudit - passes the Add, Edit and Delete changes of the repository to the audit hook
+func (tr *TenantRepository) WithAudit(audit EntityAudit) *TenantRepository {
+	tr.audit = audit
+	return tr
+}
+
+// CollectionPath - returns collection path of the context tenant
+func (tr *TenantRepository) CollectionPath(ctx context.Context) (string, error) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return "", E("TenantRepository", ErrorCodePermissionDenied, ErrNoTenant)
+	}
+
+	if tr.scope == TenantScopeField {
+		return tr.collectionName, nil
+	}
+
+	return TenantsCollection + "/" + tenantID + "/" + tr.collectionName, nil
+}
+
+// Query - returns query of the context tenant documents
+func (tr *TenantRepository) Query(ctx context.Context) (firestore.Query, error) {
+	path, err := tr.CollectionPath(ctx)
+	if err != nil {
+		return firestore.Query{}, err
+	}
+
+	query := tr.fireclient.Collection(path).Query
+	if tr.scope == TenantScopeField {
+		tenantID, _ := TenantFromContext(ctx)
+		query = query.Where(TenantIDField, "==", tenantID)
+	}
+
+	return query, nil
+}
+
+// Add - adds the entity for the context tenant, see AddEntityToFirestore
+func (tr *TenantRepository) Add(ctx context.Context, entity interface{}) (*firestore.DocumentRef, error) {
+	path, err := tr.CollectionPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.scope == TenantScopeField {
+		entity = withTenantField(ctx, entity)
+	}
+
+	return AddEntityToFirestoreWithAudit(ctx, tr.fireclient, path, entity, tr.audit)
+}
+
+// Get - gets the entity of the context tenant, see GetEntityFromFirestore
+func (tr *TenantRepository) Get(ctx context.Context, entityID string) (*firestore.DocumentSnapshot, error) {
+	path, err := tr.CollectionPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dsnap, err := GetEntityFromFirestore(ctx, tr.fireclient, path, entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.scope == TenantScopeField {
+		tenantID, _ := TenantFromContext(ctx)
+		if stored, _ := dsnap.Data()[TenantIDField].(string); stored != tenantID {
+			// documents of other tenants are reported as missing so their IDs can't be probed
+			return nil, Errorf("TenantRepository.Get", ErrorCodeNotFound, "entity %v doesn't belong to tenant %v", entityID, tenantID)
+		}
+	}
+
+	return dsnap, nil
+}
+
+// Edit - edits the entity of the context tenant, see EditEntityInFirestore
+func (tr *TenantRepository) Edit(ctx context.Context, entityID string, entity interface{}) error {
+	path, err := tr.CollectionPath(ctx)
+	if err != nil {
+		return err
+	}
+
+	if tr.scope == TenantScopeField {
+		if err := tr.checkOwner(ctx, path, entityID); err != nil {
+			return err
+		}
+		entity = withTenantField(ctx, entity)
+	}
+
+	return EditEntityInFirestoreWithAudit(ctx, tr.fireclient, path, entityID, entity, tr.audit)
+}
+
+// Delete - deletes the entity of the context tenant, see DeleteEntityFromFirestore
+func (tr *TenantRepository) Delete(ctx context.Context, entityID string) (*firestore.WriteResult, error) {
+	path, err := tr.CollectionPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.scope == TenantScopeField {
+		if err := tr.checkOwner(ctx, path, entityID); err != nil {
+			return nil, err
+		}
+	}
+
+	return DeleteEntityFromFirestoreWithAudit(ctx, tr.fireclient, path, entityID, tr.audit)
+}
+
+// checkOwner - checks that the existing document belongs to the context tenant, missing document is allowed
+// so Edit can create it
+func (tr *TenantRepository) checkOwner(ctx context.Context, path, entityID string) error {
+	tenantID, _ := TenantFromContext(ctx)
+
+	dsnap, err := tr.fireclient.Collection(path).Doc(entityID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check tenant of '%v' in the '%v' collection. Error: %v", entityID, path, err.Error())
+	}
+
+	if stored, _ := dsnap.Data()[TenantIDField].(string); stored != tenantID {
+		return Errorf("TenantRepository", ErrorCodeNotFound, "entity %v doesn't belong to tenant %v", entityID, tenantID)
+	}
+
+	return nil
+}
+
+// withTenantField - returns the entity as map with the TenantIDField of the context tenant.
+// Structs are converted with structs.Map, so their structs tags should match the firestore tags
+func withTenantField(ctx context.Context, entity interface{}) map[string]interface{} {
+	tenantID, _ := TenantFromContext(ctx)
+
+	var fields map[string]interface{}
+	if typed, ok := entity.(map[string]interface{}); ok {
+		fields = make(map[string]interface{}, len(typed)+1)
+		for key, value := range typed {
+			fields[key] = value
+		}
+	} else {
+		fields = structs.Map(entity)
+	}
+	fields[TenantIDField] = tenantID
+
+	return fields
+}
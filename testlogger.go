@@ -0,0 +1,117 @@
+package cloudfunctions_go_utils
+
+import (
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/logging"
+)
+
+// RecordedEntry - log entry captured by the TestLogger
+type RecordedEntry struct {
+	Severity     logging.Severity
+	Labels       map[string]string
+	Payload      LogEntryPayload
+	Trace        string
+	SpanID       string
+	TraceSampled bool
+}
+
+// TestLogger - Logger which records entries in memory instead of sending them to Cloud Logging,
+// so unit tests can verify logging behavior. Loggers derived from it record to the same TestLogger
+type TestLogger struct {
+	*Logger
+	recorder *memoryLogBackend
+}
+
+// NewTestLogger - returns Logger which keeps all entries in memory, minimum severity is not applied until SetMinSeverity
+func NewTestLogger(loggerInvoker string) *TestLogger {
+	recorder := &memoryLogBackend{}
+
+	return &TestLogger{
+		Logger: &Logger{
+			ProjectID:     "test-project",
+			LoggerInvoker: loggerInvoker,
+			LogName:       "test",
+			backend:       recorder,
+			minSeverity:   newLogLevel(logging.Default),
+		},
+		recorder: recorder,
+	}
+}
+
+// Entries - returns copy of the recorded entries
+func (tl *TestLogger) Entries() []RecordedEntry {
+	return tl.recorder.entries()
+}
+
+// ContainsMessage - checks if any entry message contains the substring
+func (tl *TestLogger) ContainsMessage(substring string) bool {
+	for _, entry := range tl.recorder.entries() {
+		if strings.Contains(entry.Payload.Message, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CountBySeverity - returns number of entries with the severity
+func (tl *TestLogger) CountBySeverity(severity logging.Severity) int {
+	var count int
+	for _, entry := range tl.recorder.entries() {
+		if entry.Severity == severity {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Reset - removes all recorded entries
+func (tl *TestLogger) Reset() {
+	tl.recorder.reset()
+}
+
+// memoryLogBackend - logBackend which keeps entries in memory
+type memoryLogBackend struct {
+	mu       sync.Mutex
+	recorded []RecordedEntry
+}
+
+func (b *memoryLogBackend) log(projectID, logName string, entry logging.Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	payload, _ := entry.Payload.(LogEntryPayload)
+	b.recorded = append(b.recorded, RecordedEntry{
+		Severity:     entry.Severity,
+		Labels:       entry.Labels,
+		Payload:      payload,
+		Trace:        entry.Trace,
+		SpanID:       entry.SpanID,
+		TraceSampled: entry.TraceSampled,
+	})
+}
+
+func (b *memoryLogBackend) entries() []RecordedEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]RecordedEntry(nil), b.recorded...)
+}
+
+func (b *memoryLogBackend) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recorded = nil
+}
+
+func (b *memoryLogBackend) flush() error {
+	return nil
+}
+
+func (b *memoryLogBackend) close() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/logging"
+)
+
+func TestTestLoggerCapturesEntries(t *testing.T) {
+	logger := NewTestLogger("test")
+	ctx := context.Background()
+
+	logger.Info(ctx, nil, "order shipped", Fields{"order_id": "o1"})
+	logger.Error(ctx, nil, "payment failed")
+
+	entries := logger.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Payload.Message != "order shipped" || entries[0].Payload.Invoker != "test" {
+		t.Errorf("unexpected first entry payload: %+v", entries[0].Payload)
+	}
+	if entries[0].Payload.Fields["order_id"] != "o1" {
+		t.Errorf("expected order_id field, got %v", entries[0].Payload.Fields)
+	}
+
+	if !logger.ContainsMessage("shipped") {
+		t.Error("expected ContainsMessage to find 'shipped'")
+	}
+	if logger.ContainsMessage("refunded") {
+		t.Error("expected ContainsMessage not to find 'refunded'")
+	}
+
+	logger.Reset()
+	if len(logger.Entries()) != 0 {
+		t.Errorf("expected no entries after Reset, got %d", len(logger.Entries()))
+	}
+}
+
+func TestTestLoggerLabels(t *testing.T) {
+	logger := NewTestLogger("test")
+	derived := logger.WithLabels(map[string]string{"tenant": "t1"})
+
+	derived.Info(context.Background(), nil, "with labels", Labels{"order_id": "o1"})
+
+	entries := logger.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected derived logger to record into the same TestLogger, got %d entries", len(entries))
+	}
+	if entries[0].Labels["tenant"] != "t1" || entries[0].Labels["order_id"] != "o1" {
+		t.Errorf("unexpected labels: %v", entries[0].Labels)
+	}
+}
+
+func TestTestLoggerCountBySeverity(t *testing.T) {
+	logger := NewTestLogger("test")
+	ctx := context.Background()
+
+	logger.Debug(ctx, nil, "debug")
+	logger.Info(ctx, nil, "first")
+	logger.Info(ctx, nil, "second")
+	logger.Warning(ctx, nil, "warning")
+
+	counts := map[logging.Severity]int{logging.Debug: 1, logging.Info: 2, logging.Warning: 1, logging.Error: 0}
+	for severity, expected := range counts {
+		if count := logger.CountBySeverity(severity); count != expected {
+			t.Errorf("expected %d %v entries, got %d", expected, severity, count)
+		}
+	}
+}
+
+func TestTestLoggerTrace(t *testing.T) {
+	logger := NewTestLogger("test")
+	r := httptest.NewRequest("GET", "/orders", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	logger.Info(context.Background(), r, "traced")
+
+	entries := logger.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].Trace != "projects/test-project/traces/4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace: %v", entries[0].Trace)
+	}
+	if entries[0].SpanID != "00f067aa0ba902b7" || !entries[0].TraceSampled {
+		t.Errorf("unexpected span: %v sampled %v", entries[0].SpanID, entries[0].TraceSampled)
+	}
+}
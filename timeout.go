@@ -0,0 +1,154 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFunctionTimeout = 60 * time.Second
+	defaultTimeoutReserve  = 5 * time.Second
+)
+
+// TimeoutOptions - options of the Timeout middleware
+// FunctionTimeout - execution timeout of the function, FUNCTION_TIMEOUT_SEC env variable or 60s if empty
+// Reserve - part of the function timeout reserved for writing the timeout response and logs, 5s if empty
+// Logger - logger of the timed out requests, LoggerFromContext of the request context if empty
+type TimeoutOptions struct {
+	FunctionTimeout time.Duration
+	Reserve         time.Duration
+	Logger          *Logger
+}
+
+// FunctionTimeoutFromEnv - returns function timeout from FUNCTION_TIMEOUT_SEC env variable or 60s if it's not set
+func FunctionTimeoutFromEnv() time.Duration {
+	timeout := packageConfig().FunctionTimeout
+	if timeout <= 0 {
+		return defaultFunctionTimeout
+	}
+
+	return timeout
+}
+
+// Timeout - http middleware which sets request context deadline to the function timeout minus the reserve.
+// If the handler doesn't finish before the deadline, 504 JSON error is written and Error entry is logged,
+// so the request isn't silently killed by the platform. The handler should respect the context cancellation,
+// its writes after the deadline are discarded. If the client disconnects first, nothing is written and Info entry is logged
+func Timeout(options TimeoutOptions, next http.HandlerFunc) http.HandlerFunc {
+	if options.FunctionTimeout <= 0 {
+		options.FunctionTimeout = FunctionTimeoutFromEnv()
+	}
+	if options.Reserve <= 0 {
+		options.Reserve = defaultTimeoutReserve
+	}
+
+	budget := options.FunctionTimeout - options.Reserve
+	if budget <= 0 {
+		budget = options.FunctionTimeout
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+		tw := &timeoutWriter{header: http.Header{}, statusCode: http.StatusOK}
+		done := make(chan struct{})
+		panics := make(chan interface{}, 1)
+
+		go func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					panics <- recovered
+				}
+			}()
+
+			next(tw, r)
+			close(done)
+		}()
+
+		select {
+		case recovered := <-panics:
+			panic(recovered)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			for key, values := range tw.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(tw.statusCode)
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			tw.timedOut = true
+			tw.mu.Unlock()
+
+			fields := Fields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"timeout_ms": float64(budget) / float64(time.Millisecond),
+				"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			}
+
+			// the request context is also done when the client disconnects, nobody reads the response then
+			if ctx.Err() != context.DeadlineExceeded {
+				if options.Logger != nil {
+					options.Logger.Info(ctx, r, "request canceled by the client", fields)
+				} else {
+					LoggerFromContext(ctx).Info("request canceled by the client", fields)
+				}
+				return
+			}
+
+			if options.Logger != nil {
+				options.Logger.Error(ctx, r, "request timed out", fields)
+			} else {
+				LoggerFromContext(ctx).Error("request timed out", fields)
+			}
+
+			WriteError(w, Errorf("Timeout", ErrorCodeDeadlineExceeded, "request exceeded %v", budget))
+		}
+	}
+}
+
+// timeoutWriter - buffers the handler response until it finishes, writes after the timeout return http.ErrHandlerTimeout
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	body        bytes.Buffer
+	statusCode  int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.statusCode = statusCode
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+
+	return tw.body.Write(data)
+}
@@ -0,0 +1,337 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTokenExpirySkew   = time.Minute
+	tokenRefreshLockTTL      = 30 * time.Second
+	tokenRefreshPollInterval = 200 * time.Millisecond
+	// tokenFetchTimeout - timeout of the shared load or refresh, which doesn't depend on the context of the caller
+	tokenFetchTimeout = 30 * time.Second
+)
+
+// TokenRefreshFunc - requests new access token from the auth API, Expiry of the token should be set
+type TokenRefreshFunc func(ctx context.Context) (*oauth2.Token, error)
+
+// TokenStore - persistence of the access tokens shared between the function instances
+// Load - returns stored token of the key or nil if there is no token
+// Save - stores the token of the key
+type TokenStore interface {
+	Load(ctx context.Context, key string) (*oauth2.Token, error)
+	Save(ctx context.Context, key string, token *oauth2.Token) error
+}
+
+// MemoryTokenStore - TokenStore of the single instance
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: map[string]*oauth2.Token{}}
+}
+
+// Load - returns the stored token
+func (s *MemoryTokenStore) Load(ctx context.Context, key string) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens[key], nil
+}
+
+// Save - stores the token
+func (s *MemoryTokenStore) Save(ctx context.Context, key string, token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[key] = token
+	return nil
+}
+
+// FirestoreTokenStore - TokenStore in the collection, document ID is the key.
+// Token is stored in the access_token and token_expiration_date fields (same as FCShippingSecretData),
+// other fields of the document are kept
+type FirestoreTokenStore struct {
+	fireclient     *firestore.Client
+	collectionName string
+}
+
+func NewFirestoreTokenStore(fireclient *firestore.Client, collectionName string) *FirestoreTokenStore {
+	return &FirestoreTokenStore{fireclient: fireclient, collectionName: collectionName}
+}
+
+// Load - reads the token fields of the document
+func (s *FirestoreTokenStore) Load(ctx context.Context, key string) (*oauth2.Token, error) {
+	dsnap, err := s.fireclient.Collection(s.collectionName).Doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token '%v'. Error: %v", key, err.Error())
+	}
+
+	var stored struct {
+		AccessToken         string    `firestore:"access_token"`
+		TokenExpirationDate time.Time `firestore:"token_expiration_date"`
+	}
+	if err := dsnap.DataTo(&stored); err != nil {
+		return nil, fmt.Errorf("failed to read token '%v'. Error: %v", key, err.Error())
+	}
+	if stored.AccessToken == "" {
+		return nil, nil
+	}
+
+	return &oauth2.Token{AccessToken: stored.AccessToken, Expiry: stored.TokenExpirationDate}, nil
+}
+
+// Save - updates the token fields of the document
+func (s *FirestoreTokenStore) Save(ctx context.Context, key string, token *oauth2.Token) error {
+	return EditEntityInFirestore(ctx, s.fireclient, s.collectionName, key, map[string]interface{}{
+		"access_token":          token.AccessToken,
+		"token_expiration_date": token.Expiry,
+	})
+}
+
+// TokenManager - caches the access token in memory and in the store and refreshes it before the expiry.
+// Concurrent callers of the instance share one refresh
+type TokenManager struct {
+	key     string
+	store   TokenStore
+	refresh TokenRefreshFunc
+	skew    time.Duration
+	// lockClient - Firestore client of the refresh lock, refresh is not locked if nil
+	lockClient *firestore.Client
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	group singleflight.Group
+}
+
+// NewTokenManager - returns TokenManager of the key, token is considered expired skew before its Expiry (1 minute if 0).
+// store can be nil to keep the token only in memory
+func NewTokenManager(key string, store TokenStore, refresh TokenRefreshFunc, skew time.Duration) *TokenManager {
+	if store == nil {
+		store = NewMemoryTokenStore()
+	}
+	if skew <= 0 {
+		skew = defaultTokenExpirySkew
+	}
+
+	return &TokenManager{key: key, store: store, refresh: refresh, skew: skew}
+}
+
+// WithRefreshLock - guards the refresh with the Firestore lock (AcquireLock), so concurrent instances which see
+// the expired token don't all call the auth API and overwrite each other's tokens in the store.
+// The store is re-read after the lock is acquired, instances which wait for the lock use the token refreshed by the holder
+func (tm *TokenManager) WithRefreshLock(fireclient *firestore.Client) *TokenManager {
+	tm.lockClient = fireclient
+	return tm
+}
+
+// Token - returns valid access token from memory, the store or the refresh func
+func (tm *TokenManager) Token(ctx context.Context) (string, error) {
+	token, err := tm.OAuth2Token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// OAuth2Token - Token with the expiry
+func (tm *TokenManager) OAuth2Token(ctx context.Context) (*oauth2.Token, error) {
+	tm.mu.Lock()
+	token := tm.token
+	tm.mu.Unlock()
+
+	if tm.valid(token) {
+		return token, nil
+	}
+
+	return tm.shared(ctx, tm.key, tm.load)
+}
+
+// shared - runs fetch once for the concurrent callers of the key. The fetch runs on the detached context with
+// tokenFetchTimeout, so the cancelled request of the first caller doesn't fail the others, every caller waits on its own ctx
+func (tm *TokenManager) shared(ctx context.Context, key string, fetch func(ctx context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	results := tm.group.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenFetchTimeout)
+		defer cancel()
+
+		return fetch(fetchCtx)
+	})
+
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*oauth2.Token), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for token '%v'. Error: %v", tm.key, ctx.Err().Error())
+	}
+}
+
+// Invalidate - drops the token from memory, so the next Token call reads the store or refreshes it
+// (ex: the API rejected the token before its expiry)
+func (tm *TokenManager) Invalidate() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.token = nil
+}
+
+// TokenSource - returns oauth2.TokenSource of the manager for oauth2.NewClient
+func (tm *TokenManager) TokenSource(ctx context.Context) oauth2.TokenSource {
+	return tokenManagerSource{ctx: ctx, manager: tm}
+}
+
+// load - reads the token from the store or refreshes it
+func (tm *TokenManager) load(ctx context.Context) (*oauth2.Token, error) {
+	token, err := tm.store.Load(ctx, tm.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tm.valid(token) {
+		if tm.lockClient != nil {
+			token, err = tm.refreshTokenLocked(ctx, "")
+		} else {
+			token, err = tm.refreshToken(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tm.mu.Lock()
+	tm.token = token
+	tm.mu.Unlock()
+
+	return token, nil
+}
+
+// ForceRefresh - replaces the token rejected by the API before its expiry. The stored token is used if another
+// instance already replaced the rejected one, otherwise the token is refreshed (under the refresh lock if it's set)
+func (tm *TokenManager) ForceRefresh(ctx context.Context, rejected string) (*oauth2.Token, error) {
+	return tm.shared(ctx, tm.key+":force", func(ctx context.Context) (*oauth2.Token, error) {
+		tm.mu.Lock()
+		token := tm.token
+		tm.mu.Unlock()
+
+		// concurrent caller of the instance already replaced it
+		if tm.usable(token, rejected) {
+			return token, nil
+		}
+		tm.Invalidate()
+
+		token, err := tm.store.Load(ctx, tm.key)
+		if err != nil {
+			return nil, err
+		}
+
+		if !tm.usable(token, rejected) {
+			if tm.lockClient != nil {
+				token, err = tm.refreshTokenLocked(ctx, rejected)
+			} else {
+				token, err = tm.refreshToken(ctx)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		tm.mu.Lock()
+		tm.token = token
+		tm.mu.Unlock()
+
+		return token, nil
+	})
+}
+
+// refreshToken - requests new token and saves it to the store
+func (tm *TokenManager) refreshToken(ctx context.Context) (*oauth2.Token, error) {
+	token, err := tm.refresh(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token '%v'. Error: %v", tm.key, err.Error())
+	}
+
+	if err := tm.store.Save(ctx, tm.key, token); err != nil {
+		// the token is still usable by this instance
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to save token '%v'. Error: %v", tm.key, err.Error()), "")
+	}
+
+	return token, nil
+}
+
+// refreshTokenLocked - refreshes the token holding the refresh lock, or waits for the holder to store the new token.
+// Lock of the crashed holder expires after tokenRefreshLockTTL, then the waiting instance acquires it
+// Stored token equal to the rejected one is not accepted
+func (tm *TokenManager) refreshTokenLocked(ctx context.Context, rejected string) (*oauth2.Token, error) {
+	for {
+		lock, err := AcquireLock(ctx, tm.lockClient, "token_"+tm.key, tokenRefreshLockTTL)
+		if err == nil {
+			defer lock.Release(ctx)
+
+			// another instance could refresh the token between the load and the lock
+			token, err := tm.store.Load(ctx, tm.key)
+			if err != nil {
+				return nil, err
+			}
+			if tm.usable(token, rejected) {
+				return token, nil
+			}
+
+			return tm.refreshToken(ctx)
+		}
+		if !errors.Is(err, ErrLockHeld) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to wait for token '%v' refresh. Error: %v", tm.key, ctx.Err().Error())
+		case <-time.After(tokenRefreshPollInterval):
+		}
+
+		token, err := tm.store.Load(ctx, tm.key)
+		if err != nil {
+			return nil, err
+		}
+		if tm.usable(token, rejected) {
+			return token, nil
+		}
+	}
+}
+
+// usable - checks that the token is valid and it's not the rejected one
+func (tm *TokenManager) usable(token *oauth2.Token, rejected string) bool {
+	return tm.valid(token) && token.AccessToken != rejected
+}
+
+// valid - checks that the token is set and doesn't expire in the skew
+func (tm *TokenManager) valid(token *oauth2.Token) bool {
+	return token != nil && token.AccessToken != "" && time.Now().Add(tm.skew).Before(token.Expiry)
+}
+
+// tokenManagerSource - oauth2.TokenSource adapter of the TokenManager
+type tokenManagerSource struct {
+	ctx     context.Context
+	manager *TokenManager
+}
+
+func (s tokenManagerSource) Token() (*oauth2.Token, error) {
+	return s.manager.OAuth2Token(s.ctx)
+}
@@ -0,0 +1,141 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// traceparent: version-traceid-spanid-flags, ex: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	traceParentRegexp = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+	// X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=TRACE_TRUE
+	cloudTraceContextRegexp = regexp.MustCompile(`^([0-9a-fA-F]{32})(?:/([0-9]+))?(?:;o=([01]))?`)
+	hexTraceIDRegexp        = regexp.MustCompile(`^[0-9a-f]{16}([0-9a-f]{16})?$`)
+)
+
+// TraceContext - trace correlation data of the request
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// extractTraceContext - returns trace context of the request in the following order of preference:
+// OpenTelemetry span context of ctx, W3C traceparent header, X-Cloud-Trace-Context header, B3 headers
+func extractTraceContext(ctx context.Context, httpRequest *http.Request) (TraceContext, bool) {
+	if ctx != nil {
+		spanContext := trace.SpanContextFromContext(ctx)
+		if spanContext.IsValid() {
+			return TraceContext{
+				TraceID: spanContext.TraceID().String(),
+				SpanID:  spanContext.SpanID().String(),
+				Sampled: spanContext.IsSampled(),
+			}, true
+		}
+	}
+
+	if httpRequest == nil {
+		return TraceContext{}, false
+	}
+
+	if traceContext, ok := parseTraceParent(httpRequest.Header.Get("traceparent")); ok {
+		return traceContext, true
+	}
+
+	if traceContext, ok := parseCloudTraceContext(httpRequest.Header.Get("X-Cloud-Trace-Context")); ok {
+		return traceContext, true
+	}
+
+	return parseB3(httpRequest.Header)
+}
+
+// parseTraceParent - parses W3C traceparent header
+func parseTraceParent(header string) (TraceContext, bool) {
+	matches := traceParentRegexp.FindStringSubmatch(strings.TrimSpace(strings.ToLower(header)))
+	if matches == nil || matches[1] == "ff" || matches[2] == strings.Repeat("0", 32) || matches[3] == strings.Repeat("0", 16) {
+		return TraceContext{}, false
+	}
+
+	return TraceContext{
+		TraceID: matches[2],
+		SpanID:  matches[3],
+		// trace-flags sampled bit
+		Sampled: matches[4][1]&1 == 1,
+	}, true
+}
+
+// parseCloudTraceContext - parses X-Cloud-Trace-Context header, span ID is converted from decimal to hex
+func parseCloudTraceContext(header string) (TraceContext, bool) {
+	matches := cloudTraceContextRegexp.FindStringSubmatch(header)
+	if matches == nil {
+		return TraceContext{}, false
+	}
+
+	traceContext := TraceContext{
+		TraceID: strings.ToLower(matches[1]),
+		Sampled: matches[3] == "1",
+	}
+	if matches[2] != "" {
+		traceContext.SpanID = decimalSpanIDToHex(matches[2])
+	}
+
+	return traceContext, true
+}
+
+// parseB3 - parses single "b3" header or multi X-B3-* headers
+func parseB3(header http.Header) (TraceContext, bool) {
+	if single := header.Get("b3"); single != "" {
+		parts := strings.Split(strings.ToLower(single), "-")
+		if len(parts) >= 2 && hexTraceIDRegexp.MatchString(parts[0]) {
+			traceContext := TraceContext{
+				TraceID: padTraceID(parts[0]),
+				SpanID:  parts[1],
+			}
+			if len(parts) >= 3 {
+				traceContext.Sampled = parts[2] == "1" || parts[2] == "d"
+			}
+			return traceContext, true
+		}
+	}
+
+	traceID := strings.ToLower(header.Get("X-B3-TraceId"))
+	if !hexTraceIDRegexp.MatchString(traceID) {
+		return TraceContext{}, false
+	}
+
+	return TraceContext{
+		TraceID: padTraceID(traceID),
+		SpanID:  strings.ToLower(header.Get("X-B3-SpanId")),
+		Sampled: header.Get("X-B3-Sampled") == "1" || header.Get("X-B3-Flags") == "1",
+	}, true
+}
+
+// padTraceID - converts 64 bit B3 trace ID to 128 bit
+func padTraceID(traceID string) string {
+	if len(traceID) == 16 {
+		return strings.Repeat("0", 16) + traceID
+	}
+
+	return traceID
+}
+
+// decimalSpanIDToHex - X-Cloud-Trace-Context uses decimal span IDs while Cloud Logging expects 16 hex characters
+func decimalSpanIDToHex(spanID string) string {
+	var value uint64
+	for _, digit := range spanID {
+		value = value*10 + uint64(digit-'0')
+	}
+
+	const hexDigits = "0123456789abcdef"
+	hex := make([]byte, 16)
+	for i := 15; i >= 0; i-- {
+		hex[i] = hexDigits[value&0xf]
+		value >>= 4
+	}
+
+	return string(hex)
+}
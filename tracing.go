@@ -0,0 +1,109 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	gcppropagator "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName - instrumentation name of the spans created by this package
+const tracerName = "github.com/bluebird-cx/cloudfunctions-go-utils"
+
+// InitTracing - configures global OpenTelemetry TracerProvider which exports spans to Cloud Trace
+// with the cloud function resource attributes (K_SERVICE, K_REVISION env variables),
+// and global propagator which supports W3C traceparent and X-Cloud-Trace-Context headers.
+// sampleRatio - share of the new traces (0..1) which are sampled, parent sampling decision is respected.
+// Returned shutdown function flushes pending spans and should be called on instance shutdown
+func InitTracing(ctx context.Context, projectID string, sampleRatio float64) (func(context.Context) error, error) {
+	exporter, err := texporter.New(texporter.WithProjectID(projectID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Trace exporter. Error: %v", err.Error())
+	}
+
+	serviceName := packageConfig().Service
+	if serviceName == "" {
+		serviceName = packageConfig().FunctionTarget
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(packageConfig().Revision),
+			semconv.CloudProviderGCP,
+			semconv.CloudPlatformGCPCloudFunctions,
+			semconv.CloudAccountID(projectID),
+			semconv.FaaSName(serviceName),
+			semconv.FaaSVersion(packageConfig().Revision),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource. Error: %v", err.Error())
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		gcppropagator.CloudTraceOneWayPropagator{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// StartSpan - starts span of the global TracerProvider, span should be ended by the caller (EndSpan)
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan - records the error (if any) and ends the span, ex: defer func() { EndSpan(span, err) }()
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// TraceRequests - http middleware which extracts incoming trace context and starts server span per request,
+// so Logger entries and outbound calls of the handler are correlated with the request trace
+func TraceRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		recorder := newResponseRecorder(w, 0)
+		next(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.statusCode))
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+		}
+	}
+}
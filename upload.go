@@ -0,0 +1,278 @@
+package cloudfunctions_go_utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultMaxUploadFileBytes = 10 << 20
+	defaultMaxUploadFiles     = 10
+	defaultUploadURLExpiry    = 15 * time.Minute
+
+	// maxUploadFieldBytes - size limit of the not file form fields
+	maxUploadFieldBytes = 64 << 10
+	// contentSniffBytes - bytes used by http.DetectContentType
+	contentSniffBytes = 512
+)
+
+// errUploadTooLarge - file is larger than UploadOptions.MaxFileBytes
+var errUploadTooLarge = errors.New("file is too large")
+
+// UploadTransform - optional hook which transforms the file before the upload (ex: resizes the image),
+// returns the transformed content and its content type
+type UploadTransform func(ctx context.Context, file UploadedFile, content io.Reader) (io.Reader, string, error)
+
+// UploadOptions - options of the HandleMultipartUpload
+// Bucket - Cloud Storage bucket of the uploaded files
+// ObjectPrefix - prefix of the object names, ex: "artworks/"
+// MaxFileBytes - size limit of the single file, 10 MB if empty
+// MaxFiles - limit of the files in the request, 10 if empty
+// AllowedContentTypes - detected content types allowed for the upload, "image/*" patterns are supported, any type if empty
+// Transform - optional hook called before the upload
+// SignedURLExpiry - expiry of the returned signed GET URLs, 15 minutes if empty, negative to skip signing
+type UploadOptions struct {
+	Bucket              string
+	ObjectPrefix        string
+	MaxFileBytes        int64
+	MaxFiles            int
+	AllowedContentTypes []string
+	Transform           UploadTransform
+	SignedURLExpiry     time.Duration
+}
+
+// UploadedFile - file uploaded by HandleMultipartUpload
+type UploadedFile struct {
+	FieldName   string `json:"field_name"`
+	FileName    string `json:"file_name"`
+	Bucket      string `json:"bucket"`
+	ObjectName  string `json:"object_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url,omitempty"`
+}
+
+// UploadResult - uploaded files and the not file form fields of the request
+type UploadResult struct {
+	Files  []UploadedFile    `json:"files"`
+	Fields map[string]string `json:"fields"`
+}
+
+// HandleMultipartUpload - streams files of the multipart/form-data request to the bucket without buffering them in memory.
+// Content type is detected by the file content and checked against AllowedContentTypes.
+// On failure JSON error is written to w (400 for malformed form, 413 for too large files, 415 for not allowed types)
+// and already uploaded files of the request are deleted
+func HandleMultipartUpload(w http.ResponseWriter, r *http.Request, options UploadOptions) (*UploadResult, error) {
+	if options.MaxFileBytes <= 0 {
+		options.MaxFileBytes = defaultMaxUploadFileBytes
+	}
+	if options.MaxFiles <= 0 {
+		options.MaxFiles = defaultMaxUploadFiles
+	}
+	if options.SignedURLExpiry == 0 {
+		options.SignedURLExpiry = defaultUploadURLExpiry
+	}
+
+	ctx := r.Context()
+	result, err := uploadMultipart(ctx, r, options)
+	if err != nil {
+		if result != nil {
+			deleteUploadedFiles(ctx, result.Files)
+		}
+
+		WriteError(w, err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// uploadMultipart - uploads files of the request, returns uploaded files on failure for the cleanup
+func uploadMultipart(ctx context.Context, r *http.Request, options UploadOptions) (*UploadResult, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "failed to read multipart form: %w", err).
+			WithMessage("request must be multipart/form-data")
+	}
+
+	client, err := GetStorageClient(ctx)
+	if err != nil {
+		return nil, E("HandleMultipartUpload", ErrorCodeInternal, err)
+	}
+
+	result := &UploadResult{Fields: map[string]string{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "failed to read multipart form: %w", err).
+				WithMessage("malformed multipart form")
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				return result, Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "failed to read form field: %w", err).
+					WithMessage("malformed multipart form")
+			}
+			result.Fields[part.FormName()] = string(value)
+			continue
+		}
+
+		if len(result.Files) >= options.MaxFiles {
+			return result, Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "more than %v files", options.MaxFiles).
+				WithMessage(fmt.Sprintf("request must not contain more than %v files", options.MaxFiles))
+		}
+
+		file, err := uploadPart(ctx, client, part, options)
+		if err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	return result, nil
+}
+
+// uploadPart - detects content type of the file part and streams it to the bucket
+func uploadPart(ctx context.Context, client *storage.Client, part *multipart.Part, options UploadOptions) (UploadedFile, error) {
+	sniff := make([]byte, contentSniffBytes)
+	n, err := io.ReadFull(part, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return UploadedFile{}, Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "failed to read file: %w", err).
+			WithMessage("malformed multipart form")
+	}
+	sniff = sniff[:n]
+
+	fileName := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+	file := UploadedFile{
+		FieldName:   part.FormName(),
+		FileName:    fileName,
+		Bucket:      options.Bucket,
+		ObjectName:  options.ObjectPrefix + uuid.NewString() + strings.ToLower(path.Ext(fileName)),
+		ContentType: http.DetectContentType(sniff),
+	}
+
+	if !contentTypeAllowed(options.AllowedContentTypes, file.ContentType) {
+		appErr := Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "content type %v is not allowed", file.ContentType).
+			WithMessage(fmt.Sprintf("file type %v is not allowed", file.ContentType))
+		appErr.HTTPStatus = http.StatusUnsupportedMediaType
+		return UploadedFile{}, appErr
+	}
+
+	var content io.Reader = &limitedUploadReader{
+		reader: io.MultiReader(bytes.NewReader(sniff), part),
+		limit:  options.MaxFileBytes,
+	}
+
+	if options.Transform != nil {
+		content, file.ContentType, err = options.Transform(ctx, file, content)
+		if err != nil {
+			return UploadedFile{}, uploadReadError(err, options.MaxFileBytes)
+		}
+	}
+
+	// writer context is canceled to abort the upload on failures
+	writerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := client.Bucket(options.Bucket).Object(file.ObjectName).NewWriter(writerCtx)
+	writer.ContentType = file.ContentType
+	writer.Metadata = map[string]string{"original_file_name": fileName}
+
+	file.Size, err = io.Copy(writer, content)
+	if err != nil {
+		cancel()
+		writer.Close()
+		return UploadedFile{}, uploadReadError(err, options.MaxFileBytes)
+	}
+
+	if err := writer.Close(); err != nil {
+		return UploadedFile{}, Errorf("HandleMultipartUpload", ErrorCodeExternalAPI, "failed to upload %v: %w", file.ObjectName, err)
+	}
+
+	if options.SignedURLExpiry > 0 {
+		file.URL, err = GenerateSignedURL(ctx, options.Bucket, file.ObjectName, http.MethodGet, options.SignedURLExpiry)
+		if err != nil {
+			deleteUploadedFiles(ctx, []UploadedFile{file})
+			return UploadedFile{}, E("HandleMultipartUpload", ErrorCodeExternalAPI, err)
+		}
+	}
+
+	return file, nil
+}
+
+// uploadReadError - AppError of the failed file read
+func uploadReadError(err error, maxFileBytes int64) error {
+	if errors.Is(err, errUploadTooLarge) {
+		appErr := Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "file is larger than %v bytes", maxFileBytes).
+			WithMessage(fmt.Sprintf("file must not be larger than %v bytes", maxFileBytes))
+		appErr.HTTPStatus = http.StatusRequestEntityTooLarge
+		return appErr
+	}
+
+	return Errorf("HandleMultipartUpload", ErrorCodeInvalidArgument, "failed to read file: %w", err).WithMessage("failed to read file")
+}
+
+// contentTypeAllowed - checks content type against exact and "type/*" patterns
+func contentTypeAllowed(allowedContentTypes []string, contentType string) bool {
+	if len(allowedContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range allowedContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteUploadedFiles - deletes files of the failed request
+func deleteUploadedFiles(ctx context.Context, files []UploadedFile) {
+	for _, file := range files {
+		if err := DeleteObject(context.Background(), file.Bucket, file.ObjectName); err != nil {
+			LogWrite(LogTypeError2, ErrorCodeExternalAPI, err.Error(), "")
+		}
+	}
+}
+
+// limitedUploadReader - returns errUploadTooLarge when more than limit bytes are read
+type limitedUploadReader struct {
+	reader io.Reader
+	read   int64
+	limit  int64
+}
+
+func (lr *limitedUploadReader) Read(data []byte) (int, error) {
+	n, err := lr.reader.Read(data)
+	lr.read += int64(n)
+	if lr.read > lr.limit {
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
@@ -0,0 +1,275 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// UserStatusActive - user can sign in and use the functions
+	UserStatusActive = "active"
+	// UserStatusSuspended - user is temporarily blocked
+	UserStatusSuspended = "suspended"
+	// UserStatusDeleted - user was deleted, the document is kept for the references
+	UserStatusDeleted = "deleted"
+
+	defaultUserCacheTTL = time.Minute
+	// userCacheSize - max cached users and emails of the repository
+	userCacheSize = 10000
+)
+
+// User - document of the UsersCollection, document ID is the Firebase Auth UID
+// Email - lowercase email, unique across the users
+// DeviceTokens - FCM registration tokens of the user devices (UserDeviceTokensField), see PushSender
+type User struct {
+	UID          string    `firestore:"-" json:"uid"`
+	Email        string    `firestore:"email" json:"email" validate:"required,email"`
+	DisplayName  string    `firestore:"display_name" json:"display_name"`
+	PhoneNumber  string    `firestore:"phone_number,omitempty" json:"phone_number,omitempty" secure:"true"`
+	PhotoURL     string    `firestore:"photo_url,omitempty" json:"photo_url,omitempty"`
+	Roles        []string  `firestore:"roles,omitempty" json:"roles,omitempty"`
+	TenantID     string    `firestore:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Status       string    `firestore:"status" json:"status"`
+	DeviceTokens []string  `firestore:"fcm_tokens,omitempty" json:"-"`
+	CreatedAt    time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// UserProfileUpdate - profile fields changed by UpdateProfile, nil fields are not changed
+type UserProfileUpdate struct {
+	DisplayName *string `json:"display_name" validate:"max=200"`
+	PhoneNumber *string `json:"phone_number" validate:"max=32"`
+	PhotoURL    *string `json:"photo_url" validate:"max=2048"`
+}
+
+// UserRepository - typed accessors of the UsersCollection, GetByUID and GetByEmail results are cached for the cache TTL.
+// Writes of this repository invalidate the cache, writes of other instances are visible after the TTL
+type UserRepository struct {
+	fireclient *firestore.Client
+	users      *ttlCache
+	emails     *ttlCache
+	encryptor  *FieldEncryptor
+}
+
+// NewUserRepository - returns UserRepository, cacheTTL is 1 minute if empty, up to 10000 users are cached
+func NewUserRepository(fireclient *firestore.Client, cacheTTL time.Duration) *UserRepository {
+	if cacheTTL <= 0 {
+		cacheTTL = defaultUserCacheTTL
+	}
+
+	return &UserRepository{
+		fireclient: fireclient,
+		users:      newBoundedTTLCache(cacheTTL, userCacheSize),
+		emails:     newBoundedTTLCache(cacheTTL, userCacheSize),
+	}
+}
+
+// WithFieldEncryptor - the secure fields of the users (phone number) are stored encrypted with the encryptor,
+// the users stored before are read as is
+func (ur *UserRepository) WithFieldEncryptor(encryptor *FieldEncryptor) *UserRepository {
+	ur.encryptor = encryptor
+	return ur
+}
+
+// GetByUID - returns the user, ErrUserNotFound if the document doesn't exist
+func (ur *UserRepository) GetByUID(ctx context.Context, uid string) (*User, error) {
+	if cached, ok := ur.users.get(uid); ok {
+		user := *cached.(*User)
+		return &user, nil
+	}
+
+	dsnap, err := ur.fireclient.Collection(UsersCollection).Doc(uid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrUserNotFound.Errorf("UserRepository.GetByUID", "user %v not found", uid)
+	}
+	if err != nil {
+		return nil, Errorf("UserRepository.GetByUID", ErrorCodeFirebase, "failed to get user %v: %w", uid, err)
+	}
+
+	return ur.decode(ctx, dsnap)
+}
+
+// GetByEmail - returns the user with the email (case insensitive), ErrUserNotFound if there is no such user
+func (ur *UserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	email = normalizeEmail(email)
+	if uid, ok := ur.emails.get(email); ok {
+		return ur.GetByUID(ctx, uid.(string))
+	}
+
+	dsnaps, err := NewQueryRunner(ctx, ur.fireclient.Collection(UsersCollection).Where("email", "==", email), QueryRunnerOptions{Limit: 1, Name: "users_by_email"}).GetAll()
+	if err != nil {
+		return nil, Errorf("UserRepository.GetByEmail", ErrorCodeFirebase, "failed to find user by email: %w", err)
+	}
+	if len(dsnaps) == 0 {
+		return nil, ErrUserNotFound.Errorf("UserRepository.GetByEmail", "user with email not found")
+	}
+
+	return ur.decode(ctx, dsnaps[0])
+}
+
+// Create - creates the user document, ErrUserExists if the UID or the email is already used.
+// Status is UserStatusActive if empty
+func (ur *UserRepository) Create(ctx context.Context, user *User) error {
+	op := "UserRepository.Create"
+	if user.UID == "" {
+		return Errorf(op, ErrorCodeInvalidArgument, "user has no UID")
+	}
+
+	user.Email = normalizeEmail(user.Email)
+	if err := ValidateStruct(user); err != nil {
+		return E(op, ErrorCodeValidation, err)
+	}
+	if user.Status == "" {
+		user.Status = UserStatusActive
+	}
+	if !isUserStatus(user.Status) {
+		return Errorf(op, ErrorCodeInvalidArgument, "unknown user status %v", user.Status)
+	}
+
+	now := time.Now().UTC()
+	user.CreatedAt, user.UpdatedAt = now, now
+
+	stored := *user
+	if err := ur.encryptor.EncryptStruct(ctx, &stored); err != nil {
+		return E(op, ErrorCodeInternal, err)
+	}
+
+	ref := ur.fireclient.Collection(UsersCollection).Doc(user.UID)
+	err := ur.fireclient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// the email uniqueness is checked in the transaction, so the concurrent sign-ups can't share it
+		existing, err := tx.Documents(ur.fireclient.Collection(UsersCollection).Where("email", "==", user.Email).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return ErrUserExists.Errorf(op, "email is used by user %v", existing[0].Ref.ID).WithMessage("email is already used")
+		}
+
+		return tx.Create(ref, &stored)
+	})
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrUserExists.Errorf(op, "user %v already exists", user.UID)
+	}
+	if err != nil {
+		return Errorf(op, ErrorCodeFirebase, "failed to create user %v: %w", user.UID, err)
+	}
+
+	ur.invalidate(user.UID, user.Email)
+
+	return nil
+}
+
+// UpdateProfile - updates the profile fields of the existing user, ErrUserNotFound if the user doesn't exist
+func (ur *UserRepository) UpdateProfile(ctx context.Context, uid string, update UserProfileUpdate) error {
+	op := "UserRepository.UpdateProfile"
+	if err := ValidateStruct(update); err != nil {
+		return E(op, ErrorCodeValidation, err)
+	}
+
+	updates := []firestore.Update{{Path: "updated_at", Value: time.Now().UTC()}}
+	if update.DisplayName != nil {
+		updates = append(updates, firestore.Update{Path: "display_name", Value: strings.TrimSpace(*update.DisplayName)})
+	}
+	if update.PhoneNumber != nil {
+		phoneNumber := strings.TrimSpace(*update.PhoneNumber)
+		if ur.encryptor != nil {
+			var err error
+			if phoneNumber, err = ur.encryptor.EncryptField(ctx, "PhoneNumber", phoneNumber); err != nil {
+				return E(op, ErrorCodeInternal, err)
+			}
+		}
+		updates = append(updates, firestore.Update{Path: "phone_number", Value: phoneNumber})
+	}
+	if update.PhotoURL != nil {
+		updates = append(updates, firestore.Update{Path: "photo_url", Value: *update.PhotoURL})
+	}
+
+	return ur.update(ctx, op, uid, updates)
+}
+
+// SetStatus - changes status of the existing user, ErrUserNotFound if the user doesn't exist
+func (ur *UserRepository) SetStatus(ctx context.Context, uid, userStatus string) error {
+	op := "UserRepository.SetStatus"
+	if !isUserStatus(userStatus) {
+		return Errorf(op, ErrorCodeInvalidArgument, "unknown user status %v", userStatus)
+	}
+
+	return ur.update(ctx, op, uid, []firestore.Update{
+		{Path: "status", Value: userStatus},
+		{Path: "updated_at", Value: time.Now().UTC()},
+	})
+}
+
+// Invalidate - removes the user from the cache, ex: after the user document was changed by another function
+func (ur *UserRepository) Invalidate(uid string) {
+	ur.invalidate(uid, "")
+}
+
+// update - updates the existing user document and invalidates the cache
+func (ur *UserRepository) update(ctx context.Context, op, uid string, updates []firestore.Update) error {
+	_, err := ur.fireclient.Collection(UsersCollection).Doc(uid).Update(ctx, updates)
+	if status.Code(err) == codes.NotFound {
+		return ErrUserNotFound.Errorf(op, "user %v not found", uid)
+	}
+	if err != nil {
+		return Errorf(op, ErrorCodeFirebase, "failed to update user %v: %w", uid, err)
+	}
+
+	ur.invalidate(uid, "")
+
+	return nil
+}
+
+// decode - decodes and decrypts the user document and caches it
+func (ur *UserRepository) decode(ctx context.Context, dsnap *firestore.DocumentSnapshot) (*User, error) {
+	user := &User{}
+	if err := dsnap.DataTo(user); err != nil {
+		return nil, Errorf("UserRepository", ErrorCodeInternal, "failed to decode user %v: %w", dsnap.Ref.ID, err)
+	}
+	if err := ur.encryptor.DecryptStruct(ctx, user); err != nil {
+		return nil, Errorf("UserRepository", ErrorCodeInternal, "failed to decrypt user %v: %w", dsnap.Ref.ID, err)
+	}
+	user.UID = dsnap.Ref.ID
+
+	cached := *user
+	ur.users.set(user.UID, &cached)
+	if user.Email != "" {
+		ur.emails.set(user.Email, user.UID)
+	}
+
+	return user, nil
+}
+
+// invalidate - removes the cached user and its email, the cached email of the user is found if email is empty
+func (ur *UserRepository) invalidate(uid, email string) {
+	if email == "" {
+		if cached, ok := ur.users.get(uid); ok {
+			email = cached.(*User).Email
+		}
+	}
+
+	ur.users.delete(uid)
+	if email != "" {
+		ur.emails.delete(email)
+	}
+}
+
+// isUserStatus - checks if the status is one of the UserStatus constants
+func isUserStatus(userStatus string) bool {
+	return userStatus == UserStatusActive || userStatus == UserStatusSuspended || userStatus == UserStatusDeleted
+}
+
+// normalizeEmail - lowercase email without the surrounding spaces
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,368 @@
+package cloudfunctions_go_utils
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidateTag - struct tag with the validation rules, ex: `validate:"required,min=1,max=100,email"`
+const ValidateTag = "validate"
+
+var (
+	emailRegexp = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
+	uuidRegexp  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// FieldError - validation error of the single field, Field is the json name of the field (nested fields are joined with "."),
+// Rule is the name of the failed rule, ex: required
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationError - all field errors found by ValidateStruct
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (ve *ValidationError) Error() string {
+	messages := make([]string, 0, len(ve.Errors))
+	for _, fieldError := range ve.Errors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// ValidateStruct - checks `validate` tags of the struct (or pointer to struct) fields, nested structs are validated recursively.
+// Supported rules:
+// required - value is not empty (zero value)
+// min=N, max=N - length for strings, slices and maps, value for numbers
+// len=N - exact length of strings, slices and maps
+// oneof=a|b|c - string or number is one of the values
+// email, uuid, url - string format (empty strings are skipped, combine with required)
+// Structs implementing FieldsValidator get their programmatic rules checked after the tags.
+// Returns *ValidationError with all failed fields or nil
+func ValidateStruct(value interface{}) error {
+	var fieldErrors []FieldError
+	validateValue(reflect.ValueOf(value), "", &fieldErrors)
+
+	if len(fieldErrors) > 0 {
+		return &ValidationError{Errors: fieldErrors}
+	}
+
+	return nil
+}
+
+// validateValue - collects field errors of the struct value, elements of the slices and arrays are validated
+// with the index in the field name, ex: items.0.sku
+func validateValue(value reflect.Value, prefix string, fieldErrors *[]FieldError) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+		for i := 0; i < value.Len(); i++ {
+			name := strconv.Itoa(i)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			validateValue(value.Index(i), name, fieldErrors)
+		}
+		return
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := fieldName(field)
+		if name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fieldValue := value.Field(i)
+		for _, rule := range strings.Split(field.Tag.Get(ValidateTag), ",") {
+			if rule == "" {
+				continue
+			}
+
+			if message := checkRule(fieldValue, rule); message != "" {
+				ruleName, _, _ := strings.Cut(rule, "=")
+				*fieldErrors = append(*fieldErrors, FieldError{Field: name, Rule: ruleName, Message: message})
+			}
+		}
+
+		validateValue(fieldValue, name, fieldErrors)
+	}
+
+	if fieldsValidator, ok := asFieldsValidator(value); ok {
+		validator := &Validator{prefix: prefix}
+		fieldsValidator.ValidateFields(validator)
+		*fieldErrors = append(*fieldErrors, validator.errors...)
+	}
+}
+
+// asFieldsValidator - FieldsValidator of the struct value or its pointer
+func asFieldsValidator(value reflect.Value) (FieldsValidator, bool) {
+	if value.CanInterface() {
+		if fieldsValidator, ok := value.Interface().(FieldsValidator); ok {
+			return fieldsValidator, true
+		}
+	}
+	if value.CanAddr() && value.Addr().CanInterface() {
+		if fieldsValidator, ok := value.Addr().Interface().(FieldsValidator); ok {
+			return fieldsValidator, true
+		}
+	}
+
+	return nil, false
+}
+
+// fieldName - json name of the struct field or the field name if json tag is missing
+func fieldName(field reflect.StructField) string {
+	jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+	if jsonName != "" {
+		return jsonName
+	}
+
+	return field.Name
+}
+
+// checkRule - returns error message if the value doesn't satisfy the rule
+func checkRule(value reflect.Value, rule string) string {
+	ruleName, argument, _ := strings.Cut(rule, "=")
+
+	switch ruleName {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(argument, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid %v rule argument %q", ruleName, argument)
+		}
+
+		size, ok := valueSize(value)
+		if !ok {
+			return ""
+		}
+
+		if ruleName == "min" && size < limit {
+			return fmt.Sprintf("must be at least %v", argument)
+		}
+		if ruleName == "max" && size > limit {
+			return fmt.Sprintf("must be at most %v", argument)
+		}
+	case "len":
+		length, err := strconv.Atoi(argument)
+		if err != nil {
+			return fmt.Sprintf("invalid len rule argument %q", argument)
+		}
+
+		switch value.Kind() {
+		case reflect.String:
+			if len([]rune(value.String())) != length {
+				return fmt.Sprintf("must be exactly %v characters long", length)
+			}
+		case reflect.Slice, reflect.Map, reflect.Array:
+			if value.Len() != length {
+				return fmt.Sprintf("must have exactly %v items", length)
+			}
+		}
+	case "oneof":
+		allowed := strings.Split(argument, "|")
+		if text, ok := valueText(value); ok && text != "" && !containsString(allowed, text) {
+			return "must be one of " + strings.Join(allowed, ", ")
+		}
+	case "email":
+		if value.Kind() == reflect.String && value.String() != "" && !emailRegexp.MatchString(value.String()) {
+			return "must be a valid email address"
+		}
+	case "uuid":
+		if value.Kind() == reflect.String && value.String() != "" && !uuidRegexp.MatchString(value.String()) {
+			return "must be a UUID"
+		}
+	case "url":
+		if value.Kind() == reflect.String && value.String() != "" {
+			parsed, err := url.Parse(value.String())
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "must be a valid http(s) URL"
+			}
+		}
+	}
+
+	return ""
+}
+
+// valueSize - length of strings, slices and maps or value of numbers, used by min and max rules
+func valueSize(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.Ptr:
+		if value.IsNil() {
+			return 0, false
+		}
+		return valueSize(value.Elem())
+	}
+
+	return 0, false
+}
+
+// valueText - string or number value as text, used by the oneof rule
+func valueText(value reflect.Value) (string, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), true
+	case reflect.Ptr:
+		if value.IsNil() {
+			return "", false
+		}
+		return valueText(value.Elem())
+	}
+
+	return "", false
+}
+
+// FieldsValidator - struct with the programmatic rules (ex: cross-field checks), called by ValidateStruct, DecodeJSONBody
+// and BindQuery after the tag rules, ex:
+// func (r DateRange) ValidateFields(v *Validator) { v.Check("to", r.To, Custom("after_from", func(...) ...)) }
+type FieldsValidator interface {
+	ValidateFields(v *Validator)
+}
+
+// Rule - programmatic validation rule, Check returns error message or empty string
+type Rule struct {
+	Name  string
+	Check func(value interface{}) string
+}
+
+// Validator - collects field errors of the programmatic rules
+type Validator struct {
+	prefix string
+	errors []FieldError
+}
+
+// NewValidator - returns empty Validator
+func NewValidator() *Validator {
+	return &Validator{}
+}
+
+// Check - checks the value of the field with the rules, all failed rules are collected
+func (v *Validator) Check(field string, value interface{}, rules ...Rule) *Validator {
+	for _, rule := range rules {
+		if message := rule.Check(value); message != "" {
+			v.Add(field, rule.Name, message)
+		}
+	}
+
+	return v
+}
+
+// Add - adds the field error, field is prefixed with the path of the nested struct
+func (v *Validator) Add(field, rule, message string) *Validator {
+	if v.prefix != "" {
+		field = v.prefix + "." + field
+	}
+	v.errors = append(v.errors, FieldError{Field: field, Rule: rule, Message: message})
+
+	return v
+}
+
+// Err - returns *ValidationError with the collected field errors or nil
+func (v *Validator) Err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Errors: v.errors}
+}
+
+// tagRule - Rule of the struct tag rule
+func tagRule(rule string) Rule {
+	name, _, _ := strings.Cut(rule, "=")
+
+	return Rule{Name: name, Check: func(value interface{}) string {
+		return checkRule(reflect.ValueOf(value), rule)
+	}}
+}
+
+// Required - value is not empty
+func Required() Rule {
+	return Rule{Name: "required", Check: func(value interface{}) string {
+		if value == nil || reflect.ValueOf(value).IsZero() {
+			return "is required"
+		}
+		return ""
+	}}
+}
+
+// Min - min length of strings, slices and maps or min value of numbers
+func Min(limit float64) Rule {
+	return tagRule("min=" + strconv.FormatFloat(limit, 'f', -1, 64))
+}
+
+// Max - max length of strings, slices and maps or max value of numbers
+func Max(limit float64) Rule {
+	return tagRule("max=" + strconv.FormatFloat(limit, 'f', -1, 64))
+}
+
+// Len - exact length of strings, slices and maps
+func Len(length int) Rule {
+	return tagRule("len=" + strconv.Itoa(length))
+}
+
+// OneOf - string or number is one of the values
+func OneOf(values ...string) Rule {
+	return tagRule("oneof=" + strings.Join(values, "|"))
+}
+
+// Email - string is email address, empty strings are skipped
+func Email() Rule {
+	return tagRule("email")
+}
+
+// Match - string matches the regexp, empty strings are skipped
+func Match(re *regexp.Regexp, message string) Rule {
+	return Rule{Name: "match", Check: func(value interface{}) string {
+		if text, ok := value.(string); ok && text != "" && !re.MatchString(text) {
+			return message
+		}
+		return ""
+	}}
+}
+
+// Custom - rule of the check function, ex: Custom("after_from", func(value interface{}) string { ... })
+func Custom(name string, check func(value interface{}) string) Rule {
+	return Rule{Name: name, Check: check}
+}
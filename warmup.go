@@ -0,0 +1,108 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// WarmupPath - path of the warm-up requests sent after the deploy or by the min-instance warmers
+	WarmupPath = "/_warmup"
+	// AppEngineWarmupPath - path of the App Engine style warm-up requests, accepted by WithWarmup too
+	AppEngineWarmupPath = "/_ah/warmup"
+)
+
+// WarmupTask - cache priming task of the Warmup handler, ex: reading the catalog or the fulfillment centers
+// Name - key of the task in the response
+// Timeout - timeout of the task, 5s if empty
+// Run - returns error if the cache couldn't be primed
+type WarmupTask struct {
+	Name    string
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// WarmupResponse - response of the Warmup handler, the endpoint is not authenticated so the detail of the steps
+// and the tasks is only logged
+type WarmupResponse struct {
+	Status string `json:"status"`
+}
+
+// Warmup - handler which runs the eager and the lazy steps of the initializer (so the first user request doesn't pay for them)
+// and the tasks concurrently, logs the readiness detail and writes the status, 200 if everything succeeded and 503 otherwise.
+// initializer can be nil if the function has no init steps
+func Warmup(initializer *Initializer, tasks ...WarmupTask) http.HandlerFunc {
+	var warmed sync.Once
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		start := time.Now()
+
+		response := WarmupResponse{Status: HealthStatusOK}
+		coldStart := false
+		warmed.Do(func() { coldStart = true })
+
+		var steps []InitStepResult
+		if initializer != nil {
+			if err := initializer.Run(ctx); err != nil {
+				response.Status = HealthStatusFail
+			}
+			for _, result := range initializer.Results() {
+				if !result.Lazy || result.Done {
+					continue
+				}
+				if err := initializer.Require(ctx, result.Name); err != nil {
+					response.Status = HealthStatusFail
+				}
+			}
+			steps = initializer.Results()
+		}
+
+		checks := make([]HealthCheck, 0, len(tasks))
+		for _, task := range tasks {
+			checks = append(checks, HealthCheck{Name: task.Name, Timeout: task.Timeout, Check: task.Run})
+		}
+		var taskResults map[string]HealthCheckResult
+		if len(checks) > 0 {
+			health := RunHealthChecks(ctx, checks...)
+			taskResults = health.Checks
+			if health.Status != HealthStatusOK {
+				response.Status = HealthStatusFail
+			}
+		}
+
+		fields := Fields{
+			"status":      response.Status,
+			"cold_start":  coldStart,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"steps":       steps,
+			"tasks":       taskResults,
+		}
+		statusCode := http.StatusOK
+		if response.Status != HealthStatusOK {
+			statusCode = http.StatusServiceUnavailable
+			LoggerFromContext(ctx).Error("instance warm-up failed", fields)
+		} else {
+			LoggerFromContext(ctx).Info("instance warmed up", fields)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		WriteJSON(w, statusCode, response)
+	}
+}
+
+// WithWarmup - http middleware which passes the GET requests of the WarmupPath and AppEngineWarmupPath to the warmup handler,
+// for the functions with the single entry point, ex: WithWarmup(handler, Warmup(initializer, tasks...)).
+// Other requests are passed to next
+func WithWarmup(next http.HandlerFunc, warmup http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && (r.URL.Path == WarmupPath || r.URL.Path == AppEngineWarmupPath) {
+			warmup(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
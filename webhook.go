@@ -0,0 +1,230 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// WebhookSignatureHeader - request header with the hex HMAC-SHA256 signature of "<timestamp>.<body>", "sha256=" prefix is allowed
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader - request header with the unix time of the signature
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+
+	defaultWebhookTolerance    = 5 * time.Minute
+	defaultWebhookMaxBodyBytes = 1 << 20
+	webhookSecretCacheTTL      = 5 * time.Minute
+)
+
+var (
+	WebhookEventsCollection string = "webhook_events"
+)
+
+// webhookSecrets - cached webhook secrets by the secret name
+var webhookSecrets = newTTLCache(webhookSecretCacheTTL)
+
+// ShipmentWebhookEvent - typed status event of the fulfillment callback
+type ShipmentWebhookEvent struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	OrderID        string    `json:"order_id"`
+	ShipmentID     string    `json:"shipment_id"`
+	Status         string    `json:"status"`
+	CarrierStatus  string    `json:"carrier_status"`
+	Carrier        string    `json:"carrier"`
+	TrackingNumber string    `json:"tracking_number"`
+	TrackingURL    string    `json:"tracking_url"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+// ieWebhookPayload - payload of the Imprint Engine status callback
+type ieWebhookPayload struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Data       struct {
+		OrderID         string `json:"orderId"`
+		ExternalOrderID string `json:"externalOrderId"`
+		Status          string `json:"status"`
+		Carrier         string `json:"carrier"`
+		TrackingNumber  string `json:"trackingNumber"`
+		TrackingURL     string `json:"trackingUrl"`
+	} `json:"data"`
+}
+
+// WebhookOptions - options of the ShipmentWebhook
+// SecretName - Secret Manager secret with the shared signing secret
+// Tolerance - max age of the signature timestamp, 5 minutes if empty
+// MaxBodyBytes - max size of the payload, 1 MB if empty
+type WebhookOptions struct {
+	SecretName   string
+	Tolerance    time.Duration
+	MaxBodyBytes int64
+}
+
+// webhookEventRecord - dedupe record of the processed event in the WebhookEventsCollection, document ID is the event ID
+type webhookEventRecord struct {
+	Type       string    `firestore:"type"`
+	ReceivedAt time.Time `firestore:"received_at"`
+}
+
+// VerifyWebhookSignature - checks the HMAC-SHA256 signature of "<timestamp>.<body>" in constant time
+func VerifyWebhookSignature(secret []byte, timestamp string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// ShipmentWebhook - http handler of the fulfillment status callbacks: verifies the signature and the timestamp freshness,
+// parses the payload into ShipmentWebhookEvent and calls handle once per event ID. Returns 204 for the handled events
+// and the duplicates, 401 for invalid signatures, 400 for malformed payloads and 500 if handle fails, so the sender retries it
+func ShipmentWebhook(fireclient *firestore.Client, options WebhookOptions, handle func(ctx context.Context, event *ShipmentWebhookEvent) error) http.HandlerFunc {
+	if options.Tolerance <= 0 {
+		options.Tolerance = defaultWebhookTolerance
+	}
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = defaultWebhookMaxBodyBytes
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := LoggerFromContext(ctx)
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, options.MaxBodyBytes))
+		if err != nil {
+			WriteError(w, Errorf("ShipmentWebhook", ErrorCodeInvalidArgument, "failed to read webhook body: %w", err))
+			return
+		}
+
+		if err := verifyWebhookRequest(ctx, r, body, options); err != nil {
+			logger.Warning("webhook verification failed", Fields{"error": err.Error()})
+			WriteError(w, err)
+			return
+		}
+
+		event, err := parseShipmentWebhookEvent(body)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+
+		ref := fireclient.Collection(WebhookEventsCollection).Doc(event.ID)
+		_, err = ref.Create(ctx, webhookEventRecord{Type: event.Type, ReceivedAt: time.Now()})
+		if status.Code(err) == codes.AlreadyExists {
+			logger.Info("duplicate webhook event", Fields{"event_id": event.ID})
+			WriteNoContent(w)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to record webhook event", Fields{"event_id": event.ID, "error": err.Error()})
+			WriteError(w, E("ShipmentWebhook", ErrorCodeFirebase, err))
+			return
+		}
+
+		if err := handle(ctx, event); err != nil {
+			// the retried delivery should be processed again
+			if _, deleteErr := ref.Delete(context.WithoutCancel(ctx)); deleteErr != nil {
+				logger.Error("failed to release webhook event", Fields{"event_id": event.ID, "error": deleteErr.Error()})
+			}
+			logger.Error("failed to handle webhook event", Fields{"event_id": event.ID, "error": err.Error()})
+			WriteError(w, E("ShipmentWebhook", 0, err))
+			return
+		}
+
+		WriteNoContent(w)
+	}
+}
+
+// verifyWebhookRequest - checks the timestamp freshness and the signature of the request
+func verifyWebhookRequest(ctx context.Context, r *http.Request, body []byte, options WebhookOptions) error {
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	signature := r.Header.Get(WebhookSignatureHeader)
+	if timestamp == "" || signature == "" {
+		return Errorf("ShipmentWebhook", ErrorCodeUnauthenticated, "missing webhook signature headers")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Errorf("ShipmentWebhook", ErrorCodeUnauthenticated, "invalid webhook timestamp: %w", err)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > options.Tolerance || age < -options.Tolerance {
+		return Errorf("ShipmentWebhook", ErrorCodeUnauthenticated, "webhook timestamp is outside of the tolerance: %v", age)
+	}
+
+	secret, err := webhookSecret(ctx, options.SecretName)
+	if err != nil {
+		return E("ShipmentWebhook", ErrorCodeInternal, err)
+	}
+
+	if !VerifyWebhookSignature(secret, timestamp, body, signature) {
+		return Errorf("ShipmentWebhook", ErrorCodeUnauthenticated, "invalid webhook signature")
+	}
+
+	return nil
+}
+
+// webhookSecret - returns cached signing secret from Secret Manager
+func webhookSecret(ctx context.Context, secretName string) ([]byte, error) {
+	if secretName == "" {
+		return nil, errors.New("webhook secret name is empty")
+	}
+
+	if cached, ok := webhookSecrets.get(secretName); ok {
+		return cached.([]byte), nil
+	}
+
+	secret, err := GetSecretRaw(ctx, secretName)
+	if err != nil {
+		return nil, err
+	}
+	webhookSecrets.set(secretName, secret)
+
+	return secret, nil
+}
+
+// parseShipmentWebhookEvent - converts the Imprint Engine payload into the typed event
+func parseShipmentWebhookEvent(body []byte) (*ShipmentWebhookEvent, error) {
+	var payload ieWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, Errorf("ShipmentWebhook", ErrorCodeInvalidArgument, "failed to unmarshal webhook payload: %w", err).
+			WithMessage("malformed webhook payload")
+	}
+
+	if payload.ID == "" {
+		return nil, Errorf("ShipmentWebhook", ErrorCodeInvalidArgument, "webhook payload has no event ID").
+			WithMessage("malformed webhook payload")
+	}
+
+	return &ShipmentWebhookEvent{
+		ID:             payload.ID,
+		Type:           payload.Type,
+		OrderID:        payload.Data.ExternalOrderID,
+		ShipmentID:     payload.Data.OrderID,
+		Status:         normalizeIETrackingStatus(payload.Data.Status),
+		CarrierStatus:  payload.Data.Status,
+		Carrier:        payload.Data.Carrier,
+		TrackingNumber: payload.Data.TrackingNumber,
+		TrackingURL:    payload.Data.TrackingURL,
+		OccurredAt:     payload.OccurredAt,
+	}, nil
+}
@@ -0,0 +1,259 @@
+package cloudfunctions_go_utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ErrWriteQueueFull - returned by WriteQueue when the buffer is full and the write was dropped
+var ErrWriteQueueFull = errors.New("write queue is full")
+
+// ErrWriteQueueClosed - returned by WriteQueue after Close
+var ErrWriteQueueClosed = errors.New("write queue is closed")
+
+const (
+	defaultWriteQueueBatchSize     = 100
+	defaultWriteQueueFlushInterval = time.Second
+	defaultWriteQueueMaxSize       = 5000
+)
+
+// WriteQueueOptions - options of the NewWriteQueue
+// BatchSize - buffered writes which trigger the flush, 100 if empty
+// FlushInterval - max time the write stays in the buffer, 1 second if empty
+// MaxSize - max buffered writes, new writes are rejected with ErrWriteQueueFull above it, 5000 if empty
+type WriteQueueOptions struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxSize       int
+}
+
+// queuedWrite - buffered write of the WriteQueue
+type queuedWrite struct {
+	ref     *firestore.DocumentRef
+	create  bool
+	data    interface{}
+	updates []firestore.Update
+	delete  bool
+	options []firestore.SetOption
+}
+
+// WriteQueue - buffers small independent Firestore writes (analytics events, audit rows) in memory and writes them
+// with the BulkWriter on the size and time thresholds, so the hot handlers don't wait for every write.
+// The writes are not atomic and are lost if the instance dies before the flush, so it shouldn't be used for the business data.
+// Close should be registered with RegisterShutdown
+type WriteQueue struct {
+	fireclient *firestore.Client
+	options    WriteQueueOptions
+
+	mu      sync.Mutex
+	buffer  []queuedWrite
+	closed  bool
+	flushMu sync.Mutex
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewWriteQueue - starts background flusher of the queue
+func NewWriteQueue(fireclient *firestore.Client, options WriteQueueOptions) *WriteQueue {
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultWriteQueueBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultWriteQueueFlushInterval
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaultWriteQueueMaxSize
+	}
+
+	wq := &WriteQueue{
+		fireclient: fireclient,
+		options:    options,
+		trigger:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go wq.run()
+
+	return wq
+}
+
+// Add - queues creation of the new document with generated ID in the collection, returns the document reference
+func (wq *WriteQueue) Add(collectionName string, data interface{}) (*firestore.DocumentRef, error) {
+	ref := wq.fireclient.Collection(collectionName).NewDoc()
+	return ref, wq.enqueue(queuedWrite{ref: ref, create: true, data: data})
+}
+
+// Set - queues set of the document
+func (wq *WriteQueue) Set(ref *firestore.DocumentRef, data interface{}, options ...firestore.SetOption) error {
+	return wq.enqueue(queuedWrite{ref: ref, data: data, options: options})
+}
+
+// Update - queues update of the existing document, ex: firestore.Increment of the counters
+func (wq *WriteQueue) Update(ref *firestore.DocumentRef, updates []firestore.Update) error {
+	return wq.enqueue(queuedWrite{ref: ref, updates: updates})
+}
+
+// Delete - queues deletion of the document
+func (wq *WriteQueue) Delete(ref *firestore.DocumentRef) error {
+	return wq.enqueue(queuedWrite{ref: ref, delete: true})
+}
+
+// Len - returns number of the buffered writes
+func (wq *WriteQueue) Len() int {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+
+	return len(wq.buffer)
+}
+
+// Flush - writes all buffered writes, waits until they are written or ctx is done
+func (wq *WriteQueue) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	go func() {
+		wq.flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush write queue. Error: %v", ctx.Err().Error())
+	}
+}
+
+// Close - stops accepting writes, writes the buffered ones and stops the flusher
+func (wq *WriteQueue) Close(ctx context.Context) error {
+	wq.mu.Lock()
+	if wq.closed {
+		wq.mu.Unlock()
+		return nil
+	}
+	wq.closed = true
+	wq.mu.Unlock()
+
+	close(wq.stop)
+
+	select {
+	case <-wq.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to drain write queue. Error: %v", ctx.Err().Error())
+	}
+}
+
+// enqueue - adds the write to the buffer and triggers the flush if the batch is full
+func (wq *WriteQueue) enqueue(write queuedWrite) error {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+
+	if wq.closed {
+		return ErrWriteQueueClosed
+	}
+	if len(wq.buffer) >= wq.options.MaxSize {
+		return ErrWriteQueueFull
+	}
+
+	wq.buffer = append(wq.buffer, write)
+	if len(wq.buffer) >= wq.options.BatchSize {
+		select {
+		case wq.trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// run - flusher loop, the last flush is done after Close
+func (wq *WriteQueue) run() {
+	defer close(wq.done)
+
+	ticker := time.NewTicker(wq.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wq.stop:
+			wq.flush()
+			return
+		case <-wq.trigger:
+			wq.flush()
+		case <-ticker.C:
+			wq.flush()
+		}
+	}
+}
+
+// flush - writes the buffered writes with the BulkWriter, failed writes are logged and dropped.
+// BulkWriter allows single write per document, so the writes of the same document are split into the next rounds
+func (wq *WriteQueue) flush() {
+	wq.flushMu.Lock()
+	defer wq.flushMu.Unlock()
+
+	wq.mu.Lock()
+	writes := wq.buffer
+	wq.buffer = nil
+	wq.mu.Unlock()
+
+	failed := 0
+	var lastErr error
+	for len(writes) > 0 {
+		// background context is used since the writes outlive the requests which queued them
+		bulkWriter := wq.fireclient.BulkWriter(context.Background())
+		written := map[string]bool{}
+		jobs := make([]*firestore.BulkWriterJob, 0, len(writes))
+		next := []queuedWrite{}
+
+		for _, write := range writes {
+			if written[write.ref.Path] {
+				next = append(next, write)
+				continue
+			}
+			written[write.ref.Path] = true
+
+			job, err := write.enqueue(bulkWriter)
+			if err != nil {
+				failed++
+				lastErr = err
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		bulkWriter.End()
+
+		for _, job := range jobs {
+			if _, err := job.Results(); err != nil {
+				failed++
+				lastErr = err
+			}
+		}
+
+		writes = next
+	}
+
+	if failed > 0 {
+		LogWrite(LogTypeError2, ErrorCodeFirebase, fmt.Sprintf("failed to write %d queued writes. Error: %v", failed, lastErr.Error()), "")
+	}
+}
+
+// enqueue - adds the write to the BulkWriter
+func (qw queuedWrite) enqueue(bulkWriter *firestore.BulkWriter) (*firestore.BulkWriterJob, error) {
+	switch {
+	case qw.delete:
+		return bulkWriter.Delete(qw.ref)
+	case qw.updates != nil:
+		return bulkWriter.Update(qw.ref, qw.updates)
+	case qw.create:
+		return bulkWriter.Create(qw.ref, qw.data)
+	default:
+		return bulkWriter.Set(qw.ref, qw.data, qw.options...)
+	}
+}